@@ -0,0 +1,318 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// linuxBatchSize is the number of packets sent by one sendmmsg or received by one recvmmsg
+const linuxBatchSize = 64
+
+// Control messages are large enough for IPv6 pktinfo
+var pktinfoCmsgSpace = unix.CmsgSpace(unix.SizeofInet6Pktinfo)
+
+// struct mmsghdr
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+var _ BatchBind = (*LinuxSocketBind)(nil)
+
+func recvmmsg(fd int, msgs []mmsghdr, flags int) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), uintptr(flags), 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
+
+// sendmmsgFunc is replaced by the tests to simulate the partial sends
+var sendmmsgFunc = sendmmsg
+
+func sendmmsg(fd int, msgs []mmsghdr, flags int) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), uintptr(flags), 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
+
+// recvBatch holds the message headers of recvmmsg, every BatchReceiveFunc has its own
+type recvBatch struct {
+	msgs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrInet6
+	cmsgs []byte
+}
+
+func newRecvBatch() *recvBatch {
+	b := &recvBatch{
+		msgs:  make([]mmsghdr, linuxBatchSize),
+		iovs:  make([]unix.Iovec, linuxBatchSize),
+		names: make([]unix.RawSockaddrInet6, linuxBatchSize),
+		cmsgs: make([]byte, linuxBatchSize*pktinfoCmsgSpace),
+	}
+	for i := range b.msgs {
+		b.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		b.msgs[i].hdr.Iov = &b.iovs[i]
+		b.msgs[i].hdr.SetIovlen(1)
+		b.msgs[i].hdr.Control = &b.cmsgs[i*pktinfoCmsgSpace]
+	}
+	return b
+}
+
+func (bind *LinuxSocketBind) BatchSize() int {
+	return linuxBatchSize
+}
+
+func (bind *LinuxSocketBind) OpenBatch(port uint16) ([]BatchReceiveFunc, uint16, error) {
+	_, actualPort, err := bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	var fns []BatchReceiveFunc
+	if bind.sock4 != -1 {
+		fns = append(fns, bind.makeReceiveBatchIPv4())
+	}
+	if bind.sock6 != -1 {
+		fns = append(fns, bind.makeReceiveBatchIPv6())
+	}
+	return fns, actualPort, nil
+}
+
+func (bind *LinuxSocketBind) makeReceiveBatchIPv4() BatchReceiveFunc {
+	batch := newRecvBatch()
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		return bind.receiveBatch(batch, false, bufs, sizes, eps)
+	}
+}
+
+func (bind *LinuxSocketBind) makeReceiveBatchIPv6() BatchReceiveFunc {
+	batch := newRecvBatch()
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		return bind.receiveBatch(batch, true, bufs, sizes, eps)
+	}
+}
+
+func (bind *LinuxSocketBind) receiveBatch(batch *recvBatch, isV6 bool, bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	sock := bind.sock4
+	if isV6 {
+		sock = bind.sock6
+	}
+	if sock == -1 {
+		return 0, net.ErrClosed
+	}
+	count := len(bufs)
+	if count > len(batch.msgs) {
+		count = len(batch.msgs)
+	}
+	for i := 0; i < count; i++ {
+		batch.iovs[i].Base = &bufs[i][0]
+		batch.iovs[i].SetLen(len(bufs[i]))
+		batch.msgs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+		batch.msgs[i].hdr.SetControllen(pktinfoCmsgSpace)
+		batch.msgs[i].hdr.Flags = 0
+		batch.msgs[i].len = 0
+	}
+	n, err := recvmmsg(sock, batch.msgs[:count], unix.MSG_WAITFORONE)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		end := &LinuxSocketEndpoint{isV6: isV6}
+		cmsg := batch.cmsgs[i*pktinfoCmsgSpace:]
+		if !isV6 {
+			name := (*unix.RawSockaddrInet4)(unsafe.Pointer(&batch.names[i]))
+			if name.Family == unix.AF_INET {
+				port := (*[2]byte)(unsafe.Pointer(&name.Port))
+				end.dst4().Port = int(port[0])<<8 + int(port[1])
+				end.dst4().Addr = name.Addr
+			}
+			pktinfo := (*struct {
+				cmsghdr unix.Cmsghdr
+				pktinfo unix.Inet4Pktinfo
+			})(unsafe.Pointer(&cmsg[0]))
+			if batch.msgs[i].hdr.Controllen >= unix.SizeofCmsghdr &&
+				pktinfo.cmsghdr.Level == unix.IPPROTO_IP &&
+				pktinfo.cmsghdr.Type == unix.IP_PKTINFO &&
+				pktinfo.cmsghdr.Len >= unix.SizeofInet4Pktinfo {
+				end.src4().Src = pktinfo.pktinfo.Spec_dst
+				end.src4().Ifindex = pktinfo.pktinfo.Ifindex
+			}
+		} else {
+			name := &batch.names[i]
+			if name.Family == unix.AF_INET6 {
+				port := (*[2]byte)(unsafe.Pointer(&name.Port))
+				end.dst6().Port = int(port[0])<<8 + int(port[1])
+				end.dst6().Addr = name.Addr
+				end.dst6().ZoneId = name.Scope_id
+			}
+			pktinfo := (*struct {
+				cmsghdr unix.Cmsghdr
+				pktinfo unix.Inet6Pktinfo
+			})(unsafe.Pointer(&cmsg[0]))
+			if batch.msgs[i].hdr.Controllen >= unix.SizeofCmsghdr &&
+				pktinfo.cmsghdr.Level == unix.IPPROTO_IPV6 &&
+				pktinfo.cmsghdr.Type == unix.IPV6_PKTINFO &&
+				pktinfo.cmsghdr.Len >= unix.SizeofInet6Pktinfo {
+				end.src6().src = pktinfo.pktinfo.Addr
+				end.dst6().ZoneId = pktinfo.pktinfo.Ifindex
+			}
+		}
+		sizes[i] = int(batch.msgs[i].len)
+		eps[i] = end
+	}
+	return n, nil
+}
+
+// sendBatch holds the message headers of sendmmsg. All messages share the same destination and pktinfo.
+type sendBatch struct {
+	msgs []mmsghdr
+	iovs []unix.Iovec
+	name unix.RawSockaddrInet6
+	cmsg []byte
+}
+
+var sendBatchPool = sync.Pool{
+	New: func() interface{} {
+		return &sendBatch{
+			msgs: make([]mmsghdr, linuxBatchSize),
+			iovs: make([]unix.Iovec, linuxBatchSize),
+			cmsg: make([]byte, pktinfoCmsgSpace),
+		}
+	},
+}
+
+// prepare fills the destination and the source of end
+func (batch *sendBatch) prepare(end *LinuxSocketEndpoint) (namelen uint32, cmsglen int) {
+	end.mu.Lock()
+	defer end.mu.Unlock()
+	if !end.isV6 {
+		name := (*unix.RawSockaddrInet4)(unsafe.Pointer(&batch.name))
+		*name = unix.RawSockaddrInet4{Family: unix.AF_INET, Addr: end.dst4().Addr}
+		port := (*[2]byte)(unsafe.Pointer(&name.Port))
+		port[0], port[1] = byte(end.dst4().Port>>8), byte(end.dst4().Port)
+		cmsg := (*struct {
+			cmsghdr unix.Cmsghdr
+			pktinfo unix.Inet4Pktinfo
+		})(unsafe.Pointer(&batch.cmsg[0]))
+		cmsg.cmsghdr = unix.Cmsghdr{
+			Level: unix.IPPROTO_IP,
+			Type:  unix.IP_PKTINFO,
+		}
+		cmsg.cmsghdr.SetLen(unix.CmsgLen(unix.SizeofInet4Pktinfo))
+		cmsg.pktinfo = unix.Inet4Pktinfo{
+			Spec_dst: end.src4().Src,
+			Ifindex:  end.src4().Ifindex,
+		}
+		return unix.SizeofSockaddrInet4, unix.CmsgSpace(unix.SizeofInet4Pktinfo)
+	}
+	batch.name = unix.RawSockaddrInet6{Family: unix.AF_INET6, Addr: end.dst6().Addr, Scope_id: end.dst6().ZoneId}
+	port := (*[2]byte)(unsafe.Pointer(&batch.name.Port))
+	port[0], port[1] = byte(end.dst6().Port>>8), byte(end.dst6().Port)
+	cmsg := (*struct {
+		cmsghdr unix.Cmsghdr
+		pktinfo unix.Inet6Pktinfo
+	})(unsafe.Pointer(&batch.cmsg[0]))
+	cmsg.cmsghdr = unix.Cmsghdr{
+		Level: unix.IPPROTO_IPV6,
+		Type:  unix.IPV6_PKTINFO,
+	}
+	cmsg.cmsghdr.SetLen(unix.CmsgLen(unix.SizeofInet6Pktinfo))
+	cmsg.pktinfo = unix.Inet6Pktinfo{
+		Addr:    end.src6().src,
+		Ifindex: end.dst6().ZoneId,
+	}
+	if cmsg.pktinfo.Addr == [16]byte{} {
+		cmsg.pktinfo.Ifindex = 0
+	}
+	return unix.SizeofSockaddrInet6, unix.CmsgSpace(unix.SizeofInet6Pktinfo)
+}
+
+// send sends bufs by sendmmsg until all are sent
+func (batch *sendBatch) send(sock int, end *LinuxSocketEndpoint, bufs [][]byte) error {
+	namelen, cmsglen := batch.prepare(end)
+	retried := false
+	for len(bufs) > 0 {
+		count := len(bufs)
+		if count > len(batch.msgs) {
+			count = len(batch.msgs)
+		}
+		for i := 0; i < count; i++ {
+			batch.iovs[i].Base = &bufs[i][0]
+			batch.iovs[i].SetLen(len(bufs[i]))
+			batch.msgs[i].hdr = unix.Msghdr{
+				Name:    (*byte)(unsafe.Pointer(&batch.name)),
+				Namelen: namelen,
+				Iov:     &batch.iovs[i],
+				Control: &batch.cmsg[0],
+			}
+			batch.msgs[i].hdr.SetIovlen(1)
+			batch.msgs[i].hdr.SetControllen(cmsglen)
+		}
+		n, err := sendmmsgFunc(sock, batch.msgs[:count], 0)
+		if err == unix.EINVAL && !retried {
+			// clear src and retry
+			end.ClearSrc()
+			namelen, cmsglen = batch.prepare(end)
+			retried = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		bufs = bufs[n:]
+	}
+	return nil
+}
+
+func (bind *LinuxSocketBind) SendBatch(bufs [][]byte, end Endpoint) error {
+	nend, ok := end.(*LinuxSocketEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	for _, buf := range bufs {
+		if len(buf) == 0 {
+			return errors.New("empty packet in batch")
+		}
+	}
+	if len(bufs) == 0 {
+		return nil
+	}
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	sock := bind.sock4
+	if nend.isV6 {
+		sock = bind.sock6
+	}
+	if sock == -1 {
+		return net.ErrClosed
+	}
+	batch := sendBatchPool.Get().(*sendBatch)
+	defer sendBatchPool.Put(batch)
+	return batch.send(sock, nend, bufs)
+}
@@ -0,0 +1,211 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type batchPacket struct {
+	data []byte
+	ep   Endpoint
+}
+
+// openBatchLoopback opens a LinuxSocketBind of one address family, skips the test if it's not available
+func openBatchLoopback(t *testing.T, isV6 bool) (*LinuxSocketBind, BatchReceiveFunc, uint16) {
+	t.Helper()
+	bind := NewLinuxSocketBindAf(!isV6, isV6).(*LinuxSocketBind)
+	fns, port, err := bind.OpenBatch(0)
+	if err != nil {
+		if isV6 {
+			t.Skipf("IPv6 is not available: %v", err)
+		}
+		t.Fatal(err)
+	}
+	if len(fns) != 1 {
+		bind.Close()
+		t.Fatalf("OpenBatch returned %v receive functions, want 1", len(fns))
+	}
+	return bind, fns[0], port
+}
+
+// receiveBatches receives n packets by fn, at most BatchSize packets per call
+func receiveBatches(t *testing.T, bind *LinuxSocketBind, fn BatchReceiveFunc, n int) []batchPacket {
+	t.Helper()
+	resc := make(chan []batchPacket, 1)
+	errc := make(chan error, 1)
+	go func() {
+		var ret []batchPacket
+		bufs := make([][]byte, bind.BatchSize())
+		for i := range bufs {
+			bufs[i] = make([]byte, 2048)
+		}
+		sizes := make([]int, len(bufs))
+		eps := make([]Endpoint, len(bufs))
+		for len(ret) < n {
+			count, err := fn(bufs, sizes, eps)
+			if err != nil {
+				errc <- err
+				return
+			}
+			for i := 0; i < count; i++ {
+				ret = append(ret, batchPacket{append([]byte(nil), bufs[i][:sizes[i]]...), eps[i]})
+			}
+		}
+		resc <- ret
+	}()
+	select {
+	case ret := <-resc:
+		return ret
+	case err := <-errc:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		bind.Close()
+		t.Fatalf("timeout, received less than %v packets", n)
+	}
+	return nil
+}
+
+func testBatchPackets(n int) [][]byte {
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = bytes.Repeat([]byte{byte(i)}, 1+i*7%1400)
+	}
+	return bufs
+}
+
+func checkBatchPackets(t *testing.T, got []batchPacket, want [][]byte, from string, to string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("received %v packets, want %v", len(got), len(want))
+	}
+	for i, p := range got {
+		if !bytes.Equal(p.data, want[i]) {
+			t.Fatalf("packet %v: received %v bytes of %v, want %v bytes of %v", i, len(p.data), p.data[0], len(want[i]), want[i][0])
+		}
+		if p.ep.DstToString() != from || p.ep.SrcToString() != to {
+			t.Fatalf("packet %v: received from %v to %v, want from %v to %v", i, p.ep.DstToString(), p.ep.SrcToString(), from, to)
+		}
+	}
+}
+
+func TestLinuxBatchLoopback(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		isV6 bool
+		ip   string
+	}{
+		{"v4", false, "127.0.0.1"},
+		{"v6", true, "::1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, fn, port := openBatchLoopback(t, tt.isV6)
+			defer server.Close()
+			client, _, cport := openBatchLoopback(t, tt.isV6)
+			defer client.Close()
+			ep, err := client.ParseEndpoint(net.JoinHostPort(tt.ip, strconv.Itoa(int(port))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// more than one sendmmsg and more than one recvmmsg
+			bufs := testBatchPackets(server.BatchSize() + 36)
+			if err := client.SendBatch(bufs, ep); err != nil {
+				if tt.isV6 {
+					t.Skipf("IPv6 loopback is not available: %v", err)
+				}
+				t.Fatal(err)
+			}
+			got := receiveBatches(t, server, fn, len(bufs))
+			// the source of the sender, and our address from the pktinfo
+			checkBatchPackets(t, got, bufs, net.JoinHostPort(tt.ip, strconv.Itoa(int(cport))), tt.ip)
+
+			// the reply to the received endpoint uses it as the source
+			if err := server.SendBatch(bufs[:2], got[0].ep); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	if err := (&LinuxSocketBind{sock4: -1, sock6: -1}).SendBatch([][]byte{{1}}, &StdNetEndpoint{}); err != ErrWrongEndpointType {
+		t.Errorf("SendBatch to a StdNetEndpoint: %v, want %v", err, ErrWrongEndpointType)
+	}
+}
+
+func TestLinuxBatchClearSrc(t *testing.T) {
+	// the kernel rejects a source address which is not ours with EINVAL
+	calls := 0
+	sendmmsgFunc = func(fd int, msgs []mmsghdr, flags int) (int, error) {
+		calls++
+		if calls == 1 {
+			return 0, unix.EINVAL
+		}
+		return sendmmsg(fd, msgs, flags)
+	}
+	defer func() { sendmmsgFunc = sendmmsg }()
+
+	server, fn, port := openBatchLoopback(t, false)
+	defer server.Close()
+	client, _, _ := openBatchLoopback(t, false)
+	defer client.Close()
+	ep, err := client.ParseEndpoint("127.0.0.1:" + strconv.Itoa(int(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := ep.(*LinuxSocketEndpoint)
+	end.src4().Src = [4]byte{192, 0, 2, 1}
+	bufs := testBatchPackets(3)
+	if err := client.SendBatch(bufs, ep); err != nil {
+		t.Fatalf("SendBatch with a stale source: %v", err)
+	}
+	if src := end.SrcToString(); src != "0.0.0.0" || calls != 2 {
+		t.Errorf("source after %v calls = %v, want cleared after one retry", calls, src)
+	}
+	receiveBatches(t, server, fn, len(bufs))
+
+	// it's retried only once
+	calls = 0
+	sendmmsgFunc = func(fd int, msgs []mmsghdr, flags int) (int, error) {
+		calls++
+		return 0, unix.EINVAL
+	}
+	if err := client.SendBatch(bufs, ep); err != unix.EINVAL || calls != 2 {
+		t.Errorf("SendBatch = %v after %v calls, want %v after 2 calls", err, calls, unix.EINVAL)
+	}
+}
+
+func TestLinuxBatchPartialSend(t *testing.T) {
+	calls := 0
+	sendmmsgFunc = func(fd int, msgs []mmsghdr, flags int) (int, error) {
+		calls++
+		if len(msgs) > 5 {
+			msgs = msgs[:5]
+		}
+		return sendmmsg(fd, msgs, flags)
+	}
+	defer func() { sendmmsgFunc = sendmmsg }()
+
+	server, fn, port := openBatchLoopback(t, false)
+	defer server.Close()
+	client, _, cport := openBatchLoopback(t, false)
+	defer client.Close()
+	ep, err := client.ParseEndpoint("127.0.0.1:" + strconv.Itoa(int(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufs := testBatchPackets(23)
+	if err := client.SendBatch(bufs, ep); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 5 {
+		t.Errorf("sendmmsg called %v times, want 5", calls)
+	}
+	checkBatchPackets(t, receiveBatches(t, server, fn, len(bufs)), bufs, "127.0.0.1:"+strconv.Itoa(int(cport)), "127.0.0.1")
+}
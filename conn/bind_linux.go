@@ -306,6 +306,23 @@ func (end *LinuxSocketEndpoint) SrcIP() net.IP {
 	}
 }
 
+func (end *LinuxSocketEndpoint) SetSrcIP(ip net.IP) error {
+	end.ClearSrc()
+	if !end.isV6 {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return errors.New("source address is not IPv4: " + ip.String())
+		}
+		copy(end.src4().Src[:], ip4)
+		return nil
+	}
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return errors.New("source address is not IPv6: " + ip.String())
+	}
+	copy(end.src6().src[:], ip)
+	return nil
+}
+
 func (end *LinuxSocketEndpoint) DstIP() net.IP {
 	if !end.isV6 {
 		return net.IPv4(
@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+)
+
+// MultiBind combines the UDP bind and the StreamBind.
+// Endpoints with tcp://, tls://, ws:// or wss:// scheme go to the StreamBind, others go to the UDP bind.
+type MultiBind struct {
+	udp    Bind
+	stream *StreamBind
+}
+
+var _ BatchBind = (*MultiBind)(nil)
+
+func NewMultiBind(udp Bind, stream *StreamBind) Bind {
+	return &MultiBind{
+		udp:    udp,
+		stream: stream,
+	}
+}
+
+// Unwrap returns the UDP bind
+func (bind *MultiBind) Unwrap() Bind {
+	return bind.udp
+}
+
+func (bind *MultiBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := bind.udp.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	sfns, _, err := bind.stream.Open(actualPort)
+	if err != nil {
+		bind.udp.Close()
+		return nil, 0, err
+	}
+	return append(fns, sfns...), actualPort, nil
+}
+
+func (bind *MultiBind) OpenBatch(port uint16) ([]BatchReceiveFunc, uint16, error) {
+	var fns []BatchReceiveFunc
+	var actualPort uint16
+	if bb, ok := bind.udp.(BatchBind); ok {
+		bfns, p, err := bb.OpenBatch(port)
+		if err != nil {
+			return nil, 0, err
+		}
+		fns, actualPort = bfns, p
+	} else {
+		ufns, p, err := bind.udp.Open(port)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, fn := range ufns {
+			fns = append(fns, fn.Batch())
+		}
+		actualPort = p
+	}
+	sfns, _, err := bind.stream.Open(actualPort)
+	if err != nil {
+		bind.udp.Close()
+		return nil, 0, err
+	}
+	for _, fn := range sfns {
+		fns = append(fns, fn.Batch())
+	}
+	return fns, actualPort, nil
+}
+
+func (bind *MultiBind) Close() error {
+	err1 := bind.udp.Close()
+	err2 := bind.stream.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+func (bind *MultiBind) SetMark(mark uint32) error {
+	bind.stream.SetMark(mark)
+	return bind.udp.SetMark(mark)
+}
+
+func (bind *MultiBind) Send(b []byte, ep Endpoint) error {
+	if _, ok := ep.(*StreamEndpoint); ok {
+		return bind.stream.Send(b, ep)
+	}
+	return bind.udp.Send(b, ep)
+}
+
+func (bind *MultiBind) BatchSize() int {
+	if bb, ok := bind.udp.(BatchBind); ok {
+		return bb.BatchSize()
+	}
+	return 1
+}
+
+func (bind *MultiBind) SendBatch(bufs [][]byte, ep Endpoint) error {
+	if bb, ok := bind.udp.(BatchBind); ok {
+		if _, ok := ep.(*StreamEndpoint); !ok {
+			return bb.SendBatch(bufs, ep)
+		}
+	}
+	for _, b := range bufs {
+		if err := bind.Send(b, ep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *MultiBind) ParseEndpoint(s string) (Endpoint, error) {
+	scheme, hostport := SplitScheme(s)
+	switch scheme {
+	case SchemeUDP:
+		return bind.udp.ParseEndpoint(hostport)
+	case SchemeTCP, SchemeTLS, SchemeWS, SchemeWSS:
+		return bind.stream.ParseEndpoint(s)
+	}
+	return nil, errors.New("unknown scheme of endpoint: " + scheme)
+}
+
+func (bind *MultiBind) EnabledAf() EnabledAf {
+	return bind.udp.EnabledAf()
+}
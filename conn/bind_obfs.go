@@ -0,0 +1,259 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20"
+)
+
+// An obfuscated packet is
+//
+//	nonce(8) || mask(length(2) || packet || padding)
+//
+// The length and the packet are XORed with the ChaCha20 stream of the key derived from
+// the shared secret and the random nonce. Only the first obfsMaskLen bytes of large packets
+// are masked, the rest is ciphertext already.
+const (
+	obfsNonceLen     = 8
+	obfsHeaderLen    = obfsNonceLen + 2
+	obfsMaskLen      = 64
+	obfsSmallPacket  = 256 // handshakes, cookie replies and keepalives
+	obfsSmallPadding = 256
+	obfsMaxPacket    = (1 << 16) - 1
+	obfsLabel        = "EtherGuard obfuscation v1"
+)
+
+// ObfsConf configures ObfsBind. Obfuscation is disabled if Secret is empty.
+// All nodes of the network must share the same setting.
+type ObfsConf struct {
+	Secret     string `yaml:"Secret"`
+	MaxPadding int    `yaml:"MaxPadding"`
+}
+
+// ObfsBind masks the packets of another Bind against protocol fingerprinting.
+// Packets smaller than obfsSmallPacket get up to obfsSmallPadding random bytes, so the sizes of
+// handshakes are not fixed. Others get up to MaxPadding bytes.
+type ObfsBind struct {
+	Bind
+	key        [chacha20.KeySize]byte
+	maxPadding int
+}
+
+var _ BatchBind = (*ObfsBind)(nil)
+
+var errObfsInvalid = errors.New("invalid obfuscated packet")
+
+var obfsBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([obfsMaxPacket]byte)
+	},
+}
+
+// obfsRand buffers crypto/rand for the nonces and paddings
+var obfsRand = struct {
+	sync.Mutex
+	r *bufio.Reader
+}{
+	r: bufio.NewReaderSize(rand.Reader, 4096),
+}
+
+func obfsRandRead(b []byte) {
+	obfsRand.Lock()
+	io.ReadFull(obfsRand.r, b)
+	obfsRand.Unlock()
+}
+
+func NewObfsBind(bind Bind, conf ObfsConf) Bind {
+	ob := &ObfsBind{
+		Bind:       bind,
+		maxPadding: conf.MaxPadding,
+	}
+	if ob.maxPadding < 0 {
+		ob.maxPadding = 0
+	}
+	ob.key = blake2s.Sum256([]byte(obfsLabel + conf.Secret))
+	return ob
+}
+
+// Unwrap returns the bind carrying the obfuscated packets
+func (bind *ObfsBind) Unwrap() Bind {
+	return bind.Bind
+}
+
+func (bind *ObfsBind) newMask(nonce []byte) *chacha20.Cipher {
+	var fullNonce [chacha20.NonceSize]byte
+	copy(fullNonce[:], nonce)
+	c, _ := chacha20.NewUnauthenticatedCipher(bind.key[:], fullNonce[:])
+	return c
+}
+
+// maskLen is the length of masked bytes after the nonce
+func maskLen(n int) int {
+	if n >= obfsSmallPacket && 2+n > obfsMaskLen {
+		return obfsMaskLen
+	}
+	return 2 + n
+}
+
+// encode writes the obfuscated packet of b into out and returns its length
+func (bind *ObfsBind) encode(out []byte, b []byte) (int, error) {
+	maxPadding := bind.maxPadding
+	if len(b) < obfsSmallPacket {
+		maxPadding = obfsSmallPadding
+	}
+	var r [obfsNonceLen + 2]byte
+	obfsRandRead(r[:])
+	padding := int(binary.LittleEndian.Uint16(r[obfsNonceLen:])) % (maxPadding + 1)
+	if obfsHeaderLen+len(b)+padding > len(out) {
+		padding = len(out) - obfsHeaderLen - len(b)
+		if padding < 0 {
+			return 0, errors.New("packet too large to obfuscate")
+		}
+	}
+	n := obfsHeaderLen + len(b) + padding
+	copy(out, r[:obfsNonceLen])
+	binary.BigEndian.PutUint16(out[obfsNonceLen:], uint16(len(b)))
+	copy(out[obfsHeaderLen:], b)
+	obfsRandRead(out[obfsHeaderLen+len(b) : n])
+	masked := out[obfsNonceLen : obfsNonceLen+maskLen(len(b))]
+	bind.newMask(out[:obfsNonceLen]).XORKeyStream(masked, masked)
+	return n, nil
+}
+
+// decode restores the packet in place and returns its length
+func (bind *ObfsBind) decode(b []byte) (int, error) {
+	if len(b) < obfsHeaderLen {
+		return 0, errObfsInvalid
+	}
+	c := bind.newMask(b[:obfsNonceLen])
+	masked := b[obfsNonceLen:]
+	if len(masked) > obfsMaskLen {
+		masked = masked[:obfsMaskLen]
+	}
+	c.XORKeyStream(masked, masked)
+	n := int(binary.BigEndian.Uint16(b[obfsNonceLen:]))
+	if obfsHeaderLen+n > len(b) {
+		return 0, errObfsInvalid
+	}
+	if l := maskLen(n); l > len(masked) {
+		rest := b[obfsNonceLen+len(masked) : obfsNonceLen+l]
+		c.XORKeyStream(rest, rest)
+	}
+	return copy(b, b[obfsHeaderLen:obfsHeaderLen+n]), nil
+}
+
+func (bind *ObfsBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := bind.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range fns {
+		fns[i] = bind.makeReceiveObfs(fns[i])
+	}
+	return fns, actualPort, nil
+}
+
+func (bind *ObfsBind) makeReceiveObfs(fn ReceiveFunc) ReceiveFunc {
+	return func(b []byte) (int, Endpoint, error) {
+		for {
+			n, ep, err := fn(b)
+			if err != nil {
+				return n, ep, err
+			}
+			if n, err = bind.decode(b[:n]); err == nil {
+				return n, ep, nil
+			}
+		}
+	}
+}
+
+func (bind *ObfsBind) OpenBatch(port uint16) ([]BatchReceiveFunc, uint16, error) {
+	bb, ok := bind.Bind.(BatchBind)
+	if !ok {
+		fns, actualPort, err := bind.Open(port)
+		if err != nil {
+			return nil, 0, err
+		}
+		bfns := make([]BatchReceiveFunc, len(fns))
+		for i, fn := range fns {
+			bfns[i] = fn.Batch()
+		}
+		return bfns, actualPort, nil
+	}
+	fns, actualPort, err := bb.OpenBatch(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range fns {
+		fns[i] = bind.makeReceiveBatchObfs(fns[i])
+	}
+	return fns, actualPort, nil
+}
+
+func (bind *ObfsBind) makeReceiveBatchObfs(fn BatchReceiveFunc) BatchReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		n, err := fn(bufs, sizes, eps)
+		for i := 0; i < n; i++ {
+			sizes[i], _ = bind.decode(bufs[i][:sizes[i]]) // 0 for invalid packets, which are dropped by the receiver
+		}
+		return n, err
+	}
+}
+
+func (bind *ObfsBind) Send(b []byte, ep Endpoint) error {
+	buf := obfsBufPool.Get().(*[obfsMaxPacket]byte)
+	defer obfsBufPool.Put(buf)
+	n, err := bind.encode(buf[:], b)
+	if err != nil {
+		return err
+	}
+	return bind.Bind.Send(buf[:n], ep)
+}
+
+func (bind *ObfsBind) BatchSize() int {
+	if bb, ok := bind.Bind.(BatchBind); ok {
+		return bb.BatchSize()
+	}
+	return 1
+}
+
+func (bind *ObfsBind) SendBatch(bufs [][]byte, ep Endpoint) error {
+	bb, ok := bind.Bind.(BatchBind)
+	if !ok {
+		for _, b := range bufs {
+			if err := bind.Send(b, ep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	outs := make([][]byte, len(bufs))
+	pooled := make([]*[obfsMaxPacket]byte, len(bufs))
+	defer func() {
+		for _, buf := range pooled {
+			if buf != nil {
+				obfsBufPool.Put(buf)
+			}
+		}
+	}()
+	for i, b := range bufs {
+		pooled[i] = obfsBufPool.Get().(*[obfsMaxPacket]byte)
+		n, err := bind.encode(pooled[i][:], b)
+		if err != nil {
+			return err
+		}
+		outs[i] = pooled[i][:n]
+	}
+	return bb.SendBatch(outs, ep)
+}
@@ -0,0 +1,240 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// loopBind delivers the sent packets to its own receive functions
+type loopBind struct {
+	queue chan []byte
+}
+
+func newLoopBind() *loopBind {
+	return &loopBind{queue: make(chan []byte, 64)}
+}
+
+func (b *loopBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	return []ReceiveFunc{func(buf []byte) (int, Endpoint, error) {
+		packet, ok := <-b.queue
+		if !ok {
+			return 0, nil, net.ErrClosed
+		}
+		return copy(buf, packet), nil, nil
+	}}, port, nil
+}
+
+func (b *loopBind) OpenBatch(port uint16) ([]BatchReceiveFunc, uint16, error) {
+	return []BatchReceiveFunc{func(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		n := 0
+		for ; n < len(bufs) && len(b.queue) > 0; n++ {
+			sizes[n] = copy(bufs[n], <-b.queue)
+		}
+		return n, nil
+	}}, port, nil
+}
+
+func (b *loopBind) Close() error                             { close(b.queue); return nil }
+func (b *loopBind) SetMark(mark uint32) error                { return nil }
+func (b *loopBind) ParseEndpoint(s string) (Endpoint, error) { return nil, nil }
+func (b *loopBind) EnabledAf() EnabledAf                     { return EnabledAf46 }
+func (b *loopBind) BatchSize() int                           { return 8 }
+
+func (b *loopBind) Send(packet []byte, ep Endpoint) error {
+	b.queue <- append([]byte(nil), packet...)
+	return nil
+}
+
+func (b *loopBind) SendBatch(bufs [][]byte, ep Endpoint) error {
+	for _, packet := range bufs {
+		b.Send(packet, ep)
+	}
+	return nil
+}
+
+func testObfsPacket(n int) []byte {
+	packet := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(packet)
+	return packet
+}
+
+func TestObfsRoundTrip(t *testing.T) {
+	bind := NewObfsBind(nil, ObfsConf{Secret: "secret", MaxPadding: 64}).(*ObfsBind)
+	out := make([]byte, obfsMaxPacket)
+	for _, size := range []int{0, 1, obfsMaskLen - 3, obfsMaskLen - 2, obfsMaskLen - 1, 148, 253, 254, 255, 256, 257, 1420, 9000, obfsMaxPacket - obfsHeaderLen} {
+		packet := testObfsPacket(size)
+		for i := 0; i < 20; i++ {
+			n, err := bind.encode(out, packet)
+			if err != nil {
+				t.Fatalf("encode %v bytes: %v", size, err)
+			}
+			if size > obfsMaskLen && bytes.Equal(out[obfsHeaderLen:obfsHeaderLen+obfsMaskLen-2], packet[:obfsMaskLen-2]) {
+				t.Fatalf("encode %v bytes: the header of the packet is not masked", size)
+			}
+			decoded, err := bind.decode(out[:n])
+			if err != nil {
+				t.Fatalf("decode %v bytes: %v", size, err)
+			}
+			if !bytes.Equal(out[:decoded], packet) {
+				t.Fatalf("round trip of %v bytes failed", size)
+			}
+		}
+	}
+}
+
+func TestObfsMaskLen(t *testing.T) {
+	for _, tt := range []struct {
+		n, maskLen int
+	}{
+		{0, 2},
+		{obfsMaskLen - 2, obfsMaskLen},
+		{obfsMaskLen, obfsMaskLen + 2},
+		{254, 256},
+		{255, 257},
+		{256, obfsMaskLen},
+		{1420, obfsMaskLen},
+	} {
+		if got := maskLen(tt.n); got != tt.maskLen {
+			t.Errorf("maskLen(%v) = %v, want %v", tt.n, got, tt.maskLen)
+		}
+	}
+}
+
+func TestObfsPadding(t *testing.T) {
+	out := make([]byte, obfsMaxPacket)
+	for _, tt := range []struct {
+		maxPadding int
+		size       int
+		maxLen     int
+	}{
+		{0, 1420, obfsHeaderLen + 1420},
+		{-1, 1420, obfsHeaderLen + 1420},
+		{100, 1420, obfsHeaderLen + 1420 + 100},
+		{0, 32, obfsHeaderLen + 32 + obfsSmallPadding},
+		{obfsMaxPacket, obfsMaxPacket - obfsHeaderLen - 5, obfsMaxPacket},
+	} {
+		bind := NewObfsBind(nil, ObfsConf{Secret: "secret", MaxPadding: tt.maxPadding}).(*ObfsBind)
+		lengths := make(map[int]bool)
+		for i := 0; i < 200; i++ {
+			n, err := bind.encode(out, testObfsPacket(tt.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n < obfsHeaderLen+tt.size || n > tt.maxLen {
+				t.Fatalf("MaxPadding %v: %v bytes obfuscated to %v bytes, want %v to %v", tt.maxPadding, tt.size, n, obfsHeaderLen+tt.size, tt.maxLen)
+			}
+			lengths[n] = true
+		}
+		// the padding of the largest packets is clipped to the buffer
+		if tt.maxLen > obfsHeaderLen+tt.size && tt.maxLen < obfsMaxPacket && len(lengths) < 2 {
+			t.Errorf("MaxPadding %v: the padding of %v bytes is not random", tt.maxPadding, tt.size)
+		}
+	}
+	bind := NewObfsBind(nil, ObfsConf{Secret: "secret"}).(*ObfsBind)
+	if _, err := bind.encode(out, make([]byte, obfsMaxPacket)); err == nil {
+		t.Errorf("encode of a packet larger than the buffer succeeded")
+	}
+	if _, err := bind.decode(make([]byte, obfsHeaderLen-1)); err != errObfsInvalid {
+		t.Errorf("decode of a short packet: %v, want %v", err, errObfsInvalid)
+	}
+}
+
+func TestObfsWrongSecret(t *testing.T) {
+	bind := NewObfsBind(nil, ObfsConf{Secret: "secret"}).(*ObfsBind)
+	other := NewObfsBind(nil, ObfsConf{Secret: "other secret"}).(*ObfsBind)
+	out := make([]byte, obfsMaxPacket)
+	for _, size := range []int{32, 148, 1420} {
+		packet := testObfsPacket(size)
+		for i := 0; i < 100; i++ {
+			n, err := bind.encode(out, packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded, err := other.decode(out[:n]); err == nil && bytes.Equal(out[:decoded], packet) {
+				t.Fatalf("a node with another secret decoded the packet of %v bytes", size)
+			}
+		}
+	}
+}
+
+func TestObfsBind(t *testing.T) {
+	packets := [][]byte{testObfsPacket(32), testObfsPacket(148), testObfsPacket(255), testObfsPacket(1420)}
+	t.Run("single", func(t *testing.T) {
+		inner := newLoopBind()
+		bind := NewObfsBind(inner, ObfsConf{Secret: "secret", MaxPadding: 64})
+		fns, _, err := bind.Open(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bind.Close()
+		// a packet which is not obfuscated is skipped
+		inner.Send([]byte{1, 2, 3}, nil)
+		buf := make([]byte, obfsMaxPacket)
+		for _, packet := range packets {
+			if err := bind.Send(packet, nil); err != nil {
+				t.Fatal(err)
+			}
+			n, _, err := fns[0](buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], packet) {
+				t.Fatalf("received %v bytes, want %v bytes", n, len(packet))
+			}
+		}
+	})
+	t.Run("batch", func(t *testing.T) {
+		inner := newLoopBind()
+		bind := NewObfsBind(inner, ObfsConf{Secret: "secret", MaxPadding: 64}).(*ObfsBind)
+		fns, _, err := bind.OpenBatch(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bind.Close()
+		if bind.BatchSize() != inner.BatchSize() {
+			t.Fatalf("BatchSize() = %v, want %v", bind.BatchSize(), inner.BatchSize())
+		}
+		if err := bind.SendBatch(packets[:2], nil); err != nil {
+			t.Fatal(err)
+		}
+		inner.Send([]byte{1, 2, 3}, nil)
+		if err := bind.SendBatch(packets[2:], nil); err != nil {
+			t.Fatal(err)
+		}
+		bufs := make([][]byte, inner.BatchSize())
+		for i := range bufs {
+			bufs[i] = make([]byte, obfsMaxPacket)
+		}
+		sizes := make([]int, len(bufs))
+		n, err := fns[0](bufs, sizes, make([]Endpoint, len(bufs)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(packets)+1 {
+			t.Fatalf("received %v packets, want %v", n, len(packets)+1)
+		}
+		want := [][]byte{packets[0], packets[1], nil, packets[2], packets[3]}
+		for i := range want {
+			if !bytes.Equal(bufs[i][:sizes[i]], want[i]) {
+				t.Errorf("packet %v: received %v bytes, want %v bytes", i, sizes[i], len(want[i]))
+			}
+		}
+	})
+}
+
+func TestUnwrapBind(t *testing.T) {
+	inner := newLoopBind()
+	multi := NewMultiBind(inner, NewStreamBind(StreamConf{}, EnabledAf46))
+	for _, bind := range []Bind{inner, multi, NewObfsBind(multi, ObfsConf{Secret: "secret"}), NewObfsBind(inner, ObfsConf{Secret: "secret"})} {
+		if got := UnwrapBind(bind); got != inner {
+			t.Errorf("UnwrapBind(%T) = %T, want the UDP bind", bind, got)
+		}
+	}
+}
@@ -0,0 +1,763 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Schemes of endpoint strings. An endpoint without scheme is an UDP endpoint.
+const (
+	SchemeUDP = "udp"
+	SchemeTCP = "tcp"
+	SchemeTLS = "tls"
+	SchemeWS  = "ws"
+	SchemeWSS = "wss"
+)
+
+const (
+	streamMaxFrame         = 65535
+	streamSendQueueSize    = 256
+	streamRecvQueueSize    = 1024
+	streamDialTimeout      = 10 * time.Second
+	streamMaxBackoff       = 30 * time.Second
+	streamIdleTimeout      = 3 * time.Minute
+	streamDefaultKeepalive = 15 * time.Second
+)
+
+// StreamConf configures the TCP/TLS transport of StreamBind
+type StreamConf struct {
+	ListenTCP         bool    `yaml:"ListenTCP"`
+	ListenPortTLS     int     `yaml:"ListenPortTLS"`
+	ListenPortWS      int     `yaml:"ListenPortWS"`
+	TLSCertFile       string  `yaml:"TLSCertFile"`
+	TLSKeyFile        string  `yaml:"TLSKeyFile"`
+	TLSServerName     string  `yaml:"TLSServerName"`
+	TLSVerify         bool    `yaml:"TLSVerify"`
+	HttpProxy         string  `yaml:"HttpProxy"`
+	KeepaliveInterval float64 `yaml:"KeepaliveInterval"`
+}
+
+// SplitScheme splits "tcp://1.2.3.4:5" into "tcp" and "1.2.3.4:5".
+// The scheme is SchemeUDP if s has no scheme.
+func SplitScheme(s string) (scheme string, hostport string) {
+	for i := 0; i+2 < len(s); i++ {
+		if s[i] == ':' {
+			if s[i+1] == '/' && s[i+2] == '/' {
+				return s[:i], s[i+3:]
+			}
+			break
+		}
+	}
+	return SchemeUDP, s
+}
+
+// splitPath splits "1.2.3.4:5/path" into "1.2.3.4:5" and "/path"
+func splitPath(s string) (hostport string, path string) {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		return s[:i], s[i:]
+	}
+	return s, "/"
+}
+
+// splitHostname splits "1.2.3.4:5/path#example.com" into "1.2.3.4:5/path" and "example.com".
+// LookupIP keeps the hostname of stream endpoints in the fragment, for SNI and the Host header.
+func splitHostname(s string) (addr string, hostname string) {
+	if i := strings.LastIndexByte(s, '#'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// EndpointHostPort returns the host:port of the endpoint string s, without scheme, path and hostname
+func EndpointHostPort(s string) string {
+	scheme, hostport := SplitScheme(s)
+	if !isStreamScheme(scheme) {
+		return hostport
+	}
+	hostport, _ = splitHostname(hostport)
+	hostport, _ = splitPath(hostport)
+	return hostport
+}
+
+func isStreamScheme(scheme string) bool {
+	switch scheme {
+	case SchemeTCP, SchemeTLS, SchemeWS, SchemeWSS:
+		return true
+	}
+	return false
+}
+
+// StreamBind carries the packets over TCP, TLS or WebSocket connections.
+// Connections are dialed on demand by Send, and redialed with backoff until the peer is idle.
+type StreamBind struct {
+	mu      sync.Mutex // protects following fields
+	state   *streamState
+	tlsCert *tls.Certificate
+
+	conf      StreamConf
+	keepalive time.Duration
+	mark      uint32
+	use4      bool
+	use6      bool
+}
+
+// streamState lives from Open to Close
+type streamState struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	recv      chan streamPacket
+	conns     map[string]*streamConn
+	listeners []net.Listener
+}
+
+type streamPacket struct {
+	buf *[streamMaxFrame]byte
+	n   int
+	ep  *StreamEndpoint
+}
+
+// packetConn carries the packets over a connection. A zero length packet is a keepalive.
+type packetConn interface {
+	net.Conn
+	ReadPacket(buf []byte) (int, error)
+	WritePacket(packet []byte) error
+	Buffered() int
+	Flush() error
+}
+
+// framedConn prefixes every packet by its length in 2 bytes big endian
+type framedConn struct {
+	net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	rheader [2]byte
+	wheader [2]byte
+}
+
+type streamConn struct {
+	ep       *StreamEndpoint
+	send     chan []byte
+	dialed   bool
+	lastSend int64 // unix nano, atomic
+}
+
+type StreamEndpoint struct {
+	scheme   string
+	dst      net.TCPAddr
+	path     string // WebSocket only
+	hostname string // outbound only, empty if the endpoint was an IP address
+}
+
+var _ Bind = (*StreamBind)(nil)
+var _ Endpoint = (*StreamEndpoint)(nil)
+
+var streamBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([streamMaxFrame]byte)
+	},
+}
+
+func NewStreamBind(conf StreamConf, Af EnabledAf) *StreamBind {
+	keepalive := time.Duration(conf.KeepaliveInterval * float64(time.Second))
+	if keepalive <= 0 {
+		keepalive = streamDefaultKeepalive
+	}
+	return &StreamBind{
+		conf:      conf,
+		keepalive: keepalive,
+		use4:      Af.IPv4,
+		use6:      Af.IPv6,
+	}
+}
+
+func (bind *StreamBind) ParseEndpoint(s string) (Endpoint, error) {
+	scheme, hostport := SplitScheme(s)
+	if !isStreamScheme(scheme) {
+		return nil, errors.New("unsupported scheme of stream endpoint: " + scheme)
+	}
+	hostport, hostname := splitHostname(hostport)
+	path := ""
+	if scheme == SchemeWS || scheme == SchemeWSS {
+		hostport, path = splitPath(hostport)
+	}
+	addr, err := parseEndpoint(hostport)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamEndpoint{
+		scheme:   scheme,
+		dst:      net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone},
+		path:     path,
+		hostname: hostname,
+	}, nil
+}
+
+func (bind *StreamBind) EnabledAf() EnabledAf {
+	return EnabledAf{
+		bind.use4,
+		bind.use6,
+	}
+}
+
+func (bind *StreamBind) SetMark(mark uint32) error {
+	atomic.StoreUint32(&bind.mark, mark)
+	return nil
+}
+
+func (bind *StreamBind) control(network, address string, c syscall.RawConn) error {
+	mark := atomic.LoadUint32(&bind.mark)
+	if mark == 0 {
+		return nil
+	}
+	var operr error
+	err := c.Control(func(fd uintptr) {
+		operr = setSockMark(fd, mark)
+	})
+	if err != nil {
+		return err
+	}
+	return operr
+}
+
+// Open listens on TCP port if ListenTCP is set, on ListenPortTLS for TLS and on ListenPortWS for WebSocket.
+// Outbound connections work without listening.
+func (bind *StreamBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	if bind.state != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	st := &streamState{
+		recv:  make(chan streamPacket, streamRecvQueueSize),
+		conns: make(map[string]*streamConn),
+	}
+	st.ctx, st.cancel = context.WithCancel(context.Background())
+
+	var networks []string
+	if bind.use4 {
+		networks = append(networks, "tcp4")
+	}
+	if bind.use6 {
+		networks = append(networks, "tcp6")
+	}
+	var serverConf *tls.Config
+	if bind.conf.ListenPortTLS > 0 {
+		cert, err := bind.certificate()
+		if err != nil {
+			return nil, 0, err
+		}
+		serverConf = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	}
+	lc := net.ListenConfig{Control: bind.control}
+	for _, network := range networks {
+		if bind.conf.ListenTCP {
+			l, err := lc.Listen(st.ctx, network, ":"+strconv.Itoa(int(port)))
+			if err != nil {
+				bind.closeState(st)
+				return nil, 0, err
+			}
+			st.listeners = append(st.listeners, l)
+			go bind.acceptLoop(st, l, SchemeTCP)
+		}
+		if serverConf != nil {
+			l, err := lc.Listen(st.ctx, network, ":"+strconv.Itoa(bind.conf.ListenPortTLS))
+			if err != nil {
+				bind.closeState(st)
+				return nil, 0, err
+			}
+			l = tls.NewListener(l, serverConf)
+			st.listeners = append(st.listeners, l)
+			go bind.acceptLoop(st, l, SchemeTLS)
+		}
+		if bind.conf.ListenPortWS > 0 {
+			l, err := lc.Listen(st.ctx, network, ":"+strconv.Itoa(bind.conf.ListenPortWS))
+			if err != nil {
+				bind.closeState(st)
+				return nil, 0, err
+			}
+			st.listeners = append(st.listeners, l)
+			go (&http.Server{Handler: bind}).Serve(l)
+		}
+	}
+	bind.state = st
+	return []ReceiveFunc{bind.makeReceiveStream(st)}, port, nil
+}
+
+func (bind *StreamBind) Close() error {
+	bind.mu.Lock()
+	st := bind.state
+	bind.state = nil
+	bind.mu.Unlock()
+	if st != nil {
+		bind.closeState(st)
+	}
+	return nil
+}
+
+// closeState stops all goroutines of st. Connections are closed by their own goroutines.
+func (bind *StreamBind) closeState(st *streamState) {
+	st.cancel()
+	for _, l := range st.listeners {
+		l.Close()
+	}
+}
+
+func (bind *StreamBind) makeReceiveStream(st *streamState) ReceiveFunc {
+	return func(buff []byte) (int, Endpoint, error) {
+		select {
+		case p := <-st.recv:
+			n := copy(buff, p.buf[:p.n])
+			streamBufPool.Put(p.buf)
+			return n, p.ep, nil
+		case <-st.ctx.Done():
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+func (bind *StreamBind) Send(buff []byte, endpoint Endpoint) error {
+	nend, ok := endpoint.(*StreamEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	if len(buff) > streamMaxFrame {
+		return errors.New("packet too large for stream transport")
+	}
+	key := nend.DstToString()
+	bind.mu.Lock()
+	st := bind.state
+	if st == nil {
+		bind.mu.Unlock()
+		return net.ErrClosed
+	}
+	c, ok := st.conns[key]
+	if !ok {
+		c = &streamConn{
+			ep:       nend,
+			send:     make(chan []byte, streamSendQueueSize),
+			dialed:   true,
+			lastSend: time.Now().UnixNano(),
+		}
+		st.conns[key] = c
+		go bind.dialLoop(st, c)
+	}
+	bind.mu.Unlock()
+	atomic.StoreInt64(&c.lastSend, time.Now().UnixNano())
+	packet := make([]byte, len(buff))
+	copy(packet, buff)
+	select {
+	case c.send <- packet:
+	default:
+		// drop it like an UDP socket with full buffer
+	}
+	return nil
+}
+
+func (bind *StreamBind) removeConn(st *streamState, c *streamConn) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	key := c.ep.DstToString()
+	if st.conns[key] == c {
+		delete(st.conns, key)
+	}
+}
+
+func (bind *StreamBind) idle(c *streamConn) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSend))) > streamIdleTimeout
+}
+
+// dialLoop keeps the outbound connection of c up until it is idle
+func (bind *StreamBind) dialLoop(st *streamState, c *streamConn) {
+	defer bind.removeConn(st, c)
+	backoff := time.Second
+	for {
+		pc, err := bind.dial(st.ctx, c.ep)
+		if err == nil {
+			backoff = time.Second
+			bind.serve(st, c, pc)
+		}
+		if st.ctx.Err() != nil || bind.idle(c) {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-st.ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+func (bind *StreamBind) dial(ctx context.Context, ep *StreamEndpoint) (packetConn, error) {
+	nc, err := bind.dialTCP(ctx, &ep.dst)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(streamDialTimeout))
+	if ep.scheme == SchemeTLS || ep.scheme == SchemeWSS {
+		tc := tls.Client(nc, &tls.Config{
+			ServerName:         bind.serverName(ep),
+			InsecureSkipVerify: !bind.conf.TLSVerify,
+		})
+		if err := tc.Handshake(); err != nil {
+			tc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	var pc packetConn = newFramedConn(nc)
+	if ep.scheme == SchemeWS || ep.scheme == SchemeWSS {
+		pc, err = bind.newWebSocketClient(nc, ep)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	nc.SetDeadline(time.Time{})
+	return pc, nil
+}
+
+// serverName is the name used for SNI, certificate verification and the Host header of ep.
+// It's the hostname of ep, or TLSServerName if ep was an IP address.
+func (bind *StreamBind) serverName(ep *StreamEndpoint) string {
+	if ep.hostname != "" {
+		return ep.hostname
+	}
+	if bind.conf.TLSServerName != "" {
+		return bind.conf.TLSServerName
+	}
+	return ep.dst.IP.String()
+}
+
+// dialTCP connects to addr, through HttpProxy if set
+func (bind *StreamBind) dialTCP(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout:   streamDialTimeout,
+		KeepAlive: bind.keepalive,
+		Control:   bind.control,
+	}
+	if bind.conf.HttpProxy == "" {
+		network := "tcp4"
+		if addr.IP.To4() == nil {
+			network = "tcp6"
+		}
+		return d.DialContext(ctx, network, addr.String())
+	}
+	proxy, err := url.Parse(bind.conf.HttpProxy)
+	if err != nil {
+		return nil, err
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	nc, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(streamDialTimeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr.String()},
+		Host:   addr.String(),
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	// the server speaks after us, so nothing is buffered after the response
+	resp, err := http.ReadResponse(bufio.NewReader(nc), req)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		nc.Close()
+		return nil, errors.New("proxy CONNECT " + addr.String() + ": " + resp.Status)
+	}
+	nc.SetDeadline(time.Time{})
+	return nc, nil
+}
+
+func (bind *StreamBind) acceptLoop(st *streamState, l net.Listener, scheme string) {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if st.ctx.Err() != nil {
+				return
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				time.Sleep(time.Second / 3)
+				continue
+			}
+			return
+		}
+		go bind.serveAccepted(st, nc, scheme)
+	}
+}
+
+func (bind *StreamBind) serveAccepted(st *streamState, nc net.Conn, scheme string) {
+	if tc, ok := nc.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(streamDialTimeout))
+		if err := tc.Handshake(); err != nil {
+			tc.Close()
+			return
+		}
+		tc.SetDeadline(time.Time{})
+	}
+	raddr, ok := nc.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		nc.Close()
+		return
+	}
+	bind.serveInbound(st, newFramedConn(nc), &StreamEndpoint{scheme: scheme, dst: *raddr})
+}
+
+// serveInbound runs the connection accepted from ep until it fails
+func (bind *StreamBind) serveInbound(st *streamState, pc packetConn, ep *StreamEndpoint) {
+	if ip4 := ep.dst.IP.To4(); ip4 != nil {
+		ep.dst.IP = ip4
+	}
+	c := &streamConn{
+		ep:   ep,
+		send: make(chan []byte, streamSendQueueSize),
+	}
+	bind.mu.Lock()
+	if bind.state != st {
+		bind.mu.Unlock()
+		pc.Close()
+		return
+	}
+	st.conns[ep.DstToString()] = c
+	bind.mu.Unlock()
+	defer bind.removeConn(st, c)
+	bind.serve(st, c, pc)
+}
+
+// serve runs the connection until it fails, then closes it
+func (bind *StreamBind) serve(st *streamState, c *streamConn, pc packetConn) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- bind.readLoop(st, c, pc)
+	}()
+	err := bind.writeLoop(st, c, pc, errc)
+	pc.Close()
+	return err
+}
+
+func (bind *StreamBind) readLoop(st *streamState, c *streamConn, pc packetConn) error {
+	for {
+		pc.SetReadDeadline(time.Now().Add(3 * bind.keepalive))
+		buf := streamBufPool.Get().(*[streamMaxFrame]byte)
+		n, err := pc.ReadPacket(buf[:])
+		if err != nil || n == 0 {
+			streamBufPool.Put(buf)
+			if err != nil {
+				return err
+			}
+			continue // keepalive
+		}
+		select {
+		case st.recv <- streamPacket{buf: buf, n: n, ep: c.ep}:
+		case <-st.ctx.Done():
+			streamBufPool.Put(buf)
+			return net.ErrClosed
+		}
+	}
+}
+
+func (bind *StreamBind) writeLoop(st *streamState, c *streamConn, pc packetConn, errc chan error) error {
+	ticker := time.NewTicker(bind.keepalive)
+	defer ticker.Stop()
+	wrote := false
+	for {
+		select {
+		case <-st.ctx.Done():
+			return net.ErrClosed
+		case err := <-errc:
+			return err
+		case packet := <-c.send:
+			pc.SetWriteDeadline(time.Now().Add(3 * bind.keepalive))
+			err := pc.WritePacket(packet)
+			// coalesce the queued packets into one write
+		drain:
+			for err == nil && pc.Buffered() < streamMaxFrame {
+				select {
+				case packet = <-c.send:
+					err = pc.WritePacket(packet)
+				default:
+					break drain
+				}
+			}
+			if err == nil {
+				err = pc.Flush()
+			}
+			if err != nil {
+				return err
+			}
+			wrote = true
+		case <-ticker.C:
+			if c.dialed && bind.idle(c) {
+				return nil
+			}
+			if !wrote {
+				pc.SetWriteDeadline(time.Now().Add(3 * bind.keepalive))
+				err := pc.WritePacket(nil)
+				if err == nil {
+					err = pc.Flush()
+				}
+				if err != nil {
+					return err
+				}
+			}
+			wrote = false
+		}
+	}
+}
+
+func newFramedConn(nc net.Conn) *framedConn {
+	return &framedConn{
+		Conn: nc,
+		r:    bufio.NewReaderSize(nc, streamMaxFrame),
+		w:    bufio.NewWriterSize(nc, streamMaxFrame),
+	}
+}
+
+func (c *framedConn) ReadPacket(buf []byte) (int, error) {
+	if _, err := io.ReadFull(c.r, c.rheader[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(c.rheader[:]))
+	if n > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	return io.ReadFull(c.r, buf[:n])
+}
+
+func (c *framedConn) WritePacket(packet []byte) error {
+	binary.BigEndian.PutUint16(c.wheader[:], uint16(len(packet)))
+	c.w.Write(c.wheader[:])
+	_, err := c.w.Write(packet)
+	return err
+}
+
+func (c *framedConn) Buffered() int {
+	return c.w.Buffered()
+}
+
+func (c *framedConn) Flush() error {
+	return c.w.Flush()
+}
+
+// certificate loads the TLS certificate, or generates a self-signed one.
+// Peers are authenticated by the handshake of the packets anyway.
+func (bind *StreamBind) certificate() (*tls.Certificate, error) {
+	if bind.tlsCert != nil {
+		return bind.tlsCert, nil
+	}
+	if bind.conf.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(bind.conf.TLSCertFile, bind.conf.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		bind.tlsCert = &cert
+		return bind.tlsCert, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	name := bind.conf.TLSServerName
+	if name == "" {
+		name = "localhost"
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	bind.tlsCert = &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return bind.tlsCert, nil
+}
+
+func (e *StreamEndpoint) ClearSrc() {}
+
+func (e *StreamEndpoint) DstIP() net.IP {
+	return e.dst.IP
+}
+
+func (e *StreamEndpoint) SrcIP() net.IP {
+	return nil // not supported
+}
+
+func (e *StreamEndpoint) DstToBytes() []byte {
+	ip := e.dst.IP.To4()
+	if ip == nil {
+		ip = e.dst.IP
+	}
+	out := append([]byte(nil), ip...)
+	out = append(out, byte(e.dst.Port&0xff))
+	out = append(out, byte((e.dst.Port>>8)&0xff))
+	return out
+}
+
+func (e *StreamEndpoint) DstToString() string {
+	if e.hostname != "" {
+		return e.scheme + "://" + e.dst.String() + e.path + "#" + e.hostname
+	}
+	return e.scheme + "://" + e.dst.String() + e.path
+}
+
+func (e *StreamEndpoint) SrcToString() string {
+	return ""
+}
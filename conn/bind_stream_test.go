@@ -0,0 +1,316 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSplitScheme(t *testing.T) {
+	tests := []struct {
+		s        string
+		scheme   string
+		hostport string
+	}{
+		{"192.0.2.1:3001", SchemeUDP, "192.0.2.1:3001"},
+		{"[2001:db8::1]:3001", SchemeUDP, "[2001:db8::1]:3001"},
+		{"tcp://192.0.2.1:3001", SchemeTCP, "192.0.2.1:3001"},
+		{"tls://example.com:443", SchemeTLS, "example.com:443"},
+		{"wss://example.com/eg/ws", SchemeWSS, "example.com/eg/ws"},
+		{"ws://[2001:db8::1]:80/ws", SchemeWS, "[2001:db8::1]:80/ws"},
+		{"", SchemeUDP, ""},
+	}
+	for _, tt := range tests {
+		scheme, hostport := SplitScheme(tt.s)
+		if scheme != tt.scheme || hostport != tt.hostport {
+			t.Errorf("SplitScheme(%v) = %v, %v, want %v, %v", tt.s, scheme, hostport, tt.scheme, tt.hostport)
+		}
+	}
+}
+
+func TestEndpointHostPort(t *testing.T) {
+	tests := []struct {
+		s        string
+		hostport string
+	}{
+		{"192.0.2.1:3001", "192.0.2.1:3001"},
+		{"tcp://192.0.2.1:3001", "192.0.2.1:3001"},
+		{"tls://192.0.2.1:443#example.com", "192.0.2.1:443"},
+		{"ws://192.0.2.1:80/api/edge/ws", "192.0.2.1:80"},
+		{"wss://[2001:db8::1]:443/api/edge/ws#example.com", "[2001:db8::1]:443"},
+	}
+	for _, tt := range tests {
+		if hostport := EndpointHostPort(tt.s); hostport != tt.hostport {
+			t.Errorf("EndpointHostPort(%v) = %v, want %v", tt.s, hostport, tt.hostport)
+		}
+	}
+}
+
+func TestStreamParseEndpoint(t *testing.T) {
+	bind := NewStreamBind(StreamConf{}, EnabledAf46)
+	for _, s := range []string{
+		"tcp://192.0.2.1:3001",
+		"tls://192.0.2.1:443#example.com",
+		"ws://192.0.2.1:80/api/edge/ws",
+		"wss://[2001:db8::1]:443/api/edge/ws#example.com",
+	} {
+		ep, err := bind.ParseEndpoint(s)
+		if err != nil {
+			t.Errorf("ParseEndpoint(%v): %v", s, err)
+			continue
+		}
+		if ep.DstToString() != s {
+			t.Errorf("ParseEndpoint(%v).DstToString() = %v", s, ep.DstToString())
+		}
+	}
+	for _, s := range []string{"udp://192.0.2.1:3001", "tcp://example.com:443", "tls://192.0.2.1"} {
+		if _, err := bind.ParseEndpoint(s); err == nil {
+			t.Errorf("ParseEndpoint(%v) succeeded", s)
+		}
+	}
+}
+
+func TestStreamServerName(t *testing.T) {
+	ep := func(s string) *StreamEndpoint {
+		e, err := NewStreamBind(StreamConf{}, EnabledAf46).ParseEndpoint(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e.(*StreamEndpoint)
+	}
+	tests := []struct {
+		conf string
+		ep   string
+		name string
+	}{
+		{"", "tls://192.0.2.1:443#example.com", "example.com"},
+		{"fallback.example", "tls://192.0.2.1:443#example.com", "example.com"},
+		{"fallback.example", "tls://192.0.2.1:443", "fallback.example"},
+		{"", "tls://192.0.2.1:443", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		bind := NewStreamBind(StreamConf{TLSServerName: tt.conf}, EnabledAf46)
+		if name := bind.serverName(ep(tt.ep)); name != tt.name {
+			t.Errorf("serverName(%v) with TLSServerName %q = %v, want %v", tt.ep, tt.conf, name, tt.name)
+		}
+	}
+}
+
+func TestFramedConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	w, r := newFramedConn(c1), newFramedConn(c2)
+	packets := [][]byte{
+		[]byte("hello"),
+		nil, // keepalive
+		bytes.Repeat([]byte{0xa5}, streamMaxFrame),
+		{0},
+	}
+	go func() {
+		for i, p := range packets {
+			if err := w.WritePacket(p); err != nil {
+				t.Error(err)
+				return
+			}
+			if i == 0 && w.Buffered() != 2+len(p) {
+				t.Errorf("Buffered() = %v, want %v", w.Buffered(), 2+len(p))
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Error(err)
+		}
+		// a frame larger than the buffer of the reader
+		w.WritePacket(make([]byte, 100))
+		w.Flush()
+	}()
+	buf := make([]byte, streamMaxFrame)
+	for i, p := range packets {
+		n, err := r.ReadPacket(buf)
+		if err != nil {
+			t.Fatalf("ReadPacket %v: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], p) {
+			t.Fatalf("ReadPacket %v: got %v bytes, want %v bytes", i, n, len(p))
+		}
+	}
+	if _, err := r.ReadPacket(buf[:10]); err != io.ErrShortBuffer {
+		t.Errorf("ReadPacket of a large frame into a small buffer: %v, want %v", err, io.ErrShortBuffer)
+	}
+}
+
+// receiveOne waits for one packet from fn
+func receiveOne(t *testing.T, fn ReceiveFunc) ([]byte, Endpoint) {
+	t.Helper()
+	type result struct {
+		packet []byte
+		ep     Endpoint
+		err    error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		buf := make([]byte, streamMaxFrame)
+		n, ep, err := fn(buf)
+		resc <- result{buf[:n], ep, err}
+	}()
+	select {
+	case res := <-resc:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		return res.packet, res.ep
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return nil, nil
+}
+
+func TestStreamBindRoundTrip(t *testing.T) {
+	for _, scheme := range []string{SchemeTCP, SchemeTLS} {
+		t.Run(scheme, func(t *testing.T) {
+			server := NewStreamBind(StreamConf{ListenTCP: scheme == SchemeTCP}, EnabledAf4)
+			if scheme == SchemeTLS {
+				// Open listens on ListenPortTLS, pick a free port first
+				l, err := net.Listen("tcp4", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				server.conf.ListenPortTLS = l.Addr().(*net.TCPAddr).Port
+				l.Close()
+			}
+			fns, _, err := server.Open(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			port := server.state.listeners[0].Addr().(*net.TCPAddr).Port
+
+			client := NewStreamBind(StreamConf{}, EnabledAf4)
+			cfns, _, err := client.Open(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			ep, err := client.ParseEndpoint(scheme + "://127.0.0.1:" + strconv.Itoa(port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Send([]byte("ping"), ep); err != nil {
+				t.Fatal(err)
+			}
+			packet, from := receiveOne(t, fns[0])
+			if string(packet) != "ping" {
+				t.Fatalf("server received %q", packet)
+			}
+			if _, ok := from.(*StreamEndpoint); !ok || !from.DstIP().Equal(net.IPv4(127, 0, 0, 1)) {
+				t.Fatalf("server received from %v", from.DstToString())
+			}
+			// the reply goes back over the accepted connection
+			if err := server.Send([]byte("pong"), from); err != nil {
+				t.Fatal(err)
+			}
+			packet, from = receiveOne(t, cfns[0])
+			if string(packet) != "pong" || from.DstToString() != ep.DstToString() {
+				t.Fatalf("client received %q from %v", packet, from.DstToString())
+			}
+		})
+	}
+}
+
+func TestStreamTLSServerName(t *testing.T) {
+	cert, err := NewStreamBind(StreamConf{TLSServerName: "example.com"}, EnabledAf4).certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snic := make(chan string, 1)
+	l, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			snic <- hello.ServerName
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				pc := newFramedConn(nc)
+				buf := make([]byte, streamMaxFrame)
+				if n, err := pc.ReadPacket(buf); err == nil {
+					pc.WritePacket(buf[:n])
+					pc.Flush()
+				}
+			}()
+		}
+	}()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	bind := NewStreamBind(StreamConf{TLSServerName: "fallback.example"}, EnabledAf4)
+	ep, err := bind.ParseEndpoint("tls://127.0.0.1:" + port + "#example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := bind.dial(context.Background(), ep.(*StreamEndpoint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni := <-snic; sni != "example.com" {
+		t.Errorf("SNI = %q, want the hostname of the endpoint", sni)
+	}
+	pc.WritePacket([]byte("echo"))
+	pc.Flush()
+	buf := make([]byte, streamMaxFrame)
+	if n, err := pc.ReadPacket(buf); err != nil || string(buf[:n]) != "echo" {
+		t.Errorf("ReadPacket = %q, %v", buf[:n], err)
+	}
+	pc.Close()
+
+	// the self-signed certificate is not trusted
+	bind = NewStreamBind(StreamConf{TLSVerify: true}, EnabledAf4)
+	if pc, err := bind.dial(context.Background(), ep.(*StreamEndpoint)); err == nil {
+		pc.Close()
+		t.Errorf("dial verified a self-signed certificate")
+	}
+	<-snic
+}
+
+func TestLookupIPKeepsHostname(t *testing.T) {
+	tests := []struct {
+		s      string
+		result string
+	}{
+		{"localhost:3001", "127.0.0.1:3001"},
+		{"tcp://127.0.0.1:3001", "tcp://127.0.0.1:3001"},
+		{"tls://localhost:443", "tls://127.0.0.1:443#localhost"},
+		{"wss://localhost/api/edge/ws", "wss://127.0.0.1:443/api/edge/ws#localhost"},
+		{"tls://127.0.0.1:443#example.com", "tls://127.0.0.1:443#example.com"},
+	}
+	for _, tt := range tests {
+		_, result, err := LookupIP(tt.s, EnabledAf4, 0)
+		if err != nil {
+			t.Errorf("LookupIP(%v): %v", tt.s, err)
+			continue
+		}
+		if result != tt.result {
+			t.Errorf("LookupIP(%v) = %v, want %v", tt.s, result, tt.result)
+		}
+	}
+}
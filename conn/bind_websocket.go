@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsConn carries every packet in a binary message
+type wsConn struct {
+	*websocket.Conn
+}
+
+func (c wsConn) ReadPacket(buf []byte) (int, error) {
+	var data []byte
+	if err := websocket.Message.Receive(c.Conn, &data); err != nil {
+		return 0, err
+	}
+	return copy(buf, data), nil
+}
+
+func (c wsConn) WritePacket(packet []byte) error {
+	if packet == nil {
+		packet = []byte{}
+	}
+	return websocket.Message.Send(c.Conn, packet)
+}
+
+func (c wsConn) Buffered() int {
+	return 0
+}
+
+func (c wsConn) Flush() error {
+	return nil
+}
+
+// newWebSocketClient does the WebSocket handshake over nc.
+// The Host header is the hostname of ep, or TLSServerName if ep was an IP address.
+func (bind *StreamBind) newWebSocketClient(nc net.Conn, ep *StreamEndpoint) (packetConn, error) {
+	host := ep.dst.String()
+	if ep.hostname != "" || bind.conf.TLSServerName != "" {
+		host = net.JoinHostPort(bind.serverName(ep), strconv.Itoa(ep.dst.Port))
+	}
+	config, err := websocket.NewConfig(ep.scheme+"://"+host+ep.path, "http://"+host+"/")
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, nc)
+	if err != nil {
+		return nil, err
+	}
+	ws.MaxPayloadBytes = streamMaxFrame
+	return wsConn{ws}, nil
+}
+
+// ServeHTTP accepts WebSocket peers, so the bind can be mounted on an existing HTTP server.
+func (bind *StreamBind) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bind.mu.Lock()
+	st := bind.state
+	bind.mu.Unlock()
+	if st == nil {
+		http.Error(w, "bind is closed", http.StatusServiceUnavailable)
+		return
+	}
+	raddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ep := &StreamEndpoint{
+		scheme: SchemeWS,
+		dst:    *raddr,
+		path:   "/",
+	}
+	if r.TLS != nil {
+		ep.scheme = SchemeWSS
+	}
+	websocket.Server{
+		// peers are authenticated by the handshake of the packets, any origin is fine
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.MaxPayloadBytes = streamMaxFrame
+			bind.serveInbound(st, wsConn{ws}, ep)
+		},
+	}.ServeHTTP(w, r)
+}
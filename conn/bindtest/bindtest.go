@@ -21,14 +21,22 @@ type ChannelBind struct {
 	closeSignal      chan bool
 	source4, source6 ChannelEndpoint
 	target4, target6 ChannelEndpoint
+	batchSize        int
 }
 
 type ChannelEndpoint uint16
 
 var _ conn.Bind = (*ChannelBind)(nil)
+var _ conn.BatchBind = (*ChannelBind)(nil)
 var _ conn.Endpoint = (*ChannelEndpoint)(nil)
 
 func NewChannelBinds() [2]conn.Bind {
+	return NewChannelBindsBatch(1)
+}
+
+// NewChannelBindsBatch is like NewChannelBinds, but the receive functions
+// returned by OpenBatch receive up to batchSize packets per call.
+func NewChannelBindsBatch(batchSize int) [2]conn.Bind {
 	arx4 := make(chan []byte, 8192)
 	brx4 := make(chan []byte, 8192)
 	arx6 := make(chan []byte, 8192)
@@ -50,6 +58,8 @@ func NewChannelBinds() [2]conn.Bind {
 	binds[0].source6 = binds[1].target6
 	binds[1].source4 = binds[0].target4
 	binds[1].source6 = binds[0].target6
+	binds[0].batchSize = batchSize
+	binds[1].batchSize = batchSize
 	return [2]conn.Bind{&binds[0], &binds[1]}
 }
 
@@ -83,6 +93,19 @@ func (c *ChannelBind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint
 	}
 }
 
+func (c *ChannelBind) BatchSize() int { return c.batchSize }
+
+func (c *ChannelBind) OpenBatch(port uint16) (fns []conn.BatchReceiveFunc, actualPort uint16, err error) {
+	c.closeSignal = make(chan bool)
+	fns = append(fns, c.makeBatchReceiveFunc(*c.rx4))
+	fns = append(fns, c.makeBatchReceiveFunc(*c.rx6))
+	if rand.Uint32()&1 == 0 {
+		return fns, uint16(c.source4), nil
+	} else {
+		return fns, uint16(c.source6), nil
+	}
+}
+
 func (c *ChannelBind) Close() error {
 	if c.closeSignal != nil {
 		select {
@@ -107,6 +130,35 @@ func (c *ChannelBind) makeReceiveFunc(ch chan []byte) conn.ReceiveFunc {
 	}
 }
 
+func (c *ChannelBind) makeBatchReceiveFunc(ch chan []byte) conn.BatchReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+		select {
+		case <-c.closeSignal:
+			return 0, net.ErrClosed
+		case rx := <-ch:
+			sizes[0], eps[0] = copy(bufs[0], rx), c.target6
+		}
+		for n = 1; n < len(bufs) && n < c.batchSize; n++ {
+			select {
+			case rx := <-ch:
+				sizes[n], eps[n] = copy(bufs[n], rx), c.target6
+			default:
+				return n, nil
+			}
+		}
+		return n, nil
+	}
+}
+
+func (c *ChannelBind) SendBatch(bufs [][]byte, ep conn.Endpoint) error {
+	for _, b := range bufs {
+		if err := c.Send(b, ep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *ChannelBind) Send(b []byte, ep conn.Endpoint) error {
 	select {
 	case <-c.closeSignal:
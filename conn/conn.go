@@ -20,6 +20,11 @@ import (
 // ep is the remote endpoint.
 type ReceiveFunc func(b []byte) (n int, ep Endpoint, err error)
 
+// A BatchReceiveFunc receives up to len(bufs) inbound packets from the network at once.
+// The i-th packet is written into bufs[i], its length is sizes[i] and
+// its remote endpoint is eps[i]. n is the number of packets received.
+type BatchReceiveFunc func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error)
+
 // A Bind listens on a port for both IPv6 and IPv4 UDP traffic.
 //
 // A Bind interface may also be a PeekLookAtSocketFd or BindSocketToInterface,
@@ -47,6 +52,33 @@ type Bind interface {
 	EnabledAf() EnabledAf
 }
 
+// BatchBind is implemented by Bind objects that can send and receive
+// multiple packets per syscall, like sendmmsg/recvmmsg on Linux.
+type BatchBind interface {
+	Bind
+
+	// BatchSize is the maximum number of packets handled by one call
+	// of a BatchReceiveFunc, and the preferred length of bufs of SendBatch.
+	BatchSize() int
+
+	// OpenBatch is like Open, but returns BatchReceiveFuncs.
+	OpenBatch(port uint16) (fns []BatchReceiveFunc, actualPort uint16, err error)
+
+	// SendBatch writes the packets in bufs to address ep.
+	SendBatch(bufs [][]byte, ep Endpoint) error
+}
+
+// UnwrapBind returns the innermost Bind of the wrappers like MultiBind and ObfsBind
+func UnwrapBind(bind Bind) Bind {
+	for {
+		w, ok := bind.(interface{ Unwrap() Bind })
+		if !ok {
+			return bind
+		}
+		bind = w.Unwrap()
+	}
+}
+
 type EnabledAf struct {
 	IPv4 bool `yaml:"IPv4"`
 	IPv6 bool `yaml:"IPv6"`
@@ -92,13 +124,40 @@ type Endpoint interface {
 	SrcIP() net.IP
 }
 
+// SourceEndpoint is implemented by endpoints which can send from a chosen local address,
+// like the sticky sockets on Linux.
+type SourceEndpoint interface {
+	Endpoint
+	SetSrcIP(ip net.IP) error
+}
+
 var (
 	ErrBindAlreadyOpen   = errors.New("bind is already open")
 	ErrWrongEndpointType = errors.New("endpoint type does not correspond with bind type")
 )
 
+// Batch wraps fn into a BatchReceiveFunc which receives one packet per call.
+func (fn ReceiveFunc) Batch() BatchReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		n, ep, err := fn(bufs[0])
+		if err != nil {
+			return 0, err
+		}
+		sizes[0], eps[0] = n, ep
+		return 1, nil
+	}
+}
+
 func (fn ReceiveFunc) PrettyName() string {
-	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	return prettyFuncName(reflect.ValueOf(fn).Pointer())
+}
+
+func (fn BatchReceiveFunc) PrettyName() string {
+	return prettyFuncName(reflect.ValueOf(fn).Pointer())
+}
+
+func prettyFuncName(pc uintptr) string {
+	name := runtime.FuncForPC(pc).Name()
 	// 0. cheese/taco.beansIPv6.func12.func21218-fm
 	name = strings.TrimSuffix(name, "-fm")
 	// 1. cheese/taco.beansIPv6.func12.func21218
@@ -129,7 +188,7 @@ func (fn ReceiveFunc) PrettyName() string {
 		// 5. beansIPv6
 	}
 	if name == "" {
-		return fmt.Sprintf("%p", fn)
+		return fmt.Sprintf("%#x", pc)
 	}
 	if strings.HasSuffix(name, "IPv4") {
 		return "v4"
@@ -170,10 +229,35 @@ func parseEndpoint(s string) (*net.UDPAddr, error) {
 	return addr, err
 }
 
+// LookupIP resolves host_port, the scheme of host_port is kept in the result.
+// The hostname of stream endpoints is kept after a '#', like "tls://192.0.2.1:443#example.com".
 func LookupIP(host_port string, Af EnabledAf, AfPrefer int) (string, string, error) {
 	if host_port == "" {
 		return "", "", fmt.Errorf("error lookup ip from empty string")
 	}
+	scheme, host_port := SplitScheme(host_port)
+	prefix := ""
+	path := ""
+	hostname := ""
+	switch scheme {
+	case SchemeUDP:
+	case SchemeTCP, SchemeTLS:
+		prefix = scheme + "://"
+		host_port, hostname = splitHostname(host_port)
+	case SchemeWS, SchemeWSS:
+		prefix = scheme + "://"
+		host_port, hostname = splitHostname(host_port)
+		host_port, path = splitPath(host_port)
+		if _, _, err := net.SplitHostPort(host_port); err != nil {
+			if scheme == SchemeWS {
+				host_port = net.JoinHostPort(strings.Trim(host_port, "[]"), "80")
+			} else {
+				host_port = net.JoinHostPort(strings.Trim(host_port, "[]"), "443")
+			}
+		}
+	default:
+		return "", "", fmt.Errorf("unknown scheme:%v", scheme)
+	}
 	var conn net.Conn
 	var err error
 	var af_try_order []string
@@ -209,7 +293,13 @@ func LookupIP(host_port string, Af EnabledAf, AfPrefer int) (string, string, err
 		return "", "", err
 	}
 	defer conn.Close()
-	return NetStr, conn.RemoteAddr().String(), nil
+	if host, _, _ := net.SplitHostPort(host_port); prefix != "" && strings.IndexByte(host, ':') < 0 && net.ParseIP(host) == nil {
+		hostname = host
+	}
+	if hostname != "" {
+		path += "#" + hostname
+	}
+	return NetStr, prefix + conn.RemoteAddr().String() + path, nil
 }
 
 func ValidIP(ip net.IP) bool {
@@ -10,3 +10,7 @@ package conn
 func (bind *StdNetBind) SetMark(mark uint32) error {
 	return nil
 }
+
+func setSockMark(fd uintptr, mark uint32) error {
+	return nil
+}
@@ -26,6 +26,13 @@ func init() {
 	}
 }
 
+func setSockMark(fd uintptr, mark uint32) error {
+	if fwmarkIoctl == 0 {
+		return nil
+	}
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, fwmarkIoctl, int(mark))
+}
+
 func (bind *StdNetBind) SetMark(mark uint32) error {
 	var operr error
 	if fwmarkIoctl == 0 {
@@ -0,0 +1,157 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestReceiveIncomingBatch(t *testing.T) {
+	const count = 20
+	binds := bindtest.NewChannelBindsBatch(8)
+	device := &Device{log: NewLogger(LogLevelSilent, "")}
+	device.PopulatePools()
+	device.indexTable.Init()
+	device.queue.handshake = newHandshakeQueue()
+	device.queue.decryption = newInboundQueue()
+	device.net.bind = binds[1]
+	if device.BatchSize() != 8 {
+		t.Fatalf("BatchSize() = %v, want 8", device.BatchSize())
+	}
+
+	fns, _, err := binds[1].(conn.BatchBind).OpenBatch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufs := make([][]byte, count)
+	for i := range bufs {
+		bufs[i] = make([]byte, MessageInitiationSize)
+		bufs[i][0] = byte(path.MessageInitiationType)
+		bufs[i][2] = byte(i)
+	}
+	// undersized and unknown packets in the same batch are dropped
+	bufs = append(bufs, []byte{byte(path.MessageInitiationType)}, make([]byte, MessageInitiationSize-1))
+	if err := binds[0].(conn.BatchBind).SendBatch(bufs, bindtest.ChannelEndpoint(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	device.net.stopping.Add(1)
+	go device.RoutineReceiveIncoming("v6", fns[1])
+
+	seen := make(map[*[MaxMessageSize]byte]bool)
+	for i := 0; i < count; i++ {
+		select {
+		case elem := <-device.queue.handshake.c:
+			if len(elem.packet) != MessageInitiationSize || elem.packet[2] != byte(i) {
+				t.Fatalf("handshake %v: got packet %x", i, elem.packet[:4])
+			}
+			if elem.endpoint == nil {
+				t.Fatalf("handshake %v: missing endpoint", i)
+			}
+			if seen[elem.buffer] {
+				t.Fatalf("handshake %v: buffer reused while still queued", i)
+			}
+			seen[elem.buffer] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for handshake %v", i)
+		}
+	}
+
+	binds[1].Close()
+	device.net.stopping.Wait()
+	select {
+	case elem, ok := <-device.queue.handshake.c:
+		if ok {
+			t.Fatalf("unexpected handshake %x", elem.packet[:4])
+		}
+	default:
+	}
+}
+
+// recordBatchBind records the batches sent by SendBatch
+type recordBatchBind struct {
+	sync.Mutex
+	batches [][][]byte
+	sent    chan struct{}
+}
+
+func (b *recordBatchBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	return nil, port, nil
+}
+func (b *recordBatchBind) OpenBatch(port uint16) ([]conn.BatchReceiveFunc, uint16, error) {
+	return nil, port, nil
+}
+func (b *recordBatchBind) Close() error                                  { return nil }
+func (b *recordBatchBind) SetMark(mark uint32) error                     { return nil }
+func (b *recordBatchBind) ParseEndpoint(s string) (conn.Endpoint, error) { return nil, nil }
+func (b *recordBatchBind) EnabledAf() conn.EnabledAf                     { return conn.EnabledAf46 }
+func (b *recordBatchBind) BatchSize() int                                { return 8 }
+func (b *recordBatchBind) Send(buf []byte, ep conn.Endpoint) error {
+	return b.SendBatch([][]byte{buf}, ep)
+}
+
+func (b *recordBatchBind) SendBatch(bufs [][]byte, ep conn.Endpoint) error {
+	b.Lock()
+	defer b.Unlock()
+	batch := make([][]byte, len(bufs))
+	for i := range bufs {
+		batch[i] = append([]byte(nil), bufs[i]...)
+	}
+	b.batches = append(b.batches, batch)
+	b.sent <- struct{}{}
+	return nil
+}
+
+func TestSequentialSenderBatch(t *testing.T) {
+	const count = 20
+	bind := &recordBatchBind{sent: make(chan struct{}, count)}
+	device := &Device{log: NewLogger(LogLevelSilent, "")}
+	device.PopulatePools()
+	device.net.bind = bind
+	peer := &Peer{device: device, ID: 2}
+	peer.isRunning.Set(true)
+	peer.endpoint = bindtest.ChannelEndpoint(3001)
+	peer.queue.outbound = &autodrainingOutboundQueue{c: make(chan *QueueOutboundElement, QueueOutboundSize)}
+
+	// all the packets are queued before the sender starts, they are sent in batches of BatchSize
+	for i := 0; i < count; i++ {
+		elem := device.NewOutboundElement()
+		elem.packet = elem.buffer[:MessageKeepaliveSize+1]
+		elem.packet[0] = byte(i)
+		peer.queue.outbound.c <- elem
+	}
+	peer.queue.outbound.c <- nil
+	peer.stopping.Add(1)
+	peer.RoutineSequentialSender()
+
+	bind.Lock()
+	defer bind.Unlock()
+	var sizes []int
+	next := 0
+	for _, batch := range bind.batches {
+		sizes = append(sizes, len(batch))
+		for _, packet := range batch {
+			if packet[0] != byte(next) {
+				t.Fatalf("packet %v sent at position %v", packet[0], next)
+			}
+			next++
+		}
+	}
+	if next != count || !reflect.DeepEqual(sizes, []int{8, 8, 4}) {
+		t.Errorf("sent %v packets in batches of %v, want %v in batches of [8 8 4]", next, sizes, count)
+	}
+	if tx := atomic.LoadUint64(&peer.stats.txBytes); tx != count*(MessageKeepaliveSize+1) {
+		t.Errorf("txBytes = %v, want %v", tx, count*(MessageKeepaliveSize+1))
+	}
+}
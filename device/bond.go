@@ -0,0 +1,443 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Link bonding keeps several underlay endpoints of a peer active.
+//
+// The first member is the endpoint of the peer, which roams as usual. BondEndPoints of the peer are added after it,
+// and the endpoint of the peer sent from every address in Sources after them.
+// Packets received on the path of another member don't move the endpoint of the peer.
+// Every member gets a BondProbe each HealthInterval, the peer echoes it on the same path.
+// A member is up if an echo came back in FailoverTimeout.
+
+const (
+	BondActiveBackup = "active-backup" // the first member which is up
+	BondRoundRobin   = "round-robin"   // every member which is up in turn
+	BondWeighted     = "weighted"      // members which are up by Weight
+)
+
+type bondMember struct {
+	url       string        // EndPoint of BondEndPoints, empty for the others
+	source    net.IP        // nil if the source address is not bound
+	weight    int           // weight in weighted mode
+	endpoint  conn.Endpoint // nil for the primary, which follows the endpoint of the peer
+	current   int           // current weight of smooth weighted round-robin
+	lastRecv  time.Time
+	latency   float64
+	txBytes   uint64
+	txPackets uint64
+}
+
+func (m *bondMember) getEndpoint(primary conn.Endpoint) conn.Endpoint {
+	if m.endpoint == nil {
+		return primary
+	}
+	return m.endpoint
+}
+
+type bond struct {
+	sync.Mutex
+	device     *Device
+	mode       string
+	timeout    time.Duration
+	members    []*bondMember
+	primaryDst string // the Sources members were built for this endpoint of the peer
+	next       int
+}
+
+func newBond(device *Device) *bond {
+	conf := device.EdgeConfig.Bonding
+	switch conf.Mode {
+	case BondActiveBackup, BondRoundRobin, BondWeighted:
+	default:
+		return nil
+	}
+	return &bond{
+		device:  device,
+		mode:    conf.Mode,
+		timeout: mtypes.S2TD(conf.FailoverTimeout),
+		members: []*bondMember{{weight: bondWeight(conf.Weight)}},
+	}
+}
+
+func bondWeight(w int) int {
+	if w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// newSourceEndpoint parses dst, and binds it to the source address if src is not nil
+func (device *Device) newSourceEndpoint(dst string, src net.IP) (conn.Endpoint, error) {
+	endpoint, err := device.net.bind.ParseEndpoint(dst)
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		return endpoint, nil
+	}
+	se, ok := endpoint.(conn.SourceEndpoint)
+	if !ok {
+		return nil, errors.New("binding source address is not supported by endpoint " + dst)
+	}
+	return se, se.SetSrcIP(src)
+}
+
+// SetEndpoints replaces the BondEndPoints members
+func (b *bond) SetEndpoints(infos []mtypes.BondEndpointInfo) error {
+	members := make([]*bondMember, 0, len(infos))
+	for _, info := range infos {
+		m := &bondMember{
+			url:    info.EndPoint,
+			weight: bondWeight(info.Weight),
+		}
+		if info.Source != "" {
+			if m.source = net.ParseIP(info.Source); m.source == nil {
+				return errors.New("invalid source address: " + info.Source)
+			}
+		}
+		_, connIP, err := conn.LookupIP(info.EndPoint, b.device.enabledAf, b.device.EdgeConfig.AfPrefer)
+		if err != nil {
+			return err
+		}
+		if m.endpoint, err = b.device.newSourceEndpoint(connIP, m.source); err != nil {
+			return err
+		}
+		members = append(members, m)
+	}
+	b.Lock()
+	defer b.Unlock()
+	ret := []*bondMember{b.members[0]}
+	ret = append(ret, members...)
+	for _, m := range b.members[1:] {
+		if m.url == "" {
+			ret = append(ret, m)
+		}
+	}
+	b.members = ret
+	return nil
+}
+
+// refresh rebuilds the Sources members if the endpoint of the peer has changed
+func (b *bond) refresh(primary conn.Endpoint) {
+	sources := b.device.EdgeConfig.Bonding.Sources
+	if primary == nil || len(sources) == 0 {
+		return
+	}
+	dst := primary.DstToString()
+	b.Lock()
+	defer b.Unlock()
+	if dst == b.primaryDst {
+		return
+	}
+	b.primaryDst = dst
+	ret := make([]*bondMember, 0, len(b.members)+len(sources))
+	old := make(map[string]*bondMember)
+	for _, m := range b.members {
+		if m.endpoint == nil || m.url != "" {
+			ret = append(ret, m)
+		} else if m.source != nil {
+			old[m.source.String()] = m
+		}
+	}
+	for _, s := range sources {
+		m := &bondMember{
+			source: net.ParseIP(s),
+			weight: bondWeight(b.device.EdgeConfig.Bonding.Weight),
+		}
+		if m.source == nil {
+			b.device.log.Errorf("Bonding: invalid source address %v", s)
+			continue
+		}
+		if prev, ok := old[m.source.String()]; ok {
+			// keep the health and counters of the source
+			m.lastRecv, m.latency, m.txBytes, m.txPackets = prev.lastRecv, prev.latency, prev.txBytes, prev.txPackets
+		}
+		endpoint, err := b.device.newSourceEndpoint(dst, m.source)
+		if err != nil {
+			if b.device.LogLevel.LogInternal {
+				fmt.Printf("Internal: Bonding: skip source %v for %v: %v\n", s, dst, err)
+			}
+			continue
+		}
+		m.endpoint = endpoint
+		ret = append(ret, m)
+	}
+	b.members = ret
+}
+
+func (b *bond) isUp(m *bondMember, now time.Time) bool {
+	return now.Sub(m.lastRecv) < b.timeout
+}
+
+// pick returns the endpoint to send a packet of size bytes. The endpoint of the peer is used if no member is up.
+// The caller must hold the lock.
+func (b *bond) pick(primary conn.Endpoint, size int) conn.Endpoint {
+	now := time.Now()
+	var picked *bondMember
+	switch b.mode {
+	case BondActiveBackup:
+		for _, m := range b.members {
+			if b.isUp(m, now) {
+				picked = m
+				break
+			}
+		}
+	case BondRoundRobin:
+		for i := 0; i < len(b.members); i++ {
+			m := b.members[(b.next+i)%len(b.members)]
+			if b.isUp(m, now) {
+				picked = m
+				b.next = (b.next + i + 1) % len(b.members)
+				break
+			}
+		}
+	case BondWeighted:
+		total := 0
+		for _, m := range b.members {
+			if !b.isUp(m, now) {
+				continue
+			}
+			m.current += m.weight
+			total += m.weight
+			if picked == nil || m.current > picked.current {
+				picked = m
+			}
+		}
+		if picked != nil {
+			picked.current -= total
+		}
+	}
+	if picked == nil {
+		picked = b.members[0]
+	}
+	picked.txBytes += uint64(size)
+	picked.txPackets += 1
+	return picked.getEndpoint(primary)
+}
+
+// send sends the buffers over the members, consecutive buffers to the same member in one batch
+func (b *bond) send(bind conn.Bind, primary conn.Endpoint, buffers [][]byte) error {
+	endpoints := make([]conn.Endpoint, len(buffers))
+	b.Lock()
+	for i, buffer := range buffers {
+		endpoints[i] = b.pick(primary, len(buffer))
+	}
+	b.Unlock()
+	var err error
+	for start := 0; start < len(buffers); {
+		end := start + 1
+		for end < len(buffers) && endpoints[end] == endpoints[start] {
+			end++
+		}
+		if endpoints[start] == nil {
+			err = errors.New("no known endpoint for peer")
+		} else if bb, ok := bind.(conn.BatchBind); ok {
+			err = bb.SendBatch(buffers[start:end], endpoints[start])
+		} else {
+			for _, buffer := range buffers[start:end] {
+				if err = bind.Send(buffer, endpoints[start]); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// match returns the members on the path of src, members bound to the source address first,
+// the others match any source address. The caller must hold the lock.
+func (b *bond) match(src conn.Endpoint, primary conn.Endpoint) []*bondMember {
+	dst := src.DstToString()
+	srcIP := src.SrcIP()
+	var matched []*bondMember
+	for _, bound := range []bool{true, false} {
+		for _, m := range b.members {
+			ep := m.getEndpoint(primary)
+			if ep == nil || ep.DstToString() != dst || (m.source != nil) != bound {
+				continue
+			}
+			if bound && !m.source.Equal(srcIP) {
+				continue
+			}
+			matched = append(matched, m)
+		}
+		if len(matched) > 0 {
+			break
+		}
+	}
+	return matched
+}
+
+// Observe records an echo received from src
+func (b *bond) Observe(src conn.Endpoint, primary conn.Endpoint, latency float64) {
+	b.Lock()
+	defer b.Unlock()
+	for _, m := range b.match(src, primary) {
+		m.lastRecv = time.Now()
+		m.latency = latency
+	}
+}
+
+// isSecondary reports whether src is on the path of a member other than the endpoint of the peer
+func (b *bond) isSecondary(src conn.Endpoint) bool {
+	b.Lock()
+	defer b.Unlock()
+	for _, m := range b.match(src, nil) {
+		if m.endpoint != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Endpoints returns the endpoints of all members
+func (b *bond) Endpoints(primary conn.Endpoint) []conn.Endpoint {
+	b.Lock()
+	defer b.Unlock()
+	ret := make([]conn.Endpoint, 0, len(b.members))
+	for _, m := range b.members {
+		if ep := m.getEndpoint(primary); ep != nil {
+			ret = append(ret, ep)
+		}
+	}
+	return ret
+}
+
+func (b *bond) Stats(primary conn.Endpoint) []mtypes.BondMemberStat {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	ret := make([]mtypes.BondMemberStat, 0, len(b.members))
+	for _, m := range b.members {
+		stat := mtypes.BondMemberStat{
+			Weight:    m.weight,
+			Up:        b.isUp(m, now),
+			Latency:   m.latency,
+			TxBytes:   m.txBytes,
+			TxPackets: m.txPackets,
+		}
+		if ep := m.getEndpoint(primary); ep != nil {
+			stat.EndPoint = ep.DstToString()
+		}
+		if m.source != nil {
+			stat.Source = m.source.String()
+		}
+		if !stat.Up {
+			stat.Latency = mtypes.Infinity
+		}
+		ret = append(ret, stat)
+	}
+	return ret
+}
+
+func (peer *Peer) getEndpoint() conn.Endpoint {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.endpoint
+}
+
+// SetBondEndpoints sets the BondEndPoints of the peer, if bonding is enabled
+func (peer *Peer) SetBondEndpoints(infos []mtypes.BondEndpointInfo) error {
+	if peer.bond == nil {
+		return nil
+	}
+	return peer.bond.SetEndpoints(infos)
+}
+
+func (device *Device) GetBondStats() mtypes.BondStats {
+	ret := make(mtypes.BondStats)
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for id, peer := range device.peers.IDMap {
+		if peer.bond != nil {
+			ret[id] = peer.bond.Stats(peer.getEndpoint())
+		}
+	}
+	return ret
+}
+
+func (device *Device) newBondProbe(dst mtypes.Vertex, content mtypes.BondProbeMsg) ([]byte, error) {
+	body, err := mtypes.GetByte(&content)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	header.SetSrc(device.ID)
+	header.SetDst(dst)
+	copy(buf[path.EgHeaderLen:], body)
+	return buf, nil
+}
+
+func (device *Device) process_BondProbe(peer *Peer, src conn.Endpoint, content mtypes.BondProbeMsg) error {
+	if src == nil {
+		return nil
+	}
+	if content.Echo {
+		if peer.bond != nil {
+			peer.bond.Observe(src, peer.getEndpoint(), time.Since(content.Time).Seconds()/2)
+		}
+		return nil
+	}
+	// echo on the path it came from
+	content.Echo = true
+	buf, err := device.newBondProbe(peer.ID, content)
+	if err != nil {
+		return err
+	}
+	device.SendPacketTo(peer, src, path.BondProbe, 0, buf, MessageTransportOffsetContent)
+	return nil
+}
+
+// RoutineBondHealth sends a BondProbe to every member of the bonded peers every HealthInterval seconds
+func (device *Device) RoutineBondHealth() {
+	if device.EdgeConfig.Bonding.Mode == "" || device.EdgeConfig.Bonding.HealthInterval <= 0 {
+		return
+	}
+	timeout := mtypes.S2TD(device.EdgeConfig.Bonding.HealthInterval)
+	for {
+		device.peers.RLock()
+		peers := make([]*Peer, 0, len(device.peers.IDMap))
+		for _, peer := range device.peers.IDMap {
+			if peer.bond != nil {
+				peers = append(peers, peer)
+			}
+		}
+		device.peers.RUnlock()
+		for _, peer := range peers {
+			primary := peer.getEndpoint()
+			peer.bond.refresh(primary)
+			buf, err := device.newBondProbe(peer.ID, mtypes.BondProbeMsg{
+				Src_nodeID: device.ID,
+				Time:       time.Now(),
+			})
+			if err != nil {
+				continue
+			}
+			for _, endpoint := range peer.bond.Endpoints(primary) {
+				device.SendPacketTo(peer, endpoint, path.BondProbe, 0, buf, MessageTransportOffsetContent)
+			}
+		}
+		time.Sleep(timeout)
+	}
+}
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func newTestBond(mode string, weights ...int) *bond {
+	device := &Device{EdgeConfig: &mtypes.EdgeConfig{}}
+	device.EdgeConfig.Bonding = mtypes.BondingInfo{Mode: mode, Weight: weights[0], FailoverTimeout: 1}
+	b := newBond(device)
+	for i, w := range weights[1:] {
+		b.members = append(b.members, &bondMember{
+			url:      "member",
+			weight:   w,
+			endpoint: bindtest.ChannelEndpoint(i + 2),
+		})
+	}
+	return b
+}
+
+func pickCount(b *bond, primary conn.Endpoint, n int) map[conn.Endpoint]int {
+	ret := make(map[conn.Endpoint]int)
+	for i := 0; i < n; i++ {
+		ret[b.pick(primary, 100)]++
+	}
+	return ret
+}
+
+func TestBondPick(t *testing.T) {
+	primary := bindtest.ChannelEndpoint(1)
+	b := newTestBond(BondActiveBackup, 1, 1)
+	if count := pickCount(b, primary, 4); count[primary] != 4 {
+		t.Errorf("active-backup without member up = %v, want the endpoint of the peer", count)
+	}
+	b.Observe(bindtest.ChannelEndpoint(2), primary, 0.01)
+	if count := pickCount(b, primary, 4); count[bindtest.ChannelEndpoint(2)] != 4 {
+		t.Errorf("active-backup with member 2 up = %v, want member 2", count)
+	}
+	b.Observe(primary, primary, 0.01)
+	if count := pickCount(b, primary, 4); count[primary] != 4 {
+		t.Errorf("active-backup with all up = %v, want the first member", count)
+	}
+	b.members[0].lastRecv = time.Now().Add(-2 * time.Second)
+	if count := pickCount(b, primary, 4); count[bindtest.ChannelEndpoint(2)] != 4 {
+		t.Errorf("active-backup after failover = %v, want member 2", count)
+	}
+
+	b = newTestBond(BondRoundRobin, 1, 1, 1)
+	for _, ep := range []conn.Endpoint{primary, bindtest.ChannelEndpoint(2), bindtest.ChannelEndpoint(3)} {
+		b.Observe(ep, primary, 0.01)
+	}
+	if count := pickCount(b, primary, 6); count[primary] != 2 || count[bindtest.ChannelEndpoint(2)] != 2 || count[bindtest.ChannelEndpoint(3)] != 2 {
+		t.Errorf("round-robin = %v, want 2 each", count)
+	}
+
+	b = newTestBond(BondWeighted, 1, 3)
+	b.Observe(primary, primary, 0.01)
+	b.Observe(bindtest.ChannelEndpoint(2), primary, 0.01)
+	if count := pickCount(b, primary, 8); count[primary] != 2 || count[bindtest.ChannelEndpoint(2)] != 6 {
+		t.Errorf("weighted = %v, want 2 and 6", count)
+	}
+	stats := b.Stats(primary)
+	if len(stats) != 2 || !stats[1].Up || stats[1].TxPackets != 6 || stats[1].TxBytes != 600 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+// sourceEndpoint is an endpoint which can be bound to a source address
+type sourceEndpoint struct {
+	bindtest.ChannelEndpoint
+	src net.IP
+}
+
+func (e *sourceEndpoint) SrcIP() net.IP {
+	return e.src
+}
+
+func (e *sourceEndpoint) SetSrcIP(ip net.IP) error {
+	e.src = ip
+	return nil
+}
+
+type sourceBind struct {
+	conn.Bind
+}
+
+func (sourceBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	p, err := net.LookupPort("udp", port)
+	return &sourceEndpoint{ChannelEndpoint: bindtest.ChannelEndpoint(p)}, err
+}
+
+func TestBondRefresh(t *testing.T) {
+	b := newTestBond(BondActiveBackup, 1, 1)
+	b.device.net.bind = sourceBind{}
+	b.device.EdgeConfig.Bonding.Sources = []string{"192.0.2.1", "192.0.2.2"}
+	primary := bindtest.ChannelEndpoint(1)
+	b.refresh(primary)
+	if len(b.members) != 4 {
+		t.Fatalf("%v members, want the primary, one BondEndPoints and two Sources", len(b.members))
+	}
+	fromSource := &sourceEndpoint{ChannelEndpoint: primary, src: net.ParseIP("192.0.2.2")}
+	b.Observe(fromSource, primary, 0.01)
+	if !b.isUp(b.members[3], time.Now()) || b.isUp(b.members[0], time.Now()) {
+		t.Fatalf("the echo from 192.0.2.2 marked the wrong member up")
+	}
+
+	// packets on the path of another member don't roam the endpoint of the peer
+	for _, ep := range []conn.Endpoint{fromSource, bindtest.ChannelEndpoint(2)} {
+		if !b.isSecondary(ep) {
+			t.Errorf("isSecondary(%v) = false, want true", ep.DstToString())
+		}
+	}
+	if b.isSecondary(bindtest.ChannelEndpoint(5)) {
+		t.Errorf("isSecondary() = true for an unknown path, want false")
+	}
+	if b.isSecondary(primary) {
+		t.Errorf("isSecondary() = true for the endpoint of the peer, want false")
+	}
+
+	// the Sources members keep their health after the endpoint of the peer roams
+	b.refresh(bindtest.ChannelEndpoint(4))
+	if len(b.members) != 4 || b.members[3].source.String() != "192.0.2.2" {
+		t.Fatalf("members after refresh = %v", b.members)
+	}
+	if !b.isUp(b.members[3], time.Now()) || b.members[3].latency != 0.01 {
+		t.Errorf("the Sources member lost its health after refresh")
+	}
+	if ep := b.members[3].endpoint; ep.DstToString() != bindtest.ChannelEndpoint(4).DstToString() {
+		t.Errorf("the Sources member sends to %v, want the new endpoint of the peer", ep.DstToString())
+	}
+}
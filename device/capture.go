@@ -0,0 +1,263 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	pcapngBlockSHB = 0x0A0D0D0A
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockEPB = 0x00000006
+
+	pcapngOptComment   = 1
+	pcapngOptIfName    = 2
+	pcapngOptEpbFlags  = 2
+	pcapngOptShbUserAP = 4
+
+	pcapngLinkTypeEthernet = 1
+	pcapngLinkTypeRaw      = 101
+
+	pcapngFlagInbound  = 1
+	pcapngFlagOutbound = 2
+
+	CaptureDefaultSnaplen = 65535
+)
+
+// pcapngWriter writes a pcapng file with a single interface
+type pcapngWriter struct {
+	w       *bufio.Writer
+	written uint64
+}
+
+func pcapngPad(l int) int {
+	return (4 - l%4) % 4
+}
+
+func pcapngOption(code uint16, value []byte) []byte {
+	ret := make([]byte, 4+len(value)+pcapngPad(len(value)))
+	binary.LittleEndian.PutUint16(ret[0:2], code)
+	binary.LittleEndian.PutUint16(ret[2:4], uint16(len(value)))
+	copy(ret[4:], value)
+	return ret
+}
+
+func (pw *pcapngWriter) writeBlock(blockType uint32, body []byte, options ...[]byte) error {
+	optlen := 0
+	if len(options) > 0 {
+		for _, opt := range options {
+			optlen += len(opt)
+		}
+		optlen += 4 // opt_endofopt
+	}
+	blocklen := 12 + len(body) + pcapngPad(len(body)) + optlen
+	buf := make([]byte, blocklen)
+	binary.LittleEndian.PutUint32(buf[0:4], blockType)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(blocklen))
+	copy(buf[8:], body)
+	offset := 8 + len(body) + pcapngPad(len(body))
+	for _, opt := range options {
+		copy(buf[offset:], opt)
+		offset += len(opt)
+	}
+	binary.LittleEndian.PutUint32(buf[blocklen-4:], uint32(blocklen))
+	_, err := pw.w.Write(buf)
+	pw.written += uint64(blocklen)
+	return err
+}
+
+func newPcapngWriter(w io.Writer, ifname string, linktype uint16, snaplen int, application string) (*pcapngWriter, error) {
+	pw := &pcapngWriter{
+		w: bufio.NewWriter(w),
+	}
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], 0x1A2B3C4D) // byte-order magic
+	binary.LittleEndian.PutUint16(shb[4:6], 1)          // major version
+	binary.LittleEndian.PutUint16(shb[6:8], 0)          // minor version
+	binary.LittleEndian.PutUint64(shb[8:16], 0xFFFFFFFFFFFFFFFF)
+	if err := pw.writeBlock(pcapngBlockSHB, shb, pcapngOption(pcapngOptShbUserAP, []byte(application))); err != nil {
+		return nil, err
+	}
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], linktype)
+	binary.LittleEndian.PutUint32(idb[4:8], uint32(snaplen))
+	if err := pw.writeBlock(pcapngBlockIDB, idb, pcapngOption(pcapngOptIfName, []byte(ifname))); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *pcapngWriter) WritePacket(ts time.Time, frame []byte, snaplen int, inbound bool, comment string) error {
+	caplen := len(frame)
+	if caplen > snaplen {
+		caplen = snaplen
+	}
+	epb := make([]byte, 20+caplen)
+	tsus := uint64(ts.UnixNano() / 1000)
+	binary.LittleEndian.PutUint32(epb[0:4], 0) // interface id
+	binary.LittleEndian.PutUint32(epb[4:8], uint32(tsus>>32))
+	binary.LittleEndian.PutUint32(epb[8:12], uint32(tsus))
+	binary.LittleEndian.PutUint32(epb[12:16], uint32(caplen))
+	binary.LittleEndian.PutUint32(epb[16:20], uint32(len(frame)))
+	copy(epb[20:], frame[:caplen])
+	flags := make([]byte, 4)
+	if inbound {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	}
+	return pw.writeBlock(pcapngBlockEPB, epb, pcapngOption(pcapngOptComment, []byte(comment)), pcapngOption(pcapngOptEpbFlags, flags))
+}
+
+func (pw *pcapngWriter) Flush() error {
+	return pw.w.Flush()
+}
+
+type CaptureOptions struct {
+	Filter      string
+	Snaplen     int
+	MaxSize     uint64  // bytes, 0 = unlimited
+	MaxDuration float64 // seconds, 0 = unlimited
+}
+
+type packetCapture struct {
+	sync.Mutex
+	file     *os.File
+	writer   *pcapngWriter
+	filter   captureFilter
+	snaplen  int
+	maxSize  uint64
+	timer    *time.Timer
+	packets  uint64
+	filename string
+	closed   bool
+}
+
+// StartCapture writes the tap-side frames to a pcapng file until StopCapture is called or the limit is reached
+func (device *Device) StartCapture(filename string, options CaptureOptions) error {
+	filter, err := parseCaptureFilter(options.Filter)
+	if err != nil {
+		return err
+	}
+	if options.Snaplen <= 0 {
+		options.Snaplen = CaptureDefaultSnaplen
+	}
+	device.capture.Lock()
+	defer device.capture.Unlock()
+	if device.capture.running != nil {
+		return fmt.Errorf("capture to %v is already running", device.capture.running.filename)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	ifname, _ := device.tap.device.Name()
+	linktype := uint16(pcapngLinkTypeEthernet)
+	if device.IsL3() {
+		linktype = pcapngLinkTypeRaw
+	}
+	writer, err := newPcapngWriter(file, ifname, linktype, options.Snaplen, "EtherGuard-VPN "+device.Version)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	pc := &packetCapture{
+		file:     file,
+		writer:   writer,
+		filter:   filter,
+		snaplen:  options.Snaplen,
+		maxSize:  options.MaxSize,
+		filename: filename,
+	}
+	if options.MaxDuration > 0 {
+		pc.timer = time.AfterFunc(mtypes.S2TD(options.MaxDuration), func() {
+			device.stopCapture(pc, "time limit reached")
+		})
+	}
+	device.capture.running = pc
+	device.capture.enabled.Set(true)
+	if device.LogLevel.LogInternal {
+		fmt.Printf("Internal: Capture started. File:%v Filter:%q\n", filename, options.Filter)
+	}
+	return nil
+}
+
+func (device *Device) StopCapture() error {
+	device.capture.Lock()
+	pc := device.capture.running
+	device.capture.Unlock()
+	if pc == nil {
+		return errors.New("no capture is running")
+	}
+	return device.stopCapture(pc, "stopped")
+}
+
+func (device *Device) stopCapture(pc *packetCapture, reason string) error {
+	device.capture.Lock()
+	if device.capture.running != pc {
+		device.capture.Unlock()
+		return nil
+	}
+	device.capture.running = nil
+	device.capture.enabled.Set(false)
+	device.capture.Unlock()
+
+	pc.Lock()
+	defer pc.Unlock()
+	pc.closed = true
+	if pc.timer != nil {
+		pc.timer.Stop()
+	}
+	err := pc.writer.Flush()
+	if cerr := pc.file.Close(); err == nil {
+		err = cerr
+	}
+	if device.LogLevel.LogInternal {
+		fmt.Printf("Internal: Capture %v. File:%v Packets:%v Size:%v\n", reason, pc.filename, pc.packets, pc.writer.written)
+	}
+	return err
+}
+
+// capturePacket is called for every frame read from or written to the tap device
+func (device *Device) capturePacket(meta captureMeta, frame []byte) {
+	if !device.capture.enabled.Get() {
+		return
+	}
+	device.capture.Lock()
+	pc := device.capture.running
+	device.capture.Unlock()
+	if pc == nil || !pc.filter(&meta, frame) {
+		return
+	}
+	comment := fmt.Sprintf("S:%v D:%v TTL:%v Usage:%v Peer:%v", meta.src.ToString(), meta.dst.ToString(), meta.ttl, meta.usage.ToString(), meta.peer.ToString())
+	pc.Lock()
+	if pc.closed {
+		pc.Unlock()
+		return
+	}
+	err := pc.writer.WritePacket(time.Now(), frame, pc.snaplen, meta.inbound, comment)
+	pc.packets += 1
+	full := pc.maxSize > 0 && pc.writer.written >= pc.maxSize
+	pc.Unlock()
+	if err != nil {
+		device.log.Errorf("Failed to write capture file %v: %v", pc.filename, err)
+		device.stopCapture(pc, "failed")
+		return
+	}
+	if full {
+		device.stopCapture(pc, "size limit reached")
+	}
+}
@@ -0,0 +1,250 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// captureMeta is the overlay metadata of a tap-side frame
+type captureMeta struct {
+	inbound bool
+	src     mtypes.Vertex
+	dst     mtypes.Vertex
+	peer    mtypes.Vertex
+	ttl     uint8
+	usage   path.Usage
+}
+
+type captureFilter func(meta *captureMeta, frame []byte) bool
+
+var captureEtherTypes = map[string]uint16{
+	"ip":   0x0800,
+	"arp":  0x0806,
+	"vlan": 0x8100,
+	"ip6":  0x86dd,
+}
+
+type captureFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseCaptureFilter compiles a BPF-like filter expression.
+//
+// Primitives:
+//
+//	inbound | outbound
+//	src node ID | dst node ID | node ID | peer ID | broadcast
+//	ether src MAC | ether dst MAC | ether host MAC | ether proto TYPE
+//	ip | ip6 | arp | vlan
+//
+// Primitives can be combined with and/&&, or/||, not/! and parentheses.
+// An empty expression matches everything.
+func parseCaptureFilter(expr string) (captureFilter, error) {
+	expr = strings.ReplaceAll(expr, "(", " ( ")
+	expr = strings.ReplaceAll(expr, ")", " ) ")
+	p := &captureFilterParser{
+		tokens: strings.Fields(expr),
+	}
+	if len(p.tokens) == 0 {
+		return func(meta *captureMeta, frame []byte) bool { return true }, nil
+	}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("capture filter: unexpected token %q", p.tokens[p.pos])
+	}
+	return filter, nil
+}
+
+func (p *captureFilterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *captureFilterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("capture filter: unexpected end of expression")
+	}
+	p.pos += 1
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *captureFilterParser) parseOr() (captureFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos += 1
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(meta *captureMeta, frame []byte) bool { return l(meta, frame) || right(meta, frame) }
+	}
+	return left, nil
+}
+
+func (p *captureFilterParser) parseAnd() (captureFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.pos += 1
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(meta *captureMeta, frame []byte) bool { return l(meta, frame) && right(meta, frame) }
+	}
+	return left, nil
+}
+
+func (p *captureFilterParser) parseNot() (captureFilter, error) {
+	if p.peek() == "not" || p.peek() == "!" {
+		p.pos += 1
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(meta *captureMeta, frame []byte) bool { return !inner(meta, frame) }, nil
+	}
+	if p.peek() == "(" {
+		p.pos += 1
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("capture filter: missing )")
+		}
+		return inner, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *captureFilterParser) parseVertex() (mtypes.Vertex, error) {
+	tok, err := p.next()
+	if err != nil {
+		return 0, err
+	}
+	if tok == "broadcast" {
+		return mtypes.NodeID_Broadcast, nil
+	}
+	if tok == "super" {
+		return mtypes.NodeID_SuperNode, nil
+	}
+	return mtypes.String2NodeID(tok)
+}
+
+func (p *captureFilterParser) parsePrimitive() (captureFilter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case "inbound":
+		return func(meta *captureMeta, frame []byte) bool { return meta.inbound }, nil
+	case "outbound":
+		return func(meta *captureMeta, frame []byte) bool { return !meta.inbound }, nil
+	case "broadcast":
+		return func(meta *captureMeta, frame []byte) bool { return meta.dst == mtypes.NodeID_Broadcast }, nil
+	case "src", "dst":
+		if kw, err := p.next(); err != nil || kw != "node" {
+			return nil, fmt.Errorf("capture filter: expect \"node\" after %q", tok)
+		}
+		id, err := p.parseVertex()
+		if err != nil {
+			return nil, fmt.Errorf("capture filter: %v", err)
+		}
+		if tok == "src" {
+			return func(meta *captureMeta, frame []byte) bool { return meta.src == id }, nil
+		}
+		return func(meta *captureMeta, frame []byte) bool { return meta.dst == id }, nil
+	case "node":
+		id, err := p.parseVertex()
+		if err != nil {
+			return nil, fmt.Errorf("capture filter: %v", err)
+		}
+		return func(meta *captureMeta, frame []byte) bool { return meta.src == id || meta.dst == id }, nil
+	case "peer":
+		id, err := p.parseVertex()
+		if err != nil {
+			return nil, fmt.Errorf("capture filter: %v", err)
+		}
+		return func(meta *captureMeta, frame []byte) bool { return meta.peer == id }, nil
+	case "ether":
+		return p.parseEther()
+	}
+	if ethertype, has := captureEtherTypes[tok]; has {
+		return func(meta *captureMeta, frame []byte) bool {
+			return len(frame) >= 14 && binary.BigEndian.Uint16(frame[12:14]) == ethertype
+		}, nil
+	}
+	return nil, fmt.Errorf("capture filter: unknown primitive %q", tok)
+}
+
+func (p *captureFilterParser) parseEther() (captureFilter, error) {
+	kw, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	val, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if kw == "proto" {
+		ethertype, has := captureEtherTypes[val]
+		if !has {
+			v, err := strconv.ParseUint(val, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("capture filter: invalid ether proto %q", val)
+			}
+			ethertype = uint16(v)
+		}
+		return func(meta *captureMeta, frame []byte) bool {
+			return len(frame) >= 14 && binary.BigEndian.Uint16(frame[12:14]) == ethertype
+		}, nil
+	}
+	hw, err := net.ParseMAC(val)
+	if err != nil || len(hw) != 6 {
+		return nil, fmt.Errorf("capture filter: invalid MAC address %q", val)
+	}
+	var mac tap.MacAddress
+	copy(mac[:], hw)
+	switch kw {
+	case "src":
+		return func(meta *captureMeta, frame []byte) bool {
+			return len(frame) >= 12 && tap.GetSrcMacAddr(frame) == mac
+		}, nil
+	case "dst":
+		return func(meta *captureMeta, frame []byte) bool {
+			return len(frame) >= 12 && tap.GetDstMacAddr(frame) == mac
+		}, nil
+	case "host":
+		return func(meta *captureMeta, frame []byte) bool {
+			return len(frame) >= 12 && (tap.GetSrcMacAddr(frame) == mac || tap.GetDstMacAddr(frame) == mac)
+		}, nil
+	}
+	return nil, fmt.Errorf("capture filter: unknown ether qualifier %q", kw)
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func testFrame(ethertype uint16) []byte {
+	frame := make([]byte, 60)
+	copy(frame[0:6], []byte{0x02, 0, 0, 0, 0, 0x02})
+	copy(frame[6:12], []byte{0x02, 0, 0, 0, 0, 0x01})
+	frame[12] = byte(ethertype >> 8)
+	frame[13] = byte(ethertype)
+	return frame
+}
+
+func TestCaptureFilter(t *testing.T) {
+	meta := captureMeta{
+		inbound: true,
+		src:     1,
+		dst:     2,
+		peer:    3,
+		ttl:     200,
+		usage:   path.NormalPacket,
+	}
+	frame := testFrame(0x0800)
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"", true},
+		{"inbound", true},
+		{"outbound", false},
+		{"src node 1", true},
+		{"dst node 1", false},
+		{"node 2 and peer 3", true},
+		{"not peer 3", false},
+		{"ip6 or (ip and src node 1)", true},
+		{"! ip && ether src 02:00:00:00:00:01", false},
+		{"ether host 02:00:00:00:00:02 and ether proto 0x0800", true},
+		{"arp || broadcast", false},
+	}
+	for _, test := range tests {
+		filter, err := parseCaptureFilter(test.expr)
+		if err != nil {
+			t.Fatalf("parseCaptureFilter(%q): %v", test.expr, err)
+		}
+		if filter(&meta, frame) != test.match {
+			t.Errorf("parseCaptureFilter(%q) match = %v, want %v", test.expr, !test.match, test.match)
+		}
+	}
+	for _, expr := range []string{"src 1", "(ip", "ip and", "ether src zz", "foo"} {
+		if _, err := parseCaptureFilter(expr); err == nil {
+			t.Errorf("parseCaptureFilter(%q) should fail", expr)
+		}
+	}
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := newPcapngWriter(&buf, "tap0", pcapngLinkTypeEthernet, CaptureDefaultSnaplen, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := [][]byte{testFrame(0x0800), testFrame(0x0806)}
+	for i, frame := range frames {
+		src := mtypes.Vertex(i)
+		if err := pw.WritePacket(time.Now(), frame, CaptureDefaultSnaplen, i == 0, "S:"+src.ToString()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if uint64(buf.Len()) != pw.written {
+		t.Errorf("written = %v, want %v", pw.written, buf.Len())
+	}
+
+	r, err := pcapgo.NewNgReader(&buf, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("LinkType = %v, want ethernet", r.LinkType())
+	}
+	for _, frame := range frames {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, frame) || ci.Length != len(frame) {
+			t.Errorf("frame mismatch")
+		}
+	}
+}
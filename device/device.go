@@ -77,6 +77,27 @@ type Device struct {
 	state_hashes mtypes.StateHash
 
 	event_tryendpoint chan struct{}
+	event_netchange   chan struct{}
+	event_natdetect   chan struct{}
+
+	nat struct {
+		sync.RWMutex
+		report  mtypes.NatReport
+		replies chan mtypes.NatProbeMsg
+	}
+	relaySibling *Device
+
+	supercluster struct {
+		sync.RWMutex
+		active   int // index of superEndpoints()
+		switched time.Time
+		httpFail int
+	}
+
+	statecache struct {
+		sync.Mutex
+		mtypes.EdgeStateCache
+	}
 
 	EdgeConfigPath  string
 	EdgeConfig      *mtypes.EdgeConfig
@@ -98,7 +119,13 @@ type Device struct {
 	IsSuperNode bool
 	ID          mtypes.Vertex
 	graph       *path.IG
-	l2fib       sync.Map
+	l2fib       *L2FIB
+	loopdetect  loopDetect
+	traffic     sync.Map // trafficKey -> *trafficCounter
+	prefixTable struct {
+		sync.RWMutex
+		entries []prefixEntry
+	}
 	LogLevel    mtypes.LoggerInfo
 	DupData     fixed_time_cache.Cache
 	Version     string
@@ -123,16 +150,18 @@ type Device struct {
 		mtu    int32
 	}
 
+	capture struct {
+		sync.Mutex
+		enabled AtomicBool
+		running *packetCapture
+		options CaptureOptions // set by UAPI, used by the next capture_start
+	}
+
 	ipcMutex sync.RWMutex
 	closed   chan int
 	log      *Logger
 }
 
-type IdAndTime struct {
-	ID   mtypes.Vertex
-	Time time.Time
-}
-
 // deviceState represents the state of a Device.
 // There are three states: down, up, closed.
 // Transitions:
@@ -370,6 +399,9 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		device.SuperConfig = &mtypes.SuperConfig{}
 		device.DupData = *fixed_time_cache.NewCache(mtypes.S2TD(econfig.DynamicRoute.DupCheckTimeout), false, mtypes.S2TD(1))
 		device.event_tryendpoint = make(chan struct{}, 1<<6)
+		device.event_netchange = make(chan struct{}, 1)
+		device.event_natdetect = make(chan struct{}, 1)
+		device.nat.replies = make(chan mtypes.NatProbeMsg, 1<<3)
 		device.Chan_save_config = make(chan struct{}, 1<<5)
 		device.Chan_SendPingStart = make(chan struct{}, 1<<5)
 		device.Chan_SendRegisterStart = make(chan struct{}, 1<<5)
@@ -378,6 +410,10 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		device.SuperConfig.DampingFilterRadius = device.EdgeConfig.DynamicRoute.DampingFilterRadius
 
 	}
+	device.l2fib = NewL2FIB(device.EdgeConfig.L2FIB, &device.LogLevel, device.log)
+	if device.loopDetectEnabled() {
+		device.initLoopDetect()
+	}
 
 	go func() {
 		<-device.Chan_Device_Initialized
@@ -386,14 +422,25 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		}
 		if IsSuperNode {
 			go device.RoutineResetEndpoint()
+			go device.RoutineResolveEndpoints()
 		} else {
 			go device.RoutineTryReceivedEndpoint()
+			go device.RoutineProbeEndpoints()
+			go device.RoutineBondHealth()
+			go device.RoutineNetworkChange()
+			go device.RoutineLANDiscovery()
+			go device.RoutineDetectNat()
+			go device.RoutineSuperFailover()
 			go device.RoutineDetectOfflineAndTryNextEndpoint()
 			go device.RoutineRegister(device.Chan_SendRegisterStart)
 			go device.RoutineSendPing(device.Chan_SendPingStart)
 			go device.RoutineSpreadAllMyNeighbor()
 			go device.RoutineResetEndpoint()
+			go device.RoutineResolveEndpoints()
 			go device.RoutineClearL2FIB()
+			if device.loopDetectEnabled() {
+				go device.RoutineLoopDetect()
+			}
 			go device.RoutineRecalculateNhTable()
 			go device.RoutinePostPeerInfo(device.Chan_HttpPostStart)
 		}
@@ -416,9 +463,15 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		go device.RoutineHandshake(i + 1)
 	}
 
-	device.state.stopping.Add(1)      // RoutineReadFromTUN
-	device.queue.encryption.wg.Add(1) // RoutineReadFromTUN
-	go device.RoutineReadFromTUN()
+	readers := 1 // One for each queue of the tap device
+	if mq, ok := tapDevice.(tap.MultiQueueDevice); ok && mq.NumQueues() > 1 {
+		readers = mq.NumQueues()
+	}
+	device.state.stopping.Add(readers)      // RoutineReadFromTUN
+	device.queue.encryption.wg.Add(readers) // RoutineReadFromTUN
+	for i := 0; i < readers; i++ {
+		go device.RoutineReadFromTUN(i)
+	}
 	go device.RoutineTUNEventReader()
 
 	return device
@@ -479,6 +532,20 @@ func (D *PSKDB) GetPSK(s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey)
 	return pski.(NoisePresharedKey)
 }
 
+func (D *PSKDB) SetPSK(s mtypes.Vertex, d mtypes.Vertex, psk NoisePresharedKey) {
+	if s > d {
+		s, d = d, s
+	}
+	D.db.Store(VPair{s: s, d: d}, psk)
+}
+
+func (D *PSKDB) Range(f func(s mtypes.Vertex, d mtypes.Vertex, psk NoisePresharedKey) bool) {
+	D.db.Range(func(key, value interface{}) bool {
+		vp := key.(VPair)
+		return f(vp.s, vp.d, value.(NoisePresharedKey))
+	})
+}
+
 func (D *PSKDB) DelNode(n mtypes.Vertex) {
 	D.db.Range(func(key, value interface{}) bool {
 		vp := key.(VPair)
@@ -614,6 +681,7 @@ func (device *Device) Close() {
 
 	device.tap.device.Close()
 	device.downLocked()
+	device.StopCapture()
 
 	// Remove peers before closing queues,
 	// because peers assume that queues are active.
@@ -675,6 +743,14 @@ func (device *Device) Bind() conn.Bind {
 	return device.net.bind
 }
 
+// BatchSize returns the number of packets sent or received at once by the bind
+func (device *Device) BatchSize() int {
+	if bb, ok := device.net.bind.(conn.BatchBind); ok {
+		return bb.BatchSize()
+	}
+	return 1
+}
+
 func (device *Device) BindSetMark(mark uint32) error {
 	device.net.Lock()
 	defer device.net.Unlock()
@@ -722,9 +798,22 @@ func (device *Device) BindUpdate() error {
 
 	// bind to new port
 	var err error
-	var recvFns []conn.ReceiveFunc
+	var recvFns []conn.BatchReceiveFunc
+	var recvNames []string
 	netc := &device.net
-	recvFns, netc.port, err = netc.bind.Open(netc.port)
+	if bb, ok := netc.bind.(conn.BatchBind); ok {
+		recvFns, netc.port, err = bb.OpenBatch(netc.port)
+		for _, fn := range recvFns {
+			recvNames = append(recvNames, fn.PrettyName())
+		}
+	} else {
+		var fns []conn.ReceiveFunc
+		fns, netc.port, err = netc.bind.Open(netc.port)
+		for _, fn := range fns {
+			recvFns = append(recvFns, fn.Batch())
+			recvNames = append(recvNames, fn.PrettyName())
+		}
+	}
 	if err != nil {
 		netc.port = 0
 		return err
@@ -759,8 +848,8 @@ func (device *Device) BindUpdate() error {
 	device.net.stopping.Add(len(recvFns))
 	device.queue.decryption.wg.Add(len(recvFns)) // each RoutineReceiveIncoming goroutine writes to device.queue.decryption
 	device.queue.handshake.wg.Add(len(recvFns))  // each RoutineReceiveIncoming goroutine writes to device.queue.handshake
-	for _, fn := range recvFns {
-		go device.RoutineReceiveIncoming(fn)
+	for i, fn := range recvFns {
+		go device.RoutineReceiveIncoming(recvNames[i], fn)
 	}
 
 	device.log.Verbosef("UDP bind has been updated")
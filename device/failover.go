@@ -0,0 +1,133 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Supernode failover.
+//
+// The supernodes of a cluster share the same keys, so the edge keeps the super peers and only switches their endpoints.
+// It switches to the next supernode in SuperInfo.Cluster if no super peer is alive,
+// or the edge API failed SuperFailoverHttpErrors times in a row, but not more often than SuperNodeInfoTimeout.
+
+const SuperFailoverHttpErrors = 3
+
+// superEndpoints returns the endpoints of all supernodes, the one in SuperInfo first
+func (device *Device) superEndpoints() []mtypes.SuperEndpointInfo {
+	conf := device.EdgeConfig.DynamicRoute.SuperNode
+	return append([]mtypes.SuperEndpointInfo{{
+		EndpointV4:         conf.EndpointV4,
+		EndpointV6:         conf.EndpointV6,
+		EndpointEdgeAPIUrl: conf.EndpointEdgeAPIUrl,
+	}}, conf.Cluster...)
+}
+
+// ActiveSuper returns the endpoints of the supernode in use
+func (device *Device) ActiveSuper() mtypes.SuperEndpointInfo {
+	eps := device.superEndpoints()
+	device.supercluster.RLock()
+	defer device.supercluster.RUnlock()
+	return eps[device.supercluster.active%len(eps)]
+}
+
+// superHttpResult counts the consecutive failures of the edge API
+func (device *Device) superHttpResult(err error) {
+	device.supercluster.Lock()
+	defer device.supercluster.Unlock()
+	if err != nil {
+		device.supercluster.httpFail += 1
+	} else {
+		device.supercluster.httpFail = 0
+	}
+}
+
+func (device *Device) superAlive() bool {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.SuperPeer {
+		if peer.IsPeerAlive() {
+			return true
+		}
+	}
+	return false
+}
+
+// SuperFailover switches to the next supernode of the cluster
+func (device *Device) SuperFailover() {
+	eps := device.superEndpoints()
+	device.supercluster.Lock()
+	device.supercluster.active = (device.supercluster.active + 1) % len(eps)
+	device.supercluster.switched = time.Now()
+	device.supercluster.httpFail = 0
+	next := eps[device.supercluster.active]
+	device.supercluster.Unlock()
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Supernode failover to V4:%v V6:%v API:%v\n", next.EndpointV4, next.EndpointV6, next.EndpointEdgeAPIUrl)
+	}
+	conf := device.EdgeConfig.DynamicRoute.SuperNode
+	for _, it := range []struct {
+		pubkey   string
+		endpoint string
+		af       conn.EnabledAf
+	}{
+		{conf.PubKeyV4, next.EndpointV4, conn.EnabledAf4},
+		{conf.PubKeyV6, next.EndpointV6, conn.EnabledAf6},
+	} {
+		if it.endpoint == "" {
+			continue
+		}
+		peer := device.LookupPeerByStr(it.pubkey)
+		if peer == nil {
+			continue
+		}
+		if err := peer.SetEndpointFromConnURL(it.endpoint, it.af, 0, peer.StaticConn); err != nil {
+			device.log.Errorf("Failed to set endpoint for supernode %v: %v", it.endpoint, err)
+			continue
+		}
+		peer.SendKeepalive()
+	}
+	for _, startchan := range []chan struct{}{device.Chan_SendRegisterStart, device.Chan_HttpPostStart} {
+		select {
+		case startchan <- struct{}{}:
+		default:
+		}
+	}
+	device.signalNatDetect()
+}
+
+// RoutineSuperFailover checks the supernode in use, and fails over if it's down
+func (device *Device) RoutineSuperFailover() {
+	conf := device.EdgeConfig.DynamicRoute.SuperNode
+	if !conf.UseSuperNode || len(conf.Cluster) == 0 {
+		return
+	}
+	timeout := mtypes.S2TD(conf.SuperNodeInfoTimeout)
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	device.supercluster.Lock()
+	device.supercluster.switched = time.Now()
+	device.supercluster.Unlock()
+	for {
+		time.Sleep(interval)
+		device.supercluster.RLock()
+		switched, httpFail := device.supercluster.switched, device.supercluster.httpFail
+		device.supercluster.RUnlock()
+		if time.Since(switched) < timeout {
+			continue
+		}
+		if httpFail >= SuperFailoverHttpErrors || !device.superAlive() {
+			device.SuperFailover()
+		}
+	}
+}
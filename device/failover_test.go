@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestSuperFailover(t *testing.T) {
+	econfig := &mtypes.EdgeConfig{}
+	econfig.DynamicRoute.SuperNode = mtypes.SuperInfo{
+		UseSuperNode:       true,
+		EndpointV4:         "192.0.2.1:3000",
+		EndpointEdgeAPIUrl: "http://192.0.2.1:3000/eg_api",
+		Cluster: []mtypes.SuperEndpointInfo{
+			{EndpointV4: "192.0.2.2:3000", EndpointEdgeAPIUrl: "http://192.0.2.2:3000/eg_api"},
+		},
+	}
+	device := &Device{EdgeConfig: econfig}
+	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.SuperPeer = make(map[NoisePublicKey]*Peer)
+
+	if got := device.ActiveSuper().EndpointEdgeAPIUrl; got != "http://192.0.2.1:3000/eg_api" {
+		t.Fatalf("ActiveSuper() = %v, want the first supernode", got)
+	}
+	for i := 0; i < SuperFailoverHttpErrors; i++ {
+		device.superHttpResult(errors.New("connection refused"))
+	}
+	if device.supercluster.httpFail != SuperFailoverHttpErrors {
+		t.Fatalf("httpFail = %v, want %v", device.supercluster.httpFail, SuperFailoverHttpErrors)
+	}
+	device.superHttpResult(nil)
+	if device.supercluster.httpFail != 0 {
+		t.Fatalf("httpFail not reset after a success")
+	}
+	device.SuperFailover()
+	if got := device.ActiveSuper().EndpointV4; got != "192.0.2.2:3000" {
+		t.Fatalf("after failover ActiveSuper() = %v, want the second supernode", got)
+	}
+	device.SuperFailover()
+	if got := device.ActiveSuper().EndpointV4; got != "192.0.2.1:3000" {
+		t.Fatalf("after failover ActiveSuper() = %v, want back to the first supernode", got)
+	}
+}
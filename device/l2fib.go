@@ -0,0 +1,230 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const l2fibShards = 16
+
+type L2FIBEntry struct {
+	MAC         tap.MacAddress
+	ID          mtypes.Vertex
+	Time        time.Time
+	Static      bool
+	FrozenUntil time.Time
+	moves       int
+	moveStart   time.Time
+}
+
+type l2fibShard struct {
+	sync.RWMutex
+	entries map[tap.MacAddress]*L2FIBEntry
+}
+
+// L2FIB is the MAC -> NodeID table, sharded by MAC address and bounded by MaxMAC and MaxMACPerNode
+type L2FIB struct {
+	shards    [l2fibShards]l2fibShard
+	total     int64
+	nodeCount sync.Map // mtypes.Vertex -> *int64, dynamic entries only
+	conf      mtypes.L2FIBInfo
+	loglevel  *mtypes.LoggerInfo
+	log       *Logger
+	OnMove    func(mac tap.MacAddress, from mtypes.Vertex, to mtypes.Vertex)
+}
+
+func NewL2FIB(conf mtypes.L2FIBInfo, loglevel *mtypes.LoggerInfo, logger *Logger) *L2FIB {
+	fib := &L2FIB{
+		conf:     conf,
+		loglevel: loglevel,
+		log:      logger,
+	}
+	for i := range fib.shards {
+		fib.shards[i].entries = make(map[tap.MacAddress]*L2FIBEntry)
+	}
+	for macstr, id := range conf.StaticMAC {
+		hw, err := net.ParseMAC(macstr)
+		if err != nil || len(hw) != 6 {
+			fib.log.Errorf("L2FIB: invalid static MAC address %v, ignored", macstr)
+			continue
+		}
+		var mac tap.MacAddress
+		copy(mac[:], hw)
+		if tap.IsNotUnicast(mac) {
+			fib.log.Errorf("L2FIB: static MAC address %v is not unicast, ignored", macstr)
+			continue
+		}
+		fib.shard(mac).entries[mac] = &L2FIBEntry{
+			MAC:    mac,
+			ID:     id,
+			Static: true,
+		}
+	}
+	return fib
+}
+
+func (fib *L2FIB) shard(mac tap.MacAddress) *l2fibShard {
+	return &fib.shards[(mac[3]^mac[4]^mac[5])%l2fibShards]
+}
+
+func (fib *L2FIB) counter(id mtypes.Vertex) *int64 {
+	if val, ok := fib.nodeCount.Load(id); ok {
+		return val.(*int64)
+	}
+	val, _ := fib.nodeCount.LoadOrStore(id, new(int64))
+	return val.(*int64)
+}
+
+func (fib *L2FIB) Lookup(mac tap.MacAddress) (mtypes.Vertex, bool) {
+	s := fib.shard(mac)
+	s.RLock()
+	defer s.RUnlock()
+	entry, ok := s.entries[mac]
+	if !ok {
+		return mtypes.NodeID_Invalid, false
+	}
+	return entry.ID, true
+}
+
+// Learn records that mac is behind node id
+func (fib *L2FIB) Learn(mac tap.MacAddress, id mtypes.Vertex) {
+	now := time.Now()
+	s := fib.shard(mac)
+	s.Lock()
+	entry, ok := s.entries[mac]
+	if !ok {
+		if fib.conf.MaxMAC > 0 && atomic.LoadInt64(&fib.total) >= int64(fib.conf.MaxMAC) {
+			s.Unlock()
+			if fib.loglevel.LogInternal {
+				fmt.Printf("Internal: L2FIB [%v -> %v] dropped: table full.\n", mac.String(), id.ToString())
+			}
+			return
+		}
+		if fib.conf.MaxMACPerNode > 0 && atomic.LoadInt64(fib.counter(id)) >= int64(fib.conf.MaxMACPerNode) {
+			s.Unlock()
+			if fib.loglevel.LogInternal {
+				fmt.Printf("Internal: L2FIB [%v -> %v] dropped: node %v reached MaxMACPerNode.\n", mac.String(), id.ToString(), id.ToString())
+			}
+			return
+		}
+		s.entries[mac] = &L2FIBEntry{
+			MAC:  mac,
+			ID:   id,
+			Time: now,
+		}
+		atomic.AddInt64(&fib.total, 1)
+		atomic.AddInt64(fib.counter(id), 1)
+		s.Unlock()
+		if fib.loglevel.LogInternal {
+			fmt.Printf("Internal: L2FIB [%v -> %v] added.\n", mac.String(), id.ToString())
+		}
+		return
+	}
+	if entry.ID == id {
+		entry.Time = now
+		s.Unlock()
+		return
+	}
+	// MAC move
+	from := entry.ID
+	if entry.Static {
+		s.Unlock()
+		if fib.loglevel.LogInternal {
+			fmt.Printf("Internal: L2FIB [%v -> %v] is static, ignored the move to %v.\n", mac.String(), from.ToString(), id.ToString())
+		}
+		return
+	}
+	if now.Before(entry.FrozenUntil) {
+		s.Unlock()
+		return
+	}
+	if now.After(entry.moveStart.Add(mtypes.S2TD(fib.conf.MoveWindow))) {
+		entry.moveStart = now
+		entry.moves = 0
+	}
+	entry.moves += 1
+	if fib.conf.MoveThreshold > 0 && entry.moves >= fib.conf.MoveThreshold {
+		entry.moves = 0
+		if fib.conf.FreezeTime > 0 {
+			entry.FrozenUntil = now.Add(mtypes.S2TD(fib.conf.FreezeTime))
+			entry.Time = now
+			s.Unlock()
+			fib.log.Errorf("L2FIB [%v -> %v] is flapping with node %v, frozen for %v seconds", mac.String(), from.ToString(), id.ToString(), fib.conf.FreezeTime)
+			if fib.OnMove != nil {
+				fib.OnMove(mac, from, id)
+			}
+			return
+		}
+		fib.log.Errorf("L2FIB [%v] is flapping between node %v and %v", mac.String(), from.ToString(), id.ToString())
+	}
+	entry.ID = id
+	entry.Time = now
+	atomic.AddInt64(fib.counter(from), -1)
+	atomic.AddInt64(fib.counter(id), 1)
+	s.Unlock()
+	if fib.loglevel.LogInternal {
+		fmt.Printf("Internal: L2FIB [%v -> %v] updated.\n", mac.String(), id.ToString())
+	}
+	if fib.OnMove != nil {
+		fib.OnMove(mac, from, id)
+	}
+}
+
+// Flush deletes the dynamic entries which match, and returns how many entries are deleted
+func (fib *L2FIB) Flush(match func(entry *L2FIBEntry) bool) int {
+	deleted := 0
+	for i := range fib.shards {
+		s := &fib.shards[i]
+		s.Lock()
+		for mac, entry := range s.entries {
+			if entry.Static || !match(entry) {
+				continue
+			}
+			delete(s.entries, mac)
+			atomic.AddInt64(&fib.total, -1)
+			atomic.AddInt64(fib.counter(entry.ID), -1)
+			deleted += 1
+			if fib.loglevel.LogInternal {
+				fmt.Printf("Internal: L2FIB [%v -> %v] deleted.\n", mac.String(), entry.ID.ToString())
+			}
+		}
+		s.Unlock()
+	}
+	return deleted
+}
+
+func (fib *L2FIB) Expire(timeout time.Duration) int {
+	now := time.Now()
+	return fib.Flush(func(entry *L2FIBEntry) bool {
+		return now.After(entry.Time.Add(timeout)) && now.After(entry.FrozenUntil)
+	})
+}
+
+// Dump returns a copy of all entries, sorted by MAC address
+func (fib *L2FIB) Dump() []L2FIBEntry {
+	ret := make([]L2FIBEntry, 0, atomic.LoadInt64(&fib.total))
+	for i := range fib.shards {
+		s := &fib.shards[i]
+		s.RLock()
+		for _, entry := range s.entries {
+			ret = append(ret, *entry)
+		}
+		s.RUnlock()
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return string(ret[i].MAC[:]) < string(ret[j].MAC[:])
+	})
+	return ret
+}
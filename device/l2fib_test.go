@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+func testMac(i byte) tap.MacAddress {
+	return tap.MacAddress{0x02, 0, 0, 0, 0, i}
+}
+
+func TestL2FIBLimit(t *testing.T) {
+	fib := NewL2FIB(mtypes.L2FIBInfo{
+		MaxMAC:        3,
+		MaxMACPerNode: 2,
+	}, &mtypes.LoggerInfo{}, NewLogger(LogLevelSilent, ""))
+	fib.Learn(testMac(1), 1)
+	fib.Learn(testMac(2), 1)
+	fib.Learn(testMac(3), 1)
+	if _, ok := fib.Lookup(testMac(3)); ok {
+		t.Errorf("MaxMACPerNode not applied")
+	}
+	fib.Learn(testMac(4), 2)
+	fib.Learn(testMac(5), 2)
+	if _, ok := fib.Lookup(testMac(5)); ok {
+		t.Errorf("MaxMAC not applied")
+	}
+	if n := fib.Flush(func(entry *L2FIBEntry) bool { return entry.ID == 1 }); n != 2 {
+		t.Errorf("Flush deleted %v entries, want 2", n)
+	}
+	fib.Learn(testMac(5), 2)
+	if id, ok := fib.Lookup(testMac(5)); !ok || id != 2 {
+		t.Errorf("Lookup = %v %v, want 2 true", id, ok)
+	}
+	if n := len(fib.Dump()); n != 2 {
+		t.Errorf("Dump returned %v entries, want 2", n)
+	}
+}
+
+func TestL2FIBMove(t *testing.T) {
+	fib := NewL2FIB(mtypes.L2FIBInfo{
+		StaticMAC:     map[string]mtypes.Vertex{"02:00:00:00:00:01": 1},
+		MoveThreshold: 3,
+		MoveWindow:    10,
+		FreezeTime:    10,
+	}, &mtypes.LoggerInfo{}, NewLogger(LogLevelSilent, ""))
+	moves := 0
+	fib.OnMove = func(mac tap.MacAddress, from mtypes.Vertex, to mtypes.Vertex) {
+		moves += 1
+	}
+
+	fib.Learn(testMac(1), 2)
+	if id, _ := fib.Lookup(testMac(1)); id != 1 {
+		t.Errorf("static entry moved to %v", id)
+	}
+	if n := fib.Flush(func(entry *L2FIBEntry) bool { return true }); n != 0 {
+		t.Errorf("static entry flushed")
+	}
+
+	fib.Learn(testMac(2), 2)
+	fib.Learn(testMac(2), 3) // move 1
+	fib.Learn(testMac(2), 2) // move 2
+	fib.Learn(testMac(2), 3) // move 3, frozen at 2
+	fib.Learn(testMac(2), 3)
+	if id, _ := fib.Lookup(testMac(2)); id != 2 {
+		t.Errorf("flapping MAC not frozen, now at %v", id)
+	}
+	if moves != 3 {
+		t.Errorf("OnMove called %v times, want 3", moves)
+	}
+	if n := fib.Expire(time.Nanosecond); n != 0 {
+		t.Errorf("frozen entry expired")
+	}
+}
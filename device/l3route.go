@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// In L3 mode (IType: tun), packets are routed by the destination IP instead of MAC address.
+// The IPs inside our own IPv4CIDR/IPv6CIDR are mapped to NodeID directly, the same way as tap.GetIP() assigns them.
+// Other prefixes are looked up from the prefix table, which is built from the IPv4CIDR/IPv6CIDR of other nodes.
+
+type NodeCIDR struct {
+	IPv4CIDR string
+	IPv6CIDR string
+}
+
+type prefixEntry struct {
+	prefix *net.IPNet
+	ID     mtypes.Vertex
+}
+
+func (device *Device) IsL3() bool {
+	return device.EdgeConfig != nil && device.EdgeConfig.Interface.IType == "tun"
+}
+
+// UpdatePrefixTable rebuilds the prefix table from the IPv4CIDR/IPv6CIDR of all nodes
+func (device *Device) UpdatePrefixTable(cidrs map[mtypes.Vertex]NodeCIDR) {
+	owners := make(map[string][]mtypes.Vertex)
+	prefixes := make(map[string]*net.IPNet)
+	for id, cidr := range cidrs {
+		if id == device.ID {
+			continue
+		}
+		for _, c := range []string{cidr.IPv4CIDR, cidr.IPv6CIDR} {
+			if c == "" || c == device.EdgeConfig.Interface.IPv4CIDR || c == device.EdgeConfig.Interface.IPv6CIDR {
+				// Same subnet with us, already mapped by NodeID
+				continue
+			}
+			_, prefix, err := net.ParseCIDR(c)
+			if err != nil {
+				device.log.Errorf("Invalid CIDR %v of node %v: %v", c, id.ToString(), err)
+				continue
+			}
+			owners[prefix.String()] = append(owners[prefix.String()], id)
+			prefixes[prefix.String()] = prefix
+		}
+	}
+	table := make([]prefixEntry, 0, len(prefixes))
+	for pstr, prefix := range prefixes {
+		if len(owners[pstr]) > 1 {
+			device.log.Errorf("Prefix %v is claimed by multiple nodes %v, ignored", pstr, owners[pstr])
+			continue
+		}
+		table = append(table, prefixEntry{
+			prefix: prefix,
+			ID:     owners[pstr][0],
+		})
+	}
+	// longest prefix first
+	sort.Slice(table, func(i, j int) bool {
+		oi, _ := table[i].prefix.Mask.Size()
+		oj, _ := table[j].prefix.Mask.Size()
+		return oi > oj
+	})
+	device.prefixTable.Lock()
+	device.prefixTable.entries = table
+	device.prefixTable.Unlock()
+	if device.LogLevel.LogInternal {
+		for _, entry := range table {
+			fmt.Printf("Internal: Prefix table [%v -> %v]\n", entry.prefix.String(), entry.ID.ToString())
+		}
+	}
+}
+
+// LookupIP returns the NodeID of the destination address, NodeID_Invalid if no route
+func (device *Device) LookupIP(ip net.IP) mtypes.Vertex {
+	if tap.IsNotUnicastIP(ip) {
+		return mtypes.NodeID_Broadcast
+	}
+	for _, cidr := range []string{device.EdgeConfig.Interface.IPv4CIDR, device.EdgeConfig.Interface.IPv6CIDR} {
+		if cidr == "" {
+			continue
+		}
+		uid, isBroadcast, err := tap.GetUID(cidr, ip)
+		if err != nil {
+			continue
+		}
+		if isBroadcast {
+			return mtypes.NodeID_Broadcast
+		}
+		if uid >= uint32(mtypes.NodeID_Special) {
+			return mtypes.NodeID_Invalid
+		}
+		return mtypes.Vertex(uid)
+	}
+	device.prefixTable.RLock()
+	defer device.prefixTable.RUnlock()
+	for _, entry := range device.prefixTable.entries {
+		if entry.prefix.Contains(ip) {
+			return entry.ID
+		}
+	}
+	return mtypes.NodeID_Invalid
+}
+
+// decodeTapPacket decodes the packet read from/written to the tap device for logging
+func (device *Device) decodeTapPacket(packet []byte) gopacket.Packet {
+	if device.IsL3() {
+		if len(packet) > 0 && packet[0]>>4 == 6 {
+			return gopacket.NewPacket(packet, layers.LayerTypeIPv6, gopacket.Default)
+		}
+		return gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+	}
+	return gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.Default)
+}
@@ -0,0 +1,265 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// LAN discovery sends beacons to a multicast group or the broadcast address of the underlay LAN.
+//
+// A beacon carries the node ID, the public key and the listen port of the sender.
+// It's signed once for every known peer, with the shared secret of the static keys of the two nodes,
+// so only the peers can verify it. The receiver adds srcIP:Port to the trylist of the sender with high priority.
+
+const (
+	LANBeaconMaxAge = 5 * time.Minute // beacons older than this are dropped
+	LANBeaconTagLen = 16
+)
+
+type lanDiscovery struct {
+	sync.Mutex
+	device     *Device
+	lastBeacon map[mtypes.Vertex]time.Time // replay protection
+}
+
+func lanBeaconSignData(msg *mtypes.LANBeaconMsg, dst mtypes.Vertex) []byte {
+	return []byte(fmt.Sprintf("EtherGuard LAN beacon|%d|%d|%s|%d|%d", msg.Node_id, dst, msg.PubKey, msg.Port, msg.Time.UnixNano()))
+}
+
+func (peer *Peer) lanBeaconTag(msg *mtypes.LANBeaconMsg, dst mtypes.Vertex) []byte {
+	var sum [blake2s.Size]byte
+	peer.handshake.mutex.RLock()
+	HMAC1(&sum, peer.handshake.precomputedStaticStatic[:], lanBeaconSignData(msg, dst))
+	peer.handshake.mutex.RUnlock()
+	return sum[:LANBeaconTagLen]
+}
+
+func (device *Device) newLANBeacon() ([]byte, error) {
+	device.staticIdentity.RLock()
+	pubkey := device.staticIdentity.publicKey
+	device.staticIdentity.RUnlock()
+	device.net.RLock()
+	port := device.net.port
+	device.net.RUnlock()
+	msg := mtypes.LANBeaconMsg{
+		Node_id:   device.ID,
+		PubKey:    pubkey.ToString(),
+		Port:      port,
+		Time:      time.Now(),
+		Signature: make(map[mtypes.Vertex][]byte),
+	}
+	device.peers.RLock()
+	for id, peer := range device.peers.IDMap {
+		if id >= mtypes.NodeID_Special {
+			continue
+		}
+		msg.Signature[id] = peer.lanBeaconTag(&msg, id)
+	}
+	device.peers.RUnlock()
+	if len(msg.Signature) == 0 {
+		return nil, nil
+	}
+	return mtypes.GetByte(&msg)
+}
+
+// lanInterfaces returns the interfaces of the underlay LAN, excluding the loopback and the tap device
+func (device *Device) lanInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	tapname, _ := device.tap.device.Name()
+	ret := make([]net.Interface, 0, len(ifaces))
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Name == tapname {
+			continue
+		}
+		ret = append(ret, ifi)
+	}
+	return ret
+}
+
+func (device *Device) listenLANBeacon(network string, group *net.UDPAddr) (*net.UDPConn, error) {
+	if !group.IP.IsMulticast() {
+		return net.ListenUDP(network, &net.UDPAddr{Port: group.Port})
+	}
+	c, err := net.ListenMulticastUDP(network, nil, group)
+	if err != nil {
+		return nil, err
+	}
+	// join the group on every interface, the errors of the interfaces without this af are ignored
+	for _, ifi := range device.lanInterfaces() {
+		ifi := ifi
+		if network == "udp4" {
+			ipv4.NewPacketConn(c).JoinGroup(&ifi, group)
+		} else {
+			ipv6.NewPacketConn(c).JoinGroup(&ifi, group)
+		}
+	}
+	return c, nil
+}
+
+func (device *Device) sendLANBeacon(c *net.UDPConn, network string, group *net.UDPAddr, beacon []byte) {
+	if !group.IP.IsMulticast() {
+		if _, err := c.WriteTo(beacon, group); err != nil {
+			device.log.Verbosef("Failed to send LAN beacon to %v: %v", group, err)
+		}
+		return
+	}
+	for _, ifi := range device.lanInterfaces() {
+		ifi := ifi
+		var err error
+		if network == "udp4" {
+			err = ipv4.NewPacketConn(c).SetMulticastInterface(&ifi)
+		} else {
+			err = ipv6.NewPacketConn(c).SetMulticastInterface(&ifi)
+		}
+		if err != nil {
+			continue
+		}
+		if _, err = c.WriteTo(beacon, group); err != nil {
+			device.log.Verbosef("Failed to send LAN beacon to %v via %v: %v", group, ifi.Name, err)
+		}
+	}
+}
+
+func (ld *lanDiscovery) routineReceive(c *net.UDPConn) {
+	device := ld.device
+	defer c.Close()
+	buf := make([]byte, 1<<16)
+	for {
+		n, src, err := c.ReadFromUDP(buf)
+		if err != nil {
+			device.log.Errorf("LAN discovery stopped: %v", err)
+			return
+		}
+		ld.process(buf[:n], src)
+	}
+}
+
+func (ld *lanDiscovery) process(beacon []byte, src *net.UDPAddr) {
+	device := ld.device
+	msg, err := mtypes.ParseLANBeaconMsg(beacon)
+	if err != nil || msg.Node_id == device.ID || msg.Node_id >= mtypes.NodeID_Special {
+		return
+	}
+	peer := device.LookupPeerByStr(msg.PubKey)
+	if peer == nil || peer.ID != msg.Node_id {
+		return
+	}
+	if !hmac.Equal(msg.Signature[device.ID], peer.lanBeaconTag(&msg, device.ID)) {
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: Drop LAN beacon with bad signature from %v\n", src)
+		}
+		return
+	}
+	if age := time.Since(msg.Time); age > LANBeaconMaxAge || age < -LANBeaconMaxAge {
+		return
+	}
+	ld.Lock()
+	if !msg.Time.After(ld.lastBeacon[msg.Node_id]) {
+		ld.Unlock()
+		return
+	}
+	ld.lastBeacon[msg.Node_id] = msg.Time
+	ld.Unlock()
+
+	url := net.JoinHostPort(src.IP.String(), strconv.Itoa(int(msg.Port)))
+	if src.Zone != "" {
+		url = net.JoinHostPort(src.IP.String()+"%"+src.Zone, strconv.Itoa(int(msg.Port)))
+	}
+	if device.LogLevel.LogInternal {
+		fmt.Printf("Internal: Received LAN beacon from peer %v at %v\n", peer.ID.ToString(), url)
+	}
+	if !peer.endpoint_trylist.UpdateLAN(url) || peer.GetEndpointDstStr() == url {
+		return
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Found peer %v on LAN at %v\n", peer.ID.ToString(), url)
+	}
+	if device.EdgeConfig.DynamicRoute.ProbeStagger > 0 {
+		go device.ProbeEndpoints(peer)
+	} else if !peer.IsPeerAlive() {
+		select {
+		case device.event_tryendpoint <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// RoutineLANDiscovery sends the beacons every Interval seconds, and receives the beacons of the peers
+func (device *Device) RoutineLANDiscovery() {
+	conf := device.EdgeConfig.LANDiscovery
+	if !conf.UseLANDiscovery || conf.Interval <= 0 {
+		return
+	}
+	ld := &lanDiscovery{
+		device:     device,
+		lastBeacon: make(map[mtypes.Vertex]time.Time),
+	}
+	type sender struct {
+		network string
+		group   *net.UDPAddr
+		conn    *net.UDPConn
+	}
+	var senders []sender
+	for _, g := range []struct {
+		network string
+		addr    string
+		enabled bool
+	}{
+		{"udp4", conf.GroupV4, device.enabledAf.IPv4},
+		{"udp6", conf.GroupV6, device.enabledAf.IPv6},
+	} {
+		if g.addr == "" || !g.enabled {
+			continue
+		}
+		group, err := net.ResolveUDPAddr(g.network, g.addr)
+		if err != nil {
+			device.log.Errorf("LAN discovery: invalid group %v: %v", g.addr, err)
+			continue
+		}
+		lc, err := device.listenLANBeacon(g.network, group)
+		if err != nil {
+			device.log.Errorf("LAN discovery: listen %v failed: %v", g.addr, err)
+			continue
+		}
+		go ld.routineReceive(lc)
+		sc, err := net.ListenUDP(g.network, nil)
+		if err != nil {
+			device.log.Errorf("LAN discovery: %v", err)
+			continue
+		}
+		senders = append(senders, sender{g.network, group, sc})
+	}
+	if len(senders) == 0 {
+		return
+	}
+	timeout := mtypes.S2TD(conf.Interval)
+	for {
+		beacon, err := device.newLANBeacon()
+		if err != nil {
+			device.log.Errorf("LAN discovery: %v", err)
+		}
+		if beacon != nil {
+			for _, s := range senders {
+				device.sendLANBeacon(s.conn, s.network, s.group, beacon)
+			}
+		}
+		time.Sleep(timeout)
+	}
+}
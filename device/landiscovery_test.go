@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func newTestLANDevice(t *testing.T, id mtypes.Vertex) *Device {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &Device{ID: id, EdgeConfig: &mtypes.EdgeConfig{}}
+	device.staticIdentity.privateKey = sk
+	device.staticIdentity.publicKey = sk.PublicKey()
+	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
+	device.peers.IDMap = make(map[mtypes.Vertex]*Peer)
+	device.event_tryendpoint = make(chan struct{}, 1)
+	return device
+}
+
+func addTestLANPeer(device *Device, remote *Device) *Peer {
+	peer := &Peer{device: device, ID: remote.ID}
+	peer.handshake.remoteStatic = remote.staticIdentity.publicKey
+	peer.handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(remote.staticIdentity.publicKey)
+	peer.endpoint_trylist = NewEndpoint_trylist(peer, time.Minute, conn.EnabledAf46)
+	device.peers.keyMap[remote.staticIdentity.publicKey] = peer
+	device.peers.IDMap[remote.ID] = peer
+	return peer
+}
+
+func TestLANBeacon(t *testing.T) {
+	a, b, c := newTestLANDevice(t, 1), newTestLANDevice(t, 2), newTestLANDevice(t, 3)
+	addTestLANPeer(a, b)
+	peerA := addTestLANPeer(b, a)
+	addTestLANPeer(c, a)
+	a.net.port = 3001
+
+	beacon, err := a.newLANBeacon()
+	if err != nil || beacon == nil {
+		t.Fatalf("newLANBeacon() = %v, %v", beacon, err)
+	}
+	src := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	ld := &lanDiscovery{device: b, lastBeacon: make(map[mtypes.Vertex]time.Time)}
+	ld.process(beacon, src)
+	if items := peerA.endpoint_trylist.GetProbeList(); len(items) != 1 || items[0].URL != "192.0.2.1:3001" {
+		t.Errorf("trylist after beacon = %v, want 192.0.2.1:3001", items)
+	}
+	if len(b.event_tryendpoint) != 1 {
+		t.Errorf("beacon of an offline peer should trigger the endpoint try")
+	}
+
+	// c is not a peer of a, so the beacon isn't signed for c
+	ldc := &lanDiscovery{device: c, lastBeacon: make(map[mtypes.Vertex]time.Time)}
+	ldc.process(beacon, src)
+	if items := c.peers.IDMap[1].endpoint_trylist.GetProbeList(); len(items) != 0 {
+		t.Errorf("trylist after unsigned beacon = %v, want empty", items)
+	}
+
+	// tampered
+	msg, _ := mtypes.ParseLANBeaconMsg(beacon)
+	msg.Port = 3002
+	tampered, _ := mtypes.GetByte(&msg)
+	ld.lastBeacon = make(map[mtypes.Vertex]time.Time)
+	ld.process(tampered, src)
+	if items := peerA.endpoint_trylist.GetProbeList(); len(items) != 1 {
+		t.Errorf("trylist after tampered beacon = %v, want unchanged", items)
+	}
+}
@@ -0,0 +1,281 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// Layer-2 loop detection for edges bridged to physical LANs.
+//
+// Every edge writes a probe frame to its tap device periodically. The probes are never forwarded to the overlay,
+// so if an edge reads the probe of another edge from its own tap, both edges are bridged to the same LAN segment,
+// and broadcasts will loop through the overlay and the LAN.
+// Frequent MAC moves between two nodes in the L2FIB are counted as evidence too: the looped frames reach us from both nodes,
+// so we are counted in the looping segment with them.
+//
+// The nodes in the same looping segment elect the lowest NodeID as the designated forwarder.
+// With Action "elect", only the designated forwarder bridges broadcasts between the tap and the overlay.
+// With Action "block", no node in the segment bridges broadcasts until the loop disappears for HoldTime.
+
+const (
+	loopProbeEtherType = 0x88B5
+	loopProbeMagic     = "EGLD"
+	loopProbeLen       = 60
+
+	loopDefaultHoldProbes = 3  // HoldTime if not set, in ProbeInterval
+	loopDefaultHoldTime   = 30 // HoldTime if neither is set, in seconds
+)
+
+var loopProbeDst = tap.MacAddress{0x03, 0x45, 0x47, 0x00, 0x00, 0x00}
+
+type loopPair [2]mtypes.Vertex
+
+type loopMoves struct {
+	count int
+	start time.Time
+}
+
+type loopDetect struct {
+	sync.Mutex
+	nonce   []byte
+	pairs   map[loopPair]time.Time // evidence, expires after HoldTime
+	moves   map[loopPair]*loopMoves
+	blocked AtomicBool
+	probe   chan struct{}
+}
+
+func newLoopPair(a mtypes.Vertex, b mtypes.Vertex) loopPair {
+	if a > b {
+		return loopPair{b, a}
+	}
+	return loopPair{a, b}
+}
+
+func (device *Device) initLoopDetect() {
+	ld := &device.loopdetect
+	ld.nonce = make([]byte, 8)
+	rand.Read(ld.nonce)
+	ld.pairs = make(map[loopPair]time.Time)
+	ld.moves = make(map[loopPair]*loopMoves)
+	ld.probe = make(chan struct{}, 1)
+	device.l2fib.OnMove = device.loopDetectOnMove
+}
+
+// loopHoldTime returns how long the evidence is kept
+func loopHoldTime(conf mtypes.LoopDetectInfo) time.Duration {
+	if conf.HoldTime > 0 {
+		return mtypes.S2TD(conf.HoldTime)
+	}
+	if conf.ProbeInterval > 0.01 {
+		return mtypes.S2TD(conf.ProbeInterval * loopDefaultHoldProbes)
+	}
+	return mtypes.S2TD(loopDefaultHoldTime)
+}
+
+func (device *Device) loopDetectEnabled() bool {
+	return device.EdgeConfig != nil && device.EdgeConfig.LoopDetect.UseLoopDetect && !device.IsSuperNode && !device.IsL3()
+}
+
+// loopBlockBroadcast reports whether broadcasts must not be bridged between the tap and the overlay
+func (device *Device) loopBlockBroadcast() bool {
+	return device.loopdetect.blocked.Get()
+}
+
+func (device *Device) newLoopProbe() []byte {
+	offset := MessageTransportOffsetContent + path.EgHeaderLen
+	buf := make([]byte, offset+loopProbeLen)
+	frame := buf[offset:]
+	srcmac, err := tap.GetMacAddr(device.EdgeConfig.Interface.MacAddrPrefix, uint32(device.ID))
+	if err != nil {
+		srcmac = tap.MacAddress{0x02, 0x45, 0x47, 0x00, 0x00, 0x00}
+		binary.BigEndian.PutUint16(srcmac[4:], uint16(device.ID))
+	}
+	copy(frame[0:6], loopProbeDst[:])
+	copy(frame[6:12], srcmac[:])
+	binary.BigEndian.PutUint16(frame[12:14], loopProbeEtherType)
+	copy(frame[14:18], loopProbeMagic)
+	binary.BigEndian.PutUint16(frame[18:20], uint16(device.ID))
+	copy(frame[20:28], device.loopdetect.nonce)
+	binary.BigEndian.PutUint64(frame[28:36], uint64(time.Now().UnixNano()))
+	return buf
+}
+
+// isLoopProbe returns the NodeID and nonce of the sender if the frame is a loop probe
+func isLoopProbe(frame []byte) (mtypes.Vertex, []byte, bool) {
+	if len(frame) < 36 || tap.GetDstMacAddr(frame) != loopProbeDst {
+		return 0, nil, false
+	}
+	if binary.BigEndian.Uint16(frame[12:14]) != loopProbeEtherType || string(frame[14:18]) != loopProbeMagic {
+		return 0, nil, false
+	}
+	return mtypes.Vertex(binary.BigEndian.Uint16(frame[18:20])), frame[20:28], true
+}
+
+// handleLoopProbe consumes the loop probe read from the tap device. Returns false if it is not a probe.
+func (device *Device) handleLoopProbe(frame []byte) bool {
+	id, nonce, ok := isLoopProbe(frame)
+	if !ok {
+		return false
+	}
+	if id == device.ID {
+		if bytes.Equal(nonce, device.loopdetect.nonce) {
+			device.log.Errorf("Loop detected: received my own loop probe from the tap device, the LAN is looped back")
+		} else {
+			device.log.Errorf("Loop detected: received loop probe from another node with the same NodeID %v", id.ToString())
+		}
+		return true
+	}
+	device.addLoopEvidence("loop probe of node "+id.ToString()+" received from the tap device", newLoopPair(device.ID, id))
+	return true
+}
+
+func (device *Device) loopDetectOnMove(mac tap.MacAddress, from mtypes.Vertex, to mtypes.Vertex) {
+	conf := device.EdgeConfig.LoopDetect
+	if conf.MoveThreshold <= 0 {
+		return
+	}
+	now := time.Now()
+	pair := newLoopPair(from, to)
+	ld := &device.loopdetect
+	ld.Lock()
+	m, ok := ld.moves[pair]
+	if !ok || now.After(m.start.Add(mtypes.S2TD(conf.MoveWindow))) {
+		m = &loopMoves{start: now}
+		ld.moves[pair] = m
+	}
+	m.count += 1
+	hit := m.count >= conf.MoveThreshold
+	if hit {
+		delete(ld.moves, pair)
+	}
+	ld.Unlock()
+	if hit {
+		var pairs []loopPair
+		for _, id := range pair {
+			if id != device.ID {
+				pairs = append(pairs, newLoopPair(device.ID, id))
+			}
+		}
+		device.addLoopEvidence(fmt.Sprintf("%v MAC moves between node %v and %v", conf.MoveThreshold, from.ToString(), to.ToString()), pairs...)
+		select {
+		case ld.probe <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (device *Device) addLoopEvidence(reason string, pairs ...loopPair) {
+	ld := &device.loopdetect
+	for _, pair := range pairs {
+		ld.Lock()
+		_, existed := ld.pairs[pair]
+		ld.pairs[pair] = time.Now()
+		ld.Unlock()
+		if !existed {
+			device.log.Errorf("Loop detected between node %v and %v: %v", pair[0].ToString(), pair[1].ToString(), reason)
+		} else if device.LogLevel.LogInternal {
+			fmt.Printf("Internal: Loop between node %v and %v refreshed: %v\n", pair[0].ToString(), pair[1].ToString(), reason)
+		}
+	}
+	device.updateLoopState()
+}
+
+// loopSegment returns the nodes in the same looping segment with id, sorted by NodeID
+func loopSegment(pairs map[loopPair]time.Time, id mtypes.Vertex) []mtypes.Vertex {
+	seen := map[mtypes.Vertex]bool{id: true}
+	queue := []mtypes.Vertex{id}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for pair := range pairs {
+			for i, v := range pair {
+				if v == cur && !seen[pair[1-i]] {
+					seen[pair[1-i]] = true
+					queue = append(queue, pair[1-i])
+				}
+			}
+		}
+	}
+	ret := make([]mtypes.Vertex, 0, len(seen))
+	for v := range seen {
+		ret = append(ret, v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// updateLoopState expires old evidence and recalculates whether we are allowed to bridge broadcasts
+func (device *Device) updateLoopState() {
+	conf := device.EdgeConfig.LoopDetect
+	ld := &device.loopdetect
+	now := time.Now()
+	hold := loopHoldTime(conf)
+	ld.Lock()
+	for pair, t := range ld.pairs {
+		if now.After(t.Add(hold)) {
+			delete(ld.pairs, pair)
+			device.log.Verbosef("Loop between node %v and %v disappeared", pair[0].ToString(), pair[1].ToString())
+		}
+	}
+	segment := loopSegment(ld.pairs, device.ID)
+	ld.Unlock()
+	blocked := false
+	if len(segment) > 1 {
+		switch conf.Action {
+		case "block":
+			blocked = true
+		default:
+			blocked = segment[0] != device.ID
+		}
+	}
+	if ld.blocked.Swap(blocked) != blocked {
+		if blocked {
+			device.log.Errorf("Loop detected in segment %v, stop bridging broadcasts (Action: %v)", segment, conf.Action)
+		} else {
+			device.log.Errorf("Loop resolved, resume bridging broadcasts")
+		}
+	} else if device.LogLevel.LogInternal && len(segment) > 1 {
+		fmt.Printf("Internal: Loop segment %v, designated forwarder: %v, blocked: %v\n", segment, segment[0].ToString(), blocked)
+	}
+}
+
+func (device *Device) sendLoopProbe() {
+	buf := device.newLoopProbe()
+	_, err := device.tap.device.Write(buf, MessageTransportOffsetContent+path.EgHeaderLen)
+	if err != nil && !device.isClosed() {
+		device.log.Errorf("Failed to write loop probe to TUN device: %v", err)
+	}
+}
+
+func (device *Device) RoutineLoopDetect() {
+	conf := device.EdgeConfig.LoopDetect
+	if conf.ProbeInterval <= 0.01 {
+		return
+	}
+	ticker := time.NewTicker(mtypes.S2TD(conf.ProbeInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-device.closed:
+			return
+		case <-ticker.C:
+		case <-device.loopdetect.probe:
+		}
+		device.sendLoopProbe()
+		device.updateLoopState()
+	}
+}
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+func TestLoopSegment(t *testing.T) {
+	now := time.Now()
+	pairs := map[loopPair]time.Time{
+		newLoopPair(3, 1): now,
+		newLoopPair(3, 5): now,
+		newLoopPair(7, 8): now,
+	}
+	if seg := loopSegment(pairs, 5); !reflect.DeepEqual(seg, []mtypes.Vertex{1, 3, 5}) {
+		t.Errorf("loopSegment(5) = %v, want [1 3 5]", seg)
+	}
+	if seg := loopSegment(pairs, 2); !reflect.DeepEqual(seg, []mtypes.Vertex{2}) {
+		t.Errorf("loopSegment(2) = %v, want [2]", seg)
+	}
+}
+
+func TestLoopProbe(t *testing.T) {
+	device := &Device{ID: 4, EdgeConfig: &mtypes.EdgeConfig{}}
+	device.loopdetect.nonce = []byte("12345678")
+	buf := device.newLoopProbe()
+	frame := buf[len(buf)-loopProbeLen:]
+	id, nonce, ok := isLoopProbe(frame)
+	if !ok || id != 4 || string(nonce) != "12345678" {
+		t.Errorf("isLoopProbe = %v %q %v, want 4 \"12345678\" true", id, nonce, ok)
+	}
+	if _, _, ok := isLoopProbe(testFrame(0x0800)); ok {
+		t.Errorf("normal frame is recognized as loop probe")
+	}
+}
+
+func TestLoopMoves(t *testing.T) {
+	for _, tt := range []struct {
+		id      mtypes.Vertex
+		action  string
+		blocked bool
+	}{
+		{5, "elect", true},
+		{1, "elect", false},
+		{1, "block", true},
+	} {
+		device := &Device{ID: tt.id, EdgeConfig: &mtypes.EdgeConfig{}}
+		// HoldTime is not set, the evidence is kept for 3 ProbeInterval
+		device.EdgeConfig.LoopDetect = mtypes.LoopDetectInfo{UseLoopDetect: true, ProbeInterval: 5, MoveThreshold: 3, MoveWindow: 10, Action: tt.action}
+		device.log = NewLogger(LogLevelSilent, "")
+		device.l2fib = NewL2FIB(mtypes.L2FIBInfo{}, &device.LogLevel, device.log)
+		device.initLoopDetect()
+		mac := tap.MacAddress{0x02, 0, 0, 0, 0, 9}
+		for i := 0; i < 3; i++ {
+			device.loopDetectOnMove(mac, 2, 3)
+		}
+		device.updateLoopState()
+		if got := device.loopBlockBroadcast(); got != tt.blocked {
+			t.Errorf("node %v, Action %v: blocked:%v after MAC moves between node 2 and 3, want %v", tt.id, tt.action, got, tt.blocked)
+		}
+	}
+}
+
+func TestLoopHoldTime(t *testing.T) {
+	for _, tt := range []struct {
+		conf mtypes.LoopDetectInfo
+		hold time.Duration
+	}{
+		{mtypes.LoopDetectInfo{ProbeInterval: 5, HoldTime: 60}, 60 * time.Second},
+		{mtypes.LoopDetectInfo{ProbeInterval: 5}, 15 * time.Second},
+		{mtypes.LoopDetectInfo{ProbeInterval: 5, HoldTime: -1}, 15 * time.Second},
+		{mtypes.LoopDetectInfo{}, loopDefaultHoldTime * time.Second},
+	} {
+		if hold := loopHoldTime(tt.conf); hold != tt.hold {
+			t.Errorf("loopHoldTime(%+v) = %v, want %v", tt.conf, hold, tt.hold)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"golang.org/x/crypto/blake2s"
+)
+
+// NAT detection, like STUN.
+//
+// The edge sends a NatProbe from its listening socket to the reflector port of the supernode.
+// The reflector replies with the endpoint it observed and the endpoint observed by the supernode itself,
+// then replies again from another port. Both ways are tagged with the shared secret of the static keys
+// of the edge and the supernode, so the reflector only answers the edges, and the edge only trusts the supernode.
+// Different endpoints means the mapping depends on the destination(symmetric NAT),
+// and the reply from another port tells whether the filtering depends on the port.
+//
+// The supernode collects the results, and tells both sides of a pair to punch at the same moment.
+
+const (
+	NatProbeTimeout   = 2 * time.Second
+	NatDetectInterval = 10 * time.Minute
+	NatMaxPortDelta   = 16 // larger port allocation steps are considered random
+	NatProbeTagLen    = 16
+)
+
+func natProbeSignData(msg *mtypes.NatProbeMsg) []byte {
+	return []byte(fmt.Sprintf("EtherGuard NatProbe|%d|%d|%s|%s|%t", msg.Node_id, msg.Nonce, msg.Observed, msg.SuperObserved, msg.ChangedPort))
+}
+
+func (peer *Peer) natProbeTag(msg *mtypes.NatProbeMsg) []byte {
+	var sum [blake2s.Size]byte
+	peer.handshake.mutex.RLock()
+	HMAC1(&sum, peer.handshake.precomputedStaticStatic[:], natProbeSignData(msg))
+	peer.handshake.mutex.RUnlock()
+	return sum[:NatProbeTagLen]
+}
+
+// SignNatProbe sets the tag of msg, with the shared secret of us and the peer
+func (peer *Peer) SignNatProbe(msg *mtypes.NatProbeMsg) {
+	msg.Tag = peer.natProbeTag(msg)
+}
+
+// VerifyNatProbe checks the tag of msg sent by the peer
+func (peer *Peer) VerifyNatProbe(msg mtypes.NatProbeMsg) bool {
+	return hmac.Equal(msg.Tag, peer.natProbeTag(&msg))
+}
+
+func (device *Device) LookupPeerByID(id mtypes.Vertex) *Peer {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	return device.peers.IDMap[id]
+}
+
+func (device *Device) signalNatDetect() {
+	if device.event_natdetect == nil {
+		return
+	}
+	select {
+	case device.event_natdetect <- struct{}{}:
+	default:
+	}
+}
+
+// process_NatProbe handles the NatProbe replies from the reflector
+func (device *Device) process_NatProbe(packet []byte) {
+	if device.nat.replies == nil || len(packet) <= 2 {
+		return
+	}
+	content, err := mtypes.ParseNatProbeMsg(packet[2:])
+	if err != nil {
+		return
+	}
+	if device.LogLevel.LogControl {
+		fmt.Println("Control: Recv " + content.ToString())
+	}
+	select {
+	case device.nat.replies <- content:
+	default:
+	}
+}
+
+func NewNatProbePacket(content mtypes.NatProbeMsg) ([]byte, error) {
+	body, err := mtypes.GetByte(&content)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(path.NatProbe), 0}, body...), nil
+}
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClassifyNat classifies the NAT from the reply of the reflector, and whether the reply from another port arrived
+func ClassifyNat(localPort int, reply mtypes.NatProbeMsg, changedPort bool, isLocal func(net.IP) bool) (ret mtypes.NatInfo) {
+	ret.Observed = reply.Observed
+	ret.LocalPort = localPort
+	ret.Filtering = mtypes.NatFilteringPortDependent
+	if changedPort {
+		ret.Filtering = mtypes.NatFilteringOpen
+	}
+	host, portstr, err := net.SplitHostPort(reply.Observed)
+	if err != nil {
+		return
+	}
+	port, _ := strconv.Atoi(portstr)
+	if port == localPort && isLocal(net.ParseIP(host)) {
+		ret.Mapping = mtypes.NatMappingNone
+		return
+	}
+	_, superStr := conn.SplitScheme(reply.SuperObserved)
+	superHost, superPortStr, err := net.SplitHostPort(superStr)
+	if err != nil {
+		return
+	}
+	if reply.Observed == superStr {
+		ret.Mapping = mtypes.NatMappingIndependent
+		return
+	}
+	ret.Mapping = mtypes.NatMappingDependent
+	superPort, _ := strconv.Atoi(superPortStr)
+	if delta := port - superPort; superHost == host && delta != 0 && delta <= NatMaxPortDelta && delta >= -NatMaxPortDelta {
+		ret.PortDelta = delta
+	}
+	return
+}
+
+// DetectNat probes the reflector of the supernode super, and classifies the NAT in front of the listening socket
+func (device *Device) DetectNat(reflector string, super *Peer) (ret mtypes.NatInfo, err error) {
+	endpoint, err := device.net.bind.ParseEndpoint(reflector)
+	if err != nil {
+		return
+	}
+	var nonce [8]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return
+	}
+	content := mtypes.NatProbeMsg{
+		Node_id: device.ID,
+		Nonce:   binary.LittleEndian.Uint64(nonce[:]),
+	}
+	super.SignNatProbe(&content)
+	packet, err := NewNatProbePacket(content)
+	if err != nil {
+		return
+	}
+	send := func() {
+		device.net.RLock()
+		defer device.net.RUnlock()
+		if device.net.bind != nil {
+			if err := device.net.bind.Send(packet, endpoint); err != nil {
+				device.log.Verbosef("Failed to send NatProbe to %v: %v", reflector, err)
+			}
+		}
+	}
+	// drop the late replies of the last detection
+	for len(device.nat.replies) > 0 {
+		<-device.nat.replies
+	}
+	var reply *mtypes.NatProbeMsg
+	changedPort := false
+	ticker := time.NewTicker(NatProbeTimeout / 4)
+	defer ticker.Stop()
+	timeout := time.After(NatProbeTimeout)
+	send()
+WaitLoop:
+	for reply == nil || !changedPort {
+		select {
+		case r := <-device.nat.replies:
+			if r.Nonce != content.Nonce || !super.VerifyNatProbe(r) {
+				continue
+			}
+			if r.ChangedPort {
+				changedPort = true
+			} else {
+				reply = &r
+			}
+		case <-ticker.C:
+			if reply == nil {
+				send()
+			}
+		case <-timeout:
+			break WaitLoop
+		}
+	}
+	if reply == nil {
+		return ret, fmt.Errorf("no reply from the reflector %v", reflector)
+	}
+	device.net.RLock()
+	localPort := int(device.net.port)
+	device.net.RUnlock()
+	return ClassifyNat(localPort, *reply, changedPort, isLocalIP), nil
+}
+
+func (device *Device) GetNatReport() mtypes.NatReport {
+	device.nat.RLock()
+	defer device.nat.RUnlock()
+	return device.nat.report
+}
+
+// RoutineDetectNat detects the NAT every NatDetectInterval, after the supernode sent the reflector port, and after the network changed
+func (device *Device) RoutineDetectNat() {
+	if !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		return
+	}
+	if device.EdgeConfig.Obfuscation.Secret != "" {
+		// the reflector speaks plain UDP
+		return
+	}
+	for {
+		select {
+		case <-device.event_natdetect:
+		case <-time.After(NatDetectInterval):
+		}
+		port := device.SuperConfig.NatDetect.ReflectorPort
+		if port <= 0 {
+			continue
+		}
+		var report mtypes.NatReport
+		for _, it := range []struct {
+			endpoint string
+			pubkey   string
+			af       conn.EnabledAf
+			info     *mtypes.NatInfo
+		}{
+			{device.ActiveSuper().EndpointV4, device.EdgeConfig.DynamicRoute.SuperNode.PubKeyV4, conn.EnabledAf4, &report.V4},
+			{device.ActiveSuper().EndpointV6, device.EdgeConfig.DynamicRoute.SuperNode.PubKeyV6, conn.EnabledAf6, &report.V6},
+		} {
+			scheme, hostport := conn.SplitScheme(it.endpoint)
+			if hostport == "" || scheme != conn.SchemeUDP {
+				continue
+			}
+			super := device.LookupPeerByStr(it.pubkey)
+			if super == nil {
+				continue
+			}
+			host, _, err := net.SplitHostPort(hostport)
+			if err != nil {
+				continue
+			}
+			_, reflector, err := conn.LookupIP(net.JoinHostPort(host, strconv.Itoa(port)), it.af, 0)
+			if err != nil {
+				continue
+			}
+			info, err := device.DetectNat(reflector, super)
+			if err != nil {
+				device.log.Verbosef("NAT detection: %v", err)
+				continue
+			}
+			*it.info = info
+			if device.LogLevel.LogControl {
+				fmt.Printf("Control: NAT of %v: mapping:%v filtering:%v observed:%v delta:%v\n", reflector, info.Mapping, info.Filtering, info.Observed, info.PortDelta)
+			}
+		}
+		device.nat.Lock()
+		device.nat.report = report
+		device.nat.Unlock()
+		select {
+		case device.Chan_HttpPostStart <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// NatCandidates returns the endpoints to punch at, the observed one first, then the predicted ones
+func NatCandidates(n mtypes.NatInfo, predict int) []string {
+	host, portstr, err := net.SplitHostPort(n.Observed)
+	if err != nil {
+		return nil
+	}
+	ret := []string{n.Observed}
+	if n.Mapping != mtypes.NatMappingDependent {
+		return ret
+	}
+	port, _ := strconv.Atoi(portstr)
+	if n.LocalPort != 0 && n.LocalPort != port {
+		// port preserving NAT
+		ret = append(ret, net.JoinHostPort(host, strconv.Itoa(n.LocalPort)))
+	}
+	if n.PortDelta != 0 {
+		for k := 1; k <= predict; k++ {
+			p := port + n.PortDelta*k
+			if p <= 0 || p > 65535 {
+				break
+			}
+			ret = append(ret, net.JoinHostPort(host, strconv.Itoa(p)))
+		}
+	}
+	return ret
+}
+
+// PlanHolePunch plans the punch between a and b. toA are the endpoints of b which a should punch at, and vice versa.
+// If one side is reachable, only the other side punches. relay is true if they can't connect directly.
+func PlanHolePunch(a mtypes.NatInfo, b mtypes.NatInfo, predict int) (toA []string, toB []string, relay bool) {
+	if a.Mapping == "" || b.Mapping == "" {
+		return nil, nil, false
+	}
+	switch {
+	case b.Reachable():
+		return NatCandidates(b, 0), nil, false
+	case a.Reachable():
+		return nil, NatCandidates(a, 0), false
+	case a.Predictable() && b.Predictable():
+		return NatCandidates(b, predict), NatCandidates(a, predict), false
+	}
+	return nil, nil, true
+}
+
+// process_HolePunch punches at the endpoints of the peer at the time given by the supernode
+func (device *Device) process_HolePunch(params string) error {
+	var content mtypes.HolePunchMsg
+	if err := json.Unmarshal([]byte(params), &content); err != nil {
+		return err
+	}
+	device.peers.RLock()
+	peer, has := device.peers.IDMap[content.PeerID]
+	device.peers.RUnlock()
+	if !has || len(content.Endpoints) == 0 || peer.IsPeerAlive() {
+		return nil
+	}
+	go func() {
+		time.Sleep(content.Time.Sub(device.graph.GetCurrentTime()))
+		if peer.IsPeerAlive() {
+			return
+		}
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: Punch peer %v at %v\n", peer.ID.ToString(), content.Endpoints)
+		}
+		for _, url := range content.Endpoints {
+			peer.endpoint_trylist.UpdateP2P(url)
+		}
+		if err := peer.SetEndpointFromConnURL(content.Endpoints[0], device.enabledAf, device.EdgeConfig.AfPrefer, peer.StaticConn); err != nil {
+			device.log.Errorf("Bind " + content.Endpoints[0] + " failed!")
+			return
+		}
+		// the handshake initiation is copied to the other candidates
+		peer.endpoint_trylist.SetFanout(content.Endpoints[1:], time.Now().Add(mtypes.S2TD(device.EdgeConfig.DynamicRoute.ConnNextTry)))
+		device.SendPing(peer, int(device.EdgeConfig.DynamicRoute.ConnNextTry+1), 1, 1)
+	}()
+	return nil
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestClassifyNat(t *testing.T) {
+	local := func(ip net.IP) bool { return ip.Equal(net.ParseIP("192.0.2.1")) }
+	tests := []struct {
+		observed, super string
+		changedPort     bool
+		want            mtypes.NatInfo
+	}{
+		{"192.0.2.1:3001", "192.0.2.1:3001", true, mtypes.NatInfo{Mapping: mtypes.NatMappingNone, Filtering: mtypes.NatFilteringOpen}},
+		{"198.51.100.1:4000", "198.51.100.1:4000", false, mtypes.NatInfo{Mapping: mtypes.NatMappingIndependent, Filtering: mtypes.NatFilteringPortDependent}},
+		{"198.51.100.1:4002", "198.51.100.1:4001", false, mtypes.NatInfo{Mapping: mtypes.NatMappingDependent, Filtering: mtypes.NatFilteringPortDependent, PortDelta: 1}},
+		{"198.51.100.1:50000", "198.51.100.1:4001", false, mtypes.NatInfo{Mapping: mtypes.NatMappingDependent, Filtering: mtypes.NatFilteringPortDependent}},
+		{"198.51.100.1:4000", "", true, mtypes.NatInfo{Filtering: mtypes.NatFilteringOpen}},
+	}
+	for _, tt := range tests {
+		reply := mtypes.NatProbeMsg{Observed: tt.observed, SuperObserved: tt.super}
+		tt.want.Observed = tt.observed
+		tt.want.LocalPort = 3001
+		if got := ClassifyNat(3001, reply, tt.changedPort, local); got != tt.want {
+			t.Errorf("ClassifyNat(%v, %v) = %+v, want %+v", tt.observed, tt.super, got, tt.want)
+		}
+	}
+}
+
+func TestPlanHolePunch(t *testing.T) {
+	cone := mtypes.NatInfo{Mapping: mtypes.NatMappingIndependent, Filtering: mtypes.NatFilteringPortDependent, Observed: "198.51.100.1:4000", LocalPort: 3001}
+	open := mtypes.NatInfo{Mapping: mtypes.NatMappingIndependent, Filtering: mtypes.NatFilteringOpen, Observed: "198.51.100.2:4000", LocalPort: 3001}
+	sym := mtypes.NatInfo{Mapping: mtypes.NatMappingDependent, Filtering: mtypes.NatFilteringPortDependent, Observed: "198.51.100.3:4000", LocalPort: 3001, PortDelta: 2}
+	random := mtypes.NatInfo{Mapping: mtypes.NatMappingDependent, Filtering: mtypes.NatFilteringPortDependent, Observed: "198.51.100.4:4000", LocalPort: 3001}
+
+	if toA, toB, relay := PlanHolePunch(cone, open, 2); !reflect.DeepEqual(toA, []string{"198.51.100.2:4000"}) || toB != nil || relay {
+		t.Errorf("cone to open = %v %v %v, want only the cone side dials", toA, toB, relay)
+	}
+	want := []string{"198.51.100.3:4000", "198.51.100.3:3001", "198.51.100.3:4002", "198.51.100.3:4004"}
+	if toA, toB, relay := PlanHolePunch(cone, sym, 2); !reflect.DeepEqual(toA, want) || !reflect.DeepEqual(toB, []string{"198.51.100.1:4000"}) || relay {
+		t.Errorf("cone to symmetric = %v %v %v, want both punch with the predicted ports", toA, toB, relay)
+	}
+	if toA, toB, relay := PlanHolePunch(random, open, 2); len(toA) != 1 || toB != nil || relay {
+		t.Errorf("random to open = %v %v %v, want only the random side dials", toA, toB, relay)
+	}
+	if toA, toB, relay := PlanHolePunch(random, cone, 2); toA != nil || toB != nil || !relay {
+		t.Errorf("random to cone = %v %v %v, want relay", toA, toB, relay)
+	}
+	if toA, toB, relay := PlanHolePunch(mtypes.NatInfo{}, cone, 2); toA != nil || toB != nil || relay {
+		t.Errorf("unknown to cone = %v %v %v, want nothing", toA, toB, relay)
+	}
+}
+
+func TestNatProbeTag(t *testing.T) {
+	edge, super, other := newTestLANDevice(t, 1), newTestLANDevice(t, mtypes.NodeID_SuperNode), newTestLANDevice(t, 2)
+	superAtEdge := addTestLANPeer(edge, super)
+	edgeAtSuper := addTestLANPeer(super, edge)
+	edgeAtOther := addTestLANPeer(other, edge)
+
+	probe := mtypes.NatProbeMsg{Node_id: 1, Nonce: 42}
+	superAtEdge.SignNatProbe(&probe)
+	if len(probe.Tag) != NatProbeTagLen || !edgeAtSuper.VerifyNatProbe(probe) {
+		t.Fatalf("the supernode rejected the probe of the edge")
+	}
+	if edgeAtOther.VerifyNatProbe(probe) {
+		t.Errorf("another node verified the probe of the edge")
+	}
+	forged := probe
+	forged.Nonce = 43
+	if edgeAtSuper.VerifyNatProbe(forged) {
+		t.Errorf("the supernode verified a modified probe")
+	}
+	if edgeAtSuper.VerifyNatProbe(mtypes.NatProbeMsg{Node_id: 1, Nonce: 42}) {
+		t.Errorf("the supernode verified a probe without tag")
+	}
+
+	reply := probe
+	reply.Observed = "198.51.100.1:4000"
+	reply.SuperObserved = "198.51.100.1:4000"
+	edgeAtSuper.SignNatProbe(&reply)
+	if !superAtEdge.VerifyNatProbe(reply) {
+		t.Fatalf("the edge rejected the reply of the supernode")
+	}
+	reply.SuperObserved = "203.0.113.1:4000"
+	if superAtEdge.VerifyNatProbe(reply) {
+		t.Errorf("the edge verified a reply with a forged SuperObserved")
+	}
+}
@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Wait until the address and route changes settle before reconverging
+const NetworkChangeSettle = 300 * time.Millisecond
+
+// localIPTo returns the local IP which is used to reach the endpoint dst.
+// It dials UDP for all schemes because that only looks up the route, nothing is sent and no connection is made.
+func localIPTo(dst string) (net.IP, error) {
+	c, err := net.Dial("udp", conn.EndpointHostPort(dst))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func (device *Device) signalNetworkChange() {
+	select {
+	case device.event_netchange <- struct{}{}:
+	default:
+	}
+}
+
+// localIPSet returns the local IPs used to reach the endpoints of all peers, sorted and joined
+func (device *Device) localIPSet() (string, bool, bool) {
+	device.peers.RLock()
+	dsts := make([]string, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		if dst := peer.GetEndpointDstStr(); dst != "" {
+			dsts = append(dsts, dst)
+		}
+	}
+	device.peers.RUnlock()
+	ips := make(map[string]bool)
+	has4, has6 := false, false
+	for _, dst := range dsts {
+		IP, err := localIPTo(dst)
+		if err != nil {
+			continue
+		}
+		if IP.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
+		}
+		ips[IP.String()] = true
+	}
+	ret := make([]string, 0, len(ips))
+	for ip := range ips {
+		ret = append(ret, ip)
+	}
+	sort.Strings(ret)
+	return strings.Join(ret, ","), has4, has6
+}
+
+// ReconvergeNetwork is called after the local addresses changed.
+// It re-registers to the supernodes, posts the new local IPs and tries all endpoints again.
+func (device *Device) ReconvergeNetwork(rebind bool) {
+	if rebind {
+		if err := device.BindUpdate(); err != nil {
+			device.log.Errorf("Unable to update bind: %v", err)
+		}
+	}
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+	var LocalV4, LocalV6 net.IP
+	for _, peer := range peers {
+		peer.Lock()
+		if peer.endpoint != nil {
+			peer.endpoint.ClearSrc()
+			if peer.ID == mtypes.NodeID_SuperNode {
+				if IP, err := localIPTo(peer.endpoint.DstToString()); err == nil {
+					if ip4 := IP.To4(); ip4 != nil {
+						LocalV4 = ip4
+					} else {
+						LocalV6 = IP
+					}
+				}
+			}
+		}
+		peer.Unlock()
+		peer.endpoint_trylist.Reset()
+	}
+	device.peers.Lock()
+	device.peers.LocalV4 = LocalV4
+	device.peers.LocalV6 = LocalV6
+	device.peers.Unlock()
+
+	for _, startchan := range []chan struct{}{device.Chan_SendRegisterStart, device.Chan_HttpPostStart, device.Chan_SendPingStart} {
+		select {
+		case startchan <- struct{}{}:
+		default:
+		}
+	}
+	device.signalNatDetect()
+	if device.EdgeConfig.DynamicRoute.ProbeStagger > 0 {
+		for _, peer := range peers {
+			if peer.ID != mtypes.NodeID_SuperNode {
+				go device.ProbeEndpoints(peer)
+			}
+		}
+	} else {
+		select {
+		case device.event_tryendpoint <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// RoutineNetworkChange watches the changes of the local addresses and routes, and reconverges the mesh
+func (device *Device) RoutineNetworkChange() {
+	if !device.EdgeConfig.DynamicRoute.NetworkMonitor {
+		return
+	}
+	if err := device.startNetworkMonitor(); err != nil {
+		device.log.Errorf("Unable to start network monitor: %v", err)
+		return
+	}
+	last, has4, has6 := device.localIPSet()
+	for {
+		<-device.event_netchange
+		for settled := false; !settled; {
+			select {
+			case <-device.event_netchange:
+			case <-time.After(NetworkChangeSettle):
+				settled = true
+			}
+		}
+		current, now4, now6 := device.localIPSet()
+		if current == last {
+			continue
+		}
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: Network changed, local IP [%v] -> [%v]\n", last, current)
+		}
+		device.ReconvergeNetwork((now4 && !has4) || (now6 && !has6))
+		last, has4, has6 = current, now4, now6
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import "errors"
+
+func (device *Device) startNetworkMonitor() error {
+	return errors.New("network monitor is not supported on this platform")
+}
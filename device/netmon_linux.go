@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func (device *Device) startNetworkMonitor() error {
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	saddr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR | unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err = unix.Bind(sock, saddr); err != nil {
+		unix.Close(sock)
+		return err
+	}
+	go device.routineNetworkMonitor(sock)
+	return nil
+}
+
+func (device *Device) routineNetworkMonitor(sock int) {
+	defer unix.Close(sock)
+	for msg := make([]byte, 1<<16); ; {
+		msgn, _, _, _, err := unix.Recvmsg(sock, msg[:], nil, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.ENOBUFS {
+			// some messages are dropped, assume that something changed
+			device.signalNetworkChange()
+			continue
+		}
+		if err != nil {
+			device.log.Errorf("Network monitor stopped: %v", err)
+			return
+		}
+		for remain := msg[:msgn]; len(remain) >= unix.SizeofNlMsghdr; {
+			hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&remain[0]))
+			if hdr.Len < unix.SizeofNlMsghdr || uint(hdr.Len) > uint(len(remain)) {
+				break
+			}
+			switch hdr.Type {
+			case unix.RTM_NEWADDR, unix.RTM_DELADDR, unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+				device.signalNetworkChange()
+			}
+			remain = remain[(hdr.Len+unix.NLMSG_ALIGNTO-1)&^(unix.NLMSG_ALIGNTO-1):]
+		}
+	}
+}
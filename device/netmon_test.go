@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// brokenEndpoint has a destination string which can't be dialed
+type brokenEndpoint struct {
+	conn.Endpoint
+}
+
+func (e brokenEndpoint) DstToString() string {
+	return "ws://no-port/api/edge/ws"
+}
+
+func TestLocalIPTo(t *testing.T) {
+	for _, dst := range []string{
+		"127.0.0.1:3000",
+		"tcp://127.0.0.1:3000",
+		"tls://127.0.0.1:443#localhost",
+		"ws://127.0.0.1:3000/api/edge/ws",
+		"wss://127.0.0.1:443/api/edge/ws#localhost",
+	} {
+		IP, err := localIPTo(dst)
+		if err != nil {
+			t.Errorf("localIPTo(%v): %v", dst, err)
+			continue
+		}
+		if !IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("localIPTo(%v) = %v, want 127.0.0.1", dst, IP)
+		}
+	}
+}
+
+func TestSetEndpointFromPacketSuper(t *testing.T) {
+	device := &Device{EdgeConfig: &mtypes.EdgeConfig{}}
+	peer := &Peer{device: device, ID: mtypes.NodeID_SuperNode}
+	ep, err := conn.NewStreamBind(conn.StreamConf{}, conn.EnabledAf4).ParseEndpoint("ws://127.0.0.1:3000/api/edge/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SetEndpointFromPacket(ep)
+	if peer.endpoint != ep {
+		t.Fatalf("endpoint = %v, want %v", peer.endpoint, ep.DstToString())
+	}
+	if !device.peers.LocalV4.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("LocalV4 = %v, want 127.0.0.1", device.peers.LocalV4)
+	}
+
+	// the endpoint is set even if the local IP is unknown
+	broken := brokenEndpoint{ep}
+	peer.SetEndpointFromPacket(broken)
+	if peer.endpoint != broken {
+		t.Fatalf("endpoint = %v, want the endpoint of the packet", peer.endpoint.DstToString())
+	}
+}
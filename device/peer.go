@@ -11,7 +11,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -25,9 +24,13 @@ import (
 const AfPerferVal = 10000
 
 type endpoint_tryitem struct {
-	URL      string
-	lastTry  time.Time
-	firstTry time.Time
+	URL       string
+	lastTry   time.Time
+	firstTry  time.Time
+	dst       string    // resolved endpoint, to match the probe replies
+	af        string    // udp4 or udp6
+	latency   float64   // latency of the last probe reply
+	lastReply time.Time // time of the last probe reply
 }
 
 type endpoint_trylist struct {
@@ -37,6 +40,10 @@ type endpoint_trylist struct {
 	peer         *Peer
 	trymap_super map[string]*endpoint_tryitem
 	trymap_p2p   map[string]*endpoint_tryitem
+
+	probing     AtomicBool
+	fanout      []string  // candidates which get a copy of the handshake initiation
+	fanoutUntil time.Time // the fanout is active until then
 }
 
 func NewEndpoint_trylist(peer *Peer, timeout time.Duration, enabledAf conn.EnabledAf) *endpoint_trylist {
@@ -62,7 +69,7 @@ func (et *endpoint_trylist) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool
 		if url == "" {
 			continue
 		}
-		addr, _, err := conn.LookupIP(url, et.enabledAf, AfPerfer)
+		addr, connIP, err := conn.LookupIP(url, et.enabledAf, AfPerfer)
 		switch AfPerfer {
 		case 4:
 			if addr == "udp4" {
@@ -83,6 +90,7 @@ func (et *endpoint_trylist) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool
 			if et.peer.device.LogLevel.LogInternal {
 				fmt.Printf("Internal: Peer %v : Update trylist(super) %v\n", et.peer.ID.ToString(), url)
 			}
+			val.dst, val.af = connIP, addr
 			newmap_super[url] = val
 		} else {
 			if et.peer.device.LogLevel.LogInternal {
@@ -92,6 +100,9 @@ func (et *endpoint_trylist) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool
 				URL:      url,
 				lastTry:  time.Time{}.Add(mtypes.S2TD(AfPerferVal)).Add(mtypes.S2TD(it)),
 				firstTry: time.Time{},
+				dst:      connIP,
+				af:       addr,
+				latency:  mtypes.Infinity,
 			}
 		}
 	}
@@ -99,7 +110,7 @@ func (et *endpoint_trylist) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool
 }
 
 func (et *endpoint_trylist) UpdateP2P(url string) {
-	_, _, err := conn.LookupIP(url, et.enabledAf, 0)
+	addr, connIP, err := conn.LookupIP(url, et.enabledAf, 0)
 	if err != nil {
 		return
 	}
@@ -113,10 +124,40 @@ func (et *endpoint_trylist) UpdateP2P(url string) {
 			URL:      url,
 			lastTry:  time.Now(),
 			firstTry: time.Time{},
+			dst:      connIP,
+			af:       addr,
+			latency:  mtypes.Infinity,
 		}
 	}
 }
 
+// UpdateLAN adds an endpoint found on the LAN. It's tried before all other candidates,
+// and kept as long as the beacons of the peer arrive.
+func (et *endpoint_trylist) UpdateLAN(url string) (isNew bool) {
+	addr, connIP, err := conn.LookupIP(url, et.enabledAf, 0)
+	if err != nil {
+		return false
+	}
+	et.Lock()
+	defer et.Unlock()
+	if val, ok := et.trymap_p2p[url]; ok {
+		val.firstTry = time.Time{}
+		return false
+	}
+	if et.peer.device.LogLevel.LogInternal {
+		fmt.Printf("Internal: Peer %v : Add trylist(lan) %v\n", et.peer.ID.ToString(), url)
+	}
+	et.trymap_p2p[url] = &endpoint_tryitem{
+		URL:      url,
+		lastTry:  time.Time{},
+		firstTry: time.Time{},
+		dst:      connIP,
+		af:       addr,
+		latency:  mtypes.Infinity,
+	}
+	return true
+}
+
 func (et *endpoint_trylist) Delete(url string) {
 	et.Lock()
 	defer et.Unlock()
@@ -124,6 +165,20 @@ func (et *endpoint_trylist) Delete(url string) {
 	delete(et.trymap_p2p, url)
 }
 
+// Reset forgets the try history, so that all candidates are tried again from now on
+func (et *endpoint_trylist) Reset() {
+	et.Lock()
+	defer et.Unlock()
+	for _, trymap := range []map[string]*endpoint_tryitem{et.trymap_super, et.trymap_p2p} {
+		for _, v := range trymap {
+			v.firstTry = time.Time{}
+			v.lastTry = time.Time{}
+			v.latency = mtypes.Infinity
+			v.lastReply = time.Time{}
+		}
+	}
+}
+
 func (et *endpoint_trylist) GetNextTry() (bool, string) {
 	et.RLock()
 	defer et.RUnlock()
@@ -245,6 +300,7 @@ type Peer struct {
 	device           *Device
 	endpoint         conn.Endpoint
 	endpoint_trylist *endpoint_trylist
+	bond             *bond // nil if bonding is disabled
 
 	LastPacketReceivedAdd1Sec atomic.Value // *time.Time
 
@@ -257,6 +313,7 @@ type Peer struct {
 	StaticConn       bool //if true, this peer will not write to config file when roaming, and the endpoint will be reset periodically
 	ConnURL          string
 	ConnAF           conn.EnabledAf
+	resolve          peerResolve
 
 	// These fields are accessed with atomic operations, which must be
 	// 64-bit aligned even on 32-bit platforms. Go guarantees that an
@@ -287,6 +344,8 @@ type Peer struct {
 	}
 
 	queue struct {
+		sync.Mutex // serializes the draining of staged, so the nonce order matches the outbound order
+
 		staged   chan *QueueOutboundElement // staged packets before a handshake is available
 		outbound *autodrainingOutboundQueue // sequential ordering of udp transmission
 		inbound  *autodrainingInboundQueue  // sequential ordering of tun writing
@@ -341,6 +400,9 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
 	peer.endpoint_trylist = NewEndpoint_trylist(peer, mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout), device.enabledAf)
+	if !isSuper && !device.IsSuperNode {
+		peer.bond = newBond(device)
+	}
 	peer.SingleWayLatency.device = device
 	peer.SingleWayLatency.Push(mtypes.Infinity)
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
@@ -413,13 +475,72 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 		return errors.New("no known endpoint for peer")
 	}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+	var err error
+	if peer.bond != nil {
+		err = peer.bond.send(peer.device.net.bind, peer.endpoint, [][]byte{buffer})
+	} else {
+		err = peer.device.net.bind.Send(buffer, peer.endpoint)
+	}
+	if err == nil {
+		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+	}
+	return err
+}
+
+// SendBufferTo sends the buffer to the given endpoint instead of the endpoint of the peer
+func (peer *Peer) SendBufferTo(buffer []byte, endpoint conn.Endpoint) error {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	if peer.device.isClosed() {
+		return nil
+	}
+
+	err := peer.device.net.bind.Send(buffer, endpoint)
 	if err == nil {
 		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
 	}
 	return err
 }
 
+// SendBuffers sends the buffers to the endpoint of the peer, in one batch if supported by the bind
+func (peer *Peer) SendBuffers(buffers [][]byte) error {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	if peer.device.isClosed() {
+		return nil
+	}
+
+	peer.RLock()
+	defer peer.RUnlock()
+
+	if peer.endpoint == nil {
+		return errors.New("no known endpoint for peer")
+	}
+
+	var err error
+	if peer.bond != nil {
+		err = peer.bond.send(peer.device.net.bind, peer.endpoint, buffers)
+	} else if bb, ok := peer.device.net.bind.(conn.BatchBind); ok {
+		err = bb.SendBatch(buffers, peer.endpoint)
+	} else {
+		for _, buffer := range buffers {
+			if err = peer.device.net.bind.Send(buffer, peer.endpoint); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		var txBytes uint64
+		for _, buffer := range buffers {
+			txBytes += uint64(len(buffer))
+		}
+		atomic.AddUint64(&peer.stats.txBytes, txBytes)
+	}
+	return err
+}
+
 func (peer *Peer) String() string {
 	// The awful goo that follows is identical to:
 	//
@@ -568,6 +689,7 @@ func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_p
 	if err != nil {
 		return err
 	}
+	peer.trackHostname(connurl, af, af_perfer, connIP)
 	if peer.GetEndpointDstStr() == connIP {
 		//if peer.device.LogLevel.LogInternal {
 		//	fmt.Printf("Internal: Same as original endpoint:%v, skip for NodeID:%v\n", connurl, peer.ID.ToString())
@@ -589,24 +711,21 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	if peer.disableRoaming {
 		return
 	}
+	if peer.bond != nil && peer.bond.isSecondary(endpoint) {
+		return
+	}
 	peer.Lock()
 	defer peer.Unlock()
 	if peer.ID == mtypes.NodeID_SuperNode {
-		conn, err := net.Dial("udp", endpoint.DstToString())
-		if err != nil {
+		// the local IP is only reported to the supernode, the endpoint is set anyway
+		if IP, err := localIPTo(endpoint.DstToString()); err != nil {
 			if peer.device.LogLevel.LogControl {
-				fmt.Printf("Control: Set endpoint to peer %v failed: %v", peer.ID, err)
-			}
-			return
-		}
-		defer conn.Close()
-		if err == nil {
-			IP := conn.LocalAddr().(*net.UDPAddr).IP
-			if ip4 := IP.To4(); ip4 != nil {
-				peer.device.peers.LocalV4 = ip4
-			} else {
-				peer.device.peers.LocalV6 = IP
+				fmt.Printf("Control: Unable to get the local IP to peer %v: %v\n", peer.ID, err)
 			}
+		} else if ip4 := IP.To4(); ip4 != nil {
+			peer.device.peers.LocalV4 = ip4
+		} else {
+			peer.device.peers.LocalV6 = IP
 		}
 	}
 	peer.device.SaveToConfig(peer, endpoint)
@@ -0,0 +1,256 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Probing all endpoint candidates of a peer at the same time, like happy eyeballs.
+//
+// The handshake initiation is copied to every candidate, the responder answers the first copy it received,
+// so the fastest path sets the endpoint. Then every candidate gets a probe ping, which is echoed on the same path,
+// and the candidate with the best round trip time is kept.
+
+const (
+	AfPerferLatency     = 0.05  // latency penalty of the non-preferred address family (sec)
+	EndpointSwitchDelta = 0.005 // switch to a better endpoint only if it's better than this (sec)
+)
+
+// GetProbeList returns the candidates in the order of GetNextTry
+func (et *endpoint_trylist) GetProbeList() []endpoint_tryitem {
+	et.Lock()
+	defer et.Unlock()
+	ret := make([]endpoint_tryitem, 0, len(et.trymap_super)+len(et.trymap_p2p))
+	for _, v := range et.trymap_super {
+		ret = append(ret, *v)
+	}
+	for url, v := range et.trymap_p2p {
+		if v.firstTry.After(time.Time{}) && v.firstTry.Add(et.timeout).Before(time.Now()) {
+			if et.peer.device.LogLevel.LogInternal {
+				fmt.Printf("Internal: Peer %v : Delete trylist(p2p) %v\n", et.peer.ID.ToString(), url)
+			}
+			delete(et.trymap_p2p, url)
+			continue
+		}
+		if !v.firstTry.After(time.Time{}) {
+			v.firstTry = time.Now()
+		}
+		ret = append(ret, *v)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].lastTry.Before(ret[j].lastTry)
+	})
+	return ret
+}
+
+// Observe records the round trip time of a probe echoed from src
+func (et *endpoint_trylist) Observe(src string, latency float64) {
+	et.Lock()
+	defer et.Unlock()
+	for _, trymap := range []map[string]*endpoint_tryitem{et.trymap_super, et.trymap_p2p} {
+		for _, v := range trymap {
+			if v.dst == src {
+				v.latency = latency
+				v.lastReply = time.Now()
+			}
+		}
+	}
+}
+
+func (et *endpoint_trylist) score(v *endpoint_tryitem, AfPerfer int) float64 {
+	score := v.latency
+	if (AfPerfer == 4 && v.af != "udp4") || (AfPerfer == 6 && v.af != "udp6") {
+		score += AfPerferLatency
+	}
+	return score
+}
+
+// GetBest returns the candidate with the best score which replied after since, and the score of the current endpoint
+func (et *endpoint_trylist) GetBest(since time.Time, current string, AfPerfer int) (best string, bestScore float64, currentScore float64) {
+	et.RLock()
+	defer et.RUnlock()
+	bestScore, currentScore = mtypes.Infinity, mtypes.Infinity
+	for _, trymap := range []map[string]*endpoint_tryitem{et.trymap_super, et.trymap_p2p} {
+		for _, v := range trymap {
+			if v.lastReply.Before(since) {
+				continue
+			}
+			score := et.score(v, AfPerfer)
+			if v.dst == current && score < currentScore {
+				currentScore = score
+			}
+			if score < bestScore {
+				best, bestScore = v.URL, score
+			}
+		}
+	}
+	return
+}
+
+func (et *endpoint_trylist) SetFanout(dsts []string, until time.Time) {
+	et.Lock()
+	defer et.Unlock()
+	et.fanout = dsts
+	et.fanoutUntil = until
+}
+
+// FanoutHandshake sends a copy of the handshake initiation to other candidates, staggered by ProbeStagger.
+// It stops once a new keypair is established.
+func (et *endpoint_trylist) FanoutHandshake(packet []byte) {
+	et.RLock()
+	dsts := et.fanout
+	active := time.Now().Before(et.fanoutUntil)
+	et.RUnlock()
+	if !active || len(dsts) == 0 {
+		return
+	}
+	peer := et.peer
+	device := peer.device
+	stagger := mtypes.S2TD(device.EdgeConfig.DynamicRoute.ProbeStagger)
+	packet = append([]byte(nil), packet...)
+	sent := time.Now()
+	go func() {
+		for _, dst := range dsts {
+			time.Sleep(stagger)
+			if keypair := peer.keypairs.Current(); keypair != nil && keypair.created.After(sent) {
+				return
+			}
+			if dst == peer.GetEndpointDstStr() {
+				continue
+			}
+			endpoint, err := device.net.bind.ParseEndpoint(dst)
+			if err != nil {
+				continue
+			}
+			if device.LogLevel.LogInternal {
+				fmt.Printf("Internal: Peer %v : Send handshake initiation copy to %v\n", peer.ID.ToString(), dst)
+			}
+			peer.SendBufferTo(packet, endpoint)
+		}
+	}()
+}
+
+// SendPingTo sends a probe to the endpoint dst of the peer, which is echoed on the same path
+func (device *Device) SendPingTo(peer *Peer, dst string) error {
+	endpoint, err := device.net.bind.ParseEndpoint(dst)
+	if err != nil {
+		return err
+	}
+	packet, usage, ttl, err := device.newPingPacket(mtypes.PingMsg{
+		Src_nodeID: device.ID,
+		Time:       device.graph.GetCurrentTime(),
+		Probe:      true,
+	})
+	if err != nil {
+		return err
+	}
+	device.SendPacketTo(peer, endpoint, usage, ttl, packet, MessageTransportOffsetContent)
+	return nil
+}
+
+// isProbePacket reports whether the packet is a probe ping or its echo.
+// They are sent on the candidate paths, so they don't change the endpoint of the peer.
+func isProbePacket(usage path.Usage, packet []byte) bool {
+	if usage != path.PingPacket || len(packet) <= path.EgHeaderLen {
+		return false
+	}
+	content, err := mtypes.ParsePingMsg(packet[path.EgHeaderLen:])
+	return err == nil && (content.Probe || content.Echo)
+}
+
+// ProbeEndpoints probes all candidates of the peer, and switches to the best one.
+// It waits ConnNextTry seconds after the last probe for the replies.
+func (device *Device) ProbeEndpoints(peer *Peer) {
+	et := peer.endpoint_trylist
+	if et.probing.Swap(true) {
+		return
+	}
+	defer et.probing.Set(false)
+	items := et.GetProbeList()
+	alive := peer.IsPeerAlive()
+	if len(items) == 0 || (alive && len(items) == 1) {
+		return
+	}
+	AfPerfer := device.EdgeConfig.AfPrefer
+	stagger := mtypes.S2TD(device.EdgeConfig.DynamicRoute.ProbeStagger)
+	wait := mtypes.S2TD(device.EdgeConfig.DynamicRoute.ConnNextTry)
+	start := time.Now()
+	if !alive {
+		// the handshake goes to the first candidate, and copied to the others
+		if err := peer.SetEndpointFromConnURL(items[0].URL, device.enabledAf, AfPerfer, peer.StaticConn); err != nil {
+			device.log.Errorf("Bind " + items[0].URL + " failed!")
+			peer.endpoint_trylist.Delete(items[0].URL)
+			return
+		}
+		dsts := make([]string, 0, len(items)-1)
+		for _, it := range items[1:] {
+			dsts = append(dsts, it.dst)
+		}
+		et.SetFanout(dsts, start.Add(stagger*time.Duration(len(items))+wait))
+		defer et.SetFanout(nil, time.Time{})
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Probe %v endpoints of peer %v alive:%v\n", len(items), peer.ID.ToString(), alive)
+	}
+	for i, it := range items {
+		if i > 0 {
+			time.Sleep(stagger)
+		}
+		if err := device.SendPingTo(peer, it.dst); err != nil {
+			device.log.Verbosef("%v - Failed to probe %v: %v", peer, it.URL, err)
+		}
+	}
+	time.Sleep(wait)
+
+	current := peer.GetEndpointDstStr()
+	best, bestScore, currentScore := et.GetBest(start, current, AfPerfer)
+	if best == "" {
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: Probe peer %v: no reply\n", peer.ID.ToString())
+		}
+		return
+	}
+	if bestScore+EndpointSwitchDelta >= currentScore {
+		return
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Probe peer %v: switch to %v, score %.4f (was %.4f)\n", peer.ID.ToString(), best, bestScore, currentScore)
+	}
+	if err := peer.SetEndpointFromConnURL(best, device.enabledAf, AfPerfer, peer.StaticConn); err != nil {
+		device.log.Errorf("Bind " + best + " failed!")
+	}
+}
+
+// RoutineProbeEndpoints re-evaluates the endpoints of the connected peers every ProbeInterval seconds
+func (device *Device) RoutineProbeEndpoints() {
+	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+		return
+	}
+	if device.EdgeConfig.DynamicRoute.ProbeStagger <= 0 || device.EdgeConfig.DynamicRoute.ProbeInterval <= 0 {
+		return
+	}
+	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.ProbeInterval)
+	for {
+		time.Sleep(timeout)
+		device.peers.RLock()
+		peers := make([]*Peer, 0, len(device.peers.IDMap))
+		for _, peer := range device.peers.IDMap {
+			peers = append(peers, peer)
+		}
+		device.peers.RUnlock()
+		for _, peer := range peers {
+			if peer.IsPeerAlive() {
+				go device.ProbeEndpoints(peer)
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestProbeBest(t *testing.T) {
+	device := &Device{EdgeConfig: &mtypes.EdgeConfig{}}
+	peer := &Peer{device: device}
+	et := NewEndpoint_trylist(peer, time.Minute, conn.EnabledAf46)
+	et.UpdateSuper(mtypes.API_connurl{
+		ExternalV4: map[string]float64{"192.0.2.1:3001": 0},
+		ExternalV6: map[string]float64{"[2001:db8::1]:3001": 0},
+	}, false, 6)
+	et.UpdateP2P("198.51.100.1:3001")
+	if items := et.GetProbeList(); len(items) != 3 || items[0].URL != "[2001:db8::1]:3001" {
+		t.Fatalf("GetProbeList() = %v, want 3 items with the preferred af first", items)
+	}
+
+	start := time.Now()
+	et.Observe("192.0.2.1:3001", 0.03)
+	et.Observe("[2001:db8::1]:3001", 0.07)
+	best, _, current := et.GetBest(start, "[2001:db8::1]:3001", 6)
+	if best != "[2001:db8::1]:3001" || current != 0.07 {
+		t.Errorf("GetBest() = %v %v, want the preferred af within AfPerferLatency", best, current)
+	}
+	et.Observe("198.51.100.1:3001", 0.001)
+	if best, score, _ := et.GetBest(start, "", 6); best != "198.51.100.1:3001" || score < AfPerferLatency {
+		t.Errorf("GetBest() = %v %v, want 198.51.100.1:3001 with the penalty", best, score)
+	}
+	if best, _, _ := et.GetBest(time.Now().Add(time.Second), "", 6); best != "" {
+		t.Errorf("GetBest() = %v, want no reply after since", best)
+	}
+}
+
+func TestTrylistReset(t *testing.T) {
+	device := &Device{EdgeConfig: &mtypes.EdgeConfig{}}
+	peer := &Peer{device: device}
+	et := NewEndpoint_trylist(peer, time.Minute, conn.EnabledAf46)
+	et.UpdateP2P("198.51.100.1:3001")
+	et.GetNextTry()
+	et.Observe("198.51.100.1:3001", 0.01)
+	et.Reset()
+	if best, _, _ := et.GetBest(time.Time{}.Add(time.Nanosecond), "", 4); best != "" {
+		t.Errorf("GetBest() = %v after Reset(), want no reply", best)
+	}
+	if items := et.GetProbeList(); len(items) != 1 || !items[0].lastTry.IsZero() {
+		t.Errorf("GetProbeList() = %v after Reset(), want the candidate untried", items)
+	}
+}
+
+func TestProbeEcho(t *testing.T) {
+	graph, err := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &Device{EdgeConfig: &mtypes.EdgeConfig{}, SuperConfig: &mtypes.SuperConfig{}, graph: graph, ID: 1}
+	device.PopulatePools()
+	peer := &Peer{device: device, ID: 2}
+	peer.isRunning.Set(true)
+	peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
+	peer.SingleWayLatency.device = device
+	peer.endpoint_trylist = NewEndpoint_trylist(peer, time.Minute, conn.EnabledAf4)
+	peer.endpoint_trylist.UpdateP2P("127.0.0.1:3001")
+	// the current endpoint of the peer is another path
+	peer.endpoint = bindtest.ChannelEndpoint(3002)
+	src := bindtest.ChannelEndpoint(3001)
+
+	// the probe of the peer is echoed on the path it came from
+	probe := mtypes.PingMsg{Src_nodeID: 2, Time: time.Now().Add(-time.Second), Probe: true}
+	if err := device.process_ping(peer, src, probe); err != nil {
+		t.Fatal(err)
+	}
+	var elem *QueueOutboundElement
+	select {
+	case elem = <-peer.queue.staged:
+	default:
+		t.Fatal("no echo of the probe")
+	}
+	if elem.endpoint != src {
+		t.Fatalf("echo sent to %v, want %v", elem.endpoint, src.DstToString())
+	}
+	echo, err := mtypes.ParsePingMsg(elem.packet[path.EgHeaderLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !echo.Echo || echo.Probe || echo.Src_nodeID != 2 || !echo.Time.Equal(probe.Time) {
+		t.Fatalf("echo = %v, want the probe with Echo set", echo.ToString())
+	}
+	if peer.SingleWayLatency.value != 0 || len(peer.queue.staged) != 0 {
+		t.Fatal("the probe was handled as a normal ping")
+	}
+	// a normal ping is not echoed
+	if err := device.process_ping(peer, src, mtypes.PingMsg{Src_nodeID: 2, Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if len(peer.queue.staged) != 0 {
+		t.Fatal("a normal ping was echoed")
+	}
+
+	// our own echo gives the round trip time, from our own clock
+	start := time.Now()
+	sent := device.graph.GetCurrentTime().Add(-50 * time.Millisecond)
+	if err := device.process_ping(peer, src, mtypes.PingMsg{Src_nodeID: 1, Time: sent, Echo: true}); err != nil {
+		t.Fatal(err)
+	}
+	best, score, _ := peer.endpoint_trylist.GetBest(start, "", 4)
+	if best != "127.0.0.1:3001" || score < 0.05 || score > 0.5 {
+		t.Fatalf("GetBest() = %v %v, want 127.0.0.1:3001 with the round trip time", best, score)
+	}
+	if len(peer.queue.staged) != 0 {
+		t.Fatal("an echo was echoed")
+	}
+}
+
+func TestProbeNoRoaming(t *testing.T) {
+	graph, err := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := &flushTap{}
+	device := &Device{EdgeConfig: &mtypes.EdgeConfig{}, SuperConfig: &mtypes.SuperConfig{}, graph: graph, ID: 1}
+	device.EdgeConfig.Interface.MTU = 1416
+	device.log = NewLogger(LogLevelSilent, "")
+	device.l2fib = NewL2FIB(mtypes.L2FIBInfo{}, &device.LogLevel, device.log)
+	device.tap.device = tt
+	device.PopulatePools()
+	peer := &Peer{device: device, ID: 2}
+	peer.isRunning.Set(true)
+	peer.queue.inbound = &autodrainingInboundQueue{c: make(chan *QueueInboundElement, QueueInboundSize)}
+	peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
+	peer.LastPacketReceivedAdd1Sec.Store(&time.Time{})
+	peer.SingleWayLatency.device = device
+	peer.endpoint_trylist = NewEndpoint_trylist(peer, time.Minute, conn.EnabledAf4)
+	current := bindtest.ChannelEndpoint(3002)
+	peer.endpoint = current
+	src := bindtest.ChannelEndpoint(3001)
+
+	peer.stopping.Add(1)
+	go peer.RoutineSequentialReceiver()
+	defer func() {
+		peer.queue.inbound.c <- nil
+		peer.stopping.Wait()
+	}()
+	receive := func(counter uint64, usage path.Usage, packet []byte) {
+		header, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+		header.SetSrc(2)
+		header.SetDst(1)
+		elem := newTestInbound(device, counter, packet)
+		elem.Type = usage
+		elem.endpoint = src
+		peer.queue.inbound.c <- elem
+	}
+	endpoint := func() conn.Endpoint {
+		peer.RLock()
+		defer peer.RUnlock()
+		return peer.endpoint
+	}
+
+	// a probe and an echo on a non-current path are answered, but don't switch the endpoint
+	for i, content := range []mtypes.PingMsg{
+		{Src_nodeID: 2, Time: time.Now(), Probe: true},
+		{Src_nodeID: 1, Time: time.Now(), Echo: true},
+	} {
+		packet, usage, _, err := device.newPingPacket(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(uint64(i), usage, packet)
+	}
+	select {
+	case elem := <-peer.queue.staged:
+		if elem.endpoint != src {
+			t.Fatalf("echo sent to %v, want %v", elem.endpoint, src.DstToString())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no echo of the probe")
+	}
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if best, _, _ := peer.endpoint_trylist.GetBest(time.Time{}.Add(time.Nanosecond), "", 4); best != "" {
+			break
+		}
+	}
+	if ep := endpoint(); ep != current {
+		t.Fatalf("endpoint = %v after a probe, want %v", ep.DstToString(), current.DstToString())
+	}
+
+	// a data packet on that path roams
+	frame := make([]byte, path.EgHeaderLen+60)
+	copy(frame[path.EgHeaderLen:], testFrame(0x0800))
+	receive(2, path.NormalPacket, frame)
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if endpoint() == src {
+			return
+		}
+	}
+	t.Errorf("endpoint = %v after a data packet, want %v", endpoint().DstToString(), src.DstToString())
+}
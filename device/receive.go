@@ -17,8 +17,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"golang.org/x/crypto/chacha20poly1305"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
@@ -76,8 +74,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
  * Every time the bind is updated a new routine is started for
  * IPv4 and IPv6 (separately)
  */
-func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
-	recvName := recv.PrettyName()
+func (device *Device) RoutineReceiveIncoming(recvName string, recv conn.BatchReceiveFunc) {
 	defer func() {
 		device.log.Verbosef("Routine: receive incoming %s - stopped", recvName)
 		device.queue.decryption.wg.Done()
@@ -89,20 +86,31 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 
 	// receive datagrams until conn is closed
 
-	buffer := device.GetMessageBuffer()
+	batchSize := device.BatchSize()
+	buffers := make([]*[MaxMessageSize]byte, batchSize)
+	bufs := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+	endpoints := make([]conn.Endpoint, batchSize)
+	for i := range buffers {
+		buffers[i] = device.GetMessageBuffer()
+		bufs[i] = buffers[i][:]
+	}
+	defer func() {
+		for _, buffer := range buffers {
+			device.PutMessageBuffer(buffer)
+		}
+	}()
 
 	var (
 		err         error
-		size        int
-		endpoint    conn.Endpoint
+		count       int
 		deathSpiral int
 	)
 
 	for {
-		size, endpoint, err = recv(buffer[:])
+		count, err = recv(bufs, sizes, endpoints)
 
 		if err != nil {
-			device.PutMessageBuffer(buffer)
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
@@ -113,106 +121,117 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			if deathSpiral < 10 {
 				deathSpiral++
 				time.Sleep(time.Second / 3)
-				buffer = device.GetMessageBuffer()
 				continue
 			}
 			return
 		}
 		deathSpiral = 0
 
-		if size < MinMessageSize {
-			continue
-		}
+		for i := 0; i < count; i++ {
+			size := sizes[i]
+			endpoint := endpoints[i]
+			endpoints[i] = nil
+			if size < MinMessageSize {
+				continue
+			}
 
-		// check size of packet
+			// check size of packet
 
-		packet := buffer[:size]
-		msgType := path.Usage(packet[0])
-		msgTTL := uint8(packet[1])
-		msgType_wg := msgType
-		if msgType >= path.MessageTransportType {
-			msgType_wg = path.MessageTransportType
-		}
+			buffer := buffers[i]
+			packet := buffer[:size]
+			msgType := path.Usage(packet[0])
+			msgTTL := uint8(packet[1])
+			if msgType == path.NatProbe {
+				device.process_NatProbe(packet)
+				continue
+			}
+			msgType_wg := msgType
+			if msgType >= path.MessageTransportType {
+				msgType_wg = path.MessageTransportType
+			}
 
-		var okay bool
+			var okay bool
 
-		switch msgType_wg {
+			switch msgType_wg {
 
-		// check if transport
+			// check if transport
 
-		case path.MessageTransportType:
+			case path.MessageTransportType:
 
-			// check size
+				// check size
 
-			if len(packet) < MessageTransportSize {
-				continue
-			}
+				if len(packet) < MessageTransportSize {
+					continue
+				}
 
-			// lookup key pair
+				// lookup key pair
 
-			receiver := binary.LittleEndian.Uint32(
-				packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
-			)
-			value := device.indexTable.Lookup(receiver)
-			keypair := value.keypair
-			if keypair == nil {
-				continue
-			}
+				receiver := binary.LittleEndian.Uint32(
+					packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
+				)
+				value := device.indexTable.Lookup(receiver)
+				keypair := value.keypair
+				if keypair == nil {
+					continue
+				}
 
-			// check keypair expiry
+				// check keypair expiry
 
-			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
-				continue
-			}
-
-			// create work element
-			peer := value.peer
-			elem := device.GetInboundElement()
-			elem.Type = msgType
-			elem.TTL = msgTTL
-			elem.packet = packet
-			elem.buffer = buffer
-			elem.keypair = keypair
-			elem.endpoint = endpoint
-			elem.counter = 0
-			elem.Mutex = sync.Mutex{}
-			elem.Lock()
-
-			// add to decryption queues
-			if peer.isRunning.Get() {
-				peer.queue.inbound.c <- elem
-				device.queue.decryption.c <- elem
-				buffer = device.GetMessageBuffer()
-			} else {
-				device.PutInboundElement(elem)
-			}
-			continue
+				if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+					continue
+				}
 
-		// otherwise it is a fixed size & handshake related packet
+				// create work element
+				peer := value.peer
+				elem := device.GetInboundElement()
+				elem.Type = msgType
+				elem.TTL = msgTTL
+				elem.packet = packet
+				elem.buffer = buffer
+				elem.keypair = keypair
+				elem.endpoint = endpoint
+				elem.counter = 0
+				elem.Mutex = sync.Mutex{}
+				elem.Lock()
+
+				// add to decryption queues
+				if peer.isRunning.Get() {
+					peer.queue.inbound.c <- elem
+					device.queue.decryption.c <- elem
+					buffers[i] = device.GetMessageBuffer()
+					bufs[i] = buffers[i][:]
+				} else {
+					device.PutInboundElement(elem)
+				}
+				continue
 
-		case path.MessageInitiationType:
-			okay = len(packet) == MessageInitiationSize
+			// otherwise it is a fixed size & handshake related packet
 
-		case path.MessageResponseType:
-			okay = len(packet) == MessageResponseSize
+			case path.MessageInitiationType:
+				okay = len(packet) == MessageInitiationSize
 
-		case path.MessageCookieReplyType:
-			okay = len(packet) == MessageCookieReplySize
+			case path.MessageResponseType:
+				okay = len(packet) == MessageResponseSize
 
-		default:
-			device.log.Verbosef("Received message with unknown type")
-		}
+			case path.MessageCookieReplyType:
+				okay = len(packet) == MessageCookieReplySize
 
-		if okay {
-			select {
-			case device.queue.handshake.c <- QueueHandshakeElement{
-				msgType:  msgType,
-				buffer:   buffer,
-				packet:   packet,
-				endpoint: endpoint,
-			}:
-				buffer = device.GetMessageBuffer()
 			default:
+				device.log.Verbosef("Received message with unknown type")
+			}
+
+			if okay {
+				select {
+				case device.queue.handshake.c <- QueueHandshakeElement{
+					msgType:  msgType,
+					buffer:   buffer,
+					packet:   packet,
+					endpoint: endpoint,
+				}:
+					buffers[i] = device.GetMessageBuffer()
+					bufs[i] = buffers[i][:]
+				default:
+				}
 			}
 		}
 	}
@@ -446,7 +465,10 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			goto skip
 		}
 
-		peer.SetEndpointFromPacket(elem.endpoint)
+		if !isProbePacket(elem.Type, elem.packet) {
+			// probes are sent on the candidate paths, don't roam to them
+			peer.SetEndpointFromPacket(elem.endpoint)
+		}
 		if peer.ReceivedWithKeypair(elem.keypair) {
 			peer.timersHandshakeComplete()
 			peer.SendStagedPackets()
@@ -478,7 +500,9 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			goto skip
 		}
 		if device.IsSuperNode {
-			if packet_type.IsControl_Edge2Super() {
+			if device.shouldRelay(packet_type, dst_nodeID) {
+				should_transfer = true
+			} else if packet_type.IsControl_Edge2Super() {
 				should_process = true
 			} else {
 				device.log.Errorf("received unsupported packet_type %v S:%v From:%v IP:%v", packet_type, src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
@@ -488,6 +512,9 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			case mtypes.NodeID_SuperNode:
 				should_process = true
 			default:
+				if should_transfer {
+					break
+				}
 				device.log.Errorf("received invalid dst_nodeID: %v S:%v From:%v IP:%v", dst_nodeID, src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
 				goto skip
 			}
@@ -562,6 +589,9 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				device.log.Verbosef("TTL is 0 %v", dst_nodeID)
 			} else {
 				l2ttl = l2ttl - 1
+				if packet_type == path.NormalPacket {
+					device.accountTraffic(trafficTransited, src_nodeID, dst_nodeID, len(elem.packet)-path.EgHeaderLen)
+				}
 				if dst_nodeID == mtypes.NodeID_Broadcast { //Regular transfer algorithm
 					device.TransitBoardcastPacket(src_nodeID, peer.ID, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
 				} else if dst_nodeID == mtypes.NodeID_Spread { // Control Message will try send to every know node regardless the connectivity
@@ -573,13 +603,15 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				} else {
 					next_id := device.graph.Next(device.ID, dst_nodeID)
 					if next_id != mtypes.NodeID_Invalid {
-						device.peers.RLock()
-						peer_out = device.peers.IDMap[next_id]
-						device.peers.RUnlock()
+						peer_out = device.nextHopPeer(next_id)
+						if peer_out == nil {
+							device.log.Verbosef("No peer for next hop ID %v", next_id)
+							goto skip
+						}
 						if device.LogLevel.LogTransit {
 							fmt.Printf("Transit: Transfer From:%v Me:%v To:%v S:%v D:%v TTL:%v\n", peer.ID, device.ID, peer_out.ID, src_nodeID.ToString(), dst_nodeID.ToString(), l2ttl)
 						}
-						go device.SendPacket(peer_out, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
+						go peer_out.device.SendPacket(peer_out, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
 					} else {
 						if device.LogLevel.LogTransit {
 							fmt.Printf("Transit: No route to %v,usage:%v ttl:%v, content %v PL:%v S:%v D:%v From:%v IP:%v\n", dst_nodeID.ToString(), elem.Type.ToString(), elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet), src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString(), peer.endpoint.DstToString())
@@ -596,7 +628,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 						fmt.Printf("Control: Recv %v S:%v D:%v TTL:%v From:%v IP:%v\n", device.sprint_received(packet_type, elem.packet[path.EgHeaderLen:]), src_nodeID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
 					}
 				}
-				err = device.process_received(packet_type, peer, elem.packet[path.EgHeaderLen:])
+				err = device.process_received(packet_type, peer, elem.endpoint, elem.packet[path.EgHeaderLen:])
 				if err != nil {
 					device.log.Errorf(err.Error())
 				}
@@ -609,48 +641,46 @@ func (peer *Peer) RoutineSequentialReceiver() {
 					device.log.Errorf("Invalid Normal packet: Ethernet packet too small from peer %v", peer.ID.ToString())
 					goto skip
 				}
+				if dst_nodeID == mtypes.NodeID_Broadcast && device.loopBlockBroadcast() {
+					if device.LogLevel.LogNormal {
+						fmt.Printf("Normal: Broadcast from %v dropped: loop detected, not the designated forwarder\n", src_nodeID.ToString())
+					}
+					goto skip
+				}
+				device.accountTraffic(trafficReceived, src_nodeID, dst_nodeID, len(elem.packet)-path.EgHeaderLen)
 				if device.LogLevel.LogNormal {
 					packet_len := len(elem.packet) - path.EgHeaderLen
 					fmt.Printf("Normal: Recv Len:%v S:%v D:%v TTL:%v From:%v IP:%v:\n", strconv.Itoa(packet_len), src_nodeID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
-					packet := gopacket.NewPacket(elem.packet[path.EgHeaderLen:], layers.LayerTypeEthernet, gopacket.Default)
+					packet := device.decodeTapPacket(elem.packet[path.EgHeaderLen:])
 					fmt.Println(packet.Dump())
 				}
 				src_macaddr := tap.GetSrcMacAddr(elem.packet[path.EgHeaderLen:])
-				if !tap.IsNotUnicast(src_macaddr) {
-					val, ok := device.l2fib.Load(src_macaddr)
-					if ok {
-						idtime := val.(*IdAndTime)
-						if idtime.ID != src_nodeID {
-							idtime.ID = src_nodeID
-							if device.LogLevel.LogInternal {
-								fmt.Printf("Internal: L2FIB [%v -> %v] updated.\n", src_macaddr.String(), src_nodeID)
-							}
-						}
-						idtime.Time = time.Now()
-					} else {
-						device.l2fib.Store(src_macaddr, &IdAndTime{
-							ID:   src_nodeID,
-							Time: time.Now(),
-						}) // Write to l2fib table
-						if device.LogLevel.LogInternal {
-							fmt.Printf("Internal: L2FIB [%v -> %v] added.\n", src_macaddr.String(), src_nodeID)
-						}
-					}
+				if !device.IsL3() && !tap.IsNotUnicast(src_macaddr) {
+					device.l2fib.Learn(src_macaddr, src_nodeID) // Write to l2fib table
 				}
+				device.capturePacket(captureMeta{
+					inbound: true,
+					src:     src_nodeID,
+					dst:     dst_nodeID,
+					peer:    peer.ID,
+					ttl:     elem.TTL,
+					usage:   packet_type,
+				}, elem.packet[path.EgHeaderLen:])
 				_, err = device.tap.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent+path.EgHeaderLen)
 				if err != nil && !device.isClosed() {
 					device.log.Errorf("Failed to write packet to TUN device: %v", err)
 				}
-				if len(peer.queue.inbound.c) == 0 {
-					err = device.tap.device.Flush()
-					if err != nil {
-						peer.device.log.Errorf("Unable to flush packets: %v", err)
-					}
-				}
 			}
 		}
 
 	skip:
+		// the coalesced segments of the tap device are flushed once the queue drains, whatever the last packet was
+		if len(peer.queue.inbound.c) == 0 {
+			err = device.tap.device.Flush()
+			if err != nil && !device.isClosed() {
+				device.log.Errorf("Unable to flush packets: %v", err)
+			}
+		}
 		device.PutMessageBuffer(elem.buffer)
 		device.PutInboundElement(elem)
 	}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// flushTap records the writes and flushes, the writes stay buffered until the flush like the GRO table
+type flushTap struct {
+	sync.Mutex
+	ops      []string
+	buffered int
+}
+
+func (t *flushTap) Read(buf []byte, offset int) (int, error) { select {} }
+func (t *flushTap) MTU() (int, error)                        { return 1500, nil }
+func (t *flushTap) Name() (string, error)                    { return "flushtap", nil }
+func (t *flushTap) Events() chan tap.Event                   { return nil }
+func (t *flushTap) Close() error                             { return nil }
+
+func (t *flushTap) Write(buf []byte, offset int) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.ops = append(t.ops, "write")
+	t.buffered += 1
+	return len(buf) - offset, nil
+}
+
+func (t *flushTap) Flush() error {
+	t.Lock()
+	defer t.Unlock()
+	t.ops = append(t.ops, "flush")
+	t.buffered = 0
+	return nil
+}
+
+func newTestInbound(device *Device, counter uint64, packet []byte) *QueueInboundElement {
+	elem := device.GetInboundElement()
+	elem.buffer = device.GetMessageBuffer()
+	elem.packet = elem.buffer[MessageTransportOffsetContent : MessageTransportOffsetContent+copy(elem.buffer[MessageTransportOffsetContent:], packet)]
+	elem.Type = path.NormalPacket
+	elem.TTL = 200
+	elem.counter = counter
+	elem.keypair = &Keypair{}
+	elem.Mutex = sync.Mutex{} // a recycled element is left locked, reset it like RoutineReceiveIncoming
+	return elem
+}
+
+func TestReceiverFlush(t *testing.T) {
+	tt := &flushTap{}
+	device := &Device{ID: 1, EdgeConfig: &mtypes.EdgeConfig{}}
+	device.EdgeConfig.Interface.MTU = 1416
+	device.log = NewLogger(LogLevelSilent, "")
+	device.l2fib = NewL2FIB(mtypes.L2FIBInfo{}, &device.LogLevel, device.log)
+	device.tap.device = tt
+	device.PopulatePools()
+	peer := &Peer{device: device, ID: 2, disableRoaming: true}
+	peer.queue.inbound = &autodrainingInboundQueue{c: make(chan *QueueInboundElement, QueueInboundSize)}
+	peer.LastPacketReceivedAdd1Sec.Store(&time.Time{})
+
+	frame := make([]byte, path.EgHeaderLen+60)
+	header, _ := path.NewEgHeader(frame[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	header.SetSrc(2)
+	header.SetDst(1)
+	copy(frame[path.EgHeaderLen:], testFrame(0x0800))
+
+	// a data packet followed by a keepalive, the segment buffered by the data packet must be flushed by the keepalive
+	peer.queue.inbound.c <- newTestInbound(device, 0, frame)
+	peer.queue.inbound.c <- newTestInbound(device, 1, nil)
+	peer.stopping.Add(1)
+	go peer.RoutineSequentialReceiver()
+	defer func() {
+		peer.queue.inbound.c <- nil
+		peer.stopping.Wait()
+	}()
+
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		tt.Lock()
+		ops, buffered := append([]string(nil), tt.ops...), tt.buffered
+		tt.Unlock()
+		if len(ops) > 0 && buffered == 0 {
+			if ops[0] != "write" {
+				t.Errorf("ops = %v, want the data packet written first", ops)
+			}
+			return
+		}
+	}
+	tt.Lock()
+	defer tt.Unlock()
+	t.Errorf("the write is not flushed after the keepalive, ops: %v", tt.ops)
+}
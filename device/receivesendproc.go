@@ -23,7 +23,6 @@ import (
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
-	"github.com/KusakabeSi/EtherGuard-VPN/tap"
 	"github.com/golang-jwt/jwt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -76,19 +75,35 @@ func (device *Device) SendPacket(peer *Peer, usage path.Usage, ttl uint8, packet
 	}
 }
 
+// SendPacketTo sends the packet to the given endpoint of the peer, instead of the endpoint of the peer
+func (device *Device) SendPacketTo(peer *Peer, endpoint conn.Endpoint, usage path.Usage, ttl uint8, packet []byte, offset int) {
+	if peer == nil || !peer.isRunning.Get() {
+		return
+	}
+	elem := device.NewOutboundElement()
+	copy(elem.buffer[offset:offset+len(packet)], packet)
+	elem.Type = usage
+	elem.TTL = ttl
+	elem.packet = elem.buffer[offset : offset+len(packet)]
+	elem.endpoint = endpoint
+	peer.StagePacket(elem)
+	peer.SendStagedPackets()
+}
+
 func (device *Device) BoardcastPacket(skip_list map[mtypes.Vertex]bool, usage path.Usage, ttl uint8, packet []byte, offset int) { // Send packet to all connected peers
 	send_list := device.graph.GetBoardcastList(device.ID)
 	for node_id := range skip_list {
 		send_list[node_id] = false
 	}
-	device.peers.RLock()
 	for node_id, should_send := range send_list {
 		if should_send {
-			peer_out := device.peers.IDMap[node_id]
-			go device.SendPacket(peer_out, usage, ttl, packet, offset)
+			peer_out := device.nextHopPeer(node_id)
+			if peer_out == nil {
+				continue
+			}
+			go peer_out.device.SendPacket(peer_out, usage, ttl, packet, offset)
 		}
 	}
-	device.peers.RUnlock()
 }
 
 func (device *Device) SpreadPacket(skip_list map[mtypes.Vertex]bool, usage path.Usage, ttl uint8, packet []byte, offset int) { // Send packet to all peers no matter it is alive
@@ -112,15 +127,16 @@ func (device *Device) TransitBoardcastPacket(src_nodeID mtypes.Vertex, in_id mty
 			fmt.Printf("Internal: Can't boardcast: %v", err)
 		}
 	}
-	device.peers.RLock()
 	for peer_id := range node_boardcast_list {
-		peer_out := device.peers.IDMap[peer_id]
+		peer_out := device.nextHopPeer(peer_id)
+		if peer_out == nil {
+			continue
+		}
 		if device.LogLevel.LogTransit {
 			fmt.Printf("Transit: Transfer From:%v Me:%v To:%v S:%v D:%v TTL:%v\n", in_id, device.ID, peer_out.ID, src_nodeID.ToString(), peer_out.ID.ToString(), ttl)
 		}
-		go device.SendPacket(peer_out, usage, ttl, packet, offset)
+		go peer_out.device.SendPacket(peer_out, usage, ttl, packet, offset)
 	}
-	device.peers.RUnlock()
 }
 
 func (device *Device) Send2Super(usage path.Usage, ttl uint8, packet []byte, offset int) {
@@ -145,7 +161,7 @@ func (device *Device) CheckNoDup(packet []byte) bool {
 	return !ok
 }
 
-func (device *Device) process_received(msg_type path.Usage, peer *Peer, body []byte) (err error) {
+func (device *Device) process_received(msg_type path.Usage, peer *Peer, src conn.Endpoint, body []byte) (err error) {
 	if device.IsSuperNode {
 		switch msg_type {
 		case path.Register:
@@ -173,7 +189,7 @@ func (device *Device) process_received(msg_type path.Usage, peer *Peer, body []b
 			}
 		case path.PingPacket:
 			if content, err := mtypes.ParsePingMsg(body); err == nil {
-				return device.process_ping(peer, content)
+				return device.process_ping(peer, src, content)
 			} else {
 				return err
 			}
@@ -183,6 +199,12 @@ func (device *Device) process_received(msg_type path.Usage, peer *Peer, body []b
 			} else {
 				return err
 			}
+		case path.BondProbe:
+			if content, err := mtypes.ParseBondProbeMsg(body); err == nil {
+				return device.process_BondProbe(peer, src, content)
+			} else {
+				return err
+			}
 		case path.QueryPeer:
 			if content, err := mtypes.ParseQueryPeerMsg(body); err == nil {
 				return device.process_RequestPeerMsg(content)
@@ -234,17 +256,26 @@ func (device *Device) sprint_received(msg_type path.Usage, body []byte) string {
 			return content.ToString()
 		}
 		return "BoardcastPeerMsg: Parse failed"
+	case path.BondProbe:
+		if content, err := mtypes.ParseBondProbeMsg(body); err == nil {
+			return content.ToString()
+		}
+		return "BondProbeMsg: Parse failed"
 	default:
 		return "UnknownMsg: Not a valid msg_type"
 	}
 }
 
 func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, request_reply int) ([]byte, path.Usage, uint8, error) {
-	body, err := mtypes.GetByte(&mtypes.PingMsg{
+	return device.newPingPacket(mtypes.PingMsg{
 		Src_nodeID:   src_nodeID,
 		Time:         device.graph.GetCurrentTime(),
 		RequestReply: request_reply,
 	})
+}
+
+func (device *Device) newPingPacket(content mtypes.PingMsg) ([]byte, path.Usage, uint8, error) {
+	body, err := mtypes.GetByte(&content)
 	if err != nil {
 		return nil, path.PingPacket, 0, err
 	}
@@ -322,7 +353,25 @@ func (device *Device) server_process_Pong(peer *Peer, content mtypes.PongMsg) er
 	return nil
 }
 
-func (device *Device) process_ping(peer *Peer, content mtypes.PingMsg) error {
+func (device *Device) process_ping(peer *Peer, src conn.Endpoint, content mtypes.PingMsg) error {
+	if content.Echo {
+		// Time is our own clock, so the round trip time doesn't depend on the clock sync
+		if src != nil && content.Src_nodeID == device.ID {
+			peer.endpoint_trylist.Observe(src.DstToString(), device.graph.GetCurrentTime().Sub(content.Time).Seconds())
+		}
+		return nil
+	}
+	if content.Probe {
+		// echo on the path it came from, it's not a latency report
+		if src != nil {
+			echo := content
+			echo.Probe, echo.Echo = false, true
+			if buf, usage, ttl, err := device.newPingPacket(echo); err == nil {
+				device.SendPacketTo(peer, src, usage, ttl, buf, MessageTransportOffsetContent)
+			}
+		}
+		return nil
+	}
 	Timediff := device.graph.GetCurrentTime().Sub(content.Time).Seconds()
 	NewTimediff := peer.SingleWayLatency.Push(Timediff)
 
@@ -381,12 +430,12 @@ func (device *Device) process_pong(peer *Peer, content mtypes.PongMsg) error {
 }
 
 func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error {
-	var send_signal bool
 	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.Peer.Load().(string) == State_hash {
 			if device.LogLevel.LogControl {
 				fmt.Println("Control: Same Hash, skip download PeerInfo")
 			}
+			device.touchStateCache()
 			return nil
 		}
 		var peer_infos mtypes.API_Peers
@@ -394,7 +443,7 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 		client := http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/peerinfo" ////////////////////////////////////////////////////////////////////////////////////////////////
+		downloadurl := device.ActiveSuper().EndpointEdgeAPIUrl + "/edge/peerinfo" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -409,6 +458,7 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 			fmt.Println("Control: Download PeerInfo from :" + req.URL.RequestURI())
 		}
 		resp, err := client.Do(req)
+		device.superHttpResult(err)
 		if err != nil {
 			device.log.Errorf(err.Error())
 			return err
@@ -430,74 +480,91 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 			device.log.Errorf("JSON decode error:", err.Error())
 			return err
 		}
+		device.applyPeerInfo(peer_infos)
+		device.state_hashes.Peer.Store(State_hash)
+		device.updateStateCache(func(cache *mtypes.EdgeStateCache) {
+			cache.Peers = peer_infos
+			cache.PeerHash = State_hash
+		})
+	}
+	return nil
+}
 
-		for nodeID, thepeer := range device.peers.IDMap {
-			pk := thepeer.handshake.remoteStatic
-			psk := thepeer.handshake.presharedKey
-			if val, ok := peer_infos[pk.ToString()]; ok {
-				if val.NodeID != nodeID {
-					device.RemovePeer(pk)
-					continue
-				} else if val.PSKey != psk.ToString() {
-					device.RemovePeer(pk)
-					continue
-				}
-			} else {
+// applyPeerInfo removes the peers not in peer_infos and adds or updates the others
+func (device *Device) applyPeerInfo(peer_infos mtypes.API_Peers) {
+	var send_signal bool
+	for nodeID, thepeer := range device.peers.IDMap {
+		pk := thepeer.handshake.remoteStatic
+		psk := thepeer.handshake.presharedKey
+		if val, ok := peer_infos[pk.ToString()]; ok {
+			if val.NodeID != nodeID {
+				device.RemovePeer(pk)
+				continue
+			} else if val.PSKey != psk.ToString() {
 				device.RemovePeer(pk)
 				continue
 			}
+		} else {
+			device.RemovePeer(pk)
+			continue
 		}
+	}
 
-		for PubKey, peerinfo := range peer_infos {
-			sk, err := Str2PubKey(PubKey)
-			if err != nil {
-				device.log.Errorf("Error decode base64:", err)
+	node_cidrs := make(map[mtypes.Vertex]NodeCIDR)
+	for PubKey, peerinfo := range peer_infos {
+		sk, err := Str2PubKey(PubKey)
+		if err != nil {
+			device.log.Errorf("Error decode base64:", err)
+			continue
+		}
+		if bytes.Equal(sk[:], device.staticIdentity.publicKey[:]) {
+			continue
+		}
+		node_cidrs[peerinfo.NodeID] = NodeCIDR{
+			IPv4CIDR: peerinfo.IPv4CIDR,
+			IPv6CIDR: peerinfo.IPv6CIDR,
+		}
+		thepeer := device.LookupPeer(sk)
+		if thepeer == nil { //not exist in local
+			if len(peerinfo.Connurl.ExternalV4)+len(peerinfo.Connurl.ExternalV6)+len(peerinfo.Connurl.LocalV4)+len(peerinfo.Connurl.LocalV6) == 0 {
 				continue
 			}
-			if bytes.Equal(sk[:], device.staticIdentity.publicKey[:]) {
-				continue
+			if device.LogLevel.LogControl {
+				fmt.Println("Control: Add new peer to local ID:" + peerinfo.NodeID.ToString() + " PubKey:" + PubKey)
 			}
-			thepeer := device.LookupPeer(sk)
-			if thepeer == nil { //not exist in local
-				if len(peerinfo.Connurl.ExternalV4)+len(peerinfo.Connurl.ExternalV6)+len(peerinfo.Connurl.LocalV4)+len(peerinfo.Connurl.LocalV6) == 0 {
-					continue
-				}
-				if device.LogLevel.LogControl {
-					fmt.Println("Control: Add new peer to local ID:" + peerinfo.NodeID.ToString() + " PubKey:" + PubKey)
-				}
-				if device.graph.Weight(device.ID, peerinfo.NodeID, false) == mtypes.Infinity { // add node to graph
-					device.graph.UpdateLatency(device.ID, peerinfo.NodeID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
-				}
-				if device.graph.Weight(peerinfo.NodeID, device.ID, false) == mtypes.Infinity { // add node to graph
-					device.graph.UpdateLatency(peerinfo.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
-				}
-				thepeer, err = device.NewPeer(sk, peerinfo.NodeID, false, 0)
-				if err != nil {
-					device.log.Errorf("Failed to create peer with ID:%v PunKey:%v :%v", peerinfo.NodeID.ToString(), PubKey, err)
-					continue
-				}
+			if device.graph.Weight(device.ID, peerinfo.NodeID, false) == mtypes.Infinity { // add node to graph
+				device.graph.UpdateLatency(device.ID, peerinfo.NodeID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
 			}
-			if peerinfo.PSKey != "" {
-				pk, err := Str2PSKey(peerinfo.PSKey)
-				if err != nil {
-					device.log.Errorf("Error decode base64:", err)
-					continue
-				}
-				thepeer.SetPSK(pk)
+			if device.graph.Weight(peerinfo.NodeID, device.ID, false) == mtypes.Infinity { // add node to graph
+				device.graph.UpdateLatency(peerinfo.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
 			}
-
-			thepeer.endpoint_trylist.UpdateSuper(*peerinfo.Connurl, !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP, device.EdgeConfig.AfPrefer)
-			if !thepeer.IsPeerAlive() {
-				//Peer died, try to switch to this new endpoint
-				send_signal = true
+			thepeer, err = device.NewPeer(sk, peerinfo.NodeID, false, 0)
+			if err != nil {
+				device.log.Errorf("Failed to create peer with ID:%v PunKey:%v :%v", peerinfo.NodeID.ToString(), PubKey, err)
+				continue
 			}
 		}
-		device.state_hashes.Peer.Store(State_hash)
-		if send_signal {
-			device.event_tryendpoint <- struct{}{}
+		if peerinfo.PSKey != "" {
+			pk, err := Str2PSKey(peerinfo.PSKey)
+			if err != nil {
+				device.log.Errorf("Error decode base64:", err)
+				continue
+			}
+			thepeer.SetPSK(pk)
+		}
+
+		thepeer.endpoint_trylist.UpdateSuper(*peerinfo.Connurl, !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP, device.EdgeConfig.AfPrefer)
+		if !thepeer.IsPeerAlive() {
+			//Peer died, try to switch to this new endpoint
+			send_signal = true
 		}
 	}
-	return nil
+	if device.IsL3() {
+		device.UpdatePrefixTable(node_cidrs)
+	}
+	if send_signal {
+		device.event_tryendpoint <- struct{}{}
+	}
 }
 
 func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) error {
@@ -507,6 +574,7 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 				fmt.Println("Control: Same Hash, skip download nhTable")
 			}
 			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
+			device.touchStateCache()
 			return nil
 		}
 		var NhTable mtypes.NextHopTable
@@ -514,7 +582,7 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 		client := &http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/nhtable" ////////////////////////////////////////////////////////////////////////////////////////////////
+		downloadurl := device.ActiveSuper().EndpointEdgeAPIUrl + "/edge/nhtable" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -529,6 +597,7 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 			fmt.Println("Control: Download NhTable from :" + req.URL.RequestURI())
 		}
 		resp, err := client.Do(req)
+		device.superHttpResult(err)
 		if err != nil {
 			device.log.Errorf(err.Error())
 			return err
@@ -552,6 +621,10 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 		}
 		device.graph.SetNHTable(NhTable)
 		device.state_hashes.NhTable.Store(State_hash)
+		device.updateStateCache(func(cache *mtypes.EdgeStateCache) {
+			cache.NhTable = NhTable
+			cache.NhTableHash = State_hash
+		})
 	}
 	return nil
 }
@@ -563,13 +636,14 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 				fmt.Println("Control: Same Hash, skip download SuperParams")
 			}
 			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
+			device.touchStateCache()
 			return nil
 		}
 		var SuperParams mtypes.API_SuperParams
 		client := &http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/superparams" ////////////////////////////////////////////////////////////////////////////////////////////////
+		downloadurl := device.ActiveSuper().EndpointEdgeAPIUrl + "/edge/superparams" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -584,6 +658,7 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 			fmt.Println("Control: Download SuperParams from :" + req.URL.RequestURI())
 		}
 		resp, err := client.Do(req)
+		device.superHttpResult(err)
 		if err != nil {
 			device.log.Errorf(err.Error())
 			return err
@@ -605,30 +680,44 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 			device.log.Errorf("JSON decode error:", err.Error())
 			return err
 		}
-		if SuperParams.PeerAliveTimeout <= 0 {
-			device.log.Errorf("SuperParams.PeerAliveTimeout <= 0: %v, please check the config of the supernode", SuperParams.PeerAliveTimeout)
-			return fmt.Errorf("SuperParams.PeerAliveTimeout <= 0: %v, please check the config of the supernode", SuperParams.PeerAliveTimeout)
-		}
-		if SuperParams.SendPingInterval <= 0 {
-			device.log.Errorf("SuperParams.SendPingInterval <= 0: %v, please check the config of the supernode", SuperParams.SendPingInterval)
-			return fmt.Errorf("SuperParams.SendPingInterval <= 0: %v, please check the config of the supernode", SuperParams.SendPingInterval)
-		}
-		if SuperParams.HttpPostInterval < 0 {
-			device.log.Errorf("SuperParams.HttpPostInterval < 0: %v, please check the config of the supernode", SuperParams.HttpPostInterval)
-			return fmt.Errorf("SuperParams.HttpPostInterval < 0: %v, please check the config of the supernode", SuperParams.HttpPostInterval)
+		if err := device.applySuperParams(SuperParams); err != nil {
+			return err
 		}
+		device.state_hashes.SuperParam.Store(State_hash)
+		device.updateStateCache(func(cache *mtypes.EdgeStateCache) {
+			cache.SuperParams = SuperParams
+			cache.SuperParamsHash = State_hash
+		})
+	}
+	return nil
+}
 
-		device.EdgeConfig.DynamicRoute.PeerAliveTimeout = SuperParams.PeerAliveTimeout
-		device.EdgeConfig.DynamicRoute.SendPingInterval = SuperParams.SendPingInterval
-		device.SuperConfig.HttpPostInterval = SuperParams.HttpPostInterval
-		device.SuperConfig.DampingFilterRadius = SuperParams.DampingFilterRadius
-		device.Chan_SendPingStart <- struct{}{}
-		device.Chan_HttpPostStart <- struct{}{}
-		if SuperParams.AdditionalCost >= 0 {
-			device.EdgeConfig.DynamicRoute.AdditionalCost = SuperParams.AdditionalCost
-		}
+func (device *Device) applySuperParams(SuperParams mtypes.API_SuperParams) error {
+	if SuperParams.PeerAliveTimeout <= 0 {
+		device.log.Errorf("SuperParams.PeerAliveTimeout <= 0: %v, please check the config of the supernode", SuperParams.PeerAliveTimeout)
+		return fmt.Errorf("SuperParams.PeerAliveTimeout <= 0: %v, please check the config of the supernode", SuperParams.PeerAliveTimeout)
+	}
+	if SuperParams.SendPingInterval <= 0 {
+		device.log.Errorf("SuperParams.SendPingInterval <= 0: %v, please check the config of the supernode", SuperParams.SendPingInterval)
+		return fmt.Errorf("SuperParams.SendPingInterval <= 0: %v, please check the config of the supernode", SuperParams.SendPingInterval)
+	}
+	if SuperParams.HttpPostInterval < 0 {
+		device.log.Errorf("SuperParams.HttpPostInterval < 0: %v, please check the config of the supernode", SuperParams.HttpPostInterval)
+		return fmt.Errorf("SuperParams.HttpPostInterval < 0: %v, please check the config of the supernode", SuperParams.HttpPostInterval)
+	}
 
-		device.state_hashes.SuperParam.Store(State_hash)
+	device.EdgeConfig.DynamicRoute.PeerAliveTimeout = SuperParams.PeerAliveTimeout
+	device.EdgeConfig.DynamicRoute.SendPingInterval = SuperParams.SendPingInterval
+	device.SuperConfig.HttpPostInterval = SuperParams.HttpPostInterval
+	device.SuperConfig.DampingFilterRadius = SuperParams.DampingFilterRadius
+	device.Chan_SendPingStart <- struct{}{}
+	device.Chan_HttpPostStart <- struct{}{}
+	if SuperParams.AdditionalCost >= 0 {
+		device.EdgeConfig.DynamicRoute.AdditionalCost = SuperParams.AdditionalCost
+	}
+	if device.SuperConfig.NatDetect.ReflectorPort != SuperParams.NatReflectorPort {
+		device.SuperConfig.NatDetect.ReflectorPort = SuperParams.NatReflectorPort
+		device.signalNatDetect()
 	}
 	return nil
 }
@@ -657,6 +746,8 @@ func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerU
 		return device.process_UpdatePeerMsg(peer, content.Params)
 	case mtypes.UpdateSuperParams:
 		return device.process_UpdateSuperParamsMsg(peer, content.Params)
+	case mtypes.HolePunch:
+		return device.process_HolePunch(content.Params)
 	default:
 		device.log.Errorf("Unknown Action: %v", content.ToString())
 	}
@@ -752,6 +843,8 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 			if thepeer.LastPacketReceivedAdd1Sec.Load().(*time.Time).Add(mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout)).After(time.Now()) {
 				//Peer alives
 				continue
+			} else if device.EdgeConfig.DynamicRoute.ProbeStagger > 0 {
+				go device.ProbeEndpoints(thepeer)
 			} else {
 				FastTry, connurl := thepeer.endpoint_trylist.GetNextTry()
 				if connurl == "" {
@@ -958,6 +1051,11 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 			Pongs:    pongs,
 			LocalV4s: LocalV4s,
 			LocalV6s: LocalV6s,
+			Traffic:  device.GetTrafficMatrix(),
+			Bonding:  device.GetBondStats(),
+			Nat:      device.GetNatReport(),
+			IPv4CIDR: device.EdgeConfig.Interface.IPv4CIDR,
+			IPv6CIDR: device.EdgeConfig.Interface.IPv6CIDR,
 		})
 		body = mtypes.Gzip(body)
 		bodyhash := base64.StdEncoding.EncodeToString(body)
@@ -970,7 +1068,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		client := &http.Client{
 			Timeout: 8 * time.Second,
 		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/post/nodeinfo"
+		downloadurl := device.ActiveSuper().EndpointEdgeAPIUrl + "/edge/post/nodeinfo"
 		req, err := http.NewRequest("POST", downloadurl, bytes.NewReader(body))
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -988,6 +1086,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 			fmt.Printf("Control: Post to %v\n", downloadurl)
 		}
 		resp, err := client.Do(req)
+		device.superHttpResult(err)
 		if err != nil {
 			device.log.Errorf("RoutinePostPeerInfo: " + err.Error())
 		} else {
@@ -1072,17 +1171,7 @@ func (device *Device) RoutineClearL2FIB() {
 	}
 	timeout := mtypes.S2TD(device.EdgeConfig.L2FIBTimeout)
 	for {
-		device.l2fib.Range(func(k interface{}, v interface{}) bool {
-			val := v.(*IdAndTime)
-			if time.Now().After(val.Time.Add(timeout)) {
-				mac := k.(tap.MacAddress)
-				device.l2fib.Delete(k)
-				if device.LogLevel.LogInternal {
-					fmt.Printf("Internal: L2FIB [%v -> %v] deleted.\n", mac.String(), val.ID)
-				}
-			}
-			return true
-		})
+		device.l2fib.Expire(timeout)
 		time.Sleep(timeout)
 	}
 }
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Data relay.
+//
+// If two edges can't connect directly, the supernode adds relay edges to the route graph:
+// between every alive edge and the supernode itself if UseSuperRelay is set,
+// and between every alive edge and the designated RelayNodes if they haven't measured a latency yet.
+// The NormalPacket frames are forwarded by the relay with the EG header intact, like the transit of the edges.
+
+// SetRelaySibling sets the device of the other af of the supernode.
+// The relayed packet is sent by the sibling if the next hop isn't connected to this device.
+func (device *Device) SetRelaySibling(sibling *Device) {
+	device.relaySibling = sibling
+}
+
+// shouldRelay returns true if the supernode should forward the packet instead of dropping it
+func (device *Device) shouldRelay(packet_type path.Usage, dst_nodeID mtypes.Vertex) bool {
+	if !device.IsSuperNode || !device.SuperConfig.Relay.UseSuperRelay || !packet_type.IsNormal() {
+		return false
+	}
+	switch dst_nodeID {
+	case mtypes.NodeID_Broadcast:
+		return true
+	case mtypes.NodeID_SuperNode, mtypes.NodeID_Spread, mtypes.NodeID_Invalid:
+		return false
+	}
+	return device.graph.Next(device.ID, dst_nodeID) != mtypes.NodeID_Invalid
+}
+
+// nextHopPeer returns the peer of the next hop.
+// The supernode isn't in the IDMap of the edges, any connected super peer is used.
+func (device *Device) nextHopPeer(id mtypes.Vertex) *Peer {
+	device.peers.RLock()
+	if id == mtypes.NodeID_SuperNode {
+		defer device.peers.RUnlock()
+		for _, peer := range device.peers.SuperPeer {
+			if peer.GetEndpointDstStr() != "" {
+				return peer
+			}
+		}
+		return nil
+	}
+	peer := device.peers.IDMap[id]
+	device.peers.RUnlock()
+	if peer != nil && peer.GetEndpointDstStr() == "" && device.relaySibling != nil {
+		device.relaySibling.peers.RLock()
+		sibling_peer := device.relaySibling.peers.IDMap[id]
+		device.relaySibling.peers.RUnlock()
+		if sibling_peer != nil && sibling_peer.GetEndpointDstStr() != "" {
+			return sibling_peer
+		}
+	}
+	return peer
+}
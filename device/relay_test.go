@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestShouldRelay(t *testing.T) {
+	g, err := path.NewGraph(3, true, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 and 2 can't connect directly, both of them reach the supernode
+	for _, id := range []mtypes.Vertex{1, 2} {
+		g.UpdateLatency(id, mtypes.NodeID_SuperNode, 0.5, 60, 0, false, false)
+		g.UpdateLatency(mtypes.NodeID_SuperNode, id, 0.5, 60, 0, false, false)
+	}
+	g.RecalculateNhTable(false)
+	if next := g.Next(1, 2); next != mtypes.NodeID_SuperNode {
+		t.Fatalf("Next(1, 2) = %v, want the supernode", next)
+	}
+	device := &Device{
+		IsSuperNode: true,
+		ID:          mtypes.NodeID_SuperNode,
+		graph:       g,
+		SuperConfig: &mtypes.SuperConfig{},
+	}
+	if device.shouldRelay(path.NormalPacket, 2) {
+		t.Error("relayed with UseSuperRelay disabled")
+	}
+	device.SuperConfig.Relay.UseSuperRelay = true
+	tests := []struct {
+		usage path.Usage
+		dst   mtypes.Vertex
+		want  bool
+	}{
+		{path.NormalPacket, 2, true},
+		{path.NormalPacket, mtypes.NodeID_Broadcast, true},
+		{path.NormalPacket, 3, false},
+		{path.NormalPacket, mtypes.NodeID_SuperNode, false},
+		{path.Register, 2, false},
+	}
+	for _, tt := range tests {
+		if got := device.shouldRelay(tt.usage, tt.dst); got != tt.want {
+			t.Errorf("shouldRelay(%v, %v) = %v, want %v", tt.usage.ToString(), tt.dst.ToString(), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The endpoints configured with a hostname are resolved again after the TTL of the records,
+// and the endpoint is switched if the address changed.
+// The TTL is queried from the nameservers in ResolvConf, MinTTL is used if it's not available.
+
+const (
+	ResolvConf      = "/etc/resolv.conf"
+	DNSQueryTimeout = 2 * time.Second
+)
+
+type peerResolve struct {
+	sync.Mutex
+	url      string
+	af       conn.EnabledAf
+	afPrefer int
+	resolved string // the address of the last resolution
+	next     time.Time
+}
+
+// endpointHost returns the host part of the connurl
+func endpointHost(connurl string) string {
+	hostport := conn.EndpointHostPort(connurl)
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
+
+func isHostname(host string) bool {
+	if i := strings.Index(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return host != "" && net.ParseIP(host) == nil
+}
+
+// trackHostname remembers the connurl if it's hostname based, and the address it resolved to
+func (peer *Peer) trackHostname(connurl string, af conn.EnabledAf, af_perfer int, connIP string) {
+	if !isHostname(endpointHost(connurl)) {
+		return
+	}
+	peer.resolve.Lock()
+	defer peer.resolve.Unlock()
+	if peer.resolve.url != connurl {
+		peer.resolve.next = time.Time{}
+	}
+	peer.resolve.url = connurl
+	peer.resolve.af = af
+	peer.resolve.afPrefer = af_perfer
+	peer.resolve.resolved = connIP
+}
+
+func readNameservers(resolvconf string) []string {
+	content, err := os.ReadFile(resolvconf)
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			ret = append(ret, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return ret
+}
+
+// minAnswerTTL returns the smallest TTL of the answers in the DNS response, including the CNAMEs
+func minAnswerTTL(resp []byte, id uint16, qtype dnsmessage.Type) (uint32, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return 0, err
+	}
+	if h.ID != id || !h.Response {
+		return 0, errors.New("mismatched DNS response")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return 0, fmt.Errorf("DNS response %v", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, err
+	}
+	var ttl uint32 = 1<<32 - 1
+	found := false
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if (ah.Type == qtype || ah.Type == dnsmessage.TypeCNAME) && ah.TTL < ttl {
+			ttl = ah.TTL
+		}
+		if ah.Type == qtype {
+			found = true
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return 0, err
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("no %v record", qtype)
+	}
+	return ttl, nil
+}
+
+func queryTTL(server string, name dnsmessage.Name, qtype dnsmessage.Type) (uint32, error) {
+	var idb [2]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return 0, err
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return 0, err
+	}
+	c, err := net.DialTimeout("udp", server, DNSQueryTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(DNSQueryTimeout))
+	if _, err := c.Write(query); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	n, err := c.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	return minAnswerTTL(buf[:n], id, qtype)
+}
+
+// lookupTTL returns the smallest TTL of the A/AAAA records of the host
+func lookupTTL(host string, af conn.EnabledAf) (time.Duration, error) {
+	servers := readNameservers(ResolvConf)
+	if len(servers) == 0 {
+		return 0, fmt.Errorf("no nameserver in %v", ResolvConf)
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return 0, err
+	}
+	var qtypes []dnsmessage.Type
+	if af.IPv4 {
+		qtypes = append(qtypes, dnsmessage.TypeA)
+	}
+	if af.IPv6 {
+		qtypes = append(qtypes, dnsmessage.TypeAAAA)
+	}
+	var ttl uint32
+	found := false
+	err = fmt.Errorf("no record of %v", host)
+	for _, qtype := range qtypes {
+		for _, server := range servers {
+			t, qerr := queryTTL(server, name, qtype)
+			if qerr != nil {
+				err = qerr
+				continue
+			}
+			if !found || t < ttl {
+				ttl = t
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, err
+	}
+	return time.Duration(ttl) * time.Second, nil
+}
+
+// resolveEndpoint resolves the hostname of the peer again, switches the endpoint if the address changed,
+// and returns the time until the next resolution
+func (device *Device) resolveEndpoint(peer *Peer, floor time.Duration) time.Duration {
+	peer.resolve.Lock()
+	url, af, afPrefer, last := peer.resolve.url, peer.resolve.af, peer.resolve.afPrefer, peer.resolve.resolved
+	peer.resolve.Unlock()
+	ttl, err := lookupTTL(endpointHost(url), af)
+	if err != nil {
+		device.log.Verbosef("Unable to get the TTL of %v: %v", url, err)
+	}
+	if ttl < floor {
+		ttl = floor
+	}
+	peer.resolve.Lock()
+	peer.resolve.next = time.Now().Add(ttl)
+	peer.resolve.Unlock()
+	_, connIP, err := conn.LookupIP(url, af, afPrefer)
+	if err != nil {
+		device.log.Errorf("Failed to resolve %v: %v", url, err)
+		return ttl
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Resolved %v to %v for peer %v, next after %v\n", url, connIP, peer.ID.ToString(), ttl)
+	}
+	if connIP == last {
+		return ttl
+	}
+	// round robin DNS returns the records in different orders, keep the endpoint if it's still one of them
+	if IPs, err := net.LookupIP(endpointHost(url)); err == nil && last != "" {
+		for _, IP := range IPs {
+			if IP.Equal(net.ParseIP(endpointHost(last))) {
+				return ttl
+			}
+		}
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Address of %v changed from %v to %v, switch the endpoint of peer %v\n", url, last, connIP, peer.ID.ToString())
+	}
+	if err := peer.SetEndpointFromConnURL(url, af, afPrefer, peer.StaticConn); err != nil {
+		device.log.Errorf("Failed to bind %v: %v", url, err)
+		return ttl
+	}
+	if peer.ID == mtypes.NodeID_SuperNode {
+		select {
+		case device.Chan_SendRegisterStart <- struct{}{}:
+		default:
+		}
+	}
+	peer.SendKeepalive()
+	return ttl
+}
+
+// RoutineResolveEndpoints resolves the hostname based endpoints after the TTL, but not earlier than MinTTL
+func (device *Device) RoutineResolveEndpoints() {
+	var conf mtypes.DNSResolveInfo
+	if device.IsSuperNode {
+		conf = device.SuperConfig.DNSResolve
+	} else {
+		conf = device.EdgeConfig.DNSResolve
+	}
+	if !conf.UseDNSResolve {
+		return
+	}
+	floor := mtypes.S2TD(conf.MinTTL)
+	if floor < time.Second {
+		floor = time.Second
+	}
+	for {
+		device.peers.RLock()
+		peers := make([]*Peer, 0, len(device.peers.keyMap))
+		for _, peer := range device.peers.keyMap {
+			peers = append(peers, peer)
+		}
+		device.peers.RUnlock()
+		wait := floor
+		for _, peer := range peers {
+			peer.resolve.Lock()
+			url, next := peer.resolve.url, peer.resolve.next
+			peer.resolve.Unlock()
+			if url == "" {
+				continue
+			}
+			if d := time.Until(next); d > 0 {
+				if d < wait {
+					wait = d
+				}
+				continue
+			}
+			if d := device.resolveEndpoint(peer, floor); d < wait {
+				wait = d
+			}
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestEndpointHost(t *testing.T) {
+	tests := []struct {
+		url      string
+		host     string
+		hostname bool
+	}{
+		{"example.com:3001", "example.com", true},
+		{"192.0.2.1:3001", "192.0.2.1", false},
+		{"[2001:db8::1]:3001", "2001:db8::1", false},
+		{"[fe80::1%eth0]:3001", "fe80::1%eth0", false},
+		{"wss://example.com/eg", "example.com", true},
+		{"tcp://example.com:443", "example.com", true},
+	}
+	for _, tt := range tests {
+		host := endpointHost(tt.url)
+		if host != tt.host || isHostname(host) != tt.hostname {
+			t.Errorf("endpointHost(%v) = %v hostname:%v, want %v hostname:%v", tt.url, host, isHostname(host), tt.host, tt.hostname)
+		}
+	}
+}
+
+func TestMinAnswerTTL(t *testing.T) {
+	name := dnsmessage.MustNewName("example.com.")
+	target := dnsmessage.MustNewName("dyn.example.com.")
+	pack := func(id uint16, answers ...dnsmessage.Resource) []byte {
+		msg := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: id, Response: true},
+			Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+			Answers:   answers,
+		}
+		b, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	cname := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.CNAMEResource{CNAME: target},
+	}
+	a := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: target, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+	if ttl, err := minAnswerTTL(pack(1, a), 1, dnsmessage.TypeA); err != nil || ttl != 300 {
+		t.Errorf("A: got %v %v, want 300", ttl, err)
+	}
+	if ttl, err := minAnswerTTL(pack(1, cname, a), 1, dnsmessage.TypeA); err != nil || ttl != 60 {
+		t.Errorf("CNAME: got %v %v, want 60", ttl, err)
+	}
+	if _, err := minAnswerTTL(pack(1, cname), 1, dnsmessage.TypeA); err == nil {
+		t.Error("accepted a response without A record")
+	}
+	if _, err := minAnswerTTL(pack(2, a), 1, dnsmessage.TypeA); err == nil {
+		t.Error("accepted a response with mismatched ID")
+	}
+}
@@ -16,11 +16,10 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
@@ -52,11 +51,12 @@ type QueueOutboundElement struct {
 	Type path.Usage
 	TTL  uint8
 	sync.Mutex
-	buffer  *[MaxMessageSize]byte // slice holding the packet data
-	packet  []byte                // slice of "buffer" (always!)
-	nonce   uint64                // nonce for encryption
-	keypair *Keypair              // keypair for encryption
-	peer    *Peer                 // related peer
+	buffer   *[MaxMessageSize]byte // slice holding the packet data
+	packet   []byte                // slice of "buffer" (always!)
+	nonce    uint64                // nonce for encryption
+	keypair  *Keypair              // keypair for encryption
+	peer     *Peer                 // related peer
+	endpoint conn.Endpoint         // send to this endpoint instead of the endpoint of the peer, for probes
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
@@ -77,6 +77,7 @@ func (elem *QueueOutboundElement) clearPointers() {
 	elem.packet = nil
 	elem.keypair = nil
 	elem.peer = nil
+	elem.endpoint = nil
 }
 
 /* Queues a keepalive if no packets are queued for peer
@@ -136,6 +137,7 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	if err != nil {
 		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
 	}
+	peer.endpoint_trylist.FanoutHandshake(packet)
 	peer.timersHandshakeInitiated()
 
 	return err
@@ -210,14 +212,21 @@ func (peer *Peer) keepKeyFreshSending() {
  *
  * Obs. Single instance per TUN device
  */
-func (device *Device) RoutineReadFromTUN() {
+func (device *Device) RoutineReadFromTUN(queue int) {
 	defer func() {
-		device.log.Verbosef("Routine: TUN reader - stopped")
+		device.log.Verbosef("Routine: TUN reader %d - stopped", queue)
 		device.state.stopping.Done()
 		device.queue.encryption.wg.Done()
 	}()
 
-	device.log.Verbosef("Routine: TUN reader - started")
+	device.log.Verbosef("Routine: TUN reader %d - started", queue)
+
+	read := device.tap.device.Read
+	if mq, ok := device.tap.device.(tap.MultiQueueDevice); ok && mq.NumQueues() > 1 {
+		read = func(buf []byte, offset int) (int, error) {
+			return mq.ReadQueue(queue, buf, offset)
+		}
+	}
 
 	var elem *QueueOutboundElement
 
@@ -231,7 +240,7 @@ func (device *Device) RoutineReadFromTUN() {
 		// read packet
 
 		offset := MessageTransportHeaderSize
-		size, err := device.tap.device.Read(elem.buffer[:], offset+path.EgHeaderLen)
+		size, err := read(elem.buffer[:], offset+path.EgHeaderLen)
 
 		if err != nil {
 			if !device.isClosed() {
@@ -252,16 +261,42 @@ func (device *Device) RoutineReadFromTUN() {
 		//add custom header dst_node, src_node, ttl
 		size += path.EgHeaderLen
 		elem.packet = elem.buffer[offset : offset+size]
+		if device.loopDetectEnabled() && device.handleLoopProbe(elem.packet[path.EgHeaderLen:]) {
+			continue
+		}
 		EgBody, _ := path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
 		dst_nodeID := EgBody.GetDst()
-		dstMacAddr := tap.GetDstMacAddr(elem.packet[path.EgHeaderLen:])
-		// lookup peer
-		if tap.IsNotUnicast(dstMacAddr) {
-			dst_nodeID = mtypes.NodeID_Broadcast
-		} else if val, ok := device.l2fib.Load(dstMacAddr); !ok { //Lookup failed
-			dst_nodeID = mtypes.NodeID_Broadcast
+		if device.IsL3() {
+			dstIP, err := tap.GetDstIPAddr(elem.packet[path.EgHeaderLen:])
+			if err != nil {
+				if device.LogLevel.LogNormal {
+					fmt.Println("Normal: Invalid packet: " + err.Error())
+				}
+				continue
+			}
+			dst_nodeID = device.LookupIP(dstIP)
+			if dst_nodeID == mtypes.NodeID_Invalid {
+				if device.LogLevel.LogNormal {
+					fmt.Println("Normal: No route to " + dstIP.String())
+				}
+				continue
+			}
 		} else {
-			dst_nodeID = val.(*IdAndTime).ID
+			dstMacAddr := tap.GetDstMacAddr(elem.packet[path.EgHeaderLen:])
+			// lookup peer
+			if tap.IsNotUnicast(dstMacAddr) {
+				dst_nodeID = mtypes.NodeID_Broadcast
+			} else if id, ok := device.l2fib.Lookup(dstMacAddr); !ok { //Lookup failed
+				dst_nodeID = mtypes.NodeID_Broadcast
+			} else {
+				dst_nodeID = id
+			}
+			if dst_nodeID == mtypes.NodeID_Broadcast && device.loopBlockBroadcast() {
+				if device.LogLevel.LogNormal {
+					fmt.Println("Normal: Broadcast dropped: loop detected, not the designated forwarder")
+				}
+				continue
+			}
 		}
 		packet_len := len(elem.packet) - path.EgHeaderLen
 		EgBody.SetSrc(device.ID)
@@ -274,21 +309,28 @@ func (device *Device) RoutineReadFromTUN() {
 			}
 			continue
 		}
+		device.accountTraffic(trafficOriginated, device.ID, dst_nodeID, packet_len)
 
 		if dst_nodeID != mtypes.NodeID_Broadcast {
 			var peer *Peer
 			next_id := device.graph.Next(device.ID, dst_nodeID)
+			device.capturePacket(captureMeta{
+				inbound: false,
+				src:     device.ID,
+				dst:     dst_nodeID,
+				peer:    next_id,
+				ttl:     elem.TTL,
+				usage:   elem.Type,
+			}, elem.packet[path.EgHeaderLen:])
 			if next_id != mtypes.NodeID_Invalid {
-				device.peers.RLock()
-				peer = device.peers.IDMap[next_id]
-				device.peers.RUnlock()
+				peer = device.nextHopPeer(next_id)
 				if peer == nil {
 					continue
 				}
 				if device.LogLevel.LogNormal {
 					packet_len := len(elem.packet) - path.EgHeaderLen
 					fmt.Printf("Normal: Send Len:%v S:%v D:%v TTL:%v To:%v IP:%v:\n", packet_len, device.ID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
-					packet := gopacket.NewPacket(elem.packet[path.EgHeaderLen:], layers.LayerTypeEthernet, gopacket.Default)
+					packet := device.decodeTapPacket(elem.packet[path.EgHeaderLen:])
 					fmt.Println(packet.Dump())
 				}
 				if peer.isRunning.Get() {
@@ -298,6 +340,14 @@ func (device *Device) RoutineReadFromTUN() {
 				}
 			}
 		} else {
+			device.capturePacket(captureMeta{
+				inbound: false,
+				src:     device.ID,
+				dst:     dst_nodeID,
+				peer:    mtypes.NodeID_Broadcast,
+				ttl:     elem.TTL,
+				usage:   elem.Type,
+			}, elem.packet[path.EgHeaderLen:])
 			device.BoardcastPacket(make(map[mtypes.Vertex]bool, 0), elem.Type, elem.TTL, elem.packet, offset)
 		}
 
@@ -332,6 +382,8 @@ top:
 		return
 	}
 
+	// Multiple TUN readers may send to the same peer at the same time
+	peer.queue.Lock()
 	for {
 		select {
 		case elem := <-peer.queue.staged:
@@ -340,6 +392,7 @@ top:
 			if elem.nonce >= RejectAfterMessages {
 				atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
 				peer.StagePacket(elem) // XXX: Out of order, but we can't front-load go chans
+				peer.queue.Unlock()
 				goto top
 			}
 
@@ -355,6 +408,7 @@ top:
 				peer.device.PutOutboundElement(elem)
 			}
 		default:
+			peer.queue.Unlock()
 			return
 		}
 	}
@@ -442,39 +496,83 @@ func (peer *Peer) RoutineSequentialSender() {
 	}()
 	device.log.Verbosef("%v - Routine: sequential sender - started", peer)
 
+	batchSize := device.BatchSize()
+	elems := make([]*QueueOutboundElement, 0, batchSize)
+	buffers := make([][]byte, 0, batchSize)
+
 	for elem := range peer.queue.outbound.c {
 		if elem == nil {
 			return
 		}
-		elem.Lock()
-		if !peer.isRunning.Get() {
-			// peer has been stopped; return re-usable elems to the shared pool.
-			// This is an optimization only. It is possible for the peer to be stopped
-			// immediately after this check, in which case, elem will get processed.
-			// The timers and SendBuffer code are resilient to a few stragglers.
-			// TODO: rework peer shutdown order to ensure
-			// that we never accidentally keep timers alive longer than necessary.
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
-			continue
+		// take the elements already queued, and send them in one batch
+		elems = append(elems[:0], elem)
+		closed := false
+	collect:
+		for len(elems) < batchSize {
+			select {
+			case elem = <-peer.queue.outbound.c:
+				if elem == nil {
+					closed = true
+					break collect
+				}
+				elems = append(elems, elem)
+			default:
+				break collect
+			}
+		}
+
+		buffers = buffers[:0]
+		dataSent := false
+		for _, elem := range elems {
+			elem.Lock()
+			if !peer.isRunning.Get() {
+				// peer has been stopped; return re-usable elems to the shared pool.
+				// This is an optimization only. It is possible for the peer to be stopped
+				// immediately after this check, in which case, elem will get processed.
+				// The timers and SendBuffer code are resilient to a few stragglers.
+				// TODO: rework peer shutdown order to ensure
+				// that we never accidentally keep timers alive longer than necessary.
+				continue
+			}
+			if elem.endpoint != nil {
+				// probes go to their own endpoint, out of the batch
+				if err := peer.SendBufferTo(elem.packet, elem.endpoint); err != nil {
+					device.log.Verbosef("%v - Failed to send probe to %v: %v", peer, elem.endpoint.DstToString(), err)
+				}
+				continue
+			}
+			buffers = append(buffers, elem.packet)
+			if len(elem.packet) != MessageKeepaliveSize {
+				dataSent = true
+			}
 		}
 
-		peer.timersAnyAuthenticatedPacketTraversal()
-		peer.timersAnyAuthenticatedPacketSent()
+		if len(buffers) > 0 {
+			peer.timersAnyAuthenticatedPacketTraversal()
+			peer.timersAnyAuthenticatedPacketSent()
 
-		// send message and return buffer to pool
+			// send messages and return buffers to pool
 
-		err := peer.SendBuffer(elem.packet)
-		if len(elem.packet) != MessageKeepaliveSize {
-			peer.timersDataSent()
+			err := peer.SendBuffers(buffers)
+			if dataSent {
+				peer.timersDataSent()
+			}
+			if err != nil {
+				device.log.Errorf("%v - Failed to send data packet: %v", peer, err)
+			} else {
+				peer.keepKeyFreshSending()
+			}
 		}
-		device.PutMessageBuffer(elem.buffer)
-		device.PutOutboundElement(elem)
-		if err != nil {
-			device.log.Errorf("%v - Failed to send data packet: %v", peer, err)
-			continue
+		for i, elem := range elems {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			elems[i] = nil
+		}
+		for i := range buffers {
+			buffers[i] = nil
+		}
+		if closed {
+			return
 		}
-
-		peer.keepKeyFreshSending()
 	}
 }
@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Edge state cache.
+//
+// The edge saves the PeerInfo, NhTable and SuperParams downloaded from the supernode, with their state hashes, to the CacheFile.
+// On start it loads the cache if it's younger than MaxAge, so the peers and routing are up before the supernode responds.
+// The state hashes are reported in the register, the supernode pushes the updates if they don't match.
+
+// updateStateCache updates the cache with f and saves it
+func (device *Device) updateStateCache(f func(cache *mtypes.EdgeStateCache)) {
+	conf := device.EdgeConfig.DynamicRoute.SuperNode.StateCache
+	if conf.CacheFile == "" {
+		return
+	}
+	device.statecache.Lock()
+	defer device.statecache.Unlock()
+	f(&device.statecache.EdgeStateCache)
+	device.statecache.Time = time.Now()
+	if err := device.saveStateCache(conf.CacheFile); err != nil {
+		device.log.Errorf("Failed to save the state cache %v: %v", conf.CacheFile, err)
+	}
+}
+
+// touchStateCache refreshes the time of the cache after the supernode confirmed the state hashes.
+// It's written at most every MaxAge/10 seconds.
+func (device *Device) touchStateCache() {
+	conf := device.EdgeConfig.DynamicRoute.SuperNode.StateCache
+	if conf.CacheFile == "" {
+		return
+	}
+	device.statecache.Lock()
+	defer device.statecache.Unlock()
+	if device.statecache.Time.IsZero() || time.Since(device.statecache.Time) < mtypes.S2TD(conf.MaxAge/10) {
+		return
+	}
+	device.statecache.Time = time.Now()
+	if err := device.saveStateCache(conf.CacheFile); err != nil {
+		device.log.Errorf("Failed to save the state cache %v: %v", conf.CacheFile, err)
+	}
+}
+
+func (device *Device) saveStateCache(cachefile string) error {
+	// No lock, lock before call me
+	body, err := json.Marshal(device.statecache.EdgeStateCache)
+	if err != nil {
+		return err
+	}
+	tmpfile := cachefile + ".tmp"
+	if err := ioutil.WriteFile(tmpfile, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, cachefile)
+}
+
+// LoadStateCache applies the cached state from the supernode. It's fine if the CacheFile doesn't exist.
+func (device *Device) LoadStateCache() error {
+	conf := device.EdgeConfig.DynamicRoute.SuperNode
+	if !conf.UseSuperNode || conf.StateCache.CacheFile == "" {
+		return nil
+	}
+	body, err := ioutil.ReadFile(conf.StateCache.CacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cache mtypes.EdgeStateCache
+	if err := json.Unmarshal(body, &cache); err != nil {
+		return fmt.Errorf("error parse state cache %v: %v", conf.StateCache.CacheFile, err)
+	}
+	age := time.Since(cache.Time)
+	if conf.StateCache.MaxAge > 0 && age > mtypes.S2TD(conf.StateCache.MaxAge) {
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: State cache is %v old, older than MaxAge, ignored\n", age.Round(time.Second))
+		}
+		return nil
+	}
+	if cache.SuperParamsHash != "" {
+		if err := device.applySuperParams(cache.SuperParams); err != nil {
+			cache.SuperParamsHash = ""
+		} else {
+			device.state_hashes.SuperParam.Store(cache.SuperParamsHash)
+		}
+	}
+	if cache.PeerHash != "" {
+		device.applyPeerInfo(cache.Peers)
+		device.state_hashes.Peer.Store(cache.PeerHash)
+	}
+	if cache.NhTableHash != "" {
+		device.graph.SetNHTable(cache.NhTable)
+		device.state_hashes.NhTable.Store(cache.NhTableHash)
+	}
+	device.statecache.Lock()
+	device.statecache.EdgeStateCache = cache
+	device.statecache.Unlock()
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Loaded the state cache saved %v ago, %v peers\n", age.Round(time.Second), len(cache.Peers))
+	}
+	return nil
+}
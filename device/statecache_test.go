@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func newStateCacheDevice(t *testing.T, cachefile string, maxage float64) *Device {
+	econfig := &mtypes.EdgeConfig{}
+	econfig.DynamicRoute.SuperNode = mtypes.SuperInfo{
+		UseSuperNode: true,
+		StateCache:   mtypes.StateCacheInfo{CacheFile: cachefile, MaxAge: maxage},
+	}
+	graph, err := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &Device{EdgeConfig: econfig, graph: graph}
+	device.state_hashes.NhTable.Store("")
+	device.state_hashes.Peer.Store("")
+	device.state_hashes.SuperParam.Store("")
+	return device
+}
+
+func TestStateCache(t *testing.T) {
+	cachefile := filepath.Join(t.TempDir(), "statecache.json")
+	nhTable := mtypes.NextHopTable{1: {2: 3}, 3: {2: 2}}
+
+	device := newStateCacheDevice(t, cachefile, 3600)
+	device.updateStateCache(func(cache *mtypes.EdgeStateCache) {
+		cache.NhTable = nhTable
+		cache.NhTableHash = "nhhash"
+	})
+
+	device = newStateCacheDevice(t, cachefile, 3600)
+	if err := device.LoadStateCache(); err != nil {
+		t.Fatal(err)
+	}
+	if got := device.state_hashes.NhTable.Load().(string); got != "nhhash" {
+		t.Fatalf("NhTable hash = %q, want nhhash", got)
+	}
+	if got := device.graph.GetNHTable(false)[1][2]; got != 3 {
+		t.Fatalf("NhTable[1][2] = %v, want 3", got)
+	}
+	if got := device.state_hashes.Peer.Load().(string); got != "" {
+		t.Fatalf("Peer hash = %q, want empty since no PeerInfo cached", got)
+	}
+
+	// expired cache is ignored
+	device.statecache.Time = time.Now().Add(-2 * time.Hour)
+	if err := device.saveStateCache(cachefile); err != nil {
+		t.Fatal(err)
+	}
+	device = newStateCacheDevice(t, cachefile, 3600)
+	if err := device.LoadStateCache(); err != nil {
+		t.Fatal(err)
+	}
+	if got := device.state_hashes.NhTable.Load().(string); got != "" {
+		t.Fatalf("NhTable hash = %q, want empty from the expired cache", got)
+	}
+}
@@ -0,0 +1,38 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+)
+
+func TestStartRouteListener(t *testing.T) {
+	device := &Device{log: NewLogger(LogLevelSilent, "")}
+	stream := conn.NewStreamBind(conn.StreamConf{}, conn.EnabledAf46)
+	for _, tt := range []struct {
+		name   string
+		bind   conn.Bind
+		sticky bool
+	}{
+		{"LinuxSocketBind", conn.NewLinuxSocketBind(), true},
+		{"MultiBind", conn.NewMultiBind(conn.NewLinuxSocketBind(), stream), true},
+		{"ObfsBind", conn.NewObfsBind(conn.NewMultiBind(conn.NewLinuxSocketBind(), stream), conn.ObfsConf{Secret: "secret"}), true},
+		{"StdNetBind", conn.NewMultiBind(conn.NewStdNetBind(), stream), false},
+	} {
+		netlinkCancel, err := device.startRouteListener(tt.bind)
+		if err != nil {
+			t.Skipf("netlink is not available: %v", err)
+		}
+		if (netlinkCancel != nil) != tt.sticky {
+			t.Errorf("%v: route listener started:%v, want %v", tt.name, netlinkCancel != nil, tt.sticky)
+		}
+		if netlinkCancel != nil {
+			netlinkCancel.Cancel()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+type trafficKey struct {
+	src mtypes.Vertex
+	dst mtypes.Vertex
+}
+
+type trafficCounter struct {
+	originatedBytes   uint64
+	originatedPackets uint64
+	receivedBytes     uint64
+	receivedPackets   uint64
+	transitedBytes    uint64
+	transitedPackets  uint64
+}
+
+type trafficKind int
+
+const (
+	trafficOriginated trafficKind = iota
+	trafficReceived
+	trafficTransited
+)
+
+func (device *Device) getTrafficCounter(src mtypes.Vertex, dst mtypes.Vertex) *trafficCounter {
+	key := trafficKey{src: src, dst: dst}
+	if val, ok := device.traffic.Load(key); ok {
+		return val.(*trafficCounter)
+	}
+	val, _ := device.traffic.LoadOrStore(key, &trafficCounter{})
+	return val.(*trafficCounter)
+}
+
+// accountTraffic counts one packet of size bytes, keyed by the src/dst node in the EgHeader
+func (device *Device) accountTraffic(kind trafficKind, src mtypes.Vertex, dst mtypes.Vertex, size int) {
+	counter := device.getTrafficCounter(src, dst)
+	switch kind {
+	case trafficOriginated:
+		atomic.AddUint64(&counter.originatedBytes, uint64(size))
+		atomic.AddUint64(&counter.originatedPackets, 1)
+	case trafficReceived:
+		atomic.AddUint64(&counter.receivedBytes, uint64(size))
+		atomic.AddUint64(&counter.receivedPackets, 1)
+	case trafficTransited:
+		atomic.AddUint64(&counter.transitedBytes, uint64(size))
+		atomic.AddUint64(&counter.transitedPackets, 1)
+	}
+}
+
+// GetTrafficMatrix returns a snapshot of the counters since the device started
+func (device *Device) GetTrafficMatrix() mtypes.TrafficMatrix {
+	ret := make(mtypes.TrafficMatrix)
+	device.traffic.Range(func(k, v interface{}) bool {
+		key := k.(trafficKey)
+		counter := v.(*trafficCounter)
+		ret.Add(key.src, key.dst, mtypes.TrafficCounter{
+			OriginatedBytes:   atomic.LoadUint64(&counter.originatedBytes),
+			OriginatedPackets: atomic.LoadUint64(&counter.originatedPackets),
+			ReceivedBytes:     atomic.LoadUint64(&counter.receivedBytes),
+			ReceivedPackets:   atomic.LoadUint64(&counter.receivedPackets),
+			TransitedBytes:    atomic.LoadUint64(&counter.transitedBytes),
+			TransitedPackets:  atomic.LoadUint64(&counter.transitedPackets),
+		})
+		return true
+	})
+	return ret
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestTrafficMatrix(t *testing.T) {
+	device := &Device{}
+	device.accountTraffic(trafficOriginated, 1, 2, 100)
+	device.accountTraffic(trafficOriginated, 1, 2, 50)
+	device.accountTraffic(trafficReceived, 2, 1, 70)
+	device.accountTraffic(trafficTransited, 3, 4, 1400)
+
+	matrix := device.GetTrafficMatrix()
+	want := map[[2]mtypes.Vertex]mtypes.TrafficCounter{
+		{1, 2}: {OriginatedBytes: 150, OriginatedPackets: 2},
+		{2, 1}: {ReceivedBytes: 70, ReceivedPackets: 1},
+		{3, 4}: {TransitedBytes: 1400, TransitedPackets: 1},
+	}
+	for key, counter := range want {
+		if got := matrix[key[0]][key[1]]; got != counter {
+			t.Errorf("matrix[%v][%v] = %+v, want %+v", key[0], key[1], got, counter)
+		}
+	}
+	if len(matrix) != 3 {
+		t.Errorf("matrix has %v src nodes, want 3", len(matrix))
+	}
+
+	// the matrix is a snapshot, later packets don't change it
+	device.accountTraffic(trafficOriginated, 1, 2, 10)
+	if got := matrix[1][2].OriginatedBytes; got != 150 {
+		t.Errorf("snapshot changed to %v after accounting", got)
+	}
+	if got := device.GetTrafficMatrix()[1][2].OriginatedBytes; got != 160 {
+		t.Errorf("OriginatedBytes = %v, want 160", got)
+	}
+
+	// the counters start from zero with the device, the supernode sums the reports of all edges
+	if got := (&Device{}).GetTrafficMatrix(); len(got) != 0 {
+		t.Errorf("new device has traffic %v", got)
+	}
+	sum := make(mtypes.TrafficMatrix)
+	for _, report := range []mtypes.TrafficMatrix{matrix, matrix} {
+		for src, dsts := range report {
+			for dst, counter := range dsts {
+				sum.Add(src, dst, counter)
+			}
+		}
+	}
+	if got := sum[1][2]; got.OriginatedBytes != 300 || got.OriginatedPackets != 4 {
+		t.Errorf("sum[1][2] = %+v, want 300 bytes 4 packets", got)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 )
 
 type IPCError struct {
@@ -133,6 +134,29 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 	return nil
 }
 
+// IpcL2FIBOperation dumps the L2FIB, it's an EtherGuard extension of the configuration protocol.
+func (device *Device) IpcL2FIBOperation(w io.Writer) error {
+	buf := byteBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer byteBufferPool.Put(buf)
+	now := time.Now()
+	for _, entry := range device.l2fib.Dump() {
+		fmt.Fprintf(buf, "mac=%v\n", entry.MAC.String())
+		fmt.Fprintf(buf, "node_id=%v\n", entry.ID)
+		fmt.Fprintf(buf, "static=%v\n", entry.Static)
+		if !entry.Static {
+			fmt.Fprintf(buf, "age_sec=%d\n", int64(now.Sub(entry.Time).Seconds()))
+		}
+		if now.Before(entry.FrozenUntil) {
+			fmt.Fprintf(buf, "frozen_sec=%d\n", int64(entry.FrozenUntil.Sub(now).Seconds()))
+		}
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+	}
+	return nil
+}
+
 // IpcSetOperation implements the WireGuard configuration protocol "set" operation.
 // See https://www.wireguard.com/xplatform/#configuration-protocol for details.
 func (device *Device) IpcSetOperation(r io.Reader) (err error) {
@@ -239,6 +263,80 @@ func (device *Device) handleDeviceLine(key, value string) error {
 		device.log.Verbosef("UAPI: Removing all peers")
 		device.RemoveAllPeers()
 
+	case "l2fib_flush":
+		device.log.Verbosef("UAPI: Flushing L2FIB %v", value)
+		if value == "all" {
+			device.l2fib.Flush(func(entry *L2FIBEntry) bool { return true })
+			break
+		}
+		hw, err := net.ParseMAC(value)
+		if err != nil || len(hw) != 6 {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse l2fib_flush, invalid MAC address: %v", value)
+		}
+		device.l2fib.Flush(func(entry *L2FIBEntry) bool { return bytes.Equal(entry.MAC[:], hw) })
+
+	case "l2fib_flush_node":
+		id, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse l2fib_flush_node: %w", err)
+		}
+		device.log.Verbosef("UAPI: Flushing L2FIB of node %v", value)
+		device.l2fib.Flush(func(entry *L2FIBEntry) bool { return entry.ID == mtypes.Vertex(id) })
+
+	case "capture_filter":
+		if _, err := parseCaptureFilter(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set capture_filter: %w", err)
+		}
+		device.capture.Lock()
+		device.capture.options.Filter = value
+		device.capture.Unlock()
+
+	case "capture_snaplen":
+		snaplen, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse capture_snaplen: %w", err)
+		}
+		device.capture.Lock()
+		device.capture.options.Snaplen = int(snaplen)
+		device.capture.Unlock()
+
+	case "capture_max_size":
+		size, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse capture_max_size: %w", err)
+		}
+		device.capture.Lock()
+		device.capture.options.MaxSize = size
+		device.capture.Unlock()
+
+	case "capture_max_duration":
+		duration, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse capture_max_duration: %w", err)
+		}
+		device.capture.Lock()
+		device.capture.options.MaxDuration = duration
+		device.capture.Unlock()
+
+	case "capture_start":
+		device.log.Verbosef("UAPI: Starting capture to %v", value)
+		device.capture.Lock()
+		options := device.capture.options
+		device.capture.options = CaptureOptions{}
+		device.capture.Unlock()
+		if err := device.StartCapture(value, options); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to start capture: %w", err)
+		}
+
+	case "capture_stop":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set capture_stop, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Stopping capture")
+		if err := device.StopCapture(); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to stop capture: %w", err)
+		}
+
 	default:
 		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
 	}
@@ -434,6 +532,17 @@ func (device *Device) IpcHandle(socket net.Conn) {
 				break
 			}
 			err = device.IpcGetOperation(buffered.Writer)
+		case "l2fib=1\n":
+			var nextByte byte
+			nextByte, err = buffered.ReadByte()
+			if err != nil {
+				return
+			}
+			if nextByte != '\n' {
+				err = ipcErrorf(ipc.IpcErrorInvalid, "trailing character in UAPI l2fib: %q", nextByte)
+				break
+			}
+			err = device.IpcL2FIBOperation(buffered.Writer)
 		default:
 			device.log.Errorf("invalid UAPI operation: %v", op)
 			return
@@ -34,22 +34,73 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 			VPPBridgeID:   4242,
 			MacAddrPrefix: "AA:BB:CC:DD",
 			MTU:           device.DefaultMTU,
+			Queues:        1,
+			Offload:       false,
 			RecvAddr:      "127.0.0.1:4001",
 			SendAddr:      "127.0.0.1:5001",
 			L2HeaderMode:  "nochg",
+			Netstack: mtypes.NetstackInfo{
+				SocksAddr:     "",
+				HttpProxyAddr: "",
+				Forwards:      []mtypes.NetstackForward{},
+			},
 		},
 		NodeID:       1,
 		NodeName:     "Node01",
 		PostScript:   "",
 		DefaultTTL:   200,
 		L2FIBTimeout: 3600,
-		PrivKey:      "6GyDagZKhbm5WNqMiRHhkf43RlbMJ34IieTlIuvfJ1M=",
-		ListenPort:   0,
+		L2FIB: mtypes.L2FIBInfo{
+			MaxMAC:        65536,
+			MaxMACPerNode: 4096,
+			StaticMAC:     map[string]mtypes.Vertex{},
+			MoveThreshold: 5,
+			MoveWindow:    10,
+			FreezeTime:    0,
+		},
+		LoopDetect: mtypes.LoopDetectInfo{
+			UseLoopDetect: false,
+			ProbeInterval: 5,
+			HoldTime:      30,
+			MoveThreshold: 10,
+			MoveWindow:    10,
+			Action:        "elect",
+		},
+		PrivKey:    "6GyDagZKhbm5WNqMiRHhkf43RlbMJ34IieTlIuvfJ1M=",
+		ListenPort: 0,
 		DisableAf: conn.EnabledAf{
 			IPv4: false,
 			IPv6: false,
 		},
 		AfPrefer: 4,
+		StreamTransport: conn.StreamConf{
+			ListenTCP:         false,
+			ListenPortTLS:     0,
+			ListenPortWS:      0,
+			TLSCertFile:       "",
+			TLSKeyFile:        "",
+			TLSServerName:     "",
+			TLSVerify:         false,
+			HttpProxy:         "",
+			KeepaliveInterval: 15,
+		},
+		Obfuscation: conn.ObfsConf{
+			Secret:     "",
+			MaxPadding: 16,
+		},
+		Bonding: mtypes.BondingInfo{
+			Mode:            "",
+			Sources:         []string{},
+			Weight:          1,
+			HealthInterval:  0.2,
+			FailoverTimeout: 0.6,
+		},
+		LANDiscovery: mtypes.LANDiscoveryInfo{
+			UseLANDiscovery: false,
+			GroupV4:         "239.255.77.71:3456",
+			GroupV6:         "[ff02::7771]:3456",
+			Interval:        10,
+		},
 		LogLevel: mtypes.LoggerInfo{
 			LogLevel:    "error",
 			LogTransit:  false,
@@ -64,6 +115,9 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 			DupCheckTimeout:      40,
 			TimeoutCheckInterval: 20,
 			ConnNextTry:          5,
+			ProbeStagger:         0.25,
+			ProbeInterval:        300,
+			NetworkMonitor:       true,
 			AdditionalCost:       10,
 			DampingFilterRadius:  4,
 			SaveNewPeers:         true,
@@ -78,6 +132,11 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 				SuperNodeInfoTimeout: 50,
 				SkipLocalIP:          false,
 				AdditionalLocalIP:    []string{"11.11.11.11:11111"},
+				Cluster:              []mtypes.SuperEndpointInfo{},
+				StateCache: mtypes.StateCacheInfo{
+					CacheFile: "",
+					MaxAge:    86400,
+				},
 			},
 			P2P: mtypes.P2PInfo{
 				UseP2P:           false,
@@ -149,6 +208,10 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 			},
 		},
 		ResetEndPointInterval: 600,
+		DNSResolve: mtypes.DNSResolveInfo{
+			UseDNSResolve: true,
+			MinTTL:        30,
+		},
 		Peers: []mtypes.PeerInfo{
 			{
 				NodeID:              2,
@@ -212,6 +275,21 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 		ListenPort_EdgeAPI:   "3000",
 		ListenPort_ManageAPI: "3000",
 		API_Prefix:           "/eg_api",
+		StreamTransport: conn.StreamConf{
+			ListenTCP:         false,
+			ListenPortTLS:     0,
+			ListenPortWS:      0,
+			TLSCertFile:       "",
+			TLSKeyFile:        "",
+			TLSServerName:     "",
+			TLSVerify:         false,
+			HttpProxy:         "",
+			KeepaliveInterval: 15,
+		},
+		Obfuscation: conn.ObfsConf{
+			Secret:     "",
+			MaxPadding: 16,
+		},
 		LogLevel: mtypes.LoggerInfo{
 			LogLevel:    "error",
 			LogTransit:  false,
@@ -226,6 +304,32 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 		HttpPostInterval:      50,
 		SendPingInterval:      15,
 		ResetEndPointInterval: 600,
+		DNSResolve: mtypes.DNSResolveInfo{
+			UseDNSResolve: true,
+			MinTTL:        30,
+		},
+		NatDetect: mtypes.NatDetectInfo{
+			ReflectorPort: 3001,
+			PunchInterval: 20,
+			PredictPorts:  4,
+		},
+		Relay: mtypes.RelayInfo{
+			UseSuperRelay: false,
+			RelayNodes:    []mtypes.Vertex{},
+			RelayCost:     1000,
+		},
+		Cluster: mtypes.ClusterInfo{
+			UseCluster:      false,
+			Priority:        0,
+			Secret:          random_passwd + "_cluster",
+			SyncInterval:    5,
+			FailoverTimeout: 20,
+			Members:         []mtypes.ClusterMemberInfo{},
+		},
+		Persist: mtypes.PersistInfo{
+			StateFile:    "",
+			SaveInterval: 60,
+		},
 		Passwords: mtypes.Passwords{
 			ShowState:   random_passwd + "_showstate",
 			AddPeer:     random_passwd + "_addpeer",
@@ -279,6 +279,7 @@ func GenSuperCfg(SMCinfigPath string, printExample bool) (err error) {
 		peerceconf.DynamicRoute.SuperNode.PubKeyV6 = PubKeyS6.ToString()
 		peerceconf.DynamicRoute.SuperNode.PSKey = PSKeyE.ToString()
 		peerceconf.PrivKey = PrivKeyE.ToString()
+		peerceconf.Obfuscation = sconfig.Obfuscation
 
 		SuperPeerInfo = append(SuperPeerInfo, mtypes.SuperPeerInfo{
 			NodeID:         i,
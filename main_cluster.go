@@ -0,0 +1,363 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Supernode cluster, primary/backup.
+//
+// Every member sends a ClusterSyncMsg to the others every SyncInterval seconds.
+// The alive member with the highest Priority(then the smallest Name) is the primary,
+// only the primary carries the state: the peers, the JWT secrets and post counters, the latency graph and the PSKs between edges.
+// The backups apply it, so the edges can fail over to any member without registering again.
+// The peers are versioned by Cluster.Generation, increased on every change and saved with them in the config file.
+// A backup replaces its peers only by a newer and non-empty list, and never tells the deleted peers to shut down, only the primary does.
+// A member doesn't claim to be primary during the first FailoverTimeout seconds, it waits for the state from the current primary.
+
+type HttpClusterState struct {
+	Name    string
+	Primary string
+	Members map[string]HttpClusterMember
+}
+
+type HttpClusterMember struct {
+	Priority int
+	Primary  bool
+	LastSeen string
+}
+
+type clusterMember struct {
+	Priority int
+	Primary  bool
+	LastSeen time.Time
+}
+
+type clusterStates struct {
+	sync.RWMutex
+	started time.Time
+	members map[string]*clusterMember
+}
+
+var clusterstate = clusterStates{
+	started: time.Now(),
+	members: make(map[string]*clusterMember),
+}
+
+// clusterOutrank returns true if member a should be the primary rather than b
+func clusterOutrank(aPriority int, aName string, bPriority int, bName string) bool {
+	if aPriority != bPriority {
+		return aPriority > bPriority
+	}
+	return aName < bName
+}
+
+func clusterAlive(m *clusterMember) bool {
+	return m.LastSeen.Add(mtypes.S2TD(httpobj.http_sconfig.Cluster.FailoverTimeout)).After(time.Now())
+}
+
+// ClusterPrimary returns the name of the primary supernode, "" if unknown yet
+func ClusterPrimary() string {
+	conf := httpobj.http_sconfig.Cluster
+	name := httpobj.http_sconfig.NodeName
+	if !conf.UseCluster {
+		return name
+	}
+	clusterstate.RLock()
+	defer clusterstate.RUnlock()
+	primary, priority := "", 0
+	if time.Since(clusterstate.started) >= mtypes.S2TD(conf.FailoverTimeout) {
+		primary, priority = name, conf.Priority
+	}
+	for mname, m := range clusterstate.members {
+		if !clusterAlive(m) {
+			continue
+		}
+		if primary == "" || clusterOutrank(m.Priority, mname, priority, primary) {
+			primary, priority = mname, m.Priority
+		}
+	}
+	return primary
+}
+
+func IsClusterPrimary() bool {
+	return ClusterPrimary() == httpobj.http_sconfig.NodeName
+}
+
+// clusterRejectWrite rejects the changes on the backups, they would be overwritten by the state of the primary
+func clusterRejectWrite(w http.ResponseWriter) bool {
+	if primary := ClusterPrimary(); primary != httpobj.http_sconfig.NodeName {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("Not the primary supernode of the cluster, primary: \"%v\"", primary)))
+		return true
+	}
+	return false
+}
+
+func getClusterSyncMsg() mtypes.ClusterSyncMsg {
+	msg := mtypes.ClusterSyncMsg{
+		Name:     httpobj.http_sconfig.NodeName,
+		Priority: httpobj.http_sconfig.Cluster.Priority,
+		Primary:  IsClusterPrimary(),
+	}
+	if !msg.Primary {
+		return msg
+	}
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	msg.Generation = httpobj.http_sconfig.Cluster.Generation
+	msg.Peers = append(msg.Peers, httpobj.http_sconfig.Peers...)
+	msg.PeerState = exportPeerState()
+	msg.Latency = httpobj.http_graph.ExportLatency()
+	msg.PSKeys = exportPSKeys()
+	return msg
+}
+
+func exportPeerState() map[string]mtypes.ClusterPeerState {
+	// No lock, lock before call me
+	ret := make(map[string]mtypes.ClusterPeerState, len(httpobj.http_PeerState))
+	for PubKey, state := range httpobj.http_PeerState {
+		ret[PubKey] = mtypes.ClusterPeerState{
+			JWTSecret:     state.JETSecret.Load().(mtypes.JWTSecret),
+			HttpPostCount: state.httpPostCount.Load().(uint64),
+			LastSeen:      state.LastSeen.Load().(time.Time),
+		}
+	}
+	return ret
+}
+
+// importPeerState applies the states newer than ours, the post count never goes back
+func importPeerState(states map[string]mtypes.ClusterPeerState) {
+	// No lock, lock before call me
+	for PubKey, rs := range states {
+		state, has := httpobj.http_PeerState[PubKey]
+		if !has || !rs.LastSeen.After(state.LastSeen.Load().(time.Time)) {
+			continue
+		}
+		state.LastSeen.Store(rs.LastSeen)
+		state.JETSecret.Store(rs.JWTSecret)
+		if rs.HttpPostCount > state.httpPostCount.Load().(uint64) {
+			state.httpPostCount.Store(rs.HttpPostCount)
+		}
+	}
+}
+
+func exportPSKeys() (ret []mtypes.ClusterPSK) {
+	httpobj.http_pskdb.Range(func(s mtypes.Vertex, d mtypes.Vertex, psk device.NoisePresharedKey) bool {
+		ret = append(ret, mtypes.ClusterPSK{Src: s, Dst: d, PSKey: psk.ToString()})
+		return true
+	})
+	return
+}
+
+func importPSKeys(pskeys []mtypes.ClusterPSK) {
+	for _, p := range pskeys {
+		if psk, err := device.Str2PSKey(p.PSKey); err == nil {
+			httpobj.http_pskdb.SetPSK(p.Src, p.Dst, psk)
+		}
+	}
+}
+
+// updateNhTableHash updates the NhTable and its hash from the graph, and pushes it
+func updateNhTableHash() {
+	// No lock, lock before call me
+	NhTable := httpobj.http_graph.GetNHTable(true)
+	NhTablestr, _ := json.Marshal(NhTable)
+	md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
+	httpobj.http_NhTable_Hash = hex.EncodeToString(md5_hash_raw[:])
+	httpobj.http_NhTableStr = NhTablestr
+	PushNhTable(false)
+}
+
+// applyClusterState applies the state of the primary
+func applyClusterState(msg mtypes.ClusterSyncMsg) {
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	generation := httpobj.http_sconfig.Cluster.Generation
+	// a member without peers takes them at the same generation too, there is nothing to delete
+	newer := msg.Generation > generation || msg.Generation == generation && len(httpobj.http_sconfig.Peers) == 0
+	if newer && len(msg.Peers) > 0 {
+		applyClusterPeers(msg)
+	} else if msg.Generation < generation && httpobj.http_sconfig.LogLevel.LogControl {
+		fmt.Printf("Control: Cluster peers of %v are older than mine, generation %v < %v, ignored\n", msg.Name, msg.Generation, generation)
+	}
+	importPeerState(msg.PeerState)
+	importPSKeys(msg.PSKeys)
+	if httpobj.http_graph.UpdateLatencyMulti(msg.Latency, true, true) {
+		updateNhTableHash()
+	}
+}
+
+// applyClusterPeers replaces our peers by the newer peers of the primary
+func applyClusterPeers(msg mtypes.ClusterSyncMsg) {
+	// No lock, lock before call me
+	remote := make(map[mtypes.Vertex]mtypes.SuperPeerInfo, len(msg.Peers))
+	for _, peerinfo := range msg.Peers {
+		remote[peerinfo.NodeID] = peerinfo
+	}
+	var peers_new []mtypes.SuperPeerInfo
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		if r, has := remote[peerinfo.NodeID]; !has || r.PubKey != peerinfo.PubKey {
+			super_peerdel(peerinfo.NodeID, false)
+			continue
+		}
+		if remote[peerinfo.NodeID] != peerinfo {
+			peerinfo = remote[peerinfo.NodeID]
+			httpobj.http_PeerID2Info[peerinfo.NodeID] = peerinfo
+		}
+		peers_new = append(peers_new, peerinfo)
+	}
+	for _, peerinfo := range msg.Peers {
+		if _, has := httpobj.http_PeerID2Info[peerinfo.NodeID]; has {
+			continue
+		}
+		if err := super_peeradd(peerinfo); err != nil {
+			fmt.Printf("Error: cluster: add peer %v failed: %v\n", peerinfo.NodeID.ToString(), err)
+			continue
+		}
+		peers_new = append(peers_new, peerinfo)
+	}
+	httpobj.http_sconfig.Peers = peers_new
+	httpobj.http_sconfig.Cluster.Generation = msg.Generation
+	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
+	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
+}
+
+func sendClusterSync(member mtypes.ClusterMemberInfo, body []byte) {
+	client := &http.Client{
+		Timeout: 8 * time.Second,
+	}
+	req, err := http.NewRequest("POST", member.EdgeAPIUrl+"/cluster/sync", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Error: cluster: %v\n", err)
+		return
+	}
+	q := req.URL.Query()
+	q.Add("Secret", httpobj.http_sconfig.Cluster.Secret)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		if httpobj.http_sconfig.LogLevel.LogControl {
+			fmt.Printf("Control: Cluster sync to %v failed: %v\n", member.Name, err)
+		}
+		return
+	}
+	resp.Body.Close()
+}
+
+func RoutineClusterSync() {
+	conf := httpobj.http_sconfig.Cluster
+	if !conf.UseCluster || conf.SyncInterval <= 0 {
+		return
+	}
+	was_primary := false
+	for {
+		msg := getClusterSyncMsg()
+		if msg.Primary != was_primary && httpobj.http_sconfig.LogLevel.LogControl {
+			fmt.Printf("Control: Cluster primary changed, I'm primary:%v\n", msg.Primary)
+		}
+		was_primary = msg.Primary
+		body, err := mtypes.GetByte(&msg)
+		if err == nil {
+			for _, member := range conf.Members {
+				go sendClusterSync(member, body)
+			}
+		}
+		time.Sleep(mtypes.S2TD(conf.SyncInterval))
+	}
+}
+
+func cluster_sync(w http.ResponseWriter, r *http.Request) {
+	conf := httpobj.http_sconfig.Cluster
+	if !conf.UseCluster {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Cluster is disabled"))
+		return
+	}
+	params := r.URL.Query()
+	secret, err := extractParamsStr(params, "Secret", w)
+	if err != nil {
+		return
+	}
+	if !checkPassword(secret, conf.Secret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater Secret: Wrong secret"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Request body: %v", err)))
+		return
+	}
+	msg, err := mtypes.ParseClusterSyncMsg(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Request body: %v", err)))
+		return
+	}
+	if msg.Name == httpobj.http_sconfig.NodeName {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Name: same as mine"))
+		return
+	}
+	clusterstate.Lock()
+	clusterstate.members[msg.Name] = &clusterMember{
+		Priority: msg.Priority,
+		Primary:  msg.Primary,
+		LastSeen: time.Now(),
+	}
+	clusterstate.Unlock()
+	if msg.Primary && ClusterPrimary() == msg.Name {
+		applyClusterState(msg)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func manage_get_cluster(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	password, err := extractParamsStr(params, "Password", w)
+	if err != nil {
+		return
+	}
+	if !checkPassword(password, httpobj.http_passwords.ShowState) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater Password: Wrong password"))
+		return
+	}
+	ret := HttpClusterState{
+		Name:    httpobj.http_sconfig.NodeName,
+		Primary: ClusterPrimary(),
+		Members: make(map[string]HttpClusterMember),
+	}
+	clusterstate.RLock()
+	for name, m := range clusterstate.members {
+		ret.Members[name] = HttpClusterMember{
+			Priority: m.Priority,
+			Primary:  m.Primary,
+			LastSeen: m.LastSeen.String(),
+		}
+	}
+	clusterstate.RUnlock()
+	retbytes, _ := json.Marshal(ret)
+	w.WriteHeader(http.StatusOK)
+	w.Write(retbytes)
+}
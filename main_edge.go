@@ -91,12 +91,22 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		thetap, err = tap.CreateSockTAP(econfig.Interface, "unixgram", econfig.NodeID, econfig.LogLevel)
 	case "unixpacketsock":
 		thetap, err = tap.CreateSockTAP(econfig.Interface, "unixpacket", econfig.NodeID, econfig.LogLevel)
+	case "qemutcpsock":
+		thetap, err = tap.CreateQemuSockTAP(econfig.Interface, "tcp", econfig.NodeID, econfig.LogLevel)
+	case "qemuunixsock":
+		thetap, err = tap.CreateQemuSockTAP(econfig.Interface, "unix", econfig.NodeID, econfig.LogLevel)
+	case "vde":
+		thetap, err = tap.CreateVdeTAP(econfig.Interface, econfig.NodeID, econfig.LogLevel)
 	case "fd":
 		thetap, err = tap.CreateFdTAP(econfig.Interface, econfig.NodeID)
 	case "vpp":
 		thetap, err = tap.CreateVppTAP(econfig.Interface, econfig.NodeID, econfig.LogLevel.LogLevel)
-	case "tap":
+	case "tap", "tun":
 		thetap, err = tap.CreateTAP(econfig.Interface, econfig.NodeID)
+	case "afpacket":
+		thetap, err = tap.CreateAfPacketTAP(econfig.Interface, econfig.NodeID)
+	case "netstack":
+		thetap, err = tap.CreateNetstackTAP(econfig.Interface, econfig.NodeID)
 	default:
 		return errors.New("Unknown interface type:" + econfig.Interface.IType)
 	}
@@ -125,7 +135,11 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		IPv6: !econfig.DisableAf.IPv6,
 	}
 
-	the_device := device.NewDevice(thetap, econfig.NodeID, conn.NewDefaultBind(EnabledAf, bindmode), logger, graph, false, configPath, &econfig, nil, nil, Version)
+	bind := conn.NewMultiBind(conn.NewDefaultBind(EnabledAf, bindmode), conn.NewStreamBind(econfig.StreamTransport, EnabledAf))
+	if econfig.Obfuscation.Secret != "" {
+		bind = conn.NewObfsBind(bind, econfig.Obfuscation)
+	}
+	the_device := device.NewDevice(thetap, econfig.NodeID, bind, logger, graph, false, configPath, &econfig, nil, nil, Version)
 	defer the_device.Close()
 	pk, err := device.Str2PriKey(econfig.PrivKey)
 	if err != nil {
@@ -151,6 +165,13 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 				return err
 			}
 		}
+		if len(peerconf.BondEndPoints) > 0 {
+			err = the_device.LookupPeer(pk).SetBondEndpoints(peerconf.BondEndPoints)
+			if err != nil {
+				logger.Errorf("Failed to set bond endpoints of peer %v: %v", peerconf.NodeID, err)
+				return err
+			}
+		}
 	}
 
 	if econfig.DynamicRoute.SuperNode.UseSuperNode {
@@ -173,7 +194,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 			}
 			peer.SetPSK(psk)
 			StaticSuper := true
-			sc := econfig.DynamicRoute.SuperNode.EndpointV4
+			_, sc := conn.SplitScheme(econfig.DynamicRoute.SuperNode.EndpointV4)
 			if strings.Contains(sc, ":") {
 				i := strings.LastIndex(sc, ":")
 				sch := sc[:i]
@@ -203,7 +224,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 			}
 			peer.SetPSK(psk)
 			StaticSuper := true
-			sc := econfig.DynamicRoute.SuperNode.EndpointV6
+			_, sc := conn.SplitScheme(econfig.DynamicRoute.SuperNode.EndpointV6)
 			if strings.Contains(sc, ":") {
 				i := strings.LastIndex(sc, ":")
 				sch := sc[:i]
@@ -221,6 +242,9 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 			}
 		}
 	}
+	if err := the_device.LoadStateCache(); err != nil {
+		logger.Errorf("Failed to load the state cache: %v", err)
+	}
 
 	logger.Verbosef("Device started")
 
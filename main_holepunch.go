@@ -0,0 +1,217 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/ratelimiter"
+)
+
+// Both sides of a pair punch at HolePunchDelay later, so that both of them received the HolePunch
+const HolePunchDelay = 1 * time.Second
+
+type HttpNatState struct {
+	Nat   map[mtypes.Vertex]mtypes.NatReport
+	Relay [][2]mtypes.Vertex // pairs which can't connect directly
+}
+
+var natstate struct {
+	sync.RWMutex
+	relay [][2]mtypes.Vertex
+}
+
+// RoutineNatReflector replies the endpoint of the NatProbe it observed, and the endpoint observed by the supernode.
+// Then replies again from another port, to detect the filtering.
+// Only the probes tagged by a known edge are answered, and the replies to every source address are rate limited,
+// so it can't be used for amplification with spoofed source addresses.
+func RoutineNatReflector(network string, port int, the_device *device.Device) {
+	if port <= 0 {
+		return
+	}
+	c, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+	if err != nil {
+		fmt.Printf("Error: NAT reflector listen %v port %v failed: %v\n", network, port, err)
+		return
+	}
+	defer c.Close()
+	changed, err := net.ListenUDP(network, nil)
+	if err != nil {
+		fmt.Printf("Error: NAT reflector listen %v failed: %v\n", network, err)
+		return
+	}
+	defer changed.Close()
+	var limiter ratelimiter.Ratelimiter
+	limiter.Init()
+	defer limiter.Close()
+	buf := make([]byte, device.MaxMessageSize)
+	for {
+		n, src, err := c.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("Error: NAT reflector stopped: %v\n", err)
+			return
+		}
+		if n <= 2 || path.Usage(buf[0]) != path.NatProbe {
+			continue
+		}
+		if !limiter.Allow(src.IP) {
+			continue
+		}
+		content, err := mtypes.ParseNatProbeMsg(buf[2:n])
+		if err != nil {
+			continue
+		}
+		httpobj.RLock()
+		_, known := httpobj.http_PeerID2Info[content.Node_id]
+		httpobj.RUnlock()
+		if !known {
+			continue
+		}
+		peer := the_device.LookupPeerByID(content.Node_id)
+		if peer == nil || !peer.VerifyNatProbe(content) {
+			continue
+		}
+		content.Observed = src.String()
+		content.SuperObserved = the_device.GetConnurl(content.Node_id)
+		for _, reply := range []struct {
+			conn        *net.UDPConn
+			changedPort bool
+		}{{c, false}, {changed, true}} {
+			content.ChangedPort = reply.changedPort
+			peer.SignNatProbe(&content)
+			packet, err := device.NewNatProbePacket(content)
+			if err != nil {
+				break
+			}
+			reply.conn.WriteToUDP(packet, src)
+		}
+	}
+}
+
+func sendHolePunch(the_device *device.Device, PubKey string, content mtypes.HolePunchMsg) {
+	params, _ := json.Marshal(content)
+	body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+		Node_id: mtypes.NodeID_SuperNode,
+		Action:  mtypes.HolePunch,
+		Code:    0,
+		Params:  string(params),
+	})
+	if err != nil {
+		fmt.Println("Error get byte")
+		return
+	}
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
+	header.SetDst(mtypes.NodeID_SuperNode)
+	header.SetSrc(mtypes.NodeID_SuperNode)
+	copy(buf[path.EgHeaderLen:], body)
+	if peer := the_device.LookupPeerByStr(PubKey); peer != nil && peer.GetEndpointDstStr() != "" {
+		the_device.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+	}
+}
+
+// CoordinateHolePunch tells the pairs of alive peers without a direct connection to punch at the same moment
+func CoordinateHolePunch(predict int) {
+	type natPeer struct {
+		ID     mtypes.Vertex
+		PubKey string
+		Nat    mtypes.NatReport
+	}
+	httpobj.RLock()
+	peers := make([]natPeer, 0, len(httpobj.http_sconfig.Peers))
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		state, has := httpobj.http_PeerState[peerinfo.PubKey]
+		if !has || state.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).Before(time.Now()) {
+			continue
+		}
+		peers = append(peers, natPeer{peerinfo.NodeID, peerinfo.PubKey, state.Nat.Load().(mtypes.NatReport)})
+	}
+	httpobj.RUnlock()
+
+	relay := make([][2]mtypes.Vertex, 0)
+	punchAt := httpobj.http_graph.GetCurrentTime().Add(HolePunchDelay)
+	for i, a := range peers {
+		for _, b := range peers[i+1:] {
+			if httpobj.http_graph.Weight(a.ID, b.ID, false) < mtypes.Infinity || httpobj.http_graph.Weight(b.ID, a.ID, false) < mtypes.Infinity {
+				continue
+			}
+			needRelay, punched := false, false
+			for _, af := range []struct {
+				a, b       mtypes.NatInfo
+				the_device *device.Device
+			}{
+				{a.Nat.V4, b.Nat.V4, httpobj.http_device4},
+				{a.Nat.V6, b.Nat.V6, httpobj.http_device6},
+			} {
+				toA, toB, r := device.PlanHolePunch(af.a, af.b, predict)
+				needRelay = needRelay || r
+				if len(toA) > 0 {
+					sendHolePunch(af.the_device, a.PubKey, mtypes.HolePunchMsg{PeerID: b.ID, Endpoints: toA, Time: punchAt})
+					punched = true
+				}
+				if len(toB) > 0 {
+					sendHolePunch(af.the_device, b.PubKey, mtypes.HolePunchMsg{PeerID: a.ID, Endpoints: toB, Time: punchAt})
+					punched = true
+				}
+			}
+			if needRelay && !punched {
+				relay = append(relay, [2]mtypes.Vertex{a.ID, b.ID})
+			}
+		}
+	}
+	sort.Slice(relay, func(i, j int) bool {
+		return relay[i][0] < relay[j][0] || (relay[i][0] == relay[j][0] && relay[i][1] < relay[j][1])
+	})
+	natstate.Lock()
+	natstate.relay = relay
+	natstate.Unlock()
+}
+
+func RoutineHolePunch(interval time.Duration, predict int) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		CoordinateHolePunch(predict)
+	}
+}
+
+func manage_get_nat(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	password, err := extractParamsStr(params, "Password", w)
+	if err != nil {
+		return
+	}
+	if !checkPassword(password, httpobj.http_passwords.ShowState) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater Password: Wrong password"))
+		return
+	}
+	ret := HttpNatState{
+		Nat: make(map[mtypes.Vertex]mtypes.NatReport),
+	}
+	httpobj.RLock()
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		ret.Nat[peerinfo.NodeID] = httpobj.http_PeerState[peerinfo.PubKey].Nat.Load().(mtypes.NatReport)
+	}
+	httpobj.RUnlock()
+	natstate.RLock()
+	ret.Relay = natstate.relay
+	natstate.RUnlock()
+	retbytes, _ := json.Marshal(ret)
+	w.WriteHeader(http.StatusOK)
+	w.Write(retbytes)
+}
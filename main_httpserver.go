@@ -18,6 +18,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"net"
 	"net/http"
 	"net/url"
 
@@ -35,6 +36,8 @@ type http_shared_objects struct {
 	http_graph         *path.IG
 	http_device4       *device.Device
 	http_device6       *device.Device
+	http_stream4       *conn.StreamBind
+	http_stream6       *conn.StreamBind
 	http_HashSalt      []byte
 	http_NhTable_Hash  string
 	http_PeerInfo_hash string
@@ -66,6 +69,8 @@ var (
 type HttpPeerLocalIP struct {
 	LocalIPv4 map[string]float64
 	LocalIPv6 map[string]float64
+	IPv4CIDR  string
+	IPv6CIDR  string
 }
 
 type HttpState struct {
@@ -90,6 +95,14 @@ type PeerState struct {
 	JETSecret             atomic.Value // mtypes.JWTSecret
 	httpPostCount         atomic.Value // uint64
 	LastSeen              atomic.Value // time.Time
+	Traffic               atomic.Value // mtypes.PeerTraffic
+	Bonding               atomic.Value // mtypes.BondStats
+	Nat                   atomic.Value // mtypes.NatReport
+}
+
+type HttpTraffic struct {
+	Matrix  mtypes.TrafficMatrix
+	Reports map[mtypes.Vertex]mtypes.TrafficMatrix
 }
 
 func extractParamsStr(params url.Values, key string, w http.ResponseWriter) (string, error) {
@@ -181,9 +194,11 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 			continue
 		}
 		api_peerinfo[peerinfo.PubKey] = mtypes.API_Peerinfo{
-			NodeID:  peerinfo.NodeID,
-			PSKey:   peerinfo.PSKey,
-			Connurl: &mtypes.API_connurl{},
+			NodeID:   peerinfo.NodeID,
+			PSKey:    peerinfo.PSKey,
+			Connurl:  &mtypes.API_connurl{},
+			IPv4CIDR: httpobj.http_PeerIPs[peerinfo.PubKey].IPv4CIDR,
+			IPv6CIDR: httpobj.http_PeerIPs[peerinfo.PubKey].IPv6CIDR,
 		}
 		if httpobj.http_PeerState[peerinfo.PubKey].LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now()) {
 			if connV4 != "" {
@@ -208,6 +223,21 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 	return
 }
 
+// edge_websocket accepts the WebSocket transport of the edges, by the session of the address family
+func edge_websocket(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		httpobj.http_stream4.ServeHTTP(w, r)
+	} else {
+		httpobj.http_stream6.ServeHTTP(w, r)
+	}
+}
+
 func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 	// Read all params
 	params := r.URL.Query()
@@ -260,6 +290,7 @@ func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
 		AdditionalCost:      httpobj.http_PeerID2Info[NodeID].AdditionalCost,
 		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
+		NatReflectorPort:    httpobj.http_sconfig.NatDetect.ReflectorPort,
 	}
 	SuperParamStr, _ := json.Marshal(SuperParams)
 	httpobj.http_PeerState[PubKey].SuperParamStateClient.Store(State)
@@ -486,8 +517,18 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 
 	httpobj.http_PeerIPs[PubKey].LocalIPv4 = client_report.LocalV4s
 	httpobj.http_PeerIPs[PubKey].LocalIPv6 = client_report.LocalV6s
+	httpobj.http_PeerIPs[PubKey].IPv4CIDR = client_report.IPv4CIDR
+	httpobj.http_PeerIPs[PubKey].IPv6CIDR = client_report.IPv6CIDR
 	httpobj.http_PeerState[PubKey].httpPostCount.Store(client_PostCount + 1)
 	httpobj.http_PeerState[PubKey].LastSeen.Store(time.Now())
+	if client_report.Traffic != nil {
+		traffic := httpobj.http_PeerState[PubKey].Traffic.Load().(mtypes.PeerTraffic)
+		httpobj.http_PeerState[PubKey].Traffic.Store(traffic.Update(client_report.Traffic))
+	}
+	if client_report.Bonding != nil {
+		httpobj.http_PeerState[PubKey].Bonding.Store(client_report.Bonding)
+	}
+	httpobj.http_PeerState[PubKey].Nat.Store(client_report.Nat)
 
 	applied_pones := make([]mtypes.PongMsg, 0, len(client_report.Pongs))
 	for _, pong_msg := range client_report.Pongs {
@@ -585,6 +626,64 @@ func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
 	w.Write(httpobj.http_StateString_tmp)
 }
 
+func manage_get_traffic(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	password, err := extractParamsStr(params, "Password", w)
+	if err != nil {
+		return
+	}
+	if !checkPassword(password, httpobj.http_passwords.ShowState) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater Password: Wrong password"))
+		return
+	}
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	ht := HttpTraffic{
+		Matrix:  make(mtypes.TrafficMatrix),
+		Reports: make(map[mtypes.Vertex]mtypes.TrafficMatrix),
+	}
+	// Each edge only reports the traffic it originated, received or transited, so the sum of all reports is the network-wide matrix
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		report := httpobj.http_PeerState[peerinfo.PubKey].Traffic.Load().(mtypes.PeerTraffic).Total()
+		ht.Reports[peerinfo.NodeID] = report
+		for src, dsts := range report {
+			for dst, counter := range dsts {
+				ht.Matrix.Add(src, dst, counter)
+			}
+		}
+	}
+	ret, _ := json.Marshal(ht)
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
+}
+
+func manage_get_bonding(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	password, err := extractParamsStr(params, "Password", w)
+	if err != nil {
+		return
+	}
+	if !checkPassword(password, httpobj.http_passwords.ShowState) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater Password: Wrong password"))
+		return
+	}
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	// indexed by [reporter][peer]
+	ret := make(map[mtypes.Vertex]mtypes.BondStats)
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		report := httpobj.http_PeerState[peerinfo.PubKey].Bonding.Load().(mtypes.BondStats)
+		if len(report) > 0 {
+			ret[peerinfo.NodeID] = report
+		}
+	}
+	retbytes, _ := json.Marshal(ret)
+	w.WriteHeader(http.StatusOK)
+	w.Write(retbytes)
+}
+
 func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
 	password, err := extractParamsStr(params, "Password", w)
@@ -596,6 +695,9 @@ func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Paramater Password: Wrong password"))
 		return
 	}
+	if clusterRejectWrite(w) {
+		return
+	}
 
 	r.ParseForm()
 	NodeID, err := extractParamsVertex(r.Form, "NodeID", w)
@@ -696,6 +798,7 @@ func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 		AdditionalCost: AdditionalCost,
 		SkipLocalIP:    SkipLocalIP,
 	})
+	httpobj.http_sconfig.Cluster.Generation++
 	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
 	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
 	httpobj.http_econfig_tmp.NodeID = NodeID
@@ -704,6 +807,7 @@ func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.PSKey = PSKey
 	httpobj.http_econfig_tmp.DynamicRoute.AdditionalCost = AdditionalCost
 	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.SkipLocalIP = SkipLocalIP
+	httpobj.http_econfig_tmp.Obfuscation = httpobj.http_sconfig.Obfuscation
 	httpobj.http_econfig_tmp.NextHopTable = make(mtypes.NextHopTable)
 	httpobj.http_econfig_tmp.Peers = make([]mtypes.PeerInfo, 0)
 	ret_str_byte, _ := yaml.Marshal(&httpobj.http_econfig_tmp)
@@ -727,6 +831,9 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Paramater Password: Wrong password"))
 		return
 	}
+	if clusterRejectWrite(w) {
+		return
+	}
 	NodeID, err = extractParamsVertex(params, "NodeID", w)
 	if err != nil {
 		return
@@ -768,6 +875,7 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
 		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
 		AdditionalCost:      new_superpeerinfo.AdditionalCost,
+		NatReflectorPort:    httpobj.http_sconfig.NatDetect.ReflectorPort,
 	}
 
 	SuperParamStr, _ := json.Marshal(SuperParams)
@@ -784,6 +892,7 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	httpobj.http_sconfig.Peers = peers_new
+	httpobj.http_sconfig.Cluster.Generation++
 	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
 	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
 	w.WriteHeader(http.StatusOK)
@@ -872,6 +981,7 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 		PeerAliveTimeout:    httpobj.http_sconfig.PeerAliveTimeout,
 		DampingFilterRadius: httpobj.http_sconfig.DampingFilterRadius,
 		AdditionalCost:      10,
+		NatReflectorPort:    httpobj.http_sconfig.NatDetect.ReflectorPort,
 	}
 	httpobj.Lock()
 	defer httpobj.Unlock()
@@ -904,6 +1014,9 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 	password, pwderr := extractParamsStr(params, "Password", nil)
 	httpobj.Lock()
 	defer httpobj.Unlock()
+	if clusterRejectWrite(w) {
+		return
+	}
 	if pwderr == nil { // user provide the password
 		if checkPassword(password, httpobj.http_passwords.DelPeer) {
 			NodeID, err = extractParamsVertex(params, "NodeID", w)
@@ -949,13 +1062,14 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 	var peers_new []mtypes.SuperPeerInfo
 	for _, peerinfo := range httpobj.http_sconfig.Peers {
 		if peerinfo.NodeID == toDelete {
-			super_peerdel(peerinfo.NodeID)
+			super_peerdel(peerinfo.NodeID, true)
 		} else {
 			peers_new = append(peers_new, peerinfo)
 		}
 	}
 
 	httpobj.http_sconfig.Peers = peers_new
+	httpobj.http_sconfig.Cluster.Generation++
 	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
 	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
 	w.WriteHeader(http.StatusOK)
@@ -978,10 +1092,16 @@ func HttpServer(edgeListen string, manageListen string, apiprefix string, errcha
 		mux.HandleFunc(apiprefix+"/edge/peerinfo", edge_get_peerinfo)
 		mux.HandleFunc(apiprefix+"/edge/nhtable", edge_get_nhtable)
 		mux.HandleFunc(apiprefix+"/edge/post/nodeinfo", edge_post_nodeinfo)
+		mux.HandleFunc(apiprefix+"/edge/ws", edge_websocket)
+		mux.HandleFunc(apiprefix+"/cluster/sync", cluster_sync)
 		mux.HandleFunc(apiprefix+"/manage/peer/add", manage_peeradd)
 		mux.HandleFunc(apiprefix+"/manage/peer/del", manage_peerdel)
 		mux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
 		mux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
+		mux.HandleFunc(apiprefix+"/manage/super/traffic", manage_get_traffic)
+		mux.HandleFunc(apiprefix+"/manage/super/bonding", manage_get_bonding)
+		mux.HandleFunc(apiprefix+"/manage/super/nat", manage_get_nat)
+		mux.HandleFunc(apiprefix+"/manage/super/cluster", manage_get_cluster)
 		mux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
 
 		go func() {
@@ -998,10 +1118,16 @@ func HttpServer(edgeListen string, manageListen string, apiprefix string, errcha
 		edgemux.HandleFunc(apiprefix+"/edge/peerinfo", edge_get_peerinfo)
 		edgemux.HandleFunc(apiprefix+"/edge/nhtable", edge_get_nhtable)
 		edgemux.HandleFunc(apiprefix+"/edge/post/nodeinfo", edge_post_nodeinfo)
+		edgemux.HandleFunc(apiprefix+"/edge/ws", edge_websocket)
+		edgemux.HandleFunc(apiprefix+"/cluster/sync", cluster_sync)
 		managemux.HandleFunc(apiprefix+"/manage/peer/add", manage_peeradd)
 		managemux.HandleFunc(apiprefix+"/manage/peer/del", manage_peerdel)
 		managemux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
 		managemux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
+		managemux.HandleFunc(apiprefix+"/manage/super/traffic", manage_get_traffic)
+		managemux.HandleFunc(apiprefix+"/manage/super/bonding", manage_get_bonding)
+		managemux.HandleFunc(apiprefix+"/manage/super/nat", manage_get_nat)
+		managemux.HandleFunc(apiprefix+"/manage/super/cluster", manage_get_cluster)
 		managemux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
 
 		go func() {
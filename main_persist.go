@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Supernode state persistence.
+//
+// The runtime state which is not in the config file: the JWT secrets, post counters, last seen time and traffic of the peers,
+// the latency graph, the PSKs between edges and the NextHopTable, is saved to the StateFile
+// every SaveInterval seconds and on shutdown.
+// On start it's loaded with the validity windows applied:
+// the latencies are restored with the TTL left, and the NextHopTable only if the snapshot is younger than PeerAliveTimeout.
+// The hash salt is restored too, so the edges with an up-to-date NextHopTable won't download it again.
+
+func getSuperStateSnapshot() mtypes.SuperStateSnapshot {
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	return mtypes.SuperStateSnapshot{
+		Time:      time.Now(),
+		HashSalt:  httpobj.http_HashSalt,
+		PeerState: exportPeerState(),
+		Latency:   httpobj.http_graph.ExportLatency(),
+		PSKeys:    exportPSKeys(),
+		NhTable:   httpobj.http_graph.GetNHTable(false),
+		Traffic:   exportPeerTraffic(),
+	}
+}
+
+func exportPeerTraffic() map[string]mtypes.PeerTraffic {
+	// No lock, lock before call me
+	ret := make(map[string]mtypes.PeerTraffic, len(httpobj.http_PeerState))
+	for PubKey, state := range httpobj.http_PeerState {
+		ret[PubKey] = state.Traffic.Load().(mtypes.PeerTraffic)
+	}
+	return ret
+}
+
+// SaveSuperState writes the snapshot to a temporary file and renames it, so the StateFile is never half written
+func SaveSuperState(statefile string) error {
+	if statefile == "" {
+		return nil
+	}
+	snapshot := getSuperStateSnapshot()
+	body, err := mtypes.GetByte(&snapshot)
+	if err != nil {
+		return err
+	}
+	tmpfile := statefile + ".tmp"
+	if err := ioutil.WriteFile(tmpfile, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, statefile)
+}
+
+// LoadSuperState restores the snapshot in the StateFile. It's fine if the StateFile doesn't exist.
+func LoadSuperState(statefile string) error {
+	if statefile == "" {
+		return nil
+	}
+	body, err := ioutil.ReadFile(statefile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	snapshot, err := mtypes.ParseSuperStateSnapshot(body)
+	if err != nil {
+		return fmt.Errorf("error parse state file %v: %v", statefile, err)
+	}
+	elapsed := time.Since(snapshot.Time)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	latency := make([]mtypes.PongMsg, 0, len(snapshot.Latency))
+	for _, pong := range snapshot.Latency {
+		pong.TimeToAlive -= elapsed.Seconds()
+		if pong.TimeToAlive <= 0 {
+			continue
+		}
+		latency = append(latency, pong)
+	}
+
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	importPeerState(snapshot.PeerState)
+	importPSKeys(snapshot.PSKeys)
+	for PubKey, traffic := range snapshot.Traffic {
+		if state, has := httpobj.http_PeerState[PubKey]; has {
+			state.Traffic.Store(traffic)
+		}
+	}
+	if len(snapshot.HashSalt) > 0 {
+		httpobj.http_HashSalt = snapshot.HashSalt
+	}
+	restoreNh := elapsed < mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout) && !httpobj.http_sconfig.GraphRecalculateSetting.StaticMode && snapshot.NhTable != nil
+	if restoreNh {
+		httpobj.http_graph.SetNHTable(snapshot.NhTable)
+		httpobj.http_graph.UpdateLatencyMulti(latency, false, false)
+	} else {
+		httpobj.http_graph.UpdateLatencyMulti(latency, true, false)
+	}
+	NhTable := httpobj.http_graph.GetNHTable(false)
+	NhTablestr, _ := json.Marshal(NhTable)
+	md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
+	httpobj.http_NhTable_Hash = hex.EncodeToString(md5_hash_raw[:])
+	httpobj.http_NhTableStr = NhTablestr
+	if httpobj.http_sconfig.LogLevel.LogControl {
+		fmt.Printf("Control: Loaded the state saved %v ago, %v peers, %v latencies, NextHopTable restored:%v\n", elapsed.Round(time.Second), len(snapshot.PeerState), len(latency), restoreNh)
+	}
+	return nil
+}
+
+func RoutineSaveSuperState(statefile string, interval time.Duration) {
+	if statefile == "" || interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		if err := SaveSuperState(statefile); err != nil {
+			fmt.Printf("Error: Save state to %v failed: %v\n", statefile, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+const testPersistPubKey = "peer1"
+
+// newTestSuperState resets httpobj to a supernode with one peer and an empty graph
+func newTestSuperState(t *testing.T) {
+	t.Helper()
+	graph, err := path.NewGraph(3, true, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpobj.http_sconfig = &mtypes.SuperConfig{PeerAliveTimeout: 70}
+	httpobj.http_graph = graph
+	httpobj.http_pskdb = device.PSKDB{}
+	httpobj.http_HashSalt = []byte("salt of this run")
+	httpobj.http_NhTable_Hash = ""
+	httpobj.http_NhTableStr = nil
+	PS := PeerState{}
+	PS.JETSecret.Store(mtypes.JWTSecret{})
+	PS.httpPostCount.Store(uint64(0))
+	PS.LastSeen.Store(time.Time{})
+	PS.Traffic.Store(mtypes.PeerTraffic{})
+	httpobj.http_PeerState = map[string]*PeerState{testPersistPubKey: &PS}
+}
+
+func writeTestSnapshot(t *testing.T, statefile string, snapshot mtypes.SuperStateSnapshot) {
+	t.Helper()
+	body, err := mtypes.GetByte(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(statefile, body, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSuperStateRoundTrip(t *testing.T) {
+	statefile := filepath.Join(t.TempDir(), "state.bin")
+	psk, err := device.Str2PSKey("iPM8FXfnHVzwjguZHRW9bLNY+h7+B1O2oTJtktptQkI=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := mtypes.JWTSecret{1, 2, 3}
+	lastSeen := time.Now().Round(0)
+
+	newTestSuperState(t)
+	state := httpobj.http_PeerState[testPersistPubKey]
+	state.JETSecret.Store(secret)
+	state.httpPostCount.Store(uint64(42))
+	state.LastSeen.Store(lastSeen)
+	traffic := mtypes.PeerTraffic{
+		Base: mtypes.TrafficMatrix{1: {2: {OriginatedBytes: 1000}}},
+		Last: mtypes.TrafficMatrix{1: {2: {OriginatedBytes: 10}}},
+	}
+	state.Traffic.Store(traffic)
+	httpobj.http_HashSalt = []byte("salt of the saved run")
+	httpobj.http_pskdb.SetPSK(2, 1, psk)
+	for _, id := range []mtypes.Vertex{1, 2} {
+		httpobj.http_graph.UpdateLatency(id, 3, 0.01, 60, 0, false, false)
+		httpobj.http_graph.UpdateLatency(3, id, 0.01, 60, 0, false, false)
+	}
+	httpobj.http_graph.RecalculateNhTable(false)
+	nhTable := httpobj.http_graph.GetNHTable(false)
+	if nhTable[1][2] != 3 {
+		t.Fatalf("NhTable[1][2] = %v, want 3", nhTable[1][2])
+	}
+	if err := SaveSuperState(statefile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(statefile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left after save: %v", err)
+	}
+
+	newTestSuperState(t)
+	if err := LoadSuperState(statefile); err != nil {
+		t.Fatal(err)
+	}
+	state = httpobj.http_PeerState[testPersistPubKey]
+	if got := state.JETSecret.Load().(mtypes.JWTSecret); got != secret {
+		t.Errorf("JWTSecret = %v, want %v", got, secret)
+	}
+	if got := state.httpPostCount.Load().(uint64); got != 42 {
+		t.Errorf("httpPostCount = %v, want 42", got)
+	}
+	if got := state.LastSeen.Load().(time.Time); !got.Equal(lastSeen) {
+		t.Errorf("LastSeen = %v, want %v", got, lastSeen)
+	}
+	if got := state.Traffic.Load().(mtypes.PeerTraffic); got.Base[1][2] != traffic.Base[1][2] || got.Last[1][2] != traffic.Last[1][2] {
+		t.Errorf("Traffic = %v, want %v", got, traffic)
+	}
+	if got := httpobj.http_pskdb.GetPSK(1, 2); got != psk {
+		t.Errorf("PSK of 1-2 not restored")
+	}
+	if got := len(httpobj.http_graph.ExportLatency()); got != 4 {
+		t.Errorf("%v latencies restored, want 4", got)
+	}
+	if got := httpobj.http_graph.GetNHTable(false)[1][2]; got != 3 {
+		t.Errorf("NhTable[1][2] = %v, want 3", got)
+	}
+	if string(httpobj.http_HashSalt) != "salt of the saved run" {
+		t.Errorf("HashSalt = %q, want the saved one", httpobj.http_HashSalt)
+	}
+	if httpobj.http_NhTable_Hash == "" || len(httpobj.http_NhTableStr) == 0 {
+		t.Errorf("NhTable hash is not updated")
+	}
+}
+
+func TestSuperStateLatencyTTL(t *testing.T) {
+	statefile := filepath.Join(t.TempDir(), "state.bin")
+	writeTestSnapshot(t, statefile, mtypes.SuperStateSnapshot{
+		Time: time.Now().Add(-30 * time.Second),
+		Latency: []mtypes.PongMsg{
+			{Src_nodeID: 1, Dst_nodeID: 2, Timediff: 0.01, TimeToAlive: 10},
+			{Src_nodeID: 2, Dst_nodeID: 1, Timediff: 0.01, TimeToAlive: 60},
+		},
+	})
+	newTestSuperState(t)
+	if err := LoadSuperState(statefile); err != nil {
+		t.Fatal(err)
+	}
+	latency := httpobj.http_graph.ExportLatency()
+	if len(latency) != 1 {
+		t.Fatalf("%v latencies restored, want 1: the other one expired", len(latency))
+	}
+	if pong := latency[0]; pong.Src_nodeID != 2 || pong.TimeToAlive > 30 || pong.TimeToAlive < 25 {
+		t.Errorf("restored %v, want 2->1 with about 30 seconds left", pong.ToString())
+	}
+}
+
+func TestSuperStateNhTableWindow(t *testing.T) {
+	for _, tt := range []struct {
+		age      time.Duration
+		restored bool
+	}{
+		{10 * time.Second, true},
+		{100 * time.Second, false},
+	} {
+		statefile := filepath.Join(t.TempDir(), "state.bin")
+		writeTestSnapshot(t, statefile, mtypes.SuperStateSnapshot{
+			Time:    time.Now().Add(-tt.age),
+			NhTable: mtypes.NextHopTable{1: {2: 3}},
+		})
+		newTestSuperState(t)
+		if err := LoadSuperState(statefile); err != nil {
+			t.Fatal(err)
+		}
+		if restored := httpobj.http_graph.GetNHTable(false)[1][2] == 3; restored != tt.restored {
+			t.Errorf("snapshot of %v ago with PeerAliveTimeout %v: NhTable restored:%v, want %v", tt.age, httpobj.http_sconfig.PeerAliveTimeout, restored, tt.restored)
+		}
+	}
+}
+
+func TestSuperStateMissingFile(t *testing.T) {
+	newTestSuperState(t)
+	if err := SaveSuperState(""); err != nil {
+		t.Errorf("SaveSuperState without StateFile: %v", err)
+	}
+	if err := LoadSuperState(""); err != nil {
+		t.Errorf("LoadSuperState without StateFile: %v", err)
+	}
+	if err := LoadSuperState(filepath.Join(t.TempDir(), "missing.bin")); err != nil {
+		t.Errorf("LoadSuperState of a missing file: %v", err)
+	}
+
+	statefile := filepath.Join(t.TempDir(), "state.bin")
+	if err := ioutil.WriteFile(statefile, []byte("not a snapshot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadSuperState(statefile); err == nil {
+		t.Errorf("LoadSuperState of a corrupt file succeeded")
+	}
+	if string(httpobj.http_HashSalt) != "salt of this run" || httpobj.http_NhTable_Hash != "" {
+		t.Errorf("the corrupt file changed the state")
+	}
+}
+
+func TestPeerTrafficRestart(t *testing.T) {
+	statefile := filepath.Join(t.TempDir(), "state.bin")
+	report := func(bytes ...uint64) {
+		state := httpobj.http_PeerState[testPersistPubKey]
+		for _, b := range bytes {
+			traffic := state.Traffic.Load().(mtypes.PeerTraffic)
+			state.Traffic.Store(traffic.Update(mtypes.TrafficMatrix{1: {2: {OriginatedBytes: b, OriginatedPackets: b / 10}}}))
+		}
+	}
+	total := func() uint64 {
+		return httpobj.http_PeerState[testPersistPubKey].Traffic.Load().(mtypes.PeerTraffic).Total()[1][2].OriginatedBytes
+	}
+
+	newTestSuperState(t)
+	// the edge restarts after 150 bytes
+	report(100, 150, 20)
+	if got := total(); got != 170 {
+		t.Fatalf("total after the edge restarted = %v, want 170", got)
+	}
+	// the supernode restarts, the edge doesn't
+	if err := SaveSuperState(statefile); err != nil {
+		t.Fatal(err)
+	}
+	newTestSuperState(t)
+	if err := LoadSuperState(statefile); err != nil {
+		t.Fatal(err)
+	}
+	report(30)
+	if got := total(); got != 180 {
+		t.Fatalf("total after the supernode restarted = %v, want 180", got)
+	}
+	// a counter which disappeared from the report is a reset too
+	state := httpobj.http_PeerState[testPersistPubKey]
+	traffic := state.Traffic.Load().(mtypes.PeerTraffic)
+	state.Traffic.Store(traffic.Update(mtypes.TrafficMatrix{2: {1: {ReceivedBytes: 5}}}))
+	if got := total(); got != 180 {
+		t.Fatalf("total after a report without 1->2 = %v, want 180", got)
+	}
+}
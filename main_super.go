@@ -144,11 +144,23 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 		}
 	}
 	thetap4, _ := tap.CreateDummyTAP()
-	httpobj.http_device4 = device.NewDevice(thetap4, mtypes.NodeID_SuperNode, conn.NewDefaultBind(conn.EnabledAf4, bindmode), logger4, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
+	httpobj.http_stream4 = conn.NewStreamBind(sconfig.StreamTransport, conn.EnabledAf4)
+	bind4 := conn.NewMultiBind(conn.NewDefaultBind(conn.EnabledAf4, bindmode), httpobj.http_stream4)
+	if sconfig.Obfuscation.Secret != "" {
+		bind4 = conn.NewObfsBind(bind4, sconfig.Obfuscation)
+	}
+	httpobj.http_device4 = device.NewDevice(thetap4, mtypes.NodeID_SuperNode, bind4, logger4, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
 	defer httpobj.http_device4.Close()
 	thetap6, _ := tap.CreateDummyTAP()
-	httpobj.http_device6 = device.NewDevice(thetap6, mtypes.NodeID_SuperNode, conn.NewDefaultBind(conn.EnabledAf6, bindmode), logger6, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
+	httpobj.http_stream6 = conn.NewStreamBind(sconfig.StreamTransport, conn.EnabledAf6)
+	bind6 := conn.NewMultiBind(conn.NewDefaultBind(conn.EnabledAf6, bindmode), httpobj.http_stream6)
+	if sconfig.Obfuscation.Secret != "" {
+		bind6 = conn.NewObfsBind(bind6, sconfig.Obfuscation)
+	}
+	httpobj.http_device6 = device.NewDevice(thetap6, mtypes.NodeID_SuperNode, bind6, logger6, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
 	defer httpobj.http_device6.Close()
+	httpobj.http_device4.SetRelaySibling(httpobj.http_device6)
+	httpobj.http_device6.SetRelaySibling(httpobj.http_device4)
 	if sconfig.PrivKeyV4 != "" {
 		pk4, err := device.Str2PriKey(sconfig.PrivKeyV4)
 		if err != nil {
@@ -179,6 +191,9 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 			return err
 		}
 	}
+	if err := LoadSuperState(sconfig.Persist.StateFile); err != nil {
+		return err
+	}
 	logger4.Verbosef("Device4 started")
 	logger6.Verbosef("Device6 started")
 
@@ -200,6 +215,11 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	go Event_server_event_hendler(httpobj.http_graph, httpobj.http_super_chains)
 	go RoutinePushSettings(mtypes.S2TD(sconfig.RePushConfigInterval))
 	go RoutineTimeoutCheck()
+	go RoutineNatReflector("udp4", sconfig.NatDetect.ReflectorPort, httpobj.http_device4)
+	go RoutineNatReflector("udp6", sconfig.NatDetect.ReflectorPort, httpobj.http_device6)
+	go RoutineHolePunch(mtypes.S2TD(sconfig.NatDetect.PunchInterval), sconfig.NatDetect.PredictPorts)
+	go RoutineClusterSync()
+	go RoutineSaveSuperState(sconfig.Persist.StateFile, mtypes.S2TD(sconfig.Persist.SaveInterval))
 	HttpServer(sconfig.ListenPort_EdgeAPI, sconfig.ListenPort_ManageAPI, sconfig.API_Prefix, errs)
 
 	if sconfig.PostScript != "" {
@@ -240,6 +260,9 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	case <-httpobj.http_device6.Wait():
 	}
 	logger4.Verbosef("Shutting down")
+	if err := SaveSuperState(sconfig.Persist.StateFile); err != nil {
+		logger4.Errorf("Save state to %v failed: %v", sconfig.Persist.StateFile, err)
+	}
 	return
 }
 
@@ -306,6 +329,7 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 		HttpPostInterval: httpobj.http_sconfig.HttpPostInterval,
 		PeerAliveTimeout: httpobj.http_sconfig.PeerAliveTimeout,
 		AdditionalCost:   peerconf.AdditionalCost,
+		NatReflectorPort: httpobj.http_sconfig.NatDetect.ReflectorPort,
 	}
 
 	SuperParamStr, _ := json.Marshal(SuperParams)
@@ -320,13 +344,17 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 	PS.JETSecret.Store(mtypes.JWTSecret{}) // mtypes.JWTSecret
 	PS.httpPostCount.Store(uint64(0))      // uint64
 	PS.LastSeen.Store(time.Time{})         // time.Time
+	PS.Traffic.Store(mtypes.PeerTraffic{}) // mtypes.PeerTraffic
+	PS.Bonding.Store(mtypes.BondStats{})   // mtypes.BondStats
+	PS.Nat.Store(mtypes.NatReport{})       // mtypes.NatReport
 	httpobj.http_PeerState[peerconf.PubKey] = &PS
 
 	httpobj.http_PeerIPs[peerconf.PubKey] = &HttpPeerLocalIP{}
 	return nil
 }
 
-func super_peerdel(toDelete mtypes.Vertex) {
+// super_peerdel deletes the peer. The peer is told to shut down if notify, only the primary does that
+func super_peerdel(toDelete mtypes.Vertex, notify bool) {
 	// No lock, lock before call me
 	if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
 		return
@@ -336,17 +364,17 @@ func super_peerdel(toDelete mtypes.Vertex) {
 	delete(httpobj.http_PeerState, PubKey)
 	delete(httpobj.http_PeerIPs, PubKey)
 	delete(httpobj.http_PeerID2Info, toDelete)
-	go super_peerdel_notify(toDelete, PubKey)
+	go super_peerdel_notify(toDelete, PubKey, notify)
 }
 
-func super_peerdel_notify(toDelete mtypes.Vertex, PubKey string) {
+func super_peerdel_notify(toDelete mtypes.Vertex, PubKey string, notify bool) {
 	ServerUpdateMsg := mtypes.ServerUpdateMsg{
 		Node_id: toDelete,
 		Action:  mtypes.Shutdown,
 		Code:    int(syscall.ENOENT),
 		Params:  "You've been removed from supernode.",
 	}
-	for i := 0; i < 10; i++ {
+	for i := 0; notify && i < 10; i++ {
 		body, _ := mtypes.GetByte(&ServerUpdateMsg)
 		buf := make([]byte, path.EgHeaderLen+len(body))
 		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
@@ -366,6 +394,44 @@ func super_peerdel_notify(toDelete mtypes.Vertex, PubKey string) {
 	httpobj.http_graph.RemoveVirt(toDelete, true, false)
 }
 
+// updateRelayEdges adds the relay edges between the alive peer and the relays to the graph.
+// The edges to the designated relay nodes are added only if they haven't measured a latency,
+// and the measured one overwrites it until it expires.
+func updateRelayEdges(NodeID mtypes.Vertex) (changed bool) {
+	relay := httpobj.http_sconfig.Relay
+	TimeToAlive := httpobj.http_sconfig.PeerAliveTimeout
+	cost := relay.RelayCost / 2 / 1000 // ms to s, half for each side
+	pongs := make([]mtypes.PongMsg, 0)
+	if relay.UseSuperRelay {
+		pongs = append(pongs,
+			mtypes.PongMsg{Src_nodeID: NodeID, Dst_nodeID: mtypes.NodeID_SuperNode, Timediff: cost, TimeToAlive: TimeToAlive},
+			mtypes.PongMsg{Src_nodeID: mtypes.NodeID_SuperNode, Dst_nodeID: NodeID, Timediff: cost, TimeToAlive: TimeToAlive},
+		)
+	}
+	for _, relayID := range relay.RelayNodes {
+		if relayID == NodeID {
+			continue
+		}
+		relayinfo, has := httpobj.http_PeerID2Info[relayID]
+		if !has {
+			continue
+		}
+		state, has := httpobj.http_PeerState[relayinfo.PubKey]
+		if !has || state.LastSeen.Load().(time.Time).Add(mtypes.S2TD(TimeToAlive)).Before(time.Now()) {
+			continue
+		}
+		for _, e := range [][2]mtypes.Vertex{{NodeID, relayID}, {relayID, NodeID}} {
+			if w := httpobj.http_graph.Weight(e[0], e[1], false); w >= mtypes.Infinity || w == cost { // not measured, or added by us
+				pongs = append(pongs, mtypes.PongMsg{Src_nodeID: e[0], Dst_nodeID: e[1], Timediff: cost, TimeToAlive: TimeToAlive})
+			}
+		}
+	}
+	if len(pongs) == 0 {
+		return false
+	}
+	return httpobj.http_graph.UpdateLatencyMulti(pongs, true, true)
+}
+
 func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 	for {
 		select {
@@ -392,6 +458,14 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 					httpobj.http_PeerState[PubKey].SuperParamStateClient.Store(reg_msg.SuperParamStateHash)
 					should_push_superparams = true
 				}
+				if updateRelayEdges(NodeID) {
+					NhTable := graph.GetNHTable(true)
+					NhTablestr, _ := json.Marshal(NhTable)
+					md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
+					httpobj.http_NhTable_Hash = hex.EncodeToString(md5_hash_raw[:])
+					httpobj.http_NhTableStr = NhTablestr
+					should_push_nh = true
+				}
 			}
 			var peer_state_changed bool
 
@@ -26,14 +26,21 @@ type EdgeConfig struct {
 	PostScript            string           `yaml:"PostScript"`
 	DefaultTTL            uint8            `yaml:"DefaultTTL"`
 	L2FIBTimeout          float64          `yaml:"L2FIBTimeout"`
+	L2FIB                 L2FIBInfo        `yaml:"L2FIB"`
+	LoopDetect            LoopDetectInfo   `yaml:"LoopDetect"`
 	PrivKey               string           `yaml:"PrivKey"`
 	ListenPort            int              `yaml:"ListenPort"`
 	DisableAf             conn.EnabledAf   `yaml:"DisabledAf"`
 	AfPrefer              int              `yaml:"AfPrefer"`
+	StreamTransport       conn.StreamConf  `yaml:"StreamTransport"`
+	Obfuscation           conn.ObfsConf    `yaml:"Obfuscation"`
+	Bonding               BondingInfo      `yaml:"Bonding"`
+	LANDiscovery          LANDiscoveryInfo `yaml:"LANDiscovery"`
 	LogLevel              LoggerInfo       `yaml:"LogLevel"`
 	DynamicRoute          DynamicRouteInfo `yaml:"DynamicRoute"`
 	NextHopTable          NextHopTable     `yaml:"NextHopTable"`
 	ResetEndPointInterval float64          `yaml:"ResetEndPointInterval"`
+	DNSResolve            DNSResolveInfo   `yaml:"DNSResolve"`
 	Peers                 []PeerInfo       `yaml:"Peers"`
 }
 
@@ -43,6 +50,8 @@ type SuperConfig struct {
 	PrivKeyV4               string                  `yaml:"PrivKeyV4"`
 	PrivKeyV6               string                  `yaml:"PrivKeyV6"`
 	ListenPort              int                     `yaml:"ListenPort"`
+	StreamTransport         conn.StreamConf         `yaml:"StreamTransport"`
+	Obfuscation             conn.ObfsConf           `yaml:"Obfuscation"`
 	ListenPort_EdgeAPI      string                  `yaml:"ListenPort_EdgeAPI"`
 	ListenPort_ManageAPI    string                  `yaml:"ListenPort_ManageAPI"`
 	API_Prefix              string                  `yaml:"API_Prefix"`
@@ -58,9 +67,46 @@ type SuperConfig struct {
 	EdgeTemplate            string                  `yaml:"EdgeTemplate"`
 	UsePSKForInterEdge      bool                    `yaml:"UsePSKForInterEdge"`
 	ResetEndPointInterval   float64                 `yaml:"ResetEndPointInterval"`
+	DNSResolve              DNSResolveInfo          `yaml:"DNSResolve"`
+	NatDetect               NatDetectInfo           `yaml:"NatDetect"`
+	Relay                   RelayInfo               `yaml:"Relay"`
+	Cluster                 ClusterInfo             `yaml:"Cluster"`
+	Persist                 PersistInfo             `yaml:"Persist"`
 	Peers                   []SuperPeerInfo         `yaml:"Peers"`
 }
 
+type NatDetectInfo struct {
+	ReflectorPort int     `yaml:"ReflectorPort"`
+	PunchInterval float64 `yaml:"PunchInterval"`
+	PredictPorts  int     `yaml:"PredictPorts"`
+}
+
+type RelayInfo struct {
+	UseSuperRelay bool     `yaml:"UseSuperRelay"`
+	RelayNodes    []Vertex `yaml:"RelayNodes"`
+	RelayCost     float64  `yaml:"RelayCost"`
+}
+
+type ClusterInfo struct {
+	UseCluster      bool                `yaml:"UseCluster"`
+	Priority        int                 `yaml:"Priority"`
+	Secret          string              `yaml:"Secret"`
+	SyncInterval    float64             `yaml:"SyncInterval"`
+	FailoverTimeout float64             `yaml:"FailoverTimeout"`
+	Members         []ClusterMemberInfo `yaml:"Members"`
+	Generation      uint64              `yaml:"Generation"`
+}
+
+type PersistInfo struct {
+	StateFile    string  `yaml:"StateFile"`
+	SaveInterval float64 `yaml:"SaveInterval"`
+}
+
+type ClusterMemberInfo struct {
+	Name       string `yaml:"Name"`
+	EdgeAPIUrl string `yaml:"EdgeAPIUrl"`
+}
+
 type Passwords struct {
 	ShowState   string `yaml:"ShowState"`
 	AddPeer     string `yaml:"AddPeer"`
@@ -70,27 +116,49 @@ type Passwords struct {
 }
 
 type InterfaceConf struct {
-	IType         string `yaml:"IType"`
-	Name          string `yaml:"Name"`
-	VPPIFaceID    uint32 `yaml:"VPPIFaceID"`
-	VPPBridgeID   uint32 `yaml:"VPPBridgeID"`
-	MacAddrPrefix string `yaml:"MacAddrPrefix"`
-	IPv4CIDR      string `yaml:"IPv4CIDR"`
-	IPv6CIDR      string `yaml:"IPv6CIDR"`
-	IPv6LLPrefix  string `yaml:"IPv6LLPrefix"`
-	MTU           uint16 `yaml:"MTU"`
-	RecvAddr      string `yaml:"RecvAddr"`
-	SendAddr      string `yaml:"SendAddr"`
-	L2HeaderMode  string `yaml:"L2HeaderMode"`
+	IType         string       `yaml:"IType"`
+	Name          string       `yaml:"Name"`
+	VPPIFaceID    uint32       `yaml:"VPPIFaceID"`
+	VPPBridgeID   uint32       `yaml:"VPPBridgeID"`
+	MacAddrPrefix string       `yaml:"MacAddrPrefix"`
+	IPv4CIDR      string       `yaml:"IPv4CIDR"`
+	IPv6CIDR      string       `yaml:"IPv6CIDR"`
+	IPv6LLPrefix  string       `yaml:"IPv6LLPrefix"`
+	MTU           uint16       `yaml:"MTU"`
+	Queues        int          `yaml:"Queues"`
+	Offload       bool         `yaml:"Offload"`
+	RecvAddr      string       `yaml:"RecvAddr"`
+	SendAddr      string       `yaml:"SendAddr"`
+	L2HeaderMode  string       `yaml:"L2HeaderMode"`
+	Netstack      NetstackInfo `yaml:"Netstack"`
+}
+
+type NetstackInfo struct {
+	SocksAddr     string            `yaml:"SocksAddr"`
+	HttpProxyAddr string            `yaml:"HttpProxyAddr"`
+	Forwards      []NetstackForward `yaml:"Forwards"`
+}
+
+type NetstackForward struct {
+	Proto  string `yaml:"Proto"`
+	Listen string `yaml:"Listen"`
+	Target string `yaml:"Target"`
 }
 
 type PeerInfo struct {
-	NodeID              Vertex `yaml:"NodeID"`
-	PubKey              string `yaml:"PubKey"`
-	PSKey               string `yaml:"PSKey"`
-	EndPoint            string `yaml:"EndPoint"`
-	PersistentKeepalive uint32 `yaml:"PersistentKeepalive"`
-	Static              bool   `yaml:"Static"`
+	NodeID              Vertex             `yaml:"NodeID"`
+	PubKey              string             `yaml:"PubKey"`
+	PSKey               string             `yaml:"PSKey"`
+	EndPoint            string             `yaml:"EndPoint"`
+	BondEndPoints       []BondEndpointInfo `yaml:"BondEndPoints"`
+	PersistentKeepalive uint32             `yaml:"PersistentKeepalive"`
+	Static              bool               `yaml:"Static"`
+}
+
+type BondEndpointInfo struct {
+	EndPoint string `yaml:"EndPoint"`
+	Source   string `yaml:"Source"`
+	Weight   int    `yaml:"Weight"`
 }
 
 type SuperPeerInfo struct {
@@ -104,6 +172,44 @@ type SuperPeerInfo struct {
 	ExternalIP     string  `yaml:"ExternalIP"`
 }
 
+type L2FIBInfo struct {
+	MaxMAC        int               `yaml:"MaxMAC"`
+	MaxMACPerNode int               `yaml:"MaxMACPerNode"`
+	StaticMAC     map[string]Vertex `yaml:"StaticMAC"`
+	MoveThreshold int               `yaml:"MoveThreshold"`
+	MoveWindow    float64           `yaml:"MoveWindow"`
+	FreezeTime    float64           `yaml:"FreezeTime"`
+}
+
+type LoopDetectInfo struct {
+	UseLoopDetect bool    `yaml:"UseLoopDetect"`
+	ProbeInterval float64 `yaml:"ProbeInterval"`
+	HoldTime      float64 `yaml:"HoldTime"`
+	MoveThreshold int     `yaml:"MoveThreshold"`
+	MoveWindow    float64 `yaml:"MoveWindow"`
+	Action        string  `yaml:"Action"`
+}
+
+type BondingInfo struct {
+	Mode            string   `yaml:"Mode"`
+	Sources         []string `yaml:"Sources"`
+	Weight          int      `yaml:"Weight"`
+	HealthInterval  float64  `yaml:"HealthInterval"`
+	FailoverTimeout float64  `yaml:"FailoverTimeout"`
+}
+
+type DNSResolveInfo struct {
+	UseDNSResolve bool    `yaml:"UseDNSResolve"`
+	MinTTL        float64 `yaml:"MinTTL"`
+}
+
+type LANDiscoveryInfo struct {
+	UseLANDiscovery bool    `yaml:"UseLANDiscovery"`
+	GroupV4         string  `yaml:"GroupV4"`
+	GroupV6         string  `yaml:"GroupV6"`
+	Interval        float64 `yaml:"Interval"`
+}
+
 type LoggerInfo struct {
 	LogLevel    string `yaml:"LogLevel"`
 	LogTransit  bool   `yaml:"LogTransit"`
@@ -133,6 +239,9 @@ type DynamicRouteInfo struct {
 	PeerAliveTimeout     float64   `yaml:"PeerAliveTimeout"`
 	TimeoutCheckInterval float64   `yaml:"TimeoutCheckInterval"`
 	ConnNextTry          float64   `yaml:"ConnNextTry"`
+	ProbeStagger         float64   `yaml:"ProbeStagger"`
+	ProbeInterval        float64   `yaml:"ProbeInterval"`
+	NetworkMonitor       bool      `yaml:"NetworkMonitor"`
 	DupCheckTimeout      float64   `yaml:"DupCheckTimeout"`
 	AdditionalCost       float64   `yaml:"AdditionalCost"`
 	DampingFilterRadius  uint64    `yaml:"DampingFilterRadius"`
@@ -151,16 +260,29 @@ type NTPInfo struct {
 }
 
 type SuperInfo struct {
-	UseSuperNode         bool     `yaml:"UseSuperNode"`
-	PSKey                string   `yaml:"PSKey"`
-	EndpointV4           string   `yaml:"EndpointV4"`
-	PubKeyV4             string   `yaml:"PubKeyV4"`
-	EndpointV6           string   `yaml:"EndpointV6"`
-	PubKeyV6             string   `yaml:"PubKeyV6"`
-	EndpointEdgeAPIUrl   string   `yaml:"EndpointEdgeAPIUrl"`
-	SkipLocalIP          bool     `yaml:"SkipLocalIP"`
-	AdditionalLocalIP    []string `yaml:"AdditionalLocalIP"`
-	SuperNodeInfoTimeout float64  `yaml:"SuperNodeInfoTimeout"`
+	UseSuperNode         bool                `yaml:"UseSuperNode"`
+	PSKey                string              `yaml:"PSKey"`
+	EndpointV4           string              `yaml:"EndpointV4"`
+	PubKeyV4             string              `yaml:"PubKeyV4"`
+	EndpointV6           string              `yaml:"EndpointV6"`
+	PubKeyV6             string              `yaml:"PubKeyV6"`
+	EndpointEdgeAPIUrl   string              `yaml:"EndpointEdgeAPIUrl"`
+	SkipLocalIP          bool                `yaml:"SkipLocalIP"`
+	AdditionalLocalIP    []string            `yaml:"AdditionalLocalIP"`
+	SuperNodeInfoTimeout float64             `yaml:"SuperNodeInfoTimeout"`
+	Cluster              []SuperEndpointInfo `yaml:"Cluster"`
+	StateCache           StateCacheInfo      `yaml:"StateCache"`
+}
+
+type SuperEndpointInfo struct {
+	EndpointV4         string `yaml:"EndpointV4"`
+	EndpointV6         string `yaml:"EndpointV6"`
+	EndpointEdgeAPIUrl string `yaml:"EndpointEdgeAPIUrl"`
+}
+
+type StateCacheInfo struct {
+	CacheFile string  `yaml:"CacheFile"`
+	MaxAge    float64 `yaml:"MaxAge"`
 }
 
 type P2PInfo struct {
@@ -181,6 +303,99 @@ type GraphRecalculateSetting struct {
 type DistTable map[Vertex]map[Vertex]float64
 type NextHopTable map[Vertex]map[Vertex]Vertex
 
+type TrafficCounter struct {
+	OriginatedBytes   uint64
+	OriginatedPackets uint64
+	ReceivedBytes     uint64
+	ReceivedPackets   uint64
+	TransitedBytes    uint64
+	TransitedPackets  uint64
+}
+
+func (c *TrafficCounter) Add(o TrafficCounter) {
+	c.OriginatedBytes += o.OriginatedBytes
+	c.OriginatedPackets += o.OriginatedPackets
+	c.ReceivedBytes += o.ReceivedBytes
+	c.ReceivedPackets += o.ReceivedPackets
+	c.TransitedBytes += o.TransitedBytes
+	c.TransitedPackets += o.TransitedPackets
+}
+
+// TrafficMatrix is indexed by [src node][dst node]
+type TrafficMatrix map[Vertex]map[Vertex]TrafficCounter
+
+func (m TrafficMatrix) Add(src Vertex, dst Vertex, c TrafficCounter) {
+	if _, has := m[src]; !has {
+		m[src] = make(map[Vertex]TrafficCounter)
+	}
+	old := m[src][dst]
+	old.Add(c)
+	m[src][dst] = old
+}
+
+func (m TrafficMatrix) AddMatrix(o TrafficMatrix) {
+	for src, dsts := range o {
+		for dst, c := range dsts {
+			m.Add(src, dst, c)
+		}
+	}
+}
+
+// Covers returns false if any counter of old is missing or smaller in m, which means the counters were reset
+func (m TrafficMatrix) Covers(old TrafficMatrix) bool {
+	for src, dsts := range old {
+		for dst, o := range dsts {
+			c, has := m[src][dst]
+			if !has || c.OriginatedBytes < o.OriginatedBytes || c.OriginatedPackets < o.OriginatedPackets ||
+				c.ReceivedBytes < o.ReceivedBytes || c.ReceivedPackets < o.ReceivedPackets ||
+				c.TransitedBytes < o.TransitedBytes || c.TransitedPackets < o.TransitedPackets {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// PeerTraffic is the traffic reported by an edge.
+// Last is the latest report, Base is the sum of the reports before the counters of the edge were reset by a restart.
+type PeerTraffic struct {
+	Base TrafficMatrix
+	Last TrafficMatrix
+}
+
+// Update applies a new report of the edge
+func (t PeerTraffic) Update(report TrafficMatrix) PeerTraffic {
+	if report.Covers(t.Last) {
+		return PeerTraffic{Base: t.Base, Last: report}
+	}
+	base := make(TrafficMatrix)
+	base.AddMatrix(t.Base)
+	base.AddMatrix(t.Last)
+	return PeerTraffic{Base: base, Last: report}
+}
+
+// Total returns the traffic since the edge was added, across its restarts
+func (t PeerTraffic) Total() TrafficMatrix {
+	ret := make(TrafficMatrix)
+	ret.AddMatrix(t.Base)
+	ret.AddMatrix(t.Last)
+	return ret
+}
+
+// BondMemberStat is the state of one underlay endpoint of a bonded peer
+type BondMemberStat struct {
+	EndPoint  string
+	Source    string
+	Weight    int
+	Up        bool
+	Latency   float64
+	TxBytes   uint64
+	TxPackets uint64
+}
+
+// BondStats is indexed by the NodeID of the peer
+type BondStats map[Vertex][]BondMemberStat
+
 type API_connurl struct {
 	ExternalV4 map[string]float64
 	ExternalV6 map[string]float64
@@ -220,9 +435,11 @@ func (Connurl *API_connurl) GetList(UseLocal bool) (ret map[string]float64) {
 }
 
 type API_Peerinfo struct {
-	NodeID  Vertex
-	PSKey   string
-	Connurl *API_connurl
+	NodeID   Vertex
+	PSKey    string
+	Connurl  *API_connurl
+	IPv4CIDR string
+	IPv6CIDR string
 }
 
 type API_SuperParams struct {
@@ -231,6 +448,7 @@ type API_SuperParams struct {
 	PeerAliveTimeout    float64
 	DampingFilterRadius uint64
 	AdditionalCost      float64
+	NatReflectorPort    int
 }
 
 type StateHash struct {
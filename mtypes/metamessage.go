@@ -62,6 +62,7 @@ const (
 	UpdatePeer
 	UpdateNhTable
 	UpdateSuperParams
+	HolePunch
 )
 
 func (a *ServerCommand) ToString() string {
@@ -78,6 +79,8 @@ func (a *ServerCommand) ToString() string {
 		return "UpdateNhTable"
 	case UpdateSuperParams:
 		return "UpdateSuperParams"
+	case HolePunch:
+		return "HolePunch"
 	default:
 		return "Unknown"
 	}
@@ -107,10 +110,12 @@ type PingMsg struct {
 	Src_nodeID   Vertex
 	Time         time.Time
 	RequestReply int
+	Probe        bool // echo it on the path it came from
+	Echo         bool // the echo of a probe, Time is the clock of the prober
 }
 
 func (c *PingMsg) ToString() string {
-	return "PingMsg SID:" + c.Src_nodeID.ToString() + " Time:" + c.Time.String() + " RequestID:" + strconv.Itoa(int(c.RequestID))
+	return "PingMsg SID:" + c.Src_nodeID.ToString() + " Time:" + c.Time.String() + " RequestID:" + strconv.Itoa(int(c.RequestID)) + " Probe:" + strconv.FormatBool(c.Probe) + " Echo:" + strconv.FormatBool(c.Echo)
 }
 
 func ParsePingMsg(bin []byte) (StructPlace PingMsg, err error) {
@@ -177,10 +182,176 @@ func ParseBoardcastPeerMsg(bin []byte) (StructPlace BoardcastPeerMsg, err error)
 	return
 }
 
+type BondProbeMsg struct {
+	Src_nodeID Vertex
+	Time       time.Time
+	Echo       bool
+}
+
+func (c *BondProbeMsg) ToString() string {
+	return "BondProbeMsg SID:" + c.Src_nodeID.ToString() + " Time:" + c.Time.String() + " Echo:" + strconv.FormatBool(c.Echo)
+}
+
+func ParseBondProbeMsg(bin []byte) (StructPlace BondProbeMsg, err error) {
+	var b bytes.Buffer
+	b.Write(bin)
+	d := gob.NewDecoder(&b)
+	err = d.Decode(&StructPlace)
+	return
+}
+
+type LANBeaconMsg struct {
+	Node_id   Vertex
+	PubKey    string
+	Port      uint16
+	Time      time.Time
+	Signature map[Vertex][]byte
+}
+
+func (c *LANBeaconMsg) ToString() string {
+	return "LANBeaconMsg Node_id:" + c.Node_id.ToString() + " PubKey:" + c.PubKey + " Port:" + strconv.Itoa(int(c.Port)) + " Time:" + c.Time.String()
+}
+
+func ParseLANBeaconMsg(bin []byte) (StructPlace LANBeaconMsg, err error) {
+	var b bytes.Buffer
+	b.Write(bin)
+	d := gob.NewDecoder(&b)
+	err = d.Decode(&StructPlace)
+	return
+}
+
+const (
+	NatMappingNone        = "none"        // not behind NAT
+	NatMappingIndependent = "independent" // same mapping for all destinations
+	NatMappingDependent   = "dependent"   // new mapping for every destination, symmetric NAT
+
+	NatFilteringOpen          = "open"           // packets from other ports are accepted
+	NatFilteringPortDependent = "port-dependent" // only packets from the exact ip:port sent to are accepted
+)
+
+// NatProbeMsg is exchanged between the edge and the NAT reflector of the supernode, in plain UDP
+type NatProbeMsg struct {
+	Node_id       Vertex
+	Nonce         uint64
+	Observed      string // the endpoint of the edge seen by the reflector
+	SuperObserved string // the endpoint of the edge seen by the supernode
+	ChangedPort   bool   // this reply is sent from another port
+	Tag           []byte // HMAC of the other fields, with the shared secret of the static keys of the edge and the supernode
+}
+
+func (c *NatProbeMsg) ToString() string {
+	return "NatProbeMsg Node_id:" + c.Node_id.ToString() + " Nonce:" + strconv.FormatUint(c.Nonce, 10) + " Observed:" + c.Observed + " SuperObserved:" + c.SuperObserved + " ChangedPort:" + strconv.FormatBool(c.ChangedPort)
+}
+
+func ParseNatProbeMsg(bin []byte) (StructPlace NatProbeMsg, err error) {
+	var b bytes.Buffer
+	b.Write(bin)
+	d := gob.NewDecoder(&b)
+	err = d.Decode(&StructPlace)
+	return
+}
+
+type NatInfo struct {
+	Mapping   string
+	Filtering string
+	Observed  string // the endpoint seen by the reflector
+	LocalPort int
+	PortDelta int // port allocation step of a dependent mapping, 0 if unpredictable
+}
+
+// Reachable reports whether anyone can reach the observed endpoint without hole punching
+func (n NatInfo) Reachable() bool {
+	return n.Mapping == NatMappingNone || (n.Mapping == NatMappingIndependent && n.Filtering == NatFilteringOpen)
+}
+
+// Predictable reports whether the endpoint for a new destination can be predicted
+func (n NatInfo) Predictable() bool {
+	return n.Mapping == NatMappingNone || n.Mapping == NatMappingIndependent || (n.Mapping == NatMappingDependent && n.PortDelta != 0)
+}
+
+type NatReport struct {
+	V4 NatInfo
+	V6 NatInfo
+}
+
+// HolePunchMsg is sent by the supernode in the Params of ServerUpdateMsg, in json
+type HolePunchMsg struct {
+	PeerID    Vertex
+	Endpoints []string
+	Time      time.Time
+}
+
+// ClusterSyncMsg is sent between the supernodes of a cluster. Only the primary carries the state.
+type ClusterSyncMsg struct {
+	Name       string
+	Priority   int
+	Primary    bool
+	Generation uint64 // of the Peers, increased on every change
+	Peers      []SuperPeerInfo
+	PeerState  map[string]ClusterPeerState // PubKey -> state
+	Latency    []PongMsg
+	PSKeys     []ClusterPSK
+}
+
+type ClusterPeerState struct {
+	JWTSecret     JWTSecret
+	HttpPostCount uint64
+	LastSeen      time.Time
+}
+
+type ClusterPSK struct {
+	Src   Vertex
+	Dst   Vertex
+	PSKey string
+}
+
+// SuperStateSnapshot is the runtime state of the supernode saved to the StateFile
+type SuperStateSnapshot struct {
+	Time      time.Time
+	HashSalt  []byte
+	PeerState map[string]ClusterPeerState // PubKey -> state
+	Latency   []PongMsg
+	PSKeys    []ClusterPSK
+	NhTable   NextHopTable
+	Traffic   map[string]PeerTraffic // PubKey -> traffic
+}
+
+// EdgeStateCache is the last state downloaded from the supernode, saved to the CacheFile of the edge
+type EdgeStateCache struct {
+	Time            time.Time
+	Peers           API_Peers
+	PeerHash        string
+	NhTable         NextHopTable
+	NhTableHash     string
+	SuperParams     API_SuperParams
+	SuperParamsHash string
+}
+
+func ParseClusterSyncMsg(bin []byte) (StructPlace ClusterSyncMsg, err error) {
+	var b bytes.Buffer
+	b.Write(bin)
+	d := gob.NewDecoder(&b)
+	err = d.Decode(&StructPlace)
+	return
+}
+
+func ParseSuperStateSnapshot(bin []byte) (StructPlace SuperStateSnapshot, err error) {
+	var b bytes.Buffer
+	b.Write(bin)
+	d := gob.NewDecoder(&b)
+	err = d.Decode(&StructPlace)
+	return
+}
+
 type API_report_peerinfo struct {
 	Pongs    []PongMsg
 	LocalV4s map[string]float64
 	LocalV6s map[string]float64
+	Traffic  TrafficMatrix
+	Bonding  BondStats
+	Nat      NatReport
+	IPv4CIDR string
+	IPv6CIDR string
 }
 
 func ParseAPI_report_peerinfo(bin []byte) (StructPlace API_report_peerinfo, err error) {
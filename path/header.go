@@ -30,10 +30,14 @@ const (
 	PongPacket //Send to everyone, include server
 	QueryPeer
 	BroadcastPeer
+	BondProbe //Echo between two peers over one underlay endpoint
 )
 
+// NatProbe is a plain UDP packet between the edge and the NAT reflector of the supernode, not encrypted
+const NatProbe Usage = 0xfe
+
 func (v Usage) IsValid_EgType() bool {
-	if v >= NormalPacket && v <= BroadcastPeer {
+	if v >= NormalPacket && v <= BondProbe {
 		return true
 	}
 	return false
@@ -63,6 +67,10 @@ func (v Usage) ToString() string {
 		return "QueryPeer"
 	case BroadcastPeer:
 		return "BroadcastPeer"
+	case BondProbe:
+		return "BondProbe"
+	case NatProbe:
+		return "NatProbe"
 	default:
 		return "Unknown:" + string(uint8(v))
 	}
@@ -86,6 +94,8 @@ func (v Usage) IsControl() bool {
 		return true
 	case BroadcastPeer:
 		return true
+	case BondProbe:
+		return true
 	default:
 		return false
 	}
@@ -121,6 +131,8 @@ func (v Usage) IsControl_Edge2Edge() bool {
 		return true
 	case BroadcastPeer:
 		return true
+	case BondProbe:
+		return true
 	default:
 		return false
 	}
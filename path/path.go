@@ -474,6 +474,28 @@ func (g *IG) GetEdges(isOld bool, withAC bool) (edges map[mtypes.Vertex]map[mtyp
 	return
 }
 
+// ExportLatency returns the alive edges, in the format of UpdateLatencyMulti
+func (g *IG) ExportLatency() (pongs []mtypes.PongMsg) {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	now := time.Now()
+	for u, dsts := range g.edges {
+		for v, latency := range dsts {
+			if !now.Before(latency.validUntil) {
+				continue
+			}
+			pongs = append(pongs, mtypes.PongMsg{
+				Src_nodeID:     u,
+				Dst_nodeID:     v,
+				Timediff:       latency.ping,
+				AdditionalCost: latency.additionalCost * 1000,
+				TimeToAlive:    latency.validUntil.Sub(now).Seconds(),
+			})
+		}
+	}
+	return
+}
+
 func (g *IG) GetBoardcastList(id mtypes.Vertex) (tosend map[mtypes.Vertex]bool) {
 	tosend = make(map[mtypes.Vertex]bool)
 	for _, element := range g.nhTable[id] {
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func flowIPv4(src byte, dst byte, proto byte, sport uint16, dport uint16, fragOff uint16, mf bool) []byte {
+	ip := make([]byte, 20+8)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+	flags := fragOff
+	if mf {
+		flags |= 0x2000
+	}
+	binary.BigEndian.PutUint16(ip[6:8], flags)
+	ip[8] = 64
+	ip[9] = proto
+	copy(ip[12:16], []byte{10, 0, 0, src})
+	copy(ip[16:20], []byte{10, 0, 0, dst})
+	binary.BigEndian.PutUint16(ip[20:22], sport)
+	binary.BigEndian.PutUint16(ip[22:24], dport)
+	return ip
+}
+
+func flowIPv6(src byte, dst byte, proto byte, sport uint16, dport uint16) []byte {
+	ip := make([]byte, 40+8)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], 8)
+	ip[6] = proto
+	ip[7] = 64
+	ip[8], ip[23] = 0xfd, src
+	ip[24], ip[39] = 0xfd, dst
+	binary.BigEndian.PutUint16(ip[40:42], sport)
+	binary.BigEndian.PutUint16(ip[42:44], dport)
+	return ip
+}
+
+func flowEth(ethertype uint16, vlan bool, srcmac byte, payload []byte) []byte {
+	frame := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0, 2, 0xaa, 0xbb, 0xcc, 0xdd, 0, srcmac}
+	if vlan {
+		frame = append(frame, 0x81, 0x00, 0x00, 0x64)
+	}
+	frame = binary.BigEndian.AppendUint16(frame, ethertype)
+	return append(frame, payload...)
+}
+
+func TestFlowHash(t *testing.T) {
+	tcp1 := flowIPv4(1, 2, 6, 40000, 443, 0, false)
+	for _, tc := range []struct {
+		name     string
+		a, b     []byte
+		l3a, l3b bool
+		equal    bool
+	}{
+		{"same flow", flowEth(0x0800, false, 1, tcp1), flowEth(0x0800, false, 1, flowIPv4(1, 2, 6, 40000, 443, 0, false)), false, false, true},
+		{"other port", flowEth(0x0800, false, 1, tcp1), flowEth(0x0800, false, 1, flowIPv4(1, 2, 6, 40001, 443, 0, false)), false, false, false},
+		{"other address", flowEth(0x0800, false, 1, tcp1), flowEth(0x0800, false, 1, flowIPv4(1, 3, 6, 40000, 443, 0, false)), false, false, false},
+		{"VLAN tagged", flowEth(0x0800, false, 1, tcp1), flowEth(0x0800, true, 1, tcp1), false, false, true},
+		{"mac ignored for IP", flowEth(0x0800, false, 1, tcp1), flowEth(0x0800, false, 9, tcp1), false, false, true},
+		{"first and later fragments", flowEth(0x0800, false, 1, flowIPv4(1, 2, 17, 53, 53, 0, true)), flowEth(0x0800, false, 1, flowIPv4(1, 2, 17, 1234, 5678, 185, false)), false, false, true},
+		{"ICMP ignores the ports", flowEth(0x0800, false, 1, flowIPv4(1, 2, 1, 1, 1, 0, false)), flowEth(0x0800, false, 1, flowIPv4(1, 2, 1, 2, 2, 0, false)), false, false, true},
+		{"IPv6 same flow", flowEth(0x86DD, false, 1, flowIPv6(1, 2, 17, 5000, 53)), flowEth(0x86DD, true, 1, flowIPv6(1, 2, 17, 5000, 53)), false, false, true},
+		{"IPv6 other port", flowEth(0x86DD, false, 1, flowIPv6(1, 2, 17, 5000, 53)), flowEth(0x86DD, false, 1, flowIPv6(1, 2, 17, 5001, 53)), false, false, false},
+		{"non-IP by mac", flowEth(0x0806, false, 1, make([]byte, 28)), flowEth(0x0806, false, 1, []byte{1, 2, 3}), false, false, true},
+		{"non-IP other mac", flowEth(0x0806, false, 1, make([]byte, 28)), flowEth(0x0806, false, 2, make([]byte, 28)), false, false, false},
+		{"L3 mode", tcp1, flowIPv4(1, 2, 6, 40000, 443, 0, false), true, true, true},
+		{"L3 mode other port", tcp1, flowIPv4(1, 2, 6, 40002, 443, 0, false), true, true, false},
+		{"L3 mode matches L2", tcp1, flowEth(0x0800, false, 1, tcp1), true, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ha := FlowHash(tc.a, tc.l3a)
+			hb := FlowHash(tc.b, tc.l3b)
+			if (ha == hb) != tc.equal {
+				t.Errorf("FlowHash equal:%v (%08x, %08x), want %v", ha == hb, ha, hb, tc.equal)
+			}
+		})
+	}
+	if h := FlowHash([]byte{1, 2, 3}, false); h != 0 {
+		t.Errorf("FlowHash of a runt frame = %v, want 0", h)
+	}
+}
+
+// TestFlowHashQueueAffinity checks that a flow sticks to one queue, and the flows are spread over the queues
+func TestFlowHashQueueAffinity(t *testing.T) {
+	const queues = 4
+	used := make(map[uint32]int)
+	for port := uint16(40000); port < 40064; port++ {
+		frame := flowEth(0x0800, false, 1, flowIPv4(1, 2, 6, port, 443, 0, false))
+		q := FlowHash(frame, false) % queues
+		for i := 0; i < 3; i++ {
+			if again := FlowHash(frame, false) % queues; again != q {
+				t.Fatalf("port %v moved from queue %v to %v", port, q, again)
+			}
+		}
+		used[q]++
+	}
+	if len(used) != queues {
+		t.Errorf("64 flows used only queues %v", used)
+	}
+}
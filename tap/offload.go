@@ -0,0 +1,512 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// virtio_net_hdr, prepended to every frame read from or written to a tap with IFF_VNET_HDR
+const (
+	virtioNetHdrLen = 10
+
+	virtioNetHdrFNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOECN   = 0x80
+
+	offloadMaxFrame = 14 + 4 + 65535 // ethernet + VLAN + the largest IP packet
+	groMaxFlows     = 64             // flush all if more flows are coalescing at the same time
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagURG = 0x20
+	tcpFlagCWR = 0x80
+)
+
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) error {
+	if len(b) < virtioNetHdrLen {
+		return errors.New("virtio_net_hdr too short")
+	}
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = nativeEndian.Uint16(b[2:4])
+	h.gsoSize = nativeEndian.Uint16(b[4:6])
+	h.csumStart = nativeEndian.Uint16(b[6:8])
+	h.csumOffset = nativeEndian.Uint16(b[8:10])
+	return nil
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	nativeEndian.PutUint16(b[2:4], h.hdrLen)
+	nativeEndian.PutUint16(b[4:6], h.gsoSize)
+	nativeEndian.PutUint16(b[6:8], h.csumStart)
+	nativeEndian.PutUint16(b[8:10], h.csumOffset)
+}
+
+// checksumAdd adds b to the one's complement sum. b must be even-length unless it is the last part.
+func checksumAdd(sum uint64, b []byte) uint64 {
+	for len(b) >= 8 {
+		sum += uint64(binary.BigEndian.Uint32(b)) + uint64(binary.BigEndian.Uint32(b[4:]))
+		b = b[8:]
+	}
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+func pseudoHeaderSum(proto uint8, src []byte, dst []byte, length int) uint64 {
+	sum := checksumAdd(0, src)
+	sum = checksumAdd(sum, dst)
+	return sum + uint64(proto) + uint64(length)
+}
+
+// ipOffset returns the offset of the IP header in the frame, 0 in L3 mode
+func ipOffset(frame []byte, l3 bool) int {
+	if l3 {
+		return 0
+	}
+	if len(frame) >= 18 && binary.BigEndian.Uint16(frame[12:14]) == 0x8100 {
+		return 18
+	}
+	return 14
+}
+
+// ipAddrs returns the source and destination addresses of the IP packet
+func ipAddrs(ip []byte) (src []byte, dst []byte) {
+	if ip[0]>>4 == 4 {
+		return ip[12:16], ip[16:20]
+	}
+	return ip[8:24], ip[24:40]
+}
+
+// completeChecksum fills the checksum which the kernel left partial(VIRTIO_NET_HDR_F_NEEDS_CSUM)
+func completeChecksum(frame []byte, hdr *virtioNetHdr) error {
+	start, field := int(hdr.csumStart), int(hdr.csumStart)+int(hdr.csumOffset)
+	if field+2 > len(frame) {
+		return errors.New("invalid checksum offset")
+	}
+	csum := ^checksumFold(checksumAdd(0, frame[start:]))
+	if csum == 0 && hdr.csumOffset == 6 { // UDP
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(frame[field:], csum)
+	return nil
+}
+
+// gsoSplitter splits the super-frames read from a tap with TSO enabled into MTU-sized frames.
+// Every queue has its own gsoSplitter.
+type gsoSplitter struct {
+	buf    []byte   // virtio_net_hdr + frame read from the tap
+	segbuf []byte   // backing store of segs
+	segs   [][]byte // segments not returned yet
+}
+
+func newGSOSplitter() *gsoSplitter {
+	return &gsoSplitter{
+		buf:    make([]byte, virtioNetHdrLen+offloadMaxFrame),
+		segbuf: make([]byte, 2*offloadMaxFrame),
+	}
+}
+
+// next copies the next segment to buf
+func (s *gsoSplitter) next(buf []byte) (int, bool) {
+	if len(s.segs) == 0 {
+		return 0, false
+	}
+	n := copy(buf, s.segs[0])
+	s.segs[0] = nil
+	s.segs = s.segs[1:]
+	return n, true
+}
+
+// split parses s.buf[:n] read from the tap, and splits it into segments
+func (s *gsoSplitter) split(n int, l3 bool) error {
+	var hdr virtioNetHdr
+	if err := hdr.decode(s.buf[:n]); err != nil {
+		return err
+	}
+	frame := s.buf[virtioNetHdrLen:n]
+	if hdr.gsoType == virtioNetHdrGSONone {
+		if hdr.flags&virtioNetHdrFNeedsCsum != 0 {
+			if err := completeChecksum(frame, &hdr); err != nil {
+				return err
+			}
+		}
+		s.segs = append(s.segs[:0], frame)
+		return nil
+	}
+	var err error
+	s.segs, s.segbuf, err = gsoSplit(frame, &hdr, l3, s.segs[:0], s.segbuf)
+	return err
+}
+
+// gsoSplit splits a TCP super-frame into segments of hdr.gsoSize payload, and fills the checksums of each segment.
+// The segments are stored in segbuf, it grows if not enough.
+func gsoSplit(frame []byte, hdr *virtioNetHdr, l3 bool, segs [][]byte, segbuf []byte) ([][]byte, []byte, error) {
+	gsoType := hdr.gsoType &^ virtioNetHdrGSOECN
+	if gsoType != virtioNetHdrGSOTCPv4 && gsoType != virtioNetHdrGSOTCPv6 {
+		return segs, segbuf, fmt.Errorf("unsupported gso type %v", hdr.gsoType)
+	}
+	ipStart := ipOffset(frame, l3)
+	tcpStart := int(hdr.csumStart)
+	if hdr.gsoSize == 0 || tcpStart+20 > len(frame) || ipStart >= tcpStart {
+		return segs, segbuf, errors.New("invalid gso frame")
+	}
+	isV6 := gsoType == virtioNetHdrGSOTCPv6
+	if (isV6 && (frame[ipStart]>>4 != 6 || tcpStart-ipStart != 40)) || (!isV6 && frame[ipStart]>>4 != 4) {
+		return segs, segbuf, errors.New("gso type mismatch with the IP header")
+	}
+	hdrLen := tcpStart + int(frame[tcpStart+12]>>4)*4
+	if hdrLen > len(frame) {
+		return segs, segbuf, errors.New("invalid TCP header")
+	}
+	payload := frame[hdrLen:]
+	mss := int(hdr.gsoSize)
+	nsegs := (len(payload) + mss - 1) / mss
+	if need := nsegs*hdrLen + len(payload); need > len(segbuf) {
+		segbuf = make([]byte, need)
+	}
+	src, dst := ipAddrs(frame[ipStart:])
+	seq := binary.BigEndian.Uint32(frame[tcpStart+4:])
+	flags := frame[tcpStart+13]
+	var ipid uint16
+	if !isV6 {
+		ipid = binary.BigEndian.Uint16(frame[ipStart+4:])
+	}
+	off := 0
+	for i := 0; i < nsegs; i++ {
+		chunk := payload[i*mss:]
+		if len(chunk) > mss {
+			chunk = chunk[:mss]
+		}
+		seg := segbuf[off : off+hdrLen+len(chunk)]
+		off += len(seg)
+		copy(seg, frame[:hdrLen])
+		copy(seg[hdrLen:], chunk)
+
+		ip := seg[ipStart:]
+		if isV6 {
+			binary.BigEndian.PutUint16(ip[4:], uint16(len(ip)-40))
+		} else {
+			binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+			binary.BigEndian.PutUint16(ip[4:], ipid+uint16(i))
+			ip[10], ip[11] = 0, 0
+			binary.BigEndian.PutUint16(ip[10:], ^checksumFold(checksumAdd(0, ip[:tcpStart-ipStart])))
+		}
+
+		tcp := seg[tcpStart:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(i*mss))
+		segflags := flags
+		if i != nsegs-1 {
+			segflags &^= tcpFlagFIN | tcpFlagPSH
+		}
+		if i != 0 {
+			segflags &^= tcpFlagCWR
+		}
+		tcp[13] = segflags
+		tcp[16], tcp[17] = 0, 0
+		sum := pseudoHeaderSum(6, src, dst, len(tcp))
+		binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(checksumAdd(sum, tcp)))
+		segs = append(segs, seg)
+	}
+	return segs, segbuf, nil
+}
+
+type groFlowKey struct {
+	l2    [18]byte // ethernet header, with VLAN tag if any
+	src   [16]byte
+	dst   [16]byte
+	ports [4]byte
+}
+
+// groItem is a super-frame coalesced from the segments of a flow
+type groItem struct {
+	key      groFlowKey
+	buf      []byte // virtio_net_hdr + frame
+	ipStart  int
+	tcpStart int
+	hdrLen   int
+	gsoSize  int
+	segs     int
+	ipid     uint16 // IPv4 id of the first segment
+	nextSeq  uint32
+	closed   bool // the last segment was smaller than gsoSize or had PSH, no more segments can be appended
+}
+
+func (item *groItem) frame() []byte {
+	return item.buf[virtioNetHdrLen:]
+}
+
+// groTable coalesces the TCP segments written to a tap into super-frames, and writes them at Flush.
+// Other frames are written at once.
+type groTable struct {
+	sync.Mutex
+	l3    bool
+	write func(buf []byte) error // writes virtio_net_hdr + frame to the tap
+	flows map[groFlowKey]*groItem
+	order []*groItem
+	free  [][]byte
+}
+
+func newGROTable(l3 bool, write func(buf []byte) error) *groTable {
+	return &groTable{
+		l3:    l3,
+		write: write,
+		flows: make(map[groFlowKey]*groItem),
+	}
+}
+
+// tcpSegment parses the frame, returns ok if it is a TCP segment which can be coalesced
+func (g *groTable) tcpSegment(frame []byte) (key groFlowKey, ipStart int, tcpStart int, hdrLen int, ok bool) {
+	ipStart = ipOffset(frame, g.l3)
+	if len(frame) < ipStart+40 {
+		return
+	}
+	ip := frame[ipStart:]
+	switch ip[0] >> 4 {
+	case 4:
+		ihl := int(ip[0]&0x0f) * 4
+		if ip[9] != 6 || ihl < 20 || int(binary.BigEndian.Uint16(ip[2:4])) != len(ip) || binary.BigEndian.Uint16(ip[6:8])&0xbfff != 0 { // not TCP or fragmented
+			return
+		}
+		tcpStart = ipStart + ihl
+	case 6:
+		if ip[6] != 6 || int(binary.BigEndian.Uint16(ip[4:6]))+40 != len(ip) { // extension headers are not supported
+			return
+		}
+		tcpStart = ipStart + 40
+	default:
+		return
+	}
+	if len(frame) < tcpStart+20 {
+		return
+	}
+	hdrLen = tcpStart + int(frame[tcpStart+12]>>4)*4
+	if hdrLen < tcpStart+20 || hdrLen > len(frame) {
+		return
+	}
+	copy(key.l2[:], frame[:ipStart])
+	src, dst := ipAddrs(ip)
+	copy(key.src[:], src)
+	copy(key.dst[:], dst)
+	copy(key.ports[:], frame[tcpStart:tcpStart+4])
+	ok = true
+	return
+}
+
+// canAppend checks whether the segment is the next segment of item, and all headers match
+func (item *groItem) canAppend(frame []byte, tcpStart int, hdrLen int) bool {
+	head := item.frame()
+	payload := len(frame) - hdrLen
+	if item.closed || tcpStart != item.tcpStart || hdrLen != item.hdrLen || payload > item.gsoSize {
+		return false
+	}
+	if len(head)+payload > offloadMaxFrame || len(head)-item.ipStart+payload > 65535 {
+		return false
+	}
+	ip, hip := frame[item.ipStart:], head[item.ipStart:]
+	if ip[0]>>4 == 4 {
+		if ip[1] != hip[1] || binary.BigEndian.Uint16(ip[4:]) != item.ipid+uint16(item.segs) ||
+			ip[6] != hip[6] || ip[8] != hip[8] || string(ip[20:tcpStart-item.ipStart]) != string(hip[20:tcpStart-item.ipStart]) {
+			return false
+		}
+	} else if string(ip[0:4]) != string(hip[0:4]) || ip[7] != hip[7] {
+		return false
+	}
+	tcp, htcp := frame[tcpStart:], head[tcpStart:]
+	if binary.BigEndian.Uint32(tcp[4:]) != item.nextSeq {
+		return false
+	}
+	// ack, data offset, window, urgent pointer and options must be same. PSH is allowed on the last segment
+	if string(tcp[8:13]) != string(htcp[8:13]) || tcp[13]&^tcpFlagPSH != htcp[13] || string(tcp[14:16]) != string(htcp[14:16]) ||
+		string(tcp[18:hdrLen-tcpStart]) != string(htcp[18:hdrLen-tcpStart]) {
+		return false
+	}
+	return true
+}
+
+func tcpChecksumValid(frame []byte, ipStart int, tcpStart int) bool {
+	src, dst := ipAddrs(frame[ipStart:])
+	tcp := frame[tcpStart:]
+	return checksumFold(checksumAdd(pseudoHeaderSum(6, src, dst, len(tcp)), tcp)) == 0xffff
+}
+
+// Write coalesces the frame buf[offset:] if possible, otherwise writes it at once.
+// The space before offset is used for the virtio_net_hdr if large enough.
+func (g *groTable) Write(buf []byte, offset int) error {
+	frame := buf[offset:]
+	g.Lock()
+	defer g.Unlock()
+	key, ipStart, tcpStart, hdrLen, ok := g.tcpSegment(frame)
+	if !ok {
+		return g.writeDirect(buf, offset)
+	}
+	item := g.flows[key]
+	payload := len(frame) - hdrLen
+	flags := frame[tcpStart+13]
+	coalescable := payload > 0 && flags&^tcpFlagPSH == tcpFlagACK && tcpChecksumValid(frame, ipStart, tcpStart)
+	if item != nil && coalescable && item.canAppend(frame, tcpStart, hdrLen) {
+		head := item.frame()
+		item.buf = append(item.buf, frame[hdrLen:]...)
+		item.segs += 1
+		item.nextSeq += uint32(payload)
+		if payload < item.gsoSize || flags&tcpFlagPSH != 0 {
+			item.closed = true
+			head[tcpStart+13] |= flags & tcpFlagPSH
+		}
+		return nil
+	}
+	if item != nil {
+		// Keep the order in the flow
+		if err := g.flushItem(item); err != nil {
+			return err
+		}
+	}
+	if !coalescable {
+		return g.writeDirect(buf, offset)
+	}
+	if len(g.order) >= groMaxFlows {
+		if err := g.flushLocked(); err != nil {
+			return err
+		}
+	}
+	item = &groItem{
+		key:      key,
+		ipStart:  ipStart,
+		tcpStart: tcpStart,
+		hdrLen:   hdrLen,
+		gsoSize:  payload,
+		segs:     1,
+		nextSeq:  binary.BigEndian.Uint32(frame[tcpStart+4:]) + uint32(payload),
+		closed:   flags&tcpFlagPSH != 0,
+	}
+	if frame[ipStart]>>4 == 4 {
+		item.ipid = binary.BigEndian.Uint16(frame[ipStart+4:])
+	}
+	if n := len(g.free); n > 0 {
+		item.buf = g.free[n-1][:0]
+		g.free = g.free[:n-1]
+	} else {
+		item.buf = make([]byte, 0, virtioNetHdrLen+offloadMaxFrame)
+	}
+	item.buf = append(item.buf, make([]byte, virtioNetHdrLen)...)
+	item.buf = append(item.buf, frame...)
+	g.flows[key] = item
+	g.order = append(g.order, item)
+	return nil
+}
+
+func (g *groTable) writeDirect(buf []byte, offset int) error {
+	var hdr virtioNetHdr
+	if offset >= virtioNetHdrLen {
+		hdr.encode(buf[offset-virtioNetHdrLen:])
+		return g.write(buf[offset-virtioNetHdrLen:])
+	}
+	packet := make([]byte, virtioNetHdrLen+len(buf)-offset)
+	hdr.encode(packet)
+	copy(packet[virtioNetHdrLen:], buf[offset:])
+	return g.write(packet)
+}
+
+// flushItem writes the item and removes it from the table
+func (g *groTable) flushItem(item *groItem) error {
+	delete(g.flows, item.key)
+	for i, it := range g.order {
+		if it == item {
+			g.order = append(g.order[:i], g.order[i+1:]...)
+			break
+		}
+	}
+	err := g.writeItem(item)
+	g.free = append(g.free, item.buf)
+	item.buf = nil
+	return err
+}
+
+func (g *groTable) writeItem(item *groItem) error {
+	var hdr virtioNetHdr
+	frame := item.frame()
+	if item.segs > 1 {
+		ip := frame[item.ipStart:]
+		hdr = virtioNetHdr{
+			flags:      virtioNetHdrFNeedsCsum,
+			hdrLen:     uint16(item.hdrLen),
+			gsoSize:    uint16(item.gsoSize),
+			csumStart:  uint16(item.tcpStart),
+			csumOffset: 16,
+		}
+		if ip[0]>>4 == 4 {
+			hdr.gsoType = virtioNetHdrGSOTCPv4
+			binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+			ip[10], ip[11] = 0, 0
+			binary.BigEndian.PutUint16(ip[10:], ^checksumFold(checksumAdd(0, ip[:item.tcpStart-item.ipStart])))
+		} else {
+			hdr.gsoType = virtioNetHdrGSOTCPv6
+			binary.BigEndian.PutUint16(ip[4:], uint16(len(ip)-40))
+		}
+		// The kernel fills the checksum of every segment, starting from the pseudo header checksum
+		src, dst := ipAddrs(ip)
+		tcplen := len(frame) - item.tcpStart
+		binary.BigEndian.PutUint16(frame[item.tcpStart+16:], checksumFold(pseudoHeaderSum(6, src, dst, tcplen)))
+	}
+	hdr.encode(item.buf)
+	return g.write(item.buf)
+}
+
+// Flush writes all coalesced frames
+func (g *groTable) Flush() error {
+	g.Lock()
+	defer g.Unlock()
+	return g.flushLocked()
+}
+
+func (g *groTable) flushLocked() error {
+	var err error
+	for _, item := range g.order {
+		if e := g.writeItem(item); e != nil && err == nil {
+			err = e
+		}
+		g.free = append(g.free, item.buf)
+		item.buf = nil
+		delete(g.flows, item.key)
+	}
+	g.order = g.order[:0]
+	return err
+}
@@ -0,0 +1,208 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const testMSS = 1348
+
+// buildTCPFrame builds an ethernet frame of a TCP segment with valid checksums
+func buildTCPFrame(v6 bool, seq uint32, flags byte, ipid uint16, payload []byte) []byte {
+	eth := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0, 2, 0xaa, 0xbb, 0xcc, 0xdd, 0, 1, 0x08, 0x00}
+	var ip []byte
+	if v6 {
+		eth[12], eth[13] = 0x86, 0xdd
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(20+len(payload)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], []byte{0xfd, 0x99, 15: 1})
+		copy(ip[24:], []byte{0xfd, 0x99, 15: 2})
+	} else {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+20+len(payload)))
+		binary.BigEndian.PutUint16(ip[4:], ipid)
+		ip[6] = 0x40
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], []byte{10, 99, 0, 1, 10, 99, 0, 2})
+		binary.BigEndian.PutUint16(ip[10:], ^checksumFold(checksumAdd(0, ip)))
+	}
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 5555)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], 12345)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 502)
+	copy(tcp[20:], payload)
+	src, dst := ipAddrs(ip)
+	binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(checksumAdd(pseudoHeaderSum(6, src, dst, len(tcp)), tcp)))
+	return append(append(eth, ip...), tcp...)
+}
+
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return payload
+}
+
+// buildSuperFrame builds a TSO super-frame with partial checksum, as the kernel gives
+func buildSuperFrame(v6 bool, payload []byte) (virtioNetHdr, []byte) {
+	frame := buildTCPFrame(v6, 1000, tcpFlagACK|tcpFlagPSH, 100, payload)
+	ipStart := 14
+	tcpStart := ipStart + 20
+	hdr := virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    virtioNetHdrGSOTCPv4,
+		hdrLen:     uint16(tcpStart + 20),
+		gsoSize:    testMSS,
+		csumStart:  uint16(tcpStart),
+		csumOffset: 16,
+	}
+	if v6 {
+		tcpStart = ipStart + 40
+		hdr.gsoType = virtioNetHdrGSOTCPv6
+		hdr.hdrLen = uint16(tcpStart + 20)
+		hdr.csumStart = uint16(tcpStart)
+	}
+	src, dst := ipAddrs(frame[ipStart:])
+	binary.BigEndian.PutUint16(frame[tcpStart+16:], checksumFold(pseudoHeaderSum(6, src, dst, len(frame)-tcpStart)))
+	return hdr, frame
+}
+
+func checkSegments(t *testing.T, v6 bool, segs [][]byte, payload []byte) {
+	want := (len(payload) + testMSS - 1) / testMSS
+	if len(segs) != want {
+		t.Fatalf("got %v segments, want %v", len(segs), want)
+	}
+	for i, seg := range segs {
+		chunk := payload[i*testMSS:]
+		if len(chunk) > testMSS {
+			chunk = chunk[:testMSS]
+		}
+		flags := byte(tcpFlagACK)
+		if i == len(segs)-1 {
+			flags |= tcpFlagPSH
+		}
+		expected := buildTCPFrame(v6, 1000+uint32(i*testMSS), flags, 100+uint16(i), chunk)
+		if !bytes.Equal(seg, expected) {
+			t.Fatalf("segment %v mismatch:\n got %x\nwant %x", i, seg[:74], expected[:74])
+		}
+	}
+}
+
+func TestGSOSplit(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		payload := testPayload(60000)
+		hdr, frame := buildSuperFrame(v6, payload)
+		segs, _, err := gsoSplit(frame, &hdr, false, nil, make([]byte, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSegments(t, v6, segs, payload)
+	}
+}
+
+func TestGROCoalesce(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		var written [][]byte
+		g := newGROTable(false, func(buf []byte) error {
+			written = append(written, append([]byte(nil), buf...))
+			return nil
+		})
+		payload := testPayload(20000)
+		hdr, frame := buildSuperFrame(v6, payload)
+		segs, _, err := gsoSplit(frame, &hdr, false, nil, make([]byte, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, seg := range segs {
+			buf := append(make([]byte, 16), seg...)
+			if err := g.Write(buf, 16); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// not coalescable, must be written at once
+		arp := append(make([]byte, 16), make([]byte, 60)...)
+		if err := g.Write(arp, 16); err != nil {
+			t.Fatal(err)
+		}
+		if len(written) != 1 {
+			t.Fatalf("got %v frames before flush, want 1", len(written))
+		}
+		if err := g.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if len(written) != 2 {
+			t.Fatalf("got %v frames after flush, want 2", len(written))
+		}
+		var whdr virtioNetHdr
+		whdr.decode(written[1])
+		if whdr.gsoSize != testMSS || whdr.gsoType&^virtioNetHdrGSOECN == virtioNetHdrGSONone {
+			t.Fatalf("unexpected virtio_net_hdr %+v", whdr)
+		}
+		// the kernel splits it again
+		resegs, _, err := gsoSplit(written[1][virtioNetHdrLen:], &whdr, false, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSegments(t, v6, resegs, payload)
+	}
+}
+
+func TestGROKeepOrder(t *testing.T) {
+	var written [][]byte
+	g := newGROTable(false, func(buf []byte) error {
+		written = append(written, append([]byte(nil), buf...))
+		return nil
+	})
+	payload := testPayload(testMSS)
+	g.Write(buildTCPFrame(false, 1000, tcpFlagACK, 1, payload), 0)
+	// out of sequence, the coalesced frame is written first
+	g.Write(buildTCPFrame(false, 9000, tcpFlagACK, 2, payload), 0)
+	// pure ACK is not coalesced, and the frame of the flow is written first
+	g.Write(buildTCPFrame(false, 9000+testMSS, tcpFlagACK, 3, nil), 0)
+	if len(written) != 3 {
+		t.Fatalf("got %v frames, want 3", len(written))
+	}
+	for i, seq := range []uint32{1000, 9000, 9000 + testMSS} {
+		if got := binary.BigEndian.Uint32(written[i][virtioNetHdrLen+14+20+4:]); got != seq {
+			t.Fatalf("frame %v seq %v, want %v", i, got, seq)
+		}
+	}
+	// corrupted segment is not coalesced
+	g.Write(buildTCPFrame(false, 20000, tcpFlagACK, 4, payload), 0)
+	bad := buildTCPFrame(false, 20000+testMSS, tcpFlagACK, 5, payload)
+	bad[len(bad)-1] ^= 0xff
+	g.Write(bad, 0)
+	g.Flush()
+	if len(written) != 5 {
+		t.Fatalf("got %v frames, want 5", len(written))
+	}
+}
+
+func BenchmarkGSOSplit(b *testing.B) {
+	payload := testPayload(65000)
+	hdr, frame := buildSuperFrame(false, payload)
+	orig := append([]byte(nil), frame...)
+	segbuf := make([]byte, 2*offloadMaxFrame)
+	var segs [][]byte
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		copy(frame, orig)
+		segs, segbuf, _ = gsoSplit(frame, &hdr, false, segs[:0], segbuf)
+	}
+}
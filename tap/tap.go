@@ -13,9 +13,20 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"unsafe"
 )
 
 type Event int
+
+// nativeEndian is the byte order of the host
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
 type MacAddress [6]byte
 
 func (mac *MacAddress) String() string {
@@ -124,6 +135,77 @@ func IsNotUnicast(mac_in MacAddress) bool {
 	return true
 }
 
+// GetUID is the reverse of GetIP, returns the NodeID which the ip belongs to
+func GetUID(netcidr string, ip net.IP) (uid uint32, isBroadcast bool, err error) {
+	_, the_net, err := net.ParseCIDR(netcidr)
+	if err != nil {
+		return 0, false, err
+	}
+	ones, bits := the_net.Mask.Size()
+	if bits == 32 && len(ip) == net.IPv6len && ip.To4() == nil && net.IP(ip[:12]).Equal(net.IPv6zero[:12]) {
+		ip = ip[12:] // GetIP returns IPv4 address in 16 bytes without the ::ffff: prefix
+	}
+	if !the_net.Contains(ip) {
+		return 0, false, fmt.Errorf("%v is not in %v", ip, netcidr)
+	}
+	if ones == bits {
+		return 0, false, fmt.Errorf("%v is a host route", netcidr)
+	}
+	if bits == 32 {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	maxuid := big.NewInt(1)
+	maxuid.Lsh(maxuid, uint((bits - ones)))
+	ip_use := big.NewInt(0)
+	ip_use.SetBytes(ip)
+	net_int := big.NewInt(0)
+	net_int.SetBytes(the_net.IP)
+	ip_use.Sub(ip_use, net_int)
+	if maxuid.Cmp(big.NewInt(2)) > 0 {
+		if ip_use.Sign() == 0 {
+			return 0, false, fmt.Errorf("%v is the network address of %v", ip, netcidr)
+		}
+		maxuid.Sub(maxuid, big.NewInt(1))
+		if bits == 32 && ip_use.Cmp(maxuid) == 0 {
+			return 0, true, nil
+		}
+		maxuid.Sub(maxuid, big.NewInt(1))
+		if ip_use.Cmp(maxuid) == 0 {
+			return 0, false, nil
+		}
+	}
+	if !ip_use.IsUint64() || ip_use.Uint64() > uint64(^uint32(0)) {
+		return 0, false, fmt.Errorf("%v is out of range", ip)
+	}
+	return uint32(ip_use.Uint64()), false, nil
+}
+
+// GetDstIPAddr returns the destination address of an IPv4 or IPv6 packet
+func GetDstIPAddr(packet []byte) (net.IP, error) {
+	if len(packet) < 1 {
+		return nil, errors.New("empty packet")
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, errors.New("IPv4 packet too small")
+		}
+		return net.IP(packet[16:20]), nil
+	case 6:
+		if len(packet) < 40 {
+			return nil, errors.New("IPv6 packet too small")
+		}
+		return net.IP(packet[24:40]), nil
+	}
+	return nil, fmt.Errorf("unknown IP version %v", packet[0]>>4)
+}
+
+func IsNotUnicastIP(ip net.IP) bool {
+	return ip.IsMulticast() || ip.Equal(net.IPv4bcast)
+}
+
 const (
 	EventUp = 1 << iota
 	EventDown
@@ -139,3 +221,64 @@ type Device interface {
 	Events() chan Event             // returns a constant channel of events related to the device
 	Close() error                   // stops the device and closes the event channel
 }
+
+// MultiQueueDevice is a Device with multiple queues, every queue can be read by its own goroutine.
+// Frames of the same flow are always read from the same queue, so the order is preserved per flow.
+type MultiQueueDevice interface {
+	Device
+	NumQueues() int                          // returns the number of queues
+	ReadQueue(int, []byte, int) (int, error) // read a packet from the queue
+}
+
+// FlowHash returns a hash of the flow of the packet, for per-flow queue affinity.
+// The flow is identified by the IP addresses and TCP/UDP ports if any, otherwise by the mac addresses.
+func FlowHash(packet []byte, l3 bool) uint32 {
+	h := uint32(2166136261) // FNV-1a
+	mix := func(b []byte) {
+		for _, c := range b {
+			h ^= uint32(c)
+			h *= 16777619
+		}
+	}
+	ip := packet
+	if !l3 {
+		if len(packet) < 14 {
+			return 0
+		}
+		ethertype := binary.BigEndian.Uint16(packet[12:14])
+		ip = packet[14:]
+		if ethertype == 0x8100 && len(packet) >= 18 {
+			ethertype = binary.BigEndian.Uint16(packet[16:18])
+			ip = packet[18:]
+		}
+		if ethertype != 0x0800 && ethertype != 0x86DD {
+			mix(packet[0:12])
+			return h
+		}
+	}
+	var proto byte
+	var l4 []byte
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		ihl := int(ip[0]&0x0f) * 4
+		proto = ip[9]
+		mix(ip[12:20])
+		if ihl >= 20 && len(ip) >= ihl && binary.BigEndian.Uint16(ip[6:8])&0x3fff == 0 { // not fragmented
+			l4 = ip[ihl:]
+		}
+	case len(ip) >= 40 && ip[0]>>4 == 6:
+		proto = ip[6]
+		mix(ip[8:40])
+		l4 = ip[40:]
+	default:
+		if !l3 {
+			mix(packet[0:12])
+		}
+		return h
+	}
+	mix([]byte{proto})
+	if (proto == 6 || proto == 17) && len(l4) >= 4 {
+		mix(l4[0:4])
+	}
+	return h
+}
@@ -0,0 +1,265 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
+	"golang.org/x/sys/unix"
+)
+
+// AfPacketTap bridges an existing linux interface by an AF_PACKET raw socket in promiscuous mode.
+// Frames are received from a PACKET_MMAP(TPACKET_V2) RX ring, and sent by write(2).
+// Outgoing frames are ignored, so the frames written by ourselves are not read back.
+type AfPacketTap struct {
+	name      string
+	mtu       int
+	fd        int
+	ifindex   int
+	ring      []byte
+	frameSize int
+	frameNum  int
+	rxIdx     int
+	rw        *rwcancel.RWCancel
+	events    chan Event
+	readMu    sync.Mutex   // held by Read, the ring is unmapped after the reader returned
+	fdMu      sync.RWMutex // held by Write, the fd is closed after the writers returned
+	closeOnce sync.Once
+	closed    int32
+
+	dropped    uint64 // frames dropped since dropLogged, only used by the reader
+	dropLogged time.Time
+}
+
+const (
+	afpacketRingSize        = 1 << 22
+	afpacketDropLogInterval = 10 * time.Second
+	afpacketHdrLen          = (unix.SizeofTpacket2Hdr + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+)
+
+func htons(v uint16) uint16 {
+	return (v << 8) | (v >> 8)
+}
+
+func CreateAfPacketTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (tapdev Device, err error) {
+	iface, err := net.InterfaceByName(iconfig.Name)
+	if err != nil {
+		return nil, fmt.Errorf("CreateAfPacketTAP(%q) failed: %w", iconfig.Name, err)
+	}
+	// Protocol 0 until bind, so that we don't receive packets of other interfaces
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("CreateAfPacketTAP(%q) failed: %w", iconfig.Name, err)
+	}
+	defer func() {
+		if err != nil {
+			unix.Close(fd)
+		}
+	}()
+	tap := &AfPacketTap{
+		name:    iface.Name,
+		mtu:     iface.MTU,
+		fd:      fd,
+		ifindex: iface.Index,
+		events:  make(chan Event, 1<<5),
+	}
+	if err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_IGNORE_OUTGOING, 1); err != nil {
+		// Linux < 4.20, filter by sll_pkttype instead
+		err = nil
+	}
+	mreq := unix.PacketMreq{
+		Ifindex: int32(iface.Index),
+		Type:    unix.PACKET_MR_PROMISC,
+	}
+	if err = unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		return nil, fmt.Errorf("failed to set %v to promiscuous mode: %w", iface.Name, err)
+	}
+	if err = tap.setupRing(); err != nil {
+		return nil, err
+	}
+	sa := unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ALL),
+		Ifindex:  iface.Index,
+	}
+	if err = unix.Bind(fd, &sa); err != nil {
+		unix.Munmap(tap.ring)
+		return nil, fmt.Errorf("failed to bind to %v: %w", iface.Name, err)
+	}
+	tap.rw, err = rwcancel.NewRWCancel(fd)
+	if err != nil {
+		unix.Munmap(tap.ring)
+		return nil, err
+	}
+	tap.events <- EventUp
+	return tap, nil
+}
+
+func (tap *AfPacketTap) setupRing() error {
+	if err := unix.SetsockoptInt(tap.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V2); err != nil {
+		return fmt.Errorf("failed to set TPACKET_V2: %w", err)
+	}
+	// header + sockaddr_ll + ethernet header + VLAN tag + MTU, rounded up to a power of 2
+	need := afpacketHdrLen + unix.SizeofSockaddrLinklayer + 14 + 4 + tap.mtu + unix.TPACKET_ALIGNMENT
+	tap.frameSize = unix.TPACKET_ALIGNMENT
+	for tap.frameSize < need {
+		tap.frameSize <<= 1
+	}
+	blockSize := os.Getpagesize()
+	for blockSize < tap.frameSize {
+		blockSize <<= 1
+	}
+	blockNum := afpacketRingSize / blockSize
+	if blockNum == 0 {
+		blockNum = 1
+	}
+	tap.frameNum = blockNum * (blockSize / tap.frameSize)
+	req := unix.TpacketReq{
+		Block_size: uint32(blockSize),
+		Block_nr:   uint32(blockNum),
+		Frame_size: uint32(tap.frameSize),
+		Frame_nr:   uint32(tap.frameNum),
+	}
+	if err := unix.SetsockoptTpacketReq(tap.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return fmt.Errorf("failed to setup PACKET_RX_RING: %w", err)
+	}
+	ring, err := unix.Mmap(tap.fd, 0, blockSize*blockNum, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to mmap PACKET_RX_RING: %w", err)
+	}
+	tap.ring = ring
+	return nil
+}
+
+// logDrop logs the dropped frames, at most once every afpacketDropLogInterval
+func (tap *AfPacketTap) logDrop(err error) {
+	tap.dropped += 1
+	if time.Since(tap.dropLogged) < afpacketDropLogInterval {
+		return
+	}
+	fmt.Printf("ERROR: %v frames dropped on %v: %v\n", tap.dropped, tap.name, err)
+	tap.dropped = 0
+	tap.dropLogged = time.Now()
+}
+
+// Read reads a frame from the RX ring. It must not be called concurrently.
+func (tap *AfPacketTap) Read(buf []byte, offset int) (int, error) {
+	tap.readMu.Lock()
+	defer tap.readMu.Unlock()
+	for {
+		if atomic.LoadInt32(&tap.closed) != 0 {
+			return 0, os.ErrClosed
+		}
+		frame := tap.ring[tap.rxIdx*tap.frameSize : (tap.rxIdx+1)*tap.frameSize]
+		hdr := (*unix.Tpacket2Hdr)(unsafe.Pointer(&frame[0]))
+		status := atomic.LoadUint32(&hdr.Status)
+		if status&unix.TP_STATUS_USER == 0 {
+			tap.rw.ReadyRead()
+			continue
+		}
+		size, err := tap.readFrame(frame, hdr, status, buf[offset:])
+		atomic.StoreUint32(&hdr.Status, unix.TP_STATUS_KERNEL)
+		tap.rxIdx = (tap.rxIdx + 1) % tap.frameNum
+		if err != nil {
+			tap.logDrop(err)
+			continue
+		}
+		if size == 0 {
+			continue
+		}
+		return size, nil
+	}
+}
+
+func (tap *AfPacketTap) readFrame(frame []byte, hdr *unix.Tpacket2Hdr, status uint32, buf []byte) (int, error) {
+	sll := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&frame[afpacketHdrLen]))
+	if sll.Pkttype == unix.PACKET_OUTGOING {
+		return 0, nil
+	}
+	if hdr.Snaplen < hdr.Len {
+		return 0, errors.New("frame truncated, please disable GRO/LRO of " + tap.name)
+	}
+	data := frame[hdr.Mac : uint32(hdr.Mac)+hdr.Snaplen]
+	if status&unix.TP_STATUS_VLAN_VALID == 0 || len(data) < 12 {
+		if len(buf) < len(data) {
+			return 0, fmt.Errorf("frame of %v bytes exceeds the buffer", len(data))
+		}
+		return copy(buf, data), nil
+	}
+	// The VLAN tag is stripped by the kernel, put it back
+	if len(buf) < len(data)+4 {
+		return 0, fmt.Errorf("frame of %v bytes exceeds the buffer", len(data)+4)
+	}
+	tpid := uint16(unix.ETH_P_8021Q)
+	if status&unix.TP_STATUS_VLAN_TPID_VALID != 0 && hdr.Vlan_tpid != 0 {
+		tpid = hdr.Vlan_tpid
+	}
+	copy(buf[0:12], data[0:12])
+	binary.BigEndian.PutUint16(buf[12:14], tpid)
+	binary.BigEndian.PutUint16(buf[14:16], hdr.Vlan_tci)
+	copy(buf[16:], data[12:])
+	return len(data) + 4, nil
+}
+
+func (tap *AfPacketTap) Write(buf []byte, offset int) (int, error) {
+	tap.fdMu.RLock()
+	defer tap.fdMu.RUnlock()
+	if atomic.LoadInt32(&tap.closed) != 0 {
+		return 0, os.ErrClosed
+	}
+	for {
+		n, err := unix.Write(tap.fd, buf[offset:])
+		if err == nil {
+			return n, nil
+		}
+		if !rwcancel.RetryAfterError(err) {
+			return 0, err
+		}
+		if !tap.rw.ReadyWrite() {
+			return 0, os.ErrClosed
+		}
+	}
+} // writes a packet to the device (without any additional headers)
+func (tap *AfPacketTap) Flush() error {
+	return nil
+} // flush all previous writes to the device
+func (tap *AfPacketTap) MTU() (int, error) {
+	return tap.mtu, nil
+} // returns the MTU of the device
+func (tap *AfPacketTap) Name() (string, error) {
+	return tap.name, nil
+} // fetches and returns the current name
+func (tap *AfPacketTap) Events() chan Event {
+	return tap.events
+} // returns a constant channel of events related to the device
+func (tap *AfPacketTap) Close() error {
+	tap.closeOnce.Do(func() {
+		atomic.StoreInt32(&tap.closed, 1)
+		tap.rw.Cancel()
+		// Wait for the reader and writers to return, then release the ring and the fd only once
+		tap.readMu.Lock()
+		unix.Munmap(tap.ring)
+		tap.ring = nil
+		tap.readMu.Unlock()
+		tap.fdMu.Lock()
+		unix.Close(tap.fd)
+		tap.fd = -1
+		tap.fdMu.Unlock()
+		tap.rw.Close()
+		tap.events <- EventDown
+		close(tap.events)
+	})
+	return nil
+} // stops the device and closes the event channel
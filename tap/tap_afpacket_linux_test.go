@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
+	"golang.org/x/sys/unix"
+)
+
+const testAfPacketMac = 128
+
+// newTestRingFrame builds a frame of the RX ring carrying data
+func newTestRingFrame(data []byte, pkttype uint8, truncate int) ([]byte, *unix.Tpacket2Hdr) {
+	frame := make([]byte, 2048)
+	hdr := (*unix.Tpacket2Hdr)(unsafe.Pointer(&frame[0]))
+	hdr.Mac = testAfPacketMac
+	hdr.Len = uint32(len(data))
+	hdr.Snaplen = uint32(len(data) - truncate)
+	copy(frame[testAfPacketMac:], data[:len(data)-truncate])
+	sll := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&frame[afpacketHdrLen]))
+	sll.Pkttype = pkttype
+	return frame, hdr
+}
+
+func TestAfPacketReadFrame(t *testing.T) {
+	tap := &AfPacketTap{name: "test0"}
+	data := append([]byte{0xaa, 0xbb, 0xcc, 0xdd, 0, 2, 0xaa, 0xbb, 0xcc, 0xdd, 0, 1, 0x08, 0x00}, make([]byte, 100)...)
+
+	frame, hdr := newTestRingFrame(data, unix.PACKET_HOST, 0)
+	buf := make([]byte, 1500)
+	if n, err := tap.readFrame(frame, hdr, unix.TP_STATUS_USER, buf); err != nil || !bytes.Equal(buf[:n], data) {
+		t.Fatalf("readFrame() = %v, %v, want the frame", n, err)
+	}
+
+	frame, hdr = newTestRingFrame(data, unix.PACKET_OUTGOING, 0)
+	if n, err := tap.readFrame(frame, hdr, unix.TP_STATUS_USER, buf); n != 0 || err != nil {
+		t.Errorf("outgoing frame: readFrame() = %v, %v, want skipped", n, err)
+	}
+
+	frame, hdr = newTestRingFrame(data, unix.PACKET_HOST, 10)
+	if _, err := tap.readFrame(frame, hdr, unix.TP_STATUS_USER, buf); err == nil {
+		t.Errorf("truncated frame: readFrame() didn't fail")
+	}
+
+	frame, hdr = newTestRingFrame(data, unix.PACKET_HOST, 0)
+	if _, err := tap.readFrame(frame, hdr, unix.TP_STATUS_USER, buf[:len(data)-1]); err == nil {
+		t.Errorf("oversized frame: readFrame() didn't fail")
+	}
+
+	// the VLAN tag stripped by the kernel is put back
+	frame, hdr = newTestRingFrame(data, unix.PACKET_HOST, 0)
+	hdr.Vlan_tci = 100
+	n, err := tap.readFrame(frame, hdr, unix.TP_STATUS_USER|unix.TP_STATUS_VLAN_VALID, buf)
+	if err != nil || n != len(data)+4 {
+		t.Fatalf("VLAN frame: readFrame() = %v, %v", n, err)
+	}
+	if !bytes.Equal(buf[12:16], []byte{0x81, 0x00, 0, 100}) || !bytes.Equal(buf[16:n], data[12:]) {
+		t.Errorf("VLAN tag not restored: % x", buf[:20])
+	}
+	if _, err := tap.readFrame(frame, hdr, unix.TP_STATUS_USER|unix.TP_STATUS_VLAN_VALID, buf[:len(data)+3]); err == nil {
+		t.Errorf("oversized VLAN frame: readFrame() didn't fail")
+	}
+}
+
+func TestAfPacketCloseOnce(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	rw, err := rwcancel.NewRWCancel(fds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := unix.Mmap(-1, 0, os.Getpagesize(), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap := &AfPacketTap{name: "test0", fd: fds[0], ring: ring, frameSize: os.Getpagesize(), frameNum: 1, rw: rw, events: make(chan Event, 2)}
+
+	done := make(chan error)
+	go func() {
+		_, err := tap.Read(make([]byte, 1500), 0)
+		done <- err
+	}()
+	tap.Close()
+	if err := <-done; err != os.ErrClosed {
+		t.Errorf("Read() after Close() = %v, want os.ErrClosed", err)
+	}
+	if _, err := tap.Write(make([]byte, 64), 0); err != os.ErrClosed {
+		t.Errorf("Write() after Close() = %v, want os.ErrClosed", err)
+	}
+
+	// the fd number is reused by the next socket, closing again must not close it
+	reused, err := unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(reused)
+	tap.Close()
+	if _, err := unix.FcntlInt(uintptr(reused), unix.F_GETFD, 0); err != nil {
+		t.Errorf("the second Close() closed a reused fd: %v", err)
+	}
+}
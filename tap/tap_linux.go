@@ -34,10 +34,16 @@ import (
 const (
 	cloneDevicePath = "/dev/net/tun"
 	ifReqSize       = unix.IFNAMSIZ + 64
+	maxTapQueues    = 256 // MAX_TAP_QUEUES of the kernel
 )
 
 type NativeTap struct {
 	tapFile                 *os.File
+	queues                  []*os.File // tapFile is the first queue, others are available with IFF_MULTI_QUEUE
+	l3                      bool       // IFF_TUN, packets are IP packets without ethernet header
+	vnetHdr                 bool       // IFF_VNET_HDR, every frame is prefixed by a virtio_net_hdr
+	splitters               []*gsoSplitter
+	gro                     *groTable
 	index                   int32      // if index
 	errors                  chan error // async error handling
 	events                  chan Event // device related events
@@ -401,8 +407,23 @@ func (tap *NativeTap) nameSlow() (string, error) {
 }
 
 func (tap *NativeTap) Write(buf []byte, offset int) (int, error) {
-	buf = buf[offset:]
-	n, err := tap.tapFile.Write(buf)
+	if tap.gro != nil {
+		err := tap.gro.Write(buf, offset)
+		if err != nil {
+			return 0, err
+		}
+		return len(buf) - offset, nil
+	}
+	return tap.writeFrame(buf[offset:], 0)
+}
+
+// writeFrame writes buf to the queue of the flow, the frame starts at buf[skip:]
+func (tap *NativeTap) writeFrame(buf []byte, skip int) (int, error) {
+	file := tap.tapFile
+	if len(tap.queues) > 1 {
+		file = tap.queues[FlowHash(buf[skip:], tap.l3)%uint32(len(tap.queues))]
+	}
+	n, err := file.Write(buf)
 	if errors.Is(err, syscall.EBADFD) {
 		err = os.ErrClosed
 	}
@@ -410,15 +431,30 @@ func (tap *NativeTap) Write(buf []byte, offset int) (int, error) {
 }
 
 func (tap *NativeTap) Flush() error {
-	// TODO: can flushing be implemented by buffering and using sendmmsg?
+	if tap.gro != nil {
+		return tap.gro.Flush()
+	}
 	return nil
 }
 
 func (tap *NativeTap) Read(buf []byte, offset int) (n int, err error) {
+	return tap.ReadQueue(0, buf, offset)
+}
+
+func (tap *NativeTap) NumQueues() int {
+	return len(tap.queues)
+}
+
+// ReadQueue reads a packet from the queue. The kernel steers the packets of a flow to the same queue.
+func (tap *NativeTap) ReadQueue(queue int, buf []byte, offset int) (n int, err error) {
 	select {
 	case err = <-tap.errors:
 	default:
-		n, err = tap.tapFile.Read(buf[offset:])
+		if tap.vnetHdr {
+			n, err = tap.readOffload(queue, buf[offset:])
+		} else {
+			n, err = tap.queues[queue].Read(buf[offset:])
+		}
 		if errors.Is(err, syscall.EBADFD) {
 			err = os.ErrClosed
 		}
@@ -427,6 +463,23 @@ func (tap *NativeTap) Read(buf []byte, offset int) (n int, err error) {
 	return
 }
 
+// readOffload reads a frame with virtio_net_hdr, and returns the segments of it one by one
+func (tap *NativeTap) readOffload(queue int, buf []byte) (int, error) {
+	s := tap.splitters[queue]
+	for {
+		if n, ok := s.next(buf); ok {
+			return n, nil
+		}
+		n, err := tap.queues[queue].Read(s.buf)
+		if err != nil {
+			return 0, err
+		}
+		if err = s.split(n, tap.l3); err != nil {
+			fmt.Println("ERROR: Failed to split the frame from tap:", err)
+		}
+	}
+}
+
 func (tap *NativeTap) Events() chan Event {
 	return tap.events
 }
@@ -442,7 +495,11 @@ func (tap *NativeTap) Close() error {
 		} else if tap.events != nil {
 			close(tap.events)
 		}
-		err2 = tap.tapFile.Close()
+		for _, file := range tap.queues {
+			if err := file.Close(); err != nil && err2 == nil {
+				err2 = err
+			}
+		}
 	})
 	if err1 != nil {
 		return err1
@@ -450,28 +507,15 @@ func (tap *NativeTap) Close() error {
 	return err2
 }
 
-func CreateTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, error) {
+func openTapQueue(ifr *[ifReqSize]byte) (*os.File, error) {
 	nfd, err := unix.Open(cloneDevicePath, os.O_RDWR, 0)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("CreateTAP(%q) failed; %s does not exist", iconfig.Name, cloneDevicePath)
+			return nil, fmt.Errorf("%s does not exist", cloneDevicePath)
 		}
 		return nil, err
 	}
 
-	var ifr [ifReqSize]byte
-	var flags uint16 = unix.IFF_TAP | unix.IFF_NO_PI // (disabled for TUN status hack)
-	if err != nil {
-		fmt.Println("ERROR: Failed parse mac address:", iconfig.MacAddrPrefix)
-		return nil, err
-	}
-	nameBytes := []byte(iconfig.Name)
-	if len(nameBytes) >= unix.IFNAMSIZ {
-		return nil, fmt.Errorf("interface name too long: %w", unix.ENAMETOOLONG)
-	}
-	copy(ifr[:], nameBytes)
-	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = flags
-
 	_, _, errno := unix.Syscall(
 		unix.SYS_IOCTL,
 		uintptr(nfd),
@@ -479,18 +523,111 @@ func CreateTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, erro
 		uintptr(unsafe.Pointer(&ifr[0])),
 	)
 	if errno != 0 {
+		unix.Close(nfd)
 		return nil, errno
 	}
 	err = unix.SetNonblock(nfd, true)
+	if err != nil {
+		unix.Close(nfd)
+		return nil, err
+	}
 
 	// Note that the above -- open,ioctl,nonblock -- must happen prior to handing it to netpoll as below this line.
 
-	fd := os.NewFile(uintptr(nfd), cloneDevicePath)
+	return os.NewFile(uintptr(nfd), cloneDevicePath), nil
+}
+
+func CreateTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, error) {
+	var ifr [ifReqSize]byte
+	var flags uint16 = unix.IFF_TAP | unix.IFF_NO_PI // (disabled for TUN status hack)
+	if iconfig.IType == "tun" {
+		flags = unix.IFF_TUN | unix.IFF_NO_PI // L3 mode, IP packets without ethernet header
+	}
+	queues := iconfig.Queues
+	if queues < 1 {
+		queues = 1
+	} else if queues > maxTapQueues {
+		return nil, fmt.Errorf("CreateTAP(%q) failed; too many queues: %v, max %v", iconfig.Name, queues, maxTapQueues)
+	}
+	if queues > 1 {
+		flags |= unix.IFF_MULTI_QUEUE
+	}
+	if iconfig.Offload {
+		flags |= unix.IFF_VNET_HDR
+	}
+	nameBytes := []byte(iconfig.Name)
+	if len(nameBytes) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name too long: %w", unix.ENAMETOOLONG)
+	}
+	copy(ifr[:], nameBytes)
+	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = flags
+
+	files := make([]*os.File, 0, queues)
+	for i := 0; i < queues; i++ {
+		// TUNSETIFF writes the real name back to ifr, other queues are attached to the same interface
+		file, err := openTapQueue(&ifr)
+		if err != nil && i == 0 && flags&unix.IFF_VNET_HDR != 0 {
+			fmt.Printf("ERROR: Failed to enable IFF_VNET_HDR on %v: %v, offloads disabled\n", iconfig.Name, err)
+			flags &^= unix.IFF_VNET_HDR
+			*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = flags
+			file, err = openTapQueue(&ifr)
+		}
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, fmt.Errorf("CreateTAP(%q) failed; queue %v: %w", iconfig.Name, i, err)
+		}
+		files = append(files, file)
+	}
+
+	tapdev, err := CreateTAPFromFile(files[0], iconfig, NodeID)
 	if err != nil {
+		for _, file := range files[1:] {
+			file.Close()
+		}
 		return nil, err
 	}
+	nativetap := tapdev.(*NativeTap)
+	nativetap.queues = files
+	if flags&unix.IFF_VNET_HDR != 0 {
+		nativetap.enableOffload()
+	}
+	return tapdev, nil
+}
 
-	return CreateTAPFromFile(fd, iconfig, NodeID)
+// enableOffload enables checksum offload and TSO of the tap.
+// Super-frames read from the tap are split into MTU-sized frames, and TCP segments written to the tap are coalesced until Flush.
+func (tap *NativeTap) enableOffload() {
+	tap.vnetHdr = true
+	tap.splitters = make([]*gsoSplitter, len(tap.queues))
+	for i := range tap.splitters {
+		tap.splitters[i] = newGSOSplitter()
+	}
+	tap.gro = newGROTable(tap.l3, func(buf []byte) error {
+		_, err := tap.writeFrame(buf, virtioNetHdrLen)
+		return err
+	})
+	sysconn, err := tap.tapFile.SyscallConn()
+	if err != nil {
+		return
+	}
+	var errno syscall.Errno
+	err = sysconn.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall(
+			unix.SYS_IOCTL,
+			fd,
+			uintptr(unix.TUNSETOFFLOAD),
+			uintptr(unix.TUN_F_CSUM|unix.TUN_F_TSO4|unix.TUN_F_TSO6),
+		)
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		// Frames are still prefixed by the virtio_net_hdr, but never offloaded by the kernel
+		fmt.Println("ERROR: Failed to enable offloads on tap:", err)
+	}
 }
 
 func CreateTAPFromFile(file *os.File, iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, error) {
@@ -500,6 +637,8 @@ func CreateTAPFromFile(file *os.File, iconfig mtypes.InterfaceConf, NodeID mtype
 		errors:                  make(chan error, 5),
 		statusListenersShutdown: make(chan struct{}),
 		nopi:                    false,
+		queues:                  []*os.File{file},
+		l3:                      iconfig.IType == "tun",
 	}
 
 	name, err := tap.Name()
@@ -536,14 +675,16 @@ func CreateTAPFromFile(file *os.File, iconfig mtypes.InterfaceConf, NodeID mtype
 	if err != nil {
 		return nil, err
 	}
-	IfMacAddr, err := GetMacAddr(iconfig.MacAddrPrefix, uint32(NodeID))
-	if err != nil {
-		fmt.Println("ERROR: Failed parse mac address:", iconfig.MacAddrPrefix)
-		return nil, err
-	}
-	err = tap.setMacAddr(IfMacAddr)
-	if err != nil {
-		return nil, err
+	if iconfig.IType != "tun" {
+		IfMacAddr, err := GetMacAddr(iconfig.MacAddrPrefix, uint32(NodeID))
+		if err != nil {
+			fmt.Println("ERROR: Failed parse mac address:", iconfig.MacAddrPrefix)
+			return nil, err
+		}
+		err = tap.setMacAddr(IfMacAddr)
+		if err != nil {
+			return nil, err
+		}
 	}
 	tapname, err := tap.Name()
 	if err != nil {
@@ -603,6 +744,7 @@ func CreateUnmonitoredTUNFromFD(fd int) (Device, string, error) {
 	file := os.NewFile(uintptr(fd), "/dev/tap")
 	tap := &NativeTap{
 		tapFile: file,
+		queues:  []*os.File{file},
 		events:  make(chan Event, 5),
 		errors:  make(chan error, 5),
 		nopi:    true,
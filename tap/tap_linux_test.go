@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// BenchmarkTapWrite compares writing TCP segments to a tap one by one, and coalesced by GRO. Requires CAP_NET_ADMIN.
+func BenchmarkTapWrite(b *testing.B) {
+	payload := testPayload(testMSS)
+	frames := make([][]byte, 48)
+	for i := range frames {
+		frames[i] = append(make([]byte, 20), buildTCPFrame(false, uint32(1000+i*testMSS), tcpFlagACK, uint16(i), payload)...)
+	}
+	for _, offload := range []bool{false, true} {
+		name := "plain"
+		if offload {
+			name = "offload"
+		}
+		b.Run(name, func(b *testing.B) {
+			dev, err := CreateTAP(mtypes.InterfaceConf{IType: "tap", Name: "egbench0", MacAddrPrefix: "AA:BB:CC:DD", MTU: 1400, Offload: offload}, 1)
+			if err != nil {
+				b.Skip("failed to create tap:", err)
+			}
+			defer dev.Close()
+			b.SetBytes(int64(len(frames) * len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, frame := range frames {
+					if _, err := dev.Write(frame, 20); err != nil {
+						b.Fatal(err)
+					}
+				}
+				dev.Flush()
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const netstackNIC tcpip.NICID = 1
+
+// NetstackTap is a userspace TCP/IP stack(gVisor netstack) attached to the overlay.
+// No kernel interface is created, so it runs without CAP_NET_ADMIN.
+// Local programs reach the overlay by the SOCKS5 proxy, HTTP CONNECT proxy and port forwards.
+type NetstackTap struct {
+	name      string
+	mtu       int
+	stack     *stack.Stack
+	ep        *channel.Endpoint
+	events    chan Event
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners []net.Listener
+	udpconns  []net.PacketConn
+	closeOnce sync.Once
+}
+
+func CreateNetstackTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (tapdev Device, err error) {
+	macaddr, err := GetMacAddr(iconfig.MacAddrPrefix, uint32(NodeID))
+	if err != nil {
+		fmt.Println("ERROR: Failed parse mac address:", iconfig.MacAddrPrefix)
+		return nil, err
+	}
+	if iconfig.IPv4CIDR == "" && iconfig.IPv6CIDR == "" {
+		return nil, errors.New("netstack: IPv4CIDR or IPv6CIDR is required")
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		HandleLocal:        true,
+	})
+	ep := channel.New(1024, uint32(iconfig.MTU)+header.EthernetMinimumSize, tcpip.LinkAddress(macaddr[:]))
+	if terr := s.CreateNIC(netstackNIC, ethernet.New(ep)); terr != nil {
+		return nil, fmt.Errorf("netstack: CreateNIC: %v", terr)
+	}
+	tap := &NetstackTap{
+		name:   iconfig.Name,
+		mtu:    int(iconfig.MTU),
+		stack:  s,
+		ep:     ep,
+		events: make(chan Event, 1<<5),
+	}
+	tap.ctx, tap.cancel = context.WithCancel(context.Background())
+	defer func() {
+		if err != nil {
+			tap.Close()
+		}
+	}()
+	for _, c := range []struct {
+		version int
+		cidr    string
+	}{{4, iconfig.IPv4CIDR}, {6, iconfig.IPv6CIDR}, {6, iconfig.IPv6LLPrefix}} {
+		if c.cidr == "" {
+			continue
+		}
+		if err = tap.addAddress(c.version, c.cidr, NodeID); err != nil {
+			return nil, err
+		}
+	}
+	if iconfig.Netstack.SocksAddr != "" {
+		if err = tap.listenSocks(iconfig.Netstack.SocksAddr); err != nil {
+			return nil, err
+		}
+	}
+	if iconfig.Netstack.HttpProxyAddr != "" {
+		if err = tap.listenHttpProxy(iconfig.Netstack.HttpProxyAddr); err != nil {
+			return nil, err
+		}
+	}
+	for _, fwd := range iconfig.Netstack.Forwards {
+		if err = tap.listenForward(fwd); err != nil {
+			return nil, err
+		}
+	}
+	tap.events <- EventUp
+	return tap, nil
+}
+
+func (tap *NetstackTap) addAddress(version int, cidr string, NodeID mtypes.Vertex) error {
+	ip, mask, err := GetIP(version, cidr, uint32(NodeID))
+	if err != nil {
+		return err
+	}
+	ones, _ := mask.Size()
+	proto := ipv4.ProtocolNumber
+	if version == 6 {
+		proto = ipv6.ProtocolNumber
+	} else {
+		ip = ip[len(ip)-4:] // GetIP returns IPv4 address in 16 bytes without the ::ffff: prefix
+	}
+	addr := tcpip.ProtocolAddress{
+		Protocol: proto,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFromSlice(ip),
+			PrefixLen: ones,
+		},
+	}
+	if terr := tap.stack.AddProtocolAddress(netstackNIC, addr, stack.AddressProperties{}); terr != nil {
+		return fmt.Errorf("netstack: failed to add address %v: %v", addr.AddressWithPrefix, terr)
+	}
+	tap.stack.AddRoute(tcpip.Route{
+		Destination: addr.AddressWithPrefix.Subnet(),
+		NIC:         netstackNIC,
+	})
+	return nil
+}
+
+// dial connects to addr inside the overlay
+func (tap *NetstackTap) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %v", portstr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+	proto := ipv6.ProtocolNumber
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		proto = ipv4.ProtocolNumber
+	}
+	fa := tcpip.FullAddress{
+		NIC:  netstackNIC,
+		Addr: tcpip.AddrFromSlice(ip),
+		Port: uint16(port),
+	}
+	switch network {
+	case "tcp":
+		return gonet.DialContextTCP(ctx, tap.stack, fa, proto)
+	case "udp":
+		return gonet.DialUDP(tap.stack, nil, &fa, proto)
+	}
+	return nil, errors.New("netstack: unknown network " + network)
+}
+
+func (tap *NetstackTap) Read(buf []byte, offset int) (int, error) {
+	pkt := tap.ep.ReadContext(tap.ctx)
+	if pkt.IsNil() {
+		return 0, os.ErrClosed
+	}
+	defer pkt.DecRef()
+	view := pkt.ToView()
+	defer view.Release()
+	return copy(buf[offset:], view.AsSlice()), nil
+} // read a packet from the device (without any additional headers)
+func (tap *NetstackTap) Write(buf []byte, offset int) (int, error) {
+	if tap.ctx.Err() != nil {
+		return 0, os.ErrClosed
+	}
+	packet := buf[offset:]
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(append([]byte(nil), packet...)),
+	})
+	tap.ep.InjectInbound(0, pkt)
+	pkt.DecRef()
+	return len(packet), nil
+} // writes a packet to the device (without any additional headers)
+func (tap *NetstackTap) Flush() error {
+	return nil
+} // flush all previous writes to the device
+func (tap *NetstackTap) MTU() (int, error) {
+	return tap.mtu, nil
+} // returns the MTU of the device
+func (tap *NetstackTap) Name() (string, error) {
+	return tap.name, nil
+} // fetches and returns the current name
+func (tap *NetstackTap) Events() chan Event {
+	return tap.events
+} // returns a constant channel of events related to the device
+func (tap *NetstackTap) Close() error {
+	tap.closeOnce.Do(func() {
+		tap.cancel()
+		for _, l := range tap.listeners {
+			l.Close()
+		}
+		for _, c := range tap.udpconns {
+			c.Close()
+		}
+		tap.stack.Close()
+		tap.ep.Close()
+		tap.events <- EventDown
+		close(tap.events)
+	})
+	return nil
+} // stops the device and closes the event channel
@@ -0,0 +1,280 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	netstackDialTimeout = 10 * time.Second
+	netstackUDPTimeout  = 60 * time.Second
+)
+
+// netstackPipe copies data between a and b until one side is closed
+func netstackPipe(a net.Conn, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	cp := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+func (tap *NetstackTap) serve(l net.Listener, handle func(conn net.Conn)) {
+	tap.listeners = append(tap.listeners, l)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if tap.ctx.Err() == nil {
+					fmt.Println("ERROR: netstack:", err)
+				}
+				return
+			}
+			go handle(conn)
+		}
+	}()
+}
+
+func (tap *NetstackTap) dialTimeout(network string, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(tap.ctx, netstackDialTimeout)
+	defer cancel()
+	return tap.dial(ctx, network, addr)
+}
+
+// listenSocks starts a SOCKS5 proxy(no authentication, CONNECT only) to the overlay
+func (tap *NetstackTap) listenSocks(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("netstack: SOCKS5 proxy: %w", err)
+	}
+	tap.serve(l, tap.handleSocks)
+	return nil
+}
+
+func (tap *NetstackTap) handleSocks(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	reply := func(rep byte) {
+		conn.Write([]byte{0x05, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	}
+	// greeting: VER NMETHODS METHODS
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil || hdr[0] != 0x05 {
+		conn.Close()
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{0x05, 0x00})
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil || req[0] != 0x05 {
+		conn.Close()
+		return
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		ip := make([]byte, 4)
+		if req[3] == 0x04 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			conn.Close()
+			return
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		l, err := r.ReadByte()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(r, name); err != nil {
+			conn.Close()
+			return
+		}
+		host = string(name)
+	default:
+		reply(0x08) // address type not supported
+		conn.Close()
+		return
+	}
+	portbuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, portbuf); err != nil {
+		conn.Close()
+		return
+	}
+	if req[1] != 0x01 {
+		reply(0x07) // command not supported
+		conn.Close()
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portbuf))))
+	remote, err := tap.dialTimeout("tcp", target)
+	if err != nil {
+		reply(0x05) // connection refused
+		conn.Close()
+		return
+	}
+	reply(0x00)
+	netstackPipe(&bufferedConn{Conn: conn, r: r}, remote)
+}
+
+// listenHttpProxy starts a HTTP CONNECT proxy to the overlay
+func (tap *NetstackTap) listenHttpProxy(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("netstack: HTTP proxy: %w", err)
+	}
+	tap.listeners = append(tap.listeners, l)
+	server := &http.Server{
+		Handler: http.HandlerFunc(tap.handleHttpConnect),
+	}
+	go server.Serve(l)
+	return nil
+}
+
+func (tap *NetstackTap) handleHttpConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "Only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	remote, err := tap.dialTimeout("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		remote.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		remote.Close()
+		return
+	}
+	rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	rw.Flush()
+	netstackPipe(&bufferedConn{Conn: conn, r: rw.Reader}, remote)
+}
+
+// listenForward forwards a local tcp/udp port to Target inside the overlay
+func (tap *NetstackTap) listenForward(fwd mtypes.NetstackForward) error {
+	switch fwd.Proto {
+	case "tcp":
+		l, err := net.Listen("tcp", fwd.Listen)
+		if err != nil {
+			return fmt.Errorf("netstack: forward %v: %w", fwd.Listen, err)
+		}
+		tap.serve(l, func(conn net.Conn) {
+			remote, err := tap.dialTimeout("tcp", fwd.Target)
+			if err != nil {
+				fmt.Println("ERROR: netstack: forward to", fwd.Target, "failed:", err)
+				conn.Close()
+				return
+			}
+			netstackPipe(conn, remote)
+		})
+	case "udp":
+		pc, err := net.ListenPacket("udp", fwd.Listen)
+		if err != nil {
+			return fmt.Errorf("netstack: forward %v: %w", fwd.Listen, err)
+		}
+		tap.udpconns = append(tap.udpconns, pc)
+		go tap.forwardUDP(pc, fwd.Target)
+	default:
+		return errors.New("netstack: unknown forward Proto: " + fwd.Proto)
+	}
+	return nil
+}
+
+// forwardUDP relays datagrams between local clients and target. Each client gets its own session in the overlay.
+func (tap *NetstackTap) forwardUDP(pc net.PacketConn, target string) {
+	var mu sync.Mutex
+	sessions := make(map[string]net.Conn)
+	buf := make([]byte, 65535)
+	for {
+		n, caddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		remote, ok := sessions[caddr.String()]
+		if !ok {
+			remote, err = tap.dialTimeout("udp", target)
+			if err != nil {
+				mu.Unlock()
+				fmt.Println("ERROR: netstack: forward to", target, "failed:", err)
+				continue
+			}
+			sessions[caddr.String()] = remote
+			go func(remote net.Conn, caddr net.Addr) {
+				rbuf := make([]byte, 65535)
+				for {
+					remote.SetReadDeadline(time.Now().Add(netstackUDPTimeout))
+					n, err := remote.Read(rbuf)
+					if err != nil {
+						break
+					}
+					pc.WriteTo(rbuf[:n], caddr)
+				}
+				mu.Lock()
+				delete(sessions, caddr.String())
+				mu.Unlock()
+				remote.Close()
+			}(remote, caddr)
+		}
+		mu.Unlock()
+		remote.Write(buf[:n])
+	}
+}
+
+// bufferedConn is a net.Conn which reads the data buffered in r first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+const testNetstackEchoPort = 7
+
+// newTestNetstackPair creates the netstacks of node 1 and 2, wired to each other.
+// Node 1 has the proxies, node 2 runs an echo server.
+func newTestNetstackPair(t *testing.T) (proxy *NetstackTap) {
+	iconfig := mtypes.InterfaceConf{
+		Name:          "netstack0",
+		MacAddrPrefix: "AA:BB:CC:DD",
+		IPv4CIDR:      "192.168.76.0/24",
+		MTU:           1400,
+		Netstack: mtypes.NetstackInfo{
+			SocksAddr:     "127.0.0.1:0",
+			HttpProxyAddr: "127.0.0.1:0",
+		},
+	}
+	dev1, err := CreateNetstackTAP(iconfig, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iconfig.Netstack = mtypes.NetstackInfo{}
+	dev2, err := CreateNetstackTAP(iconfig, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dev1.Close()
+		dev2.Close()
+	})
+	wire := func(from Device, to Device) {
+		buf := make([]byte, 2048)
+		for {
+			n, err := from.Read(buf, 0)
+			if err != nil {
+				return
+			}
+			to.Write(buf[:n], 0)
+		}
+	}
+	go wire(dev1, dev2)
+	go wire(dev2, dev1)
+
+	l, err := gonet.ListenTCP(dev2.(*NetstackTap).stack, tcpip.FullAddress{NIC: netstackNIC, Port: testNetstackEchoPort}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return dev1.(*NetstackTap)
+}
+
+func checkEcho(t *testing.T, conn net.Conn, r io.Reader) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello overlay")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("echo = %q, want %q", got, msg)
+	}
+}
+
+func socksRequest(cmd byte, ip net.IP, port uint16) []byte {
+	req := []byte{0x05, 0x01, 0x00, 0x05, cmd, 0x00, 0x01}
+	req = append(req, ip.To4()...)
+	return binary.BigEndian.AppendUint16(req, port)
+}
+
+func TestNetstackSocks(t *testing.T) {
+	tap := newTestNetstackPair(t)
+	socksAddr := tap.listeners[0].Addr().String()
+	for _, tc := range []struct {
+		name string
+		cmd  byte
+		port uint16
+		rep  byte
+	}{
+		{"connect", 0x01, testNetstackEchoPort, 0x00},
+		{"bind", 0x02, testNetstackEchoPort, 0x07},
+		{"refused", 0x01, testNetstackEchoPort + 1, 0x05},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", socksAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(15 * time.Second))
+			if _, err := conn.Write(socksRequest(tc.cmd, net.IPv4(192, 168, 76, 2), tc.port)); err != nil {
+				t.Fatal(err)
+			}
+			resp := make([]byte, 2+10)
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(resp[:2], []byte{0x05, 0x00}) || resp[3] != tc.rep {
+				t.Fatalf("SOCKS5 response % x, want reply %v", resp, tc.rep)
+			}
+			if tc.rep == 0x00 {
+				checkEcho(t, conn, conn)
+			}
+		})
+	}
+}
+
+func TestNetstackHttpConnect(t *testing.T) {
+	tap := newTestNetstackPair(t)
+	proxyAddr := tap.listeners[1].Addr().String()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	conn.Write([]byte("CONNECT 192.168.76.2:7 HTTP/1.1\r\nHost: 192.168.76.2:7\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status %v", resp.Status)
+	}
+	checkEcho(t, conn, r)
+
+	resp, err = http.Get("http://" + proxyAddr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status %v, want 405", resp.Status)
+	}
+}
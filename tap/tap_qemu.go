@@ -0,0 +1,190 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const qemuMaxFrame = 65536
+
+// QemuSockTap speaks the wire format of QEMU `-netdev stream` / `-netdev socket`: every frame is prefixed by its length in 4-byte big-endian.
+// With RecvAddr, QEMU connects to us(`-netdev stream,server=off` / `-netdev socket,connect=`). Many VMs can be connected at the same time.
+// With SendAddr, we connect to QEMU(`-netdev stream,server=on` / `-netdev socket,listen=`) and reconnect if disconnected.
+// Every connection is a port of a small learning switch.
+type QemuSockTap struct {
+	name      string
+	mtu       int
+	protocol  string
+	server    net.Listener
+	sw        *portSwitch
+	loglevel  mtypes.LoggerInfo
+	closeOnce sync.Once
+	closed    chan struct{}
+	events    chan Event
+}
+
+func CreateQemuSockTAP(iconfig mtypes.InterfaceConf, protocol string, NodeID mtypes.Vertex, loglevel mtypes.LoggerInfo) (tapdev Device, err error) {
+	tap := &QemuSockTap{
+		name:     iconfig.Name,
+		mtu:      int(iconfig.MTU),
+		protocol: protocol,
+		sw:       newPortSwitch(loglevel),
+		loglevel: loglevel,
+		closed:   make(chan struct{}),
+		events:   make(chan Event, 1<<5),
+	}
+	if iconfig.RecvAddr == "" && iconfig.SendAddr == "" {
+		return nil, errors.New("At least one of RecvAddr or SendAddr required.")
+	}
+	if iconfig.RecvAddr != "" {
+		tap.server, err = net.Listen(protocol, iconfig.RecvAddr)
+		if err != nil {
+			return nil, err
+		}
+		go tap.RoutineAcceptConnection()
+	}
+	if iconfig.SendAddr != "" {
+		go tap.RoutineConnect(iconfig.SendAddr)
+	}
+	tap.events <- EventUp
+	return tap, nil
+}
+
+func (tap *QemuSockTap) isClosed() bool {
+	select {
+	case <-tap.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (tap *QemuSockTap) RoutineAcceptConnection() {
+	for {
+		conn, err := tap.server.Accept()
+		if tap.isClosed() {
+			return
+		}
+		if err != nil {
+			if tap.loglevel.LogInternal {
+				fmt.Printf("Internal: Accept error %v\n", err)
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if tap.loglevel.LogInternal {
+			fmt.Printf("Internal: New connection accepted from %v\n", conn.RemoteAddr())
+		}
+		go tap.serveConn(conn)
+	}
+}
+
+// RoutineConnect keeps a connection to the QEMU which listens at addr
+func (tap *QemuSockTap) RoutineConnect(addr string) {
+	for !tap.isClosed() {
+		conn, err := net.Dial(tap.protocol, addr)
+		if err != nil {
+			if tap.loglevel.LogInternal {
+				fmt.Printf("Internal: Connect to %v failed: %v\n", addr, err)
+			}
+		} else {
+			tap.serveConn(conn)
+		}
+		select {
+		case <-tap.closed:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (tap *QemuSockTap) serveConn(conn net.Conn) {
+	var lock sync.Mutex
+	port := tap.sw.AddPort(conn.RemoteAddr().String(), func(frame []byte) error {
+		buf := make([]byte, 4+len(frame))
+		binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+		copy(buf[4:], frame)
+		lock.Lock()
+		defer lock.Unlock()
+		_, err := conn.Write(buf)
+		return err
+	})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-tap.closed:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		tap.sw.RemovePort(port)
+		conn.Close()
+		if tap.loglevel.LogInternal {
+			fmt.Printf("Internal: Connection closed: %v\n", conn.RemoteAddr())
+		}
+	}()
+	hdr := make([]byte, 4)
+	buf := make([]byte, qemuMaxFrame)
+	for {
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(hdr)
+		if size > qemuMaxFrame {
+			fmt.Printf("ERROR: Invalid frame size %v from %v\n", size, conn.RemoteAddr())
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:size]); err != nil {
+			return
+		}
+		tap.sw.Input(port, buf[:size])
+	}
+}
+
+func (tap *QemuSockTap) Read(buf []byte, offset int) (int, error) {
+	return tap.sw.Read(buf[offset:])
+} // read a packet from the device (without any additional headers)
+func (tap *QemuSockTap) Write(buf []byte, offset int) (int, error) {
+	if tap.isClosed() {
+		return 0, errors.New("Tap closed")
+	}
+	tap.sw.Output(buf[offset:])
+	return len(buf) - offset, nil
+} // writes a packet to the device (without any additional headers)
+func (tap *QemuSockTap) Flush() error {
+	return nil
+} // flush all previous writes to the device
+func (tap *QemuSockTap) MTU() (int, error) {
+	return tap.mtu, nil
+} // returns the MTU of the device
+func (tap *QemuSockTap) Name() (string, error) {
+	return tap.name, nil
+} // fetches and returns the current name
+func (tap *QemuSockTap) Events() chan Event {
+	return tap.events
+} // returns a constant channel of events related to the device
+func (tap *QemuSockTap) Close() error {
+	tap.closeOnce.Do(func() {
+		close(tap.closed)
+		tap.sw.Close()
+		if tap.server != nil {
+			tap.server.Close()
+		}
+		tap.events <- EventDown
+		close(tap.events)
+	})
+	return nil
+} // stops the device and closes the event channel
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestQemuSockFraming(t *testing.T) {
+	tap := &QemuSockTap{
+		name:   "qemu0",
+		mtu:    1400,
+		sw:     newPortSwitch(mtypes.LoggerInfo{}),
+		closed: make(chan struct{}),
+		events: make(chan Event, 1<<5),
+	}
+	defer tap.Close()
+	vm, ours := net.Pipe()
+	go tap.serveConn(ours)
+	vm.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// a frame from the VM comes out of the tap without the length prefix
+	frame := testFrame(testMacBcast, testMacA)
+	if _, err := vm.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := tap.Read(buf, 0)
+	if err != nil || !bytes.Equal(buf[:n], frame) {
+		t.Fatalf("Read() = %x, %v, want %x", buf[:n], err, frame)
+	}
+
+	// a frame to the VM is prefixed by its length in 4-byte big-endian
+	reply := testFrame(testMacA, testMacB)
+	go tap.Write(reply, 0)
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(vm, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if size := binary.BigEndian.Uint32(hdr); size != uint32(len(reply)) {
+		t.Fatalf("length prefix %v, want %v", size, len(reply))
+	}
+	got := make([]byte, len(reply))
+	if _, err := io.ReadFull(vm, got); err != nil || !bytes.Equal(got, reply) {
+		t.Fatalf("frame to the VM = %x, %v", got, err)
+	}
+
+	// an oversized length closes the connection
+	vm.Write(binary.BigEndian.AppendUint32(nil, qemuMaxFrame+1))
+	if _, err := vm.Read(buf); err == nil {
+		t.Fatalf("connection not closed after an invalid frame size")
+	}
+	if mtu, _ := tap.MTU(); mtu != 1400 {
+		t.Errorf("MTU() = %v, want 1400", mtu)
+	}
+}
@@ -4,23 +4,33 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 )
 
+// SockServerTap accepts many clients at the same time on RecvAddr. Every client is a port of a small learning switch,
+// frames between clients are switched locally, and flooded to other clients and the overlay if the destination is unknown.
+// If SendAddr is set, all frames from the overlay are sent to SendAddr instead of the clients,
+// and the frames from SendAddr are sent to the overlay.
 type SockServerTap struct {
 	name     string
 	mtu      int
 	protocol string
 	server   *net.Listener
-	connRx   *net.Conn
-	connTx   *net.Conn
-	static   bool
+	sw       *portSwitch
 	loglevel mtypes.LoggerInfo
 
-	closed bool
-	events chan Event
+	sendAddr string
+	send     struct {
+		sync.Mutex
+		conn net.Conn
+	}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	events    chan Event
 }
 
 // New creates and returns a new TUN interface for the application.
@@ -32,11 +42,10 @@ func CreateSockTAP(iconfig mtypes.InterfaceConf, protocol string, NodeID mtypes.
 		mtu:      1500,
 		protocol: protocol,
 		server:   nil,
-		connRx:   nil,
-		connTx:   nil,
-		static:   false,
-		closed:   false,
+		sw:       newPortSwitch(loglevel),
 		loglevel: loglevel,
+		sendAddr: iconfig.SendAddr,
+		closed:   make(chan struct{}),
 		events:   make(chan Event, 1<<5),
 	}
 
@@ -61,11 +70,7 @@ func CreateSockTAP(iconfig mtypes.InterfaceConf, protocol string, NodeID mtypes.
 			}
 			return nil, err
 		}
-		tap.connTx = &client
-		tap.static = true
-		if tap.server == nil {
-			tap.connRx = &client
-		}
+		go tap.RoutineConnect(client, iconfig.SendAddr)
 	}
 
 	tapdev = tap
@@ -73,35 +78,125 @@ func CreateSockTAP(iconfig mtypes.InterfaceConf, protocol string, NodeID mtypes.
 	return
 }
 
+func (tap *SockServerTap) isClosed() bool {
+	select {
+	case <-tap.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 func (tap *SockServerTap) RoutineAcceptConnection() {
 	if tap.server == nil {
 		return
 	}
 	for {
 		conn, err := (*tap.server).Accept()
-		if tap.closed == true {
+		if tap.isClosed() {
 			return
 		}
 		if err != nil {
 			if tap.loglevel.LogInternal {
 				fmt.Printf("Internal: Accept error %v\n", err)
 			}
+			time.Sleep(time.Second)
 			continue
 		}
 		if tap.loglevel.LogInternal {
 			fmt.Printf("Internal: New connection accepted from %v\n", conn.RemoteAddr())
 		}
-		if tap.connRx != nil {
+		go tap.serveConn(conn)
+	}
+}
+
+// RoutineConnect serves the connection to SendAddr, and reconnects if disconnected
+func (tap *SockServerTap) RoutineConnect(conn net.Conn, addr string) {
+	for {
+		tap.serveSendConn(conn)
+		for {
+			select {
+			case <-tap.closed:
+				return
+			case <-time.After(time.Second):
+			}
+			var err error
+			conn, err = net.Dial(tap.protocol, addr)
+			if err == nil {
+				break
+			}
 			if tap.loglevel.LogInternal {
-				fmt.Printf("Internal: Old connection %v closed due to new connection\n", (*tap.connRx).RemoteAddr())
+				fmt.Printf("Internal: Connect to %v failed: %v\n", addr, err)
 			}
-			(*tap.connRx).Close()
 		}
+	}
+}
+
+// serveConn adds conn to the switch, and reads frames from it until disconnected
+func (tap *SockServerTap) serveConn(conn net.Conn) {
+	var lock sync.Mutex
+	port := tap.sw.AddPort(fmt.Sprint(conn.RemoteAddr()), func(frame []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		_, err := conn.Write(frame)
+		return err
+	})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-tap.closed:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		tap.sw.RemovePort(port)
+		conn.Close()
+		if tap.loglevel.LogInternal {
+			fmt.Printf("Internal: Connection closed: %v\n", conn.RemoteAddr())
+		}
+	}()
+	buf := make([]byte, 65536)
+	for {
+		size, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		tap.sw.Input(port, buf[:size])
+	}
+}
 
-		tap.connRx = &conn
-		if tap.static == false {
-			tap.connTx = &conn
+// serveSendConn reads frames from the connection to SendAddr until disconnected, they go to the overlay directly
+func (tap *SockServerTap) serveSendConn(conn net.Conn) {
+	tap.send.Lock()
+	tap.send.conn = conn
+	tap.send.Unlock()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-tap.closed:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		tap.send.Lock()
+		tap.send.conn = nil
+		tap.send.Unlock()
+		conn.Close()
+		if tap.loglevel.LogInternal {
+			fmt.Printf("Internal: Connection closed: %v\n", conn.RemoteAddr())
 		}
+	}()
+	buf := make([]byte, 65536)
+	for {
+		size, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		tap.sw.ToOverlay(buf[:size])
 	}
 }
 
@@ -109,38 +204,22 @@ func (tap *SockServerTap) RoutineAcceptConnection() {
 // Packet on the interface.
 
 func (tap *SockServerTap) Read(buf []byte, offset int) (size int, err error) {
-	if tap.closed {
-		return 0, errors.New("Tap closed")
-	}
-	if tap.connRx == nil {
-		time.Sleep(time.Second)
-		return 0, nil
-	}
-	size, err = (*tap.connRx).Read(buf[offset:])
-	if err != nil && tap.server != nil {
-		if tap.loglevel.LogInternal {
-			fmt.Printf("Internal: Connection closed: %v\n", (*tap.connRx).RemoteAddr())
-		}
-		tap.connRx = nil
-		return 0, nil
-	}
-	return
+	return tap.sw.Read(buf[offset:])
 } // read a packet from the device (without any additional headers)
 func (tap *SockServerTap) Write(buf []byte, offset int) (size int, err error) {
-	if tap.closed {
+	if tap.isClosed() {
 		return 0, errors.New("Tap closed")
 	}
-	if tap.connTx == nil {
-		return
-	}
-	size, err = (*tap.connTx).Write(buf[offset:])
-	if serr, ok := err.(*net.OpError); ok && tap.server != nil {
-		if serr.Err.Error() == "use of closed network connection" || serr.Err.Error() == "EOF" {
-			tap.connTx = nil
-			return 0, nil
+	if tap.sendAddr != "" {
+		tap.send.Lock()
+		defer tap.send.Unlock()
+		if tap.send.conn != nil {
+			tap.send.conn.Write(buf[offset:])
 		}
+		return len(buf) - offset, nil
 	}
-	return
+	tap.sw.Output(buf[offset:])
+	return len(buf) - offset, nil
 } // writes a packet to the device (without any additional headers)
 func (tap *SockServerTap) Flush() error {
 	return nil
@@ -155,17 +234,14 @@ func (tap *SockServerTap) Events() chan Event {
 	return tap.events
 } // returns a constant channel of events related to the device
 func (tap *SockServerTap) Close() error {
-	tap.events <- EventDown
-	tap.closed = true
-	if tap.connRx != nil {
-		(*tap.connRx).Close()
-	}
-	if tap.connTx != nil {
-		(*tap.connTx).Close()
-	}
-	if tap.server != nil {
-		(*tap.server).Close()
-	}
-	close(tap.events)
+	tap.closeOnce.Do(func() {
+		tap.events <- EventDown
+		close(tap.closed)
+		tap.sw.Close()
+		if tap.server != nil {
+			(*tap.server).Close()
+		}
+		close(tap.events)
+	})
 	return nil
 } // stops the device and closes the event channel
@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func newTestSockTap(t *testing.T, recv string, send string) Device {
+	dev, err := CreateSockTAP(mtypes.InterfaceConf{Name: "sock0", RecvAddr: recv, SendAddr: send}, "unix", 1, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+// dialTestClients connects n clients to addr, and waits until the switch has all of them
+func dialTestClients(t *testing.T, dev Device, addr string, n int) []net.Conn {
+	clients := make([]net.Conn, n)
+	for i := range clients {
+		c, err := net.Dial("unix", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		clients[i] = c
+	}
+	sw := dev.(*SockServerTap).sw
+	for i := 0; sw.NumPorts() < n; i++ {
+		if i > 100 {
+			t.Fatalf("%v clients connected, want %v", sw.NumPorts(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return clients
+}
+
+func expectFrame(t *testing.T, c net.Conn, frame []byte) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := c.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], frame) {
+		t.Fatalf("got %x, %v, want %x", buf[:n], err, frame)
+	}
+}
+
+func expectNoFrame(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 2048)
+	if n, err := c.Read(buf); err == nil {
+		t.Fatalf("unexpected frame %x", buf[:n])
+	}
+}
+
+func TestSockTapRecvAndSend(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recv, send := filepath.Join(dir, "recv"), filepath.Join(dir, "send")
+	sendServer, err := net.Listen("unix", send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sendServer.Close()
+
+	dev := newTestSockTap(t, recv, send)
+	sendConn, err := sendServer.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sendConn.Close()
+	clients := dialTestClients(t, dev, recv, 2)
+
+	// frames from the RecvAddr clients are learned, and go to the overlay
+	frame := testFrame(testMacBcast, testMacA)
+	clients[0].Write(frame)
+	buf := make([]byte, 2048)
+	if n, err := dev.Read(buf, 0); err != nil || !bytes.Equal(buf[:n], frame) {
+		t.Fatalf("Read() = %x, %v, want %x", buf[:n], err, frame)
+	}
+	expectFrame(t, clients[1], frame)
+
+	// frames from the overlay always go to SendAddr, even to a learned MAC
+	toA := testFrame(testMacA, testMacC)
+	dev.Write(toA, 0)
+	expectFrame(t, sendConn, toA)
+	expectNoFrame(t, clients[0])
+	expectNoFrame(t, clients[1])
+
+	// frames from SendAddr go to the overlay
+	fromSend := testFrame(testMacC, testMacB)
+	sendConn.Write(fromSend)
+	if n, err := dev.Read(buf, 0); err != nil || !bytes.Equal(buf[:n], fromSend) {
+		t.Fatalf("Read() = %x, %v, want %x", buf[:n], err, fromSend)
+	}
+}
+
+func TestSockTapRecvOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recv := filepath.Join(dir, "recv")
+	dev := newTestSockTap(t, recv, "")
+	clients := dialTestClients(t, dev, recv, 2)
+
+	frame := testFrame(testMacBcast, testMacA)
+	clients[0].Write(frame)
+	buf := make([]byte, 2048)
+	if _, err := dev.Read(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectFrame(t, clients[1], frame)
+
+	// without SendAddr, frames from the overlay go to the learned client only
+	toA := testFrame(testMacA, testMacC)
+	dev.Write(toA, 0)
+	expectFrame(t, clients[0], toA)
+	expectNoFrame(t, clients[1])
+}
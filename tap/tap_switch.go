@@ -0,0 +1,185 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	switchMacTimeout = 300 * time.Second
+	switchRxQueue    = 1 << 10
+)
+
+// switchPort is a local port of the portSwitch, like a VM or a container connected to the tap
+type switchPort struct {
+	id   int
+	name string
+	send func(frame []byte) error
+}
+
+type switchMacEntry struct {
+	port *switchPort
+	time time.Time
+}
+
+// portSwitch is a small learning switch for the tap backends which accept multiple clients.
+// Frames between local ports are switched locally without touching the overlay.
+// Broadcast and unknown unicast frames are flooded to other local ports and the overlay.
+type portSwitch struct {
+	sync.RWMutex
+	ports    map[int]*switchPort
+	macs     map[MacAddress]switchMacEntry
+	nextID   int
+	rx       chan []byte // frames to the overlay
+	closed   chan struct{}
+	loglevel mtypes.LoggerInfo
+}
+
+func newPortSwitch(loglevel mtypes.LoggerInfo) *portSwitch {
+	return &portSwitch{
+		ports:    make(map[int]*switchPort),
+		macs:     make(map[MacAddress]switchMacEntry),
+		rx:       make(chan []byte, switchRxQueue),
+		closed:   make(chan struct{}),
+		loglevel: loglevel,
+	}
+}
+
+func (sw *portSwitch) AddPort(name string, send func(frame []byte) error) *switchPort {
+	sw.Lock()
+	defer sw.Unlock()
+	sw.nextID += 1
+	port := &switchPort{
+		id:   sw.nextID,
+		name: name,
+		send: send,
+	}
+	sw.ports[port.id] = port
+	if sw.loglevel.LogInternal {
+		fmt.Printf("Internal: Switch port %v(%v) added\n", port.id, name)
+	}
+	return port
+}
+
+func (sw *portSwitch) RemovePort(port *switchPort) {
+	sw.Lock()
+	defer sw.Unlock()
+	if _, ok := sw.ports[port.id]; !ok {
+		return
+	}
+	delete(sw.ports, port.id)
+	for mac, entry := range sw.macs {
+		if entry.port == port {
+			delete(sw.macs, mac)
+		}
+	}
+	if sw.loglevel.LogInternal {
+		fmt.Printf("Internal: Switch port %v(%v) removed\n", port.id, port.name)
+	}
+}
+
+func (sw *portSwitch) NumPorts() int {
+	sw.RLock()
+	defer sw.RUnlock()
+	return len(sw.ports)
+}
+
+// lookup returns the local port of mac, nil if unknown
+func (sw *portSwitch) lookup(mac MacAddress) *switchPort {
+	if IsNotUnicast(mac) {
+		return nil
+	}
+	sw.RLock()
+	entry, ok := sw.macs[mac]
+	sw.RUnlock()
+	if !ok || time.Since(entry.time) > switchMacTimeout {
+		return nil
+	}
+	return entry.port
+}
+
+// flood sends the frame to all local ports except skip
+func (sw *portSwitch) flood(skip *switchPort, frame []byte) {
+	sw.RLock()
+	ports := make([]*switchPort, 0, len(sw.ports))
+	for _, port := range sw.ports {
+		if port != skip {
+			ports = append(ports, port)
+		}
+	}
+	sw.RUnlock()
+	for _, port := range ports {
+		port.send(frame)
+	}
+}
+
+// Input handles a frame received from a local port
+func (sw *portSwitch) Input(port *switchPort, frame []byte) {
+	if len(frame) < 12 {
+		return
+	}
+	src := GetSrcMacAddr(frame)
+	if !IsNotUnicast(src) {
+		sw.Lock()
+		if entry, ok := sw.macs[src]; !ok || entry.port != port {
+			if sw.loglevel.LogInternal {
+				fmt.Printf("Internal: Switch learned %v on port %v(%v)\n", src.String(), port.id, port.name)
+			}
+		}
+		sw.macs[src] = switchMacEntry{port: port, time: time.Now()}
+		sw.Unlock()
+	}
+	if dst := sw.lookup(GetDstMacAddr(frame)); dst != nil {
+		if dst != port {
+			dst.send(frame)
+		}
+		return
+	}
+	sw.flood(port, frame)
+	sw.ToOverlay(frame)
+}
+
+// ToOverlay sends a frame to the overlay without switching
+func (sw *portSwitch) ToOverlay(frame []byte) {
+	packet := make([]byte, len(frame))
+	copy(packet, frame)
+	select {
+	case sw.rx <- packet:
+	case <-sw.closed:
+	}
+}
+
+// Output handles a frame from the overlay
+func (sw *portSwitch) Output(frame []byte) {
+	if len(frame) < 12 {
+		return
+	}
+	if dst := sw.lookup(GetDstMacAddr(frame)); dst != nil {
+		dst.send(frame)
+		return
+	}
+	sw.flood(nil, frame)
+}
+
+// Read returns the next frame to the overlay
+func (sw *portSwitch) Read(buf []byte) (int, error) {
+	select {
+	case packet := <-sw.rx:
+		return copy(buf, packet), nil
+	case <-sw.closed:
+		return 0, errors.New("Tap closed")
+	}
+}
+
+func (sw *portSwitch) Close() {
+	close(sw.closed)
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+var (
+	testMacA     = MacAddress{0xaa, 0xbb, 0xcc, 0xdd, 0, 1}
+	testMacB     = MacAddress{0xaa, 0xbb, 0xcc, 0xdd, 0, 2}
+	testMacC     = MacAddress{0xaa, 0xbb, 0xcc, 0xdd, 0, 3}
+	testMacBcast = MacAddress{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+func testFrame(dst MacAddress, src MacAddress) []byte {
+	frame := make([]byte, 60)
+	copy(frame[0:6], dst[:])
+	copy(frame[6:12], src[:])
+	frame[12], frame[13] = 0x08, 0x00
+	return frame
+}
+
+// testPort records the frames sent to a switch port
+type testPort struct {
+	sync.Mutex
+	frames [][]byte
+}
+
+func (p *testPort) send(frame []byte) error {
+	p.Lock()
+	defer p.Unlock()
+	p.frames = append(p.frames, append([]byte(nil), frame...))
+	return nil
+}
+
+func (p *testPort) count() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.frames)
+}
+
+// overlayFrames drains the frames sent to the overlay
+func overlayFrames(sw *portSwitch) (n int) {
+	for {
+		select {
+		case <-sw.rx:
+			n++
+		default:
+			return
+		}
+	}
+}
+
+func TestPortSwitch(t *testing.T) {
+	sw := newPortSwitch(mtypes.LoggerInfo{})
+	defer sw.Close()
+	var pa, pb testPort
+	portA := sw.AddPort("a", pa.send)
+	portB := sw.AddPort("b", pb.send)
+
+	// unknown destination: flooded to other ports and the overlay, the source is learned
+	sw.Input(portA, testFrame(testMacB, testMacA))
+	if pa.count() != 0 || pb.count() != 1 || overlayFrames(sw) != 1 {
+		t.Fatalf("unknown unicast: a:%v b:%v, want flooded to b and the overlay", pa.count(), pb.count())
+	}
+	// B answers A: switched locally, the overlay doesn't see it
+	sw.Input(portB, testFrame(testMacA, testMacB))
+	if pa.count() != 1 || overlayFrames(sw) != 0 {
+		t.Fatalf("known unicast: a:%v, want switched to a only", pa.count())
+	}
+	// from the overlay to a learned MAC goes to its port only
+	sw.Output(testFrame(testMacB, testMacC))
+	if pa.count() != 1 || pb.count() != 2 {
+		t.Fatalf("overlay to b: a:%v b:%v, want b only", pa.count(), pb.count())
+	}
+	// broadcast from the overlay goes to all ports
+	sw.Output(testFrame(testMacBcast, testMacC))
+	if pa.count() != 2 || pb.count() != 3 {
+		t.Fatalf("overlay broadcast: a:%v b:%v, want both", pa.count(), pb.count())
+	}
+	// a frame to its own port is dropped
+	sw.Input(portA, testFrame(testMacA, testMacA))
+	if pa.count() != 2 || pb.count() != 3 || overlayFrames(sw) != 0 {
+		t.Fatalf("hairpin frame not dropped")
+	}
+	// the MACs of a removed port are forgotten
+	sw.RemovePort(portB)
+	if sw.lookup(testMacB) != nil || sw.NumPorts() != 1 {
+		t.Fatalf("port b still known after removal")
+	}
+	// the learned MAC expires
+	sw.Lock()
+	sw.macs[testMacA] = switchMacEntry{port: portA, time: time.Now().Add(-switchMacTimeout - time.Second)}
+	sw.Unlock()
+	if sw.lookup(testMacA) != nil {
+		t.Fatalf("expired MAC still known")
+	}
+}
@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGetUIDRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		version int
+		cidr    string
+		uids    []uint32
+	}{
+		{4, "192.168.76.0/24", []uint32{0, 1, 2, 100, 253}},
+		{4, "10.0.0.0/30", []uint32{0, 1}},
+		{4, "10.0.0.0/31", []uint32{0, 1}},
+		{6, "fd95:71cb:a3df:e586::/64", []uint32{0, 1, 2, 100, 65535, 1<<32 - 1}},
+		{6, "fe80::/64", []uint32{0, 1, 2}},
+		{6, "fd00::/127", []uint32{0, 1}},
+	} {
+		for _, uid := range tc.uids {
+			ip, _, err := GetIP(tc.version, tc.cidr, uid)
+			if err != nil {
+				t.Fatalf("GetIP(%v, %v) failed: %v", tc.cidr, uid, err)
+			}
+			got, isBroadcast, err := GetUID(tc.cidr, ip)
+			if err != nil {
+				t.Fatalf("GetUID(%v, %v) failed: %v", tc.cidr, ip, err)
+			}
+			if got != uid || isBroadcast {
+				t.Errorf("GetUID(%v, GetIP(%v)=%v) = %v broadcast:%v, want %v", tc.cidr, uid, ip, got, isBroadcast, uid)
+			}
+		}
+	}
+}
+
+func TestGetUIDSpecial(t *testing.T) {
+	if _, isBroadcast, err := GetUID("192.168.76.0/24", net.ParseIP("192.168.76.255")); err != nil || !isBroadcast {
+		t.Errorf("192.168.76.255 should be the broadcast address, err:%v", err)
+	}
+	if _, isBroadcast, err := GetUID("fd00::/120", net.ParseIP("fd00::ff")); err != nil || isBroadcast {
+		t.Errorf("IPv6 has no broadcast address, broadcast:%v err:%v", isBroadcast, err)
+	}
+	for _, tc := range []struct {
+		cidr string
+		ip   string
+	}{
+		{"192.168.76.0/24", "192.168.76.0"}, // network address
+		{"192.168.76.0/24", "192.168.77.1"}, // not in the CIDR
+		{"192.168.76.1/32", "192.168.76.1"}, // host route
+		{"fd00::/64", "fd00::"},             // network address
+		{"fd00::/16", "fd00:0:1::"},         // out of uint32
+	} {
+		if uid, _, err := GetUID(tc.cidr, net.ParseIP(tc.ip)); err == nil {
+			t.Errorf("GetUID(%v, %v) = %v, want an error", tc.cidr, tc.ip, uid)
+		}
+	}
+}
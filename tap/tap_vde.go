@@ -0,0 +1,295 @@
+//go:build !windows
+// +build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// VDE switch protocol(vde2 libvdeplug, request v3).
+// A plug connects to the control socket and sends a request with the path of its datagram socket.
+// The switch replies with the path of the datagram socket of the new port. Then frames are exchanged by unix datagrams.
+// The port is closed when the control connection is closed. The control messages are in host byte order.
+const (
+	vdeSwitchMagic   = 0xfeedface
+	vdeVersion       = 3
+	vdeMaxDescr      = 128
+	vdeSockaddrLen   = 110 // sizeof(struct sockaddr_un)
+	vdeRequestLen    = 12 + vdeSockaddrLen + vdeMaxDescr
+	vdeReqNewControl = 0
+	vdeMaxFrame      = 65536
+)
+
+var vdePlugSeq uint32
+
+func vdeEncodeSockaddr(buf []byte, path string) {
+	nativeEndian.PutUint16(buf[0:2], 1) // AF_UNIX
+	copy(buf[2:vdeSockaddrLen-1], path)
+}
+
+func vdeDecodeSockaddr(buf []byte) string {
+	path := buf[2:vdeSockaddrLen]
+	if i := bytes.IndexByte(path, 0); i != -1 {
+		path = path[:i]
+	}
+	return string(path)
+}
+
+func vdeCtlPath(path string) string {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return filepath.Join(path, "ctl")
+	}
+	return path
+}
+
+// VdeTap speaks the VDE switch protocol over unix sockets.
+// With RecvAddr, we act as a vde_switch at this directory, QEMU(`-netdev vde,sock=`) and vde_plug can connect to us. Every connection is a switch port.
+// With SendAddr, we plug into the vde_switch at this directory, and reconnect if disconnected.
+type VdeTap struct {
+	name      string
+	mtu       int
+	ctldir    string
+	server    net.Listener
+	sw        *portSwitch
+	loglevel  mtypes.LoggerInfo
+	closeOnce sync.Once
+	closed    chan struct{}
+	events    chan Event
+}
+
+func CreateVdeTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex, loglevel mtypes.LoggerInfo) (tapdev Device, err error) {
+	tap := &VdeTap{
+		name:     iconfig.Name,
+		mtu:      int(iconfig.MTU),
+		sw:       newPortSwitch(loglevel),
+		loglevel: loglevel,
+		closed:   make(chan struct{}),
+		events:   make(chan Event, 1<<5),
+	}
+	if iconfig.RecvAddr == "" && iconfig.SendAddr == "" {
+		return nil, errors.New("At least one of RecvAddr or SendAddr required.")
+	}
+	if iconfig.RecvAddr != "" {
+		tap.ctldir = iconfig.RecvAddr
+		if err = os.MkdirAll(tap.ctldir, 0777); err != nil {
+			return nil, err
+		}
+		ctl := filepath.Join(tap.ctldir, "ctl")
+		os.Remove(ctl)
+		tap.server, err = net.Listen("unix", ctl)
+		if err != nil {
+			return nil, err
+		}
+		go tap.RoutineAcceptConnection()
+	}
+	if iconfig.SendAddr != "" {
+		go tap.RoutinePlug(iconfig.SendAddr)
+	}
+	tap.events <- EventUp
+	return tap, nil
+}
+
+func (tap *VdeTap) isClosed() bool {
+	select {
+	case <-tap.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (tap *VdeTap) RoutineAcceptConnection() {
+	portno := 0
+	for {
+		conn, err := tap.server.Accept()
+		if tap.isClosed() {
+			return
+		}
+		if err != nil {
+			if tap.loglevel.LogInternal {
+				fmt.Printf("Internal: Accept error %v\n", err)
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		portno += 1
+		go tap.servePlug(conn, portno)
+	}
+}
+
+// servePlug handles a control connection from a vde plug
+func (tap *VdeTap) servePlug(ctl net.Conn, portno int) {
+	defer ctl.Close()
+	req := make([]byte, vdeRequestLen)
+	n, err := ctl.Read(req)
+	if err != nil {
+		return
+	}
+	if n < 12+vdeSockaddrLen || nativeEndian.Uint32(req[0:4]) != vdeSwitchMagic || nativeEndian.Uint32(req[4:8]) != vdeVersion {
+		fmt.Println("ERROR: VDE: invalid request from", ctl.RemoteAddr())
+		return
+	}
+	if nativeEndian.Uint32(req[8:12])&0xff != vdeReqNewControl {
+		fmt.Println("ERROR: VDE: unsupported request type", nativeEndian.Uint32(req[8:12]))
+		return
+	}
+	remote := &net.UnixAddr{Name: vdeDecodeSockaddr(req[12 : 12+vdeSockaddrLen]), Net: "unixgram"}
+	descr := string(bytes.TrimRight(req[12+vdeSockaddrLen:n], "\x00"))
+
+	local := filepath.Join(tap.ctldir, fmt.Sprintf("%03d.%d", portno, os.Getpid()))
+	os.Remove(local)
+	data, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"})
+	if err != nil {
+		fmt.Println("ERROR: VDE:", err)
+		return
+	}
+	defer os.Remove(local)
+	defer data.Close()
+	reply := make([]byte, vdeSockaddrLen)
+	vdeEncodeSockaddr(reply, local)
+	if _, err = ctl.Write(reply); err != nil {
+		return
+	}
+	if tap.loglevel.LogInternal {
+		fmt.Printf("Internal: VDE plug %v(%v) connected to port %v\n", remote.Name, descr, portno)
+	}
+	port := tap.sw.AddPort(fmt.Sprintf("vde%v:%v", portno, descr), func(frame []byte) error {
+		_, err := data.WriteToUnix(frame, remote)
+		return err
+	})
+	defer tap.sw.RemovePort(port)
+	tap.exchange(ctl, data, port)
+}
+
+// RoutinePlug keeps plugged into the vde_switch at path
+func (tap *VdeTap) RoutinePlug(path string) {
+	for !tap.isClosed() {
+		if err := tap.plug(path); err != nil && tap.loglevel.LogInternal {
+			fmt.Printf("Internal: VDE plug to %v: %v\n", path, err)
+		}
+		select {
+		case <-tap.closed:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (tap *VdeTap) plug(path string) error {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("vde.%05d-%05d", os.Getpid(), atomic.AddUint32(&vdePlugSeq, 1)))
+	os.Remove(local)
+	data, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(local)
+	defer data.Close()
+	ctl, err := net.Dial("unix", vdeCtlPath(path))
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+	descr := "EtherGuard " + tap.name
+	req := make([]byte, 12+vdeSockaddrLen+len(descr))
+	nativeEndian.PutUint32(req[0:4], vdeSwitchMagic)
+	nativeEndian.PutUint32(req[4:8], vdeVersion)
+	nativeEndian.PutUint32(req[8:12], vdeReqNewControl)
+	vdeEncodeSockaddr(req[12:12+vdeSockaddrLen], local)
+	copy(req[12+vdeSockaddrLen:], descr)
+	if _, err = ctl.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, vdeSockaddrLen)
+	if _, err = io.ReadFull(ctl, reply); err != nil {
+		return err
+	}
+	remote := &net.UnixAddr{Name: vdeDecodeSockaddr(reply), Net: "unixgram"}
+	if tap.loglevel.LogInternal {
+		fmt.Printf("Internal: VDE plugged into %v, data socket %v\n", path, remote.Name)
+	}
+	port := tap.sw.AddPort("vde:"+path, func(frame []byte) error {
+		_, err := data.WriteToUnix(frame, remote)
+		return err
+	})
+	defer tap.sw.RemovePort(port)
+	tap.exchange(ctl, data, port)
+	return errors.New("disconnected")
+}
+
+// exchange reads frames from the data socket until the control connection or the tap is closed
+func (tap *VdeTap) exchange(ctl net.Conn, data *net.UnixConn, port *switchPort) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-tap.closed:
+		case <-done:
+		}
+		ctl.Close()
+		data.Close()
+	}()
+	go func() {
+		// The port is closed when the control connection is closed
+		io.Copy(io.Discard, ctl)
+		data.Close()
+	}()
+	defer close(done)
+	buf := make([]byte, vdeMaxFrame)
+	for {
+		n, _, err := data.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		tap.sw.Input(port, buf[:n])
+	}
+}
+
+func (tap *VdeTap) Read(buf []byte, offset int) (int, error) {
+	return tap.sw.Read(buf[offset:])
+} // read a packet from the device (without any additional headers)
+func (tap *VdeTap) Write(buf []byte, offset int) (int, error) {
+	if tap.isClosed() {
+		return 0, errors.New("Tap closed")
+	}
+	tap.sw.Output(buf[offset:])
+	return len(buf) - offset, nil
+} // writes a packet to the device (without any additional headers)
+func (tap *VdeTap) Flush() error {
+	return nil
+} // flush all previous writes to the device
+func (tap *VdeTap) MTU() (int, error) {
+	return tap.mtu, nil
+} // returns the MTU of the device
+func (tap *VdeTap) Name() (string, error) {
+	return tap.name, nil
+} // fetches and returns the current name
+func (tap *VdeTap) Events() chan Event {
+	return tap.events
+} // returns a constant channel of events related to the device
+func (tap *VdeTap) Close() error {
+	tap.closeOnce.Do(func() {
+		close(tap.closed)
+		tap.sw.Close()
+		if tap.server != nil {
+			tap.server.Close()
+		}
+		tap.events <- EventDown
+		close(tap.events)
+	})
+	return nil
+} // stops the device and closes the event channel
@@ -0,0 +1,113 @@
+//go:build !windows
+// +build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tap
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestVdeHandshake(t *testing.T) {
+	// unix socket paths are limited to 108 bytes, t.TempDir() may be too long
+	dir, err := os.MkdirTemp("", "vde")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tap := &VdeTap{
+		name:   "vde0",
+		ctldir: dir,
+		sw:     newPortSwitch(mtypes.LoggerInfo{}),
+		closed: make(chan struct{}),
+		events: make(chan Event, 1<<5),
+	}
+	defer tap.Close()
+
+	plugPath := filepath.Join(dir, "plug")
+	plugData, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: plugPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugData.Close()
+	plugCtl, ours := net.Pipe()
+	go tap.servePlug(ours, 1)
+	plugCtl.SetDeadline(time.Now().Add(5 * time.Second))
+	plugData.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := make([]byte, 12+vdeSockaddrLen+4)
+	nativeEndian.PutUint32(req[0:4], vdeSwitchMagic)
+	nativeEndian.PutUint32(req[4:8], vdeVersion)
+	nativeEndian.PutUint32(req[8:12], vdeReqNewControl)
+	vdeEncodeSockaddr(req[12:12+vdeSockaddrLen], plugPath)
+	copy(req[12+vdeSockaddrLen:], "test")
+	if _, err := plugCtl.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, vdeSockaddrLen)
+	if _, err := plugCtl.Read(reply); err != nil {
+		t.Fatal(err)
+	}
+	port := &net.UnixAddr{Name: vdeDecodeSockaddr(reply), Net: "unixgram"}
+	if filepath.Dir(port.Name) != dir {
+		t.Fatalf("data socket %v is not in %v", port.Name, dir)
+	}
+
+	// frames from the plug come out of the tap
+	frame := testFrame(testMacBcast, testMacA)
+	if _, err := plugData.WriteToUnix(frame, port); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	if n, err := tap.Read(buf, 0); err != nil || !bytes.Equal(buf[:n], frame) {
+		t.Fatalf("Read() = %x, %v, want %x", buf[:n], err, frame)
+	}
+	// frames to the plug are sent to its data socket
+	back := testFrame(testMacA, testMacB)
+	tap.Write(back, 0)
+	if n, _, err := plugData.ReadFromUnix(buf); err != nil || !bytes.Equal(buf[:n], back) {
+		t.Fatalf("frame to the plug = %x, %v, want %x", buf[:n], err, back)
+	}
+
+	// the port is removed when the control connection is closed
+	plugCtl.Close()
+	for i := 0; tap.sw.NumPorts() != 0; i++ {
+		if i > 100 {
+			t.Fatalf("port not removed after the control connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVdeInvalidRequest(t *testing.T) {
+	tap := &VdeTap{sw: newPortSwitch(mtypes.LoggerInfo{}), closed: make(chan struct{}), events: make(chan Event, 1<<5)}
+	defer tap.Close()
+	plugCtl, ours := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		tap.servePlug(ours, 1)
+		close(done)
+	}()
+	req := make([]byte, 12+vdeSockaddrLen)
+	nativeEndian.PutUint32(req[0:4], 0xdeadbeef)
+	plugCtl.Write(req)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalid request not rejected")
+	}
+	if tap.sw.NumPorts() != 0 {
+		t.Fatal("port added for an invalid request")
+	}
+}